@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"encoding/base64"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"net"
+	"testing"
+)
+
+func lookupFrom(users map[string]string) PasswordLookup {
+	return func(user string) (string, bool) {
+		pw, ok := users[user]
+		return pw, ok
+	}
+}
+
+// Run the client and server sides of an authentication exchange
+// against each other over an in-memory connection.
+func exchange(t *testing.T, a Authenticator, user, password string) (clientErr, serverErr error) {
+	feConn, beConn := net.Pipe()
+	defer feConn.Close()
+	defer beConn.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		fe := core.NewFrontendStream(feConn)
+		var m core.Message
+		if err := fe.Next(&m); err != nil {
+			serverDone <- err
+			return
+		}
+		if _, err := proto.ReadStartupMessage(&m); err != nil {
+			serverDone <- err
+			return
+		}
+		err := a.Authenticate(fe, user)
+		if err == nil {
+			err = fe.Flush()
+		}
+		serverDone <- err
+	}()
+
+	be := core.NewBackendStream(beConn)
+	var startup core.Message
+	proto.InitStartupMessage(&startup, map[string]string{"user": user})
+	if err := be.Send(&startup); err != nil {
+		t.Fatal(err)
+	}
+	clientErr = Authenticate(be, user, password)
+	if clientErr != nil {
+		// unblock the server if it is still waiting on us
+		beConn.Close()
+	}
+	return clientErr, <-serverDone
+}
+
+func TestAuthenticators(t *testing.T) {
+	users := map[string]string{
+		"alice": "sekrit",
+		// as stored by Postgres for password "hunter2"
+		"bob": "md5" + md5Hex("hunter2bob"),
+	}
+	lookup := lookupFrom(users)
+	authenticators := map[string]Authenticator{
+		"cleartext": NewCleartextAuthenticator(lookup),
+		"md5":       NewMD5Authenticator(lookup),
+		"scram":     NewSCRAMAuthenticator(lookup),
+	}
+
+	for name, a := range authenticators {
+		cErr, sErr := exchange(t, a, "alice", "sekrit")
+		if cErr != nil || sErr != nil {
+			t.Errorf("%v: got errors %v, %v; want success", name, cErr, sErr)
+		}
+
+		cErr, sErr = exchange(t, a, "alice", "wrong")
+		if _, ok := cErr.(*proto.ErrorResponse); !ok {
+			t.Errorf("%v: got client error %#v; want ErrorResponse", name, cErr)
+		}
+		if _, ok := sErr.(e.ErrAuth); !ok {
+			t.Errorf("%v: got server error %#v; want ErrAuth", name, sErr)
+		}
+
+		cErr, sErr = exchange(t, a, "mallory", "sekrit")
+		if cErr == nil || sErr == nil {
+			t.Errorf("%v: unknown user was let in", name)
+		}
+	}
+
+	cErr, sErr := exchange(t, NewMD5Authenticator(lookup), "bob", "hunter2")
+	if cErr != nil || sErr != nil {
+		t.Errorf("md5 with stored hash: got errors %v, %v; want success",
+			cErr, sErr)
+	}
+
+	cErr, sErr = exchange(t, NewTrustAuthenticator(), "anyone", "")
+	if cErr != nil || sErr != nil {
+		t.Errorf("trust: got errors %v, %v; want success", cErr, sErr)
+	}
+}
+
+// The SCRAM-SHA-256 example exchange from RFC 7677
+func TestSCRAMClientRFC7677(t *testing.T) {
+	c := &scramClient{
+		password:    "pencil",
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		clientFirst: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+	}
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := c.finalMessage([]byte(serverFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != want {
+		t.Errorf("got client-final-message %v; want %v", string(final), want)
+	}
+	err = c.verifyServer([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil {
+		t.Errorf("could not verify server signature: %v", err)
+	}
+	if err = c.verifyServer([]byte("v=AAAA")); err == nil {
+		t.Errorf("expected error verifying bogus server signature")
+	}
+}
+
+func TestSCRAMStoredSecret(t *testing.T) {
+	secret := newSCRAMSecret("sekrit", []byte("0123456789abcdef"), 4096)
+	stored := scramSecretPrefix + "4096:" +
+		base64.StdEncoding.EncodeToString(secret.salt) + "$" +
+		base64.StdEncoding.EncodeToString(secret.storedKey) + ":" +
+		base64.StdEncoding.EncodeToString(secret.serverKey)
+
+	lookup := lookupFrom(map[string]string{"alice": stored})
+	cErr, sErr := exchange(t, NewSCRAMAuthenticator(lookup), "alice", "sekrit")
+	if cErr != nil || sErr != nil {
+		t.Errorf("got errors %v, %v; want success", cErr, sErr)
+	}
+	cErr, sErr = exchange(t, NewSCRAMAuthenticator(lookup), "alice", "wrong")
+	if cErr == nil || sErr == nil {
+		t.Errorf("wrong password was accepted")
+	}
+
+	if _, err := parseSCRAMSecret("SCRAM-SHA-256$bogus"); err == nil {
+		t.Errorf("expected error parsing malformed secret")
+	}
+}
+
+func TestCleartextStoredHashes(t *testing.T) {
+	secret := newSCRAMSecret("sekrit", []byte("0123456789abcdef"), 4096)
+	scram := scramSecretPrefix + "4096:" +
+		base64.StdEncoding.EncodeToString(secret.salt) + "$" +
+		base64.StdEncoding.EncodeToString(secret.storedKey) + ":" +
+		base64.StdEncoding.EncodeToString(secret.serverKey)
+	md5 := "md5" + md5Hex("sekritbob")
+	lookup := lookupFrom(map[string]string{"alice": scram, "bob": md5})
+
+	cleartext := NewCleartextAuthenticator(lookup)
+	for user, stored := range map[string]string{"alice": scram, "bob": md5} {
+		cErr, sErr := exchange(t, cleartext, user, "sekrit")
+		if cErr != nil || sErr != nil {
+			t.Errorf("%v: got errors %v, %v; want success", user, cErr, sErr)
+		}
+		cErr, sErr = exchange(t, cleartext, user, stored)
+		if cErr == nil || sErr == nil {
+			t.Errorf("%v: the stored hash was accepted as the password", user)
+		}
+		cErr, sErr = exchange(t, cleartext, user, "wrong")
+		if cErr == nil || sErr == nil {
+			t.Errorf("%v: wrong password was accepted", user)
+		}
+	}
+
+	cErr, sErr := exchange(t, NewMD5Authenticator(lookup), "alice", "sekrit")
+	if cErr == nil || sErr == nil {
+		t.Errorf("md5 with stored SCRAM secret: password was accepted")
+	}
+	cErr, sErr = exchange(t, NewMD5Authenticator(lookup), "alice", scram)
+	if cErr == nil || sErr == nil {
+		t.Errorf("md5 with stored SCRAM secret: the secret was accepted")
+	}
+}
+
+func TestParseSCRAMSecretMalformed(t *testing.T) {
+	if _, err := parseSCRAMSecret("SCRAM-SHA-256$bogus"); err == nil {
+		t.Errorf("expected error parsing malformed secret")
+	}
+}
+
+func TestMD5Password(t *testing.T) {
+	// md5(md5("postgrespostgres") || "\x01\x02\x03\x04")
+	got := MD5Password("postgres", "postgres", [4]byte{1, 2, 3, 4})
+	want := "md5" + md5Hex("3175bce1d3201d16594cebf9d7eb3f9d\x01\x02\x03\x04")
+	if got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+// Package auth implements both sides of the Postgres authentication
+// exchange: cleartext and MD5 passwords, and SCRAM-SHA-256 without
+// channel binding.
+package auth
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// MD5Password returns the response to an AuthenticationMD5Password
+// request with the given salt, as the frontend would send it.
+func MD5Password(user, password string, salt [4]byte) string {
+	return md5Salted(md5Hex(password+user), salt)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash an already-encrypted "md5<hex>" or bare hex password with the
+// salt.
+func md5Salted(hashed string, salt [4]byte) string {
+	return "md5" + md5Hex(hashed+string(salt[:]))
+}
+
+// Authenticate performs the frontend side of the authentication
+// exchange on be, which must just have had a StartupMessage sent on
+// it. It answers cleartext, MD5 and SCRAM-SHA-256 requests with the
+// given user and password and returns once the backend sends
+// AuthenticationOk; the ParameterStatus, BackendKeyData and
+// ReadyForQuery messages that follow are left on the stream. If the
+// backend rejects the credentials, the returned error is the
+// backend's *proto.ErrorResponse.
+func Authenticate(be core.Stream, user, password string) error {
+	var m core.Message
+	var resp core.Message
+	var scram *scramClient
+	scramDone := false
+
+	for {
+		if err := be.Next(&m); err != nil {
+			return err
+		}
+		switch t := m.MsgType(); t {
+		case proto.MsgErrorResponseE:
+			errResp, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return err
+			}
+			return errResp
+		case proto.MsgAuthenticationOkR:
+			// handled below
+		default:
+			return e.Auth("unexpected message type %q during authentication", t)
+		}
+
+		req, err := proto.ReadAuthentication(&m)
+		if err != nil {
+			return err
+		}
+
+		switch req.Type {
+		case proto.AuthOk:
+			if scram != nil && !scramDone {
+				return e.Auth("server did not complete SCRAM exchange")
+			}
+			return nil
+		case proto.AuthCleartextPassword:
+			proto.InitPasswordMessage(&resp, password)
+		case proto.AuthMD5Password:
+			proto.InitPasswordMessage(&resp,
+				MD5Password(user, password, req.Salt))
+		case proto.AuthSASL:
+			if !hasMechanism(req.Mechanisms, SCRAMSHA256) {
+				return e.Auth("no supported SASL mechanism in %v",
+					req.Mechanisms)
+			}
+			scram, err = newSCRAMClient(password)
+			if err != nil {
+				return err
+			}
+			proto.InitSASLInitialResponse(&resp, SCRAMSHA256,
+				scram.firstMessage())
+		case proto.AuthSASLContinue:
+			if scram == nil {
+				return e.Auth("unexpected SASL continuation")
+			}
+			final, err := scram.finalMessage(req.Data)
+			if err != nil {
+				return err
+			}
+			proto.InitSASLResponse(&resp, final)
+		case proto.AuthSASLFinal:
+			if scram == nil {
+				return e.Auth("unexpected SASL final message")
+			}
+			if err = scram.verifyServer(req.Data); err != nil {
+				return err
+			}
+			// No response: AuthenticationOk follows
+			scramDone = true
+			continue
+		default:
+			return e.Auth("unsupported authentication type %v", req.Type)
+		}
+
+		if err = be.Send(&resp); err != nil {
+			return err
+		}
+		if err = be.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func hasMechanism(mechanisms []string, mech string) bool {
+	for _, m := range mechanisms {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"strconv"
+	"strings"
+)
+
+// The only SASL mechanism Postgres supports without channel binding
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// The iteration count used for secrets derived from a cleartext
+// password; this matches the Postgres default.
+const scramIterations = 4096
+
+// The prefix of SCRAM secrets as stored in pg_authid.rolpassword
+const scramSecretPrefix = SCRAMSHA256 + "$"
+
+// The GS2 header sent by a client that does not support channel
+// binding, and its base64 encoding as echoed in the final message.
+const (
+	gs2NoBinding      = "n,,"
+	gs2NoBindingB64   = "biws"
+	gs2ServerBinds    = "y,,"
+	gs2ServerBindsB64 = "eSws"
+)
+
+type scramSecret struct {
+	salt       []byte
+	iterations int
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// Derive the SCRAM secret for the given password. Postgres SASLprep
+// normalizes the password first; we use it as-is, which is
+// equivalent for ASCII passwords.
+func newSCRAMSecret(password string, salt []byte, iterations int) *scramSecret {
+	salted := pbkdf2SHA256([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return &scramSecret{
+		salt:       salt,
+		iterations: iterations,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// Parse a secret in the pg_authid format
+// "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+func parseSCRAMSecret(s string) (*scramSecret, error) {
+	parts := strings.Split(strings.TrimPrefix(s, scramSecretPrefix), "$")
+	if !strings.HasPrefix(s, scramSecretPrefix) || len(parts) != 2 {
+		return nil, e.Auth("malformed SCRAM secret")
+	}
+	iterSalt := strings.SplitN(parts[0], ":", 2)
+	keys := strings.SplitN(parts[1], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, e.Auth("malformed SCRAM secret")
+	}
+	iterations, err := strconv.Atoi(iterSalt[0])
+	if err != nil || iterations < 1 {
+		return nil, e.Auth("malformed SCRAM secret iteration count")
+	}
+	var decoded [3][]byte
+	for i, enc := range []string{iterSalt[1], keys[0], keys[1]} {
+		decoded[i], err = base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return nil, e.Auth("malformed SCRAM secret: %v", err)
+		}
+	}
+	return &scramSecret{
+		salt:       decoded[0],
+		iterations: iterations,
+		storedKey:  decoded[1],
+		serverKey:  decoded[2],
+	}, nil
+}
+
+// The client side of a SCRAM-SHA-256 exchange
+type scramClient struct {
+	password    string
+	clientNonce string
+	clientFirst string
+	// Expected server signature, once the final message is built
+	serverSignature []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{password: password, clientNonce: nonce}, nil
+}
+
+// The client-first-message. Postgres takes the user name from the
+// StartupMessage, so the one in the message is left empty.
+func (c *scramClient) firstMessage() []byte {
+	c.clientFirst = "n=,r=" + c.clientNonce
+	return []byte(gs2NoBinding + c.clientFirst)
+}
+
+// Build the client-final-message in response to the
+// server-first-message.
+func (c *scramClient) finalMessage(serverFirst []byte) ([]byte, error) {
+	attrs, err := parseSCRAMAttributes(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, e.Auth("invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, e.Auth("invalid SCRAM salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, e.Auth("invalid SCRAM iteration count %q", attrs['i'])
+	}
+
+	salted := pbkdf2SHA256([]byte(c.password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + gs2NoBindingB64 + ",r=" + nonce
+	authMessage := []byte(c.clientFirst + "," + string(serverFirst) +
+		"," + withoutProof)
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := hmacSHA256(salted, []byte("Server Key"))
+	c.serverSignature = hmacSHA256(serverKey, authMessage)
+
+	return []byte(withoutProof + ",p=" +
+		base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Check the server-final-message, which proves that the server
+// knows the password as well.
+func (c *scramClient) verifyServer(serverFinal []byte) error {
+	if c.serverSignature == nil {
+		return e.Auth("unexpected SCRAM server-final-message")
+	}
+	attrs, err := parseSCRAMAttributes(string(serverFinal))
+	if err != nil {
+		return err
+	}
+	if msg, ok := attrs['e']; ok {
+		return e.Auth("SCRAM authentication failed: %v", msg)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(sig, c.serverSignature) {
+		return e.Auth("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+// Parse a comma-separated list of "k=value" SCRAM attributes.
+func parseSCRAMAttributes(s string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, attr := range strings.Split(s, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, e.Auth("malformed SCRAM attribute %q", attr)
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+func scramNonce() (string, error) {
+	raw := make([]byte, 18)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// PBKDF2 with HMAC-SHA-256 (the "Hi" function of RFC 5802). A single
+// block suffices since SCRAM only needs a digest-sized key.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// Whether the stored key matches the client proof for the given
+// authentication message.
+func (s *scramSecret) verifyProof(authMessage, proof []byte) bool {
+	clientSignature := hmacSHA256(s.storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return false
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	return hmac.Equal(storedKey[:], s.storedKey)
+}
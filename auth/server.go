@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"strconv"
+	"strings"
+)
+
+// PasswordLookup returns the password for the given user and whether
+// the user exists. Besides cleartext, the password may be in one of
+// the encrypted forms Postgres stores in pg_authid: "md5<hex>" for
+// the MD5 authenticator, or a "SCRAM-SHA-256$..." secret for the
+// SCRAM authenticator.
+type PasswordLookup func(user string) (password string, ok bool)
+
+// Authenticator performs the backend side of the authentication
+// exchange, as a Postgres-compatible server would.
+type Authenticator interface {
+	// Authenticate the frontend fe, which has sent a
+	// StartupMessage for the given user. On success,
+	// AuthenticationOk has been sent (but not flushed); on
+	// failure, a FATAL ErrorResponse has been sent and flushed
+	// and an error is returned.
+	Authenticate(fe core.Stream, user string) error
+}
+
+type trustAuthenticator struct{}
+
+// NewTrustAuthenticator returns an Authenticator that lets every
+// frontend in without asking for a password.
+func NewTrustAuthenticator() Authenticator {
+	return trustAuthenticator{}
+}
+
+func (trustAuthenticator) Authenticate(fe core.Stream, user string) error {
+	var m core.Message
+	proto.InitAuthenticationOk(&m)
+	return fe.Send(&m)
+}
+
+type cleartextAuthenticator struct {
+	lookup PasswordLookup
+}
+
+// NewCleartextAuthenticator returns an Authenticator that asks the
+// frontend for its password in cleartext.
+func NewCleartextAuthenticator(lookup PasswordLookup) Authenticator {
+	return &cleartextAuthenticator{lookup}
+}
+
+func (a *cleartextAuthenticator) Authenticate(fe core.Stream, user string) error {
+	var m core.Message
+	proto.InitAuthenticationCleartextPassword(&m)
+	pw, err := requestPassword(fe, &m)
+	if err != nil {
+		return err
+	}
+	stored, ok := a.lookup(user)
+	if !ok || !checkPassword(user, pw, stored) {
+		return rejectPassword(fe, user)
+	}
+	return sendOk(fe)
+}
+
+// Whether the cleartext password pw matches the stored password,
+// which may be an MD5 hash or SCRAM secret as well as cleartext.
+func checkPassword(user, pw, stored string) bool {
+	switch {
+	case strings.HasPrefix(stored, scramSecretPrefix):
+		secret, err := parseSCRAMSecret(stored)
+		if err != nil {
+			return false
+		}
+		derived := newSCRAMSecret(pw, secret.salt, secret.iterations)
+		return subtle.ConstantTimeCompare(derived.storedKey, secret.storedKey) == 1
+	case isMD5Hash(stored):
+		return subtle.ConstantTimeCompare([]byte("md5"+md5Hex(pw+user)),
+			[]byte(stored)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(pw), []byte(stored)) == 1
+}
+
+func isMD5Hash(stored string) bool {
+	return len(stored) == 35 && strings.HasPrefix(stored, "md5")
+}
+
+type md5Authenticator struct {
+	lookup PasswordLookup
+}
+
+// NewMD5Authenticator returns an Authenticator that asks the frontend
+// for its MD5-encrypted password.
+func NewMD5Authenticator(lookup PasswordLookup) Authenticator {
+	return &md5Authenticator{lookup}
+}
+
+func (a *md5Authenticator) Authenticate(fe core.Stream, user string) error {
+	var salt [4]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	var m core.Message
+	proto.InitAuthenticationMD5Password(&m, salt)
+	pw, err := requestPassword(fe, &m)
+	if err != nil {
+		return err
+	}
+
+	stored, ok := a.lookup(user)
+	// a SCRAM secret cannot be turned into the MD5 hash
+	if !ok || strings.HasPrefix(stored, scramSecretPrefix) {
+		return rejectPassword(fe, user)
+	}
+	var expected string
+	if isMD5Hash(stored) {
+		expected = md5Salted(stored[3:], salt)
+	} else {
+		expected = MD5Password(user, stored, salt)
+	}
+	if subtle.ConstantTimeCompare([]byte(pw), []byte(expected)) != 1 {
+		return rejectPassword(fe, user)
+	}
+	return sendOk(fe)
+}
+
+type scramAuthenticator struct {
+	lookup PasswordLookup
+}
+
+// NewSCRAMAuthenticator returns an Authenticator that performs a
+// SCRAM-SHA-256 exchange without channel binding.
+func NewSCRAMAuthenticator(lookup PasswordLookup) Authenticator {
+	return &scramAuthenticator{lookup}
+}
+
+func (a *scramAuthenticator) secret(user string) (*scramSecret, error) {
+	stored, ok := a.lookup(user)
+	if ok && strings.HasPrefix(stored, scramSecretPrefix) {
+		return parseSCRAMSecret(stored)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Go through the motions of the exchange with a
+		// secret nobody knows, so as not to reveal which
+		// users exist.
+		var err error
+		stored, err = scramNonce()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newSCRAMSecret(stored, salt, scramIterations), nil
+}
+
+func (a *scramAuthenticator) Authenticate(fe core.Stream, user string) error {
+	secret, err := a.secret(user)
+	if err != nil {
+		return err
+	}
+
+	var m core.Message
+	proto.InitAuthenticationSASL(&m, []string{SCRAMSHA256})
+	if err = sendAndReceive(fe, &m); err != nil {
+		return err
+	}
+	initial, err := proto.ReadSASLInitialResponse(&m)
+	if err != nil {
+		return err
+	}
+	if initial.Mechanism != SCRAMSHA256 {
+		return rejectAuth(fe, "unsupported SASL mechanism %q",
+			initial.Mechanism)
+	}
+
+	// client-first-message: a GS2 header followed by the bare
+	// message
+	clientFirst := string(initial.Data)
+	var gs2Header, gs2HeaderB64 string
+	if strings.HasPrefix(clientFirst, gs2NoBinding) {
+		gs2Header, gs2HeaderB64 = gs2NoBinding, gs2NoBindingB64
+	} else if strings.HasPrefix(clientFirst, gs2ServerBinds) {
+		// the client supports channel binding, but thinks we
+		// do not
+		gs2Header, gs2HeaderB64 = gs2ServerBinds, gs2ServerBindsB64
+	} else {
+		return rejectAuth(fe, "unsupported SCRAM GS2 header")
+	}
+	clientFirstBare := clientFirst[len(gs2Header):]
+	attrs, err := parseSCRAMAttributes(clientFirstBare)
+	if err != nil {
+		return rejectAuth(fe, "%v", err)
+	}
+	clientNonce := attrs['r']
+	if clientNonce == "" {
+		return rejectAuth(fe, "missing SCRAM client nonce")
+	}
+
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	nonce := clientNonce + serverNonce
+	serverFirst := "r=" + nonce + ",s=" +
+		base64.StdEncoding.EncodeToString(secret.salt) +
+		",i=" + strconv.Itoa(secret.iterations)
+	proto.InitAuthenticationSASLContinue(&m, []byte(serverFirst))
+	if err = sendAndReceive(fe, &m); err != nil {
+		return err
+	}
+	resp, err := proto.ReadSASLResponse(&m)
+	if err != nil {
+		return err
+	}
+
+	clientFinal := string(resp.Data)
+	proofIdx := strings.LastIndex(clientFinal, ",p=")
+	if proofIdx < 0 {
+		return rejectAuth(fe, "missing SCRAM client proof")
+	}
+	withoutProof := clientFinal[:proofIdx]
+	attrs, err = parseSCRAMAttributes(clientFinal)
+	if err != nil {
+		return rejectAuth(fe, "%v", err)
+	}
+	if attrs['c'] != gs2HeaderB64 {
+		return rejectAuth(fe, "SCRAM channel binding mismatch")
+	}
+	if attrs['r'] != nonce {
+		return rejectAuth(fe, "SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs['p'])
+	if err != nil {
+		return rejectAuth(fe, "malformed SCRAM client proof")
+	}
+
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," +
+		withoutProof)
+	if !secret.verifyProof(authMessage, proof) {
+		return rejectPassword(fe, user)
+	}
+
+	serverSignature := hmacSHA256(secret.serverKey, authMessage)
+	proto.InitAuthenticationSASLFinal(&m, []byte("v="+
+		base64.StdEncoding.EncodeToString(serverSignature)))
+	if err = fe.Send(&m); err != nil {
+		return err
+	}
+	return sendOk(fe)
+}
+
+// Send the request m, flush, and read the frontend's 'p' response
+// back into m.
+func sendAndReceive(fe core.Stream, m *core.Message) error {
+	if err := fe.Send(m); err != nil {
+		return err
+	}
+	if err := fe.Flush(); err != nil {
+		return err
+	}
+	if err := fe.Next(m); err != nil {
+		return err
+	}
+	if t := m.MsgType(); t != proto.MsgPasswordMessageP {
+		return rejectAuth(fe, "expected password response, got message type %q", t)
+	}
+	return nil
+}
+
+func requestPassword(fe core.Stream, m *core.Message) (string, error) {
+	if err := sendAndReceive(fe, m); err != nil {
+		return "", err
+	}
+	pw, err := proto.ReadPasswordMessage(m)
+	if err != nil {
+		return "", err
+	}
+	return pw.Password, nil
+}
+
+func sendOk(fe core.Stream) error {
+	var m core.Message
+	proto.InitAuthenticationOk(&m)
+	return fe.Send(&m)
+}
+
+func rejectPassword(fe core.Stream, user string) error {
+	return rejectAuth(fe, "password authentication failed for user %q", user)
+}
+
+// Send a FATAL invalid_password error to the frontend and return it
+// as an ErrAuth.
+func rejectAuth(fe core.Stream, format string, args ...interface{}) error {
+	authErr := e.Auth(format, args...)
+	var m core.Message
+	proto.InitErrorResponse(&m, map[byte]string{
+		'S': "FATAL",
+		'V': "FATAL",
+		'C': "28P01",
+		'M': authErr.Error(),
+	})
+	if err := fe.Send(&m); err != nil {
+		return err
+	}
+	if err := fe.Flush(); err != nil {
+		return err
+	}
+	return authErr
+}
@@ -0,0 +1,96 @@
+package femebe
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// ErrUnknownCancelKey is returned for a cancellation request whose
+// key data belongs to no known session.
+var ErrUnknownCancelKey = errors.New("no session with the given cancellation key data")
+
+type cancelKey struct {
+	backendPid uint32
+	secretKey  uint32
+}
+
+// Where requests with a given key data go: to c, with the key data
+// of the target
+type cancelTarget struct {
+	c Canceller
+	cancelKey
+}
+
+// CancelRegistry routes cancellation requests to the Cancellers of
+// the sessions they are for, by their key data. It can also issue
+// key data of its own for frontends to use in place of their
+// backends', which is mandatory once backends are shared between
+// frontends; requests with it are translated back for the backend.
+// It is safe for concurrent use.
+type CancelRegistry struct {
+	lock    sync.Mutex
+	targets map[cancelKey]cancelTarget
+	lastPid uint32
+}
+
+func NewCancelRegistry() *CancelRegistry {
+	return &CancelRegistry{targets: make(map[cancelKey]cancelTarget)}
+}
+
+// Register routes requests with the key data (backendPid, secretKey)
+// to c as they are, replacing any route for the same key data.
+func (r *CancelRegistry) Register(backendPid, secretKey uint32, c Canceller) {
+	key := cancelKey{backendPid, secretKey}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.targets[key] = cancelTarget{c, key}
+}
+
+// Issue makes up key data, unique in r, for a frontend to use in
+// place of the key data (backendPid, secretKey) of its backend, and
+// routes requests with it to c with the backend's key data instead.
+// The backend's key data may be zero if c works out where to send
+// requests itself, as the Sessions of a PoolingSessionManager do.
+func (r *CancelRegistry) Issue(backendPid, secretKey uint32,
+	c Canceller) (uint32, uint32, error) {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, 0, err
+	}
+	secret := binary.BigEndian.Uint32(buf[:])
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		r.lastPid++
+		if _, ok := r.targets[cancelKey{r.lastPid, secret}]; !ok && r.lastPid != 0 {
+			break
+		}
+	}
+	r.targets[cancelKey{r.lastPid, secret}] = cancelTarget{c,
+		cancelKey{backendPid, secretKey}}
+	return r.lastPid, secret, nil
+}
+
+// Unregister stops routing requests with the given key data.
+func (r *CancelRegistry) Unregister(backendPid, secretKey uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.targets, cancelKey{backendPid, secretKey})
+}
+
+// Cancel passes on a request with the given key data, returning
+// ErrUnknownCancelKey if it has no route.
+func (r *CancelRegistry) Cancel(backendPid, secretKey uint32) error {
+	r.lock.Lock()
+	target, ok := r.targets[cancelKey{backendPid, secretKey}]
+	r.lock.Unlock()
+	if !ok {
+		return ErrUnknownCancelKey
+	}
+	// Cancellers may take a while to reach the backend, so this
+	// is done without the lock held
+	return target.c.Cancel(target.backendPid, target.secretKey)
+}
@@ -0,0 +1,197 @@
+package femebe
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"net"
+	"sync"
+	"testing"
+)
+
+// A Canceller recording the key data of its requests
+type recordingCanceller struct {
+	lock     sync.Mutex
+	requests []cancelKey
+}
+
+func (c *recordingCanceller) Cancel(backendPid, secretKey uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.requests = append(c.requests, cancelKey{backendPid, secretKey})
+	return nil
+}
+
+func (c *recordingCanceller) last() cancelKey {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.requests) == 0 {
+		return cancelKey{}
+	}
+	return c.requests[len(c.requests)-1]
+}
+
+func TestCancelRegistry(t *testing.T) {
+	r := NewCancelRegistry()
+	direct := &recordingCanceller{}
+	r.Register(42, 7, direct)
+	if err := r.Cancel(42, 7); err != nil || direct.last() != (cancelKey{42, 7}) {
+		t.Errorf("got %v, %v", direct.requests, err)
+	}
+	if err := r.Cancel(42, 8); err != ErrUnknownCancelKey {
+		t.Errorf("got %v for the wrong secret key", err)
+	}
+
+	issued := &recordingCanceller{}
+	seen := make(map[cancelKey]bool)
+	for i := 0; i < 100; i++ {
+		pid, key, err := r.Issue(1234, 5678, issued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid == 0 || seen[cancelKey{pid, key}] {
+			t.Fatalf("issued bad key data %v, %v", pid, key)
+		}
+		seen[cancelKey{pid, key}] = true
+		if err = r.Cancel(pid, key); err != nil {
+			t.Fatal(err)
+		}
+		if got := issued.last(); got != (cancelKey{1234, 5678}) {
+			t.Fatalf("got request %v; want the backend's key data", got)
+		}
+		r.Unregister(pid, key)
+		if err = r.Cancel(pid, key); err != ErrUnknownCancelKey {
+			t.Fatalf("got %v after unregistering", err)
+		}
+	}
+}
+
+// A Session that runs until told to stop, and learns its key data
+// along the way
+type fakeSession struct {
+	recordingCanceller
+	running    chan bool
+	stop       chan bool
+	backendPid uint32
+	secretKey  uint32
+	notify     func(backendPid, secretKey uint32)
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{running: make(chan bool), stop: make(chan bool)}
+}
+
+func (s *fakeSession) Run() error {
+	close(s.running)
+	<-s.stop
+	return nil
+}
+
+func (s *fakeSession) BackendKeyData() (uint32, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backendPid, s.secretKey
+}
+
+func (s *fakeSession) NotifyBackendKeyData(f func(backendPid, secretKey uint32)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.notify = f
+}
+
+func (s *fakeSession) setBackendKeyData(pid, key uint32) {
+	s.lock.Lock()
+	s.backendPid, s.secretKey = pid, key
+	notify := s.notify
+	s.lock.Unlock()
+	notify(pid, key)
+}
+
+func TestSimpleSessionManagerCancel(t *testing.T) {
+	manager := NewSimpleSessionManager()
+	s1, s2 := newFakeSession(), newFakeSession()
+	done := make(chan error, 2)
+	go func() { done <- manager.RunSession(s1) }()
+	go func() { done <- manager.RunSession(s2) }()
+	<-s1.running
+	<-s2.running
+
+	s1.setBackendKeyData(1, 11)
+	if err := manager.Cancel(1, 11); err != nil {
+		t.Fatal(err)
+	}
+	if got := s1.last(); got != (cancelKey{1, 11}) {
+		t.Errorf("got request %v", got)
+	}
+	if err := manager.Cancel(2, 22); err != ErrUnknownCancelKey {
+		t.Errorf("got %v before the session learned its key data", err)
+	}
+	s2.setBackendKeyData(2, 22)
+	if err := manager.Cancel(2, 22); err != nil {
+		t.Fatal(err)
+	}
+	if got := s2.last(); got != (cancelKey{2, 22}) {
+		t.Errorf("got request %v", got)
+	}
+
+	close(s1.stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Cancel(1, 11); err != ErrUnknownCancelKey {
+		t.Errorf("got %v after the session ended", err)
+	}
+	close(s2.stop)
+	<-done
+}
+
+// A Router that hides whether the one it wraps is a
+// BackendKeyNotifier
+type plainRouter struct {
+	Router
+}
+
+func TestSimpleRouterCancel(t *testing.T) {
+	testSimpleRouterCancel(t, func(r Router) Router { return r })
+	testSimpleRouterCancel(t, func(r Router) Router { return plainRouter{r} })
+}
+
+func testSimpleRouterCancel(t *testing.T, wrap func(Router) Router) {
+	clientConn, feConn := net.Pipe()
+	beConn, serverConn := net.Pipe()
+	go runEchoQueryBackend(serverConn)
+
+	router := wrap(NewSimpleRouter(
+		core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn)),
+		core.NewBackendStream(util.NewBufferedReadWriteCloser(beConn))))
+	canceller := &recordingCanceller{}
+	manager := NewSimpleSessionManager()
+	session := NewSimpleSession(router, canceller)
+	_, notifier := router.(BackendKeyNotifier)
+	if _, ok := session.(BackendKeyNotifier); ok != notifier {
+		t.Errorf("got a session that is a BackendKeyNotifier: %v; want %v",
+			ok, notifier)
+	}
+	done := make(chan error, 1)
+	go func() { done <- manager.RunSession(session) }()
+
+	// the session can be cancelled by the time its
+	// BackendKeyData reaches the frontend
+	client := core.NewBackendStream(clientConn)
+	var m core.Message
+	if err := client.Next(&m); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Cancel(42, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := canceller.last(); got != (cancelKey{42, 7}) {
+		t.Errorf("got request %v", got)
+	}
+
+	client.Close()
+	beConn.Close()
+	<-done
+	if err := manager.Cancel(42, 7); err != ErrUnknownCancelKey {
+		t.Errorf("got %v after the session ended", err)
+	}
+}
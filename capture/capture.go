@@ -0,0 +1,249 @@
+// Package capture records protocol traffic to a compact on-disk
+// format and plays it back, to reproduce a session against a real
+// backend or to stand in for the backend of a recorded session.
+//
+// A capture starts with a short header identifying the format,
+// followed by one entry per message. Each entry is framed like a
+// protocol message itself: an envelope message of type 'r' holding
+// the direction and a timestamp, and then the recorded message as
+// it appeared on the wire (with a zero type byte for the untyped
+// startup packets), so captures can be read back with a
+// core.MessageStream.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction identifies which side of a connection sent a message.
+type Direction byte
+
+const (
+	FromFrontend Direction = 'F'
+	FromBackend  Direction = 'B'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromFrontend:
+		return "frontend"
+	case FromBackend:
+		return "backend"
+	}
+	return fmt.Sprintf("unknown direction %q", byte(d))
+}
+
+func (d Direction) opposite() Direction {
+	if d == FromFrontend {
+		return FromBackend
+	}
+	return FromFrontend
+}
+
+// Magic bytes and format version at the start of every capture
+var header = []byte("FEMEBECAP\0001")
+
+// Type of the envelope message preceding each recorded message
+const envelopeType = 'r'
+
+// Size of the envelope payload: the direction and the timestamp in
+// nanoseconds since the Unix epoch
+const envelopeSize = 1 + 8
+
+var ErrBadCapture = errors.New("not a capture, or unsupported capture version")
+
+// Record is a single recorded message.
+type Record struct {
+	Dir  Direction
+	Time time.Time
+	Msg  core.Message
+}
+
+// Writer writes records to a capture. It is safe to write to a
+// Writer from several goroutines.
+type Writer struct {
+	lock sync.Mutex
+	w    *bufio.Writer
+	// Whether the header has been written
+	started bool
+}
+
+// Make a Writer that writes a new capture to w. Nothing is written
+// until the first record; records are buffered until Flush.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Record m as sent in direction dir at the current time. This forces
+// m (see core.Message.Force), but leaves it otherwise intact for the
+// caller to read or send.
+func (w *Writer) Write(dir Direction, m *core.Message) error {
+	return w.WriteAt(dir, time.Now(), m)
+}
+
+// Record m as sent in direction dir at time t.
+func (w *Writer) WriteAt(dir Direction, t time.Time, m *core.Message) error {
+	if _, err := m.Force(); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.started {
+		if _, err := w.w.Write(header); err != nil {
+			return err
+		}
+		w.started = true
+	}
+
+	var envelope core.Message
+	var payload [envelopeSize]byte
+	payload[0] = byte(dir)
+	binary.BigEndian.PutUint64(payload[1:], uint64(t.UnixNano()))
+	envelope.InitFromBytes(envelopeType, payload[:])
+	if _, err := envelope.WriteTo(w.w); err != nil {
+		return err
+	}
+	if m.MsgType() == core.MsgTypeFirst {
+		// WriteTo leaves out the type of startup packets
+		if err := w.w.WriteByte(core.MsgTypeFirst); err != nil {
+			return err
+		}
+	}
+	_, err := m.WriteTo(w.w)
+	return err
+}
+
+// Write out any buffered records.
+func (w *Writer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Flush()
+}
+
+// Reader reads the records of a capture in order.
+type Reader struct {
+	r       io.Reader
+	stream  *core.MessageStream
+	started bool
+}
+
+type readOnly struct {
+	io.Reader
+}
+
+func (readOnly) Write(p []byte) (int, error) {
+	return 0, errors.New("capture streams are read-only")
+}
+
+func (readOnly) Close() error {
+	return nil
+}
+
+// Make a Reader for the capture in r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read the next record into rec, returning io.EOF at the end of the
+// capture. The message is copied into rec, so it stays valid after
+// further calls.
+func (r *Reader) Next(rec *Record) error {
+	if !r.started {
+		h := make([]byte, len(header))
+		if _, err := io.ReadFull(r.r, h); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return ErrBadCapture
+			}
+			return err
+		}
+		if !bytes.Equal(h, header) {
+			return ErrBadCapture
+		}
+		r.stream = core.NewBackendStream(readOnly{r.r})
+		r.started = true
+	}
+
+	var m core.Message
+	if err := r.stream.Next(&m); err != nil {
+		return err
+	}
+	if m.MsgType() != envelopeType || m.Size() != envelopeSize+4 {
+		return fmt.Errorf("malformed capture: expected record envelope, "+
+			"got message type %q", m.MsgType())
+	}
+	envelope, err := m.Force()
+	if err != nil {
+		return err
+	}
+	rec.Dir = Direction(envelope[0])
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(envelope[1:])))
+
+	if err = r.stream.Next(&m); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	rec.Msg.InitFromMessage(&m)
+	return nil
+}
+
+// Read all the remaining records in r.
+func ReadAll(r *Reader) ([]Record, error) {
+	var records []Record
+	for {
+		records = append(records, Record{})
+		err := r.Next(&records[len(records)-1])
+		if err == io.EOF {
+			return records[:len(records)-1], nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type recordingStream struct {
+	core.Stream
+	w *Writer
+	// The direction of messages received on the stream
+	remote Direction
+}
+
+// Wrap s so that every message received and sent on it is recorded
+// to w. The remote direction is the side s talks to: FromFrontend
+// for a stream to a frontend, whose messages it receives, or
+// FromBackend for a stream to a backend. Flushing the stream also
+// flushes w.
+func NewRecordingStream(s core.Stream, w *Writer, remote Direction) core.Stream {
+	return &recordingStream{s, w, remote}
+}
+
+func (s *recordingStream) Next(m *core.Message) error {
+	if err := s.Stream.Next(m); err != nil {
+		return err
+	}
+	return s.w.Write(s.remote, m)
+}
+
+func (s *recordingStream) Send(m *core.Message) error {
+	if err := s.w.Write(s.remote.opposite(), m); err != nil {
+		return err
+	}
+	return s.Stream.Send(m)
+}
+
+func (s *recordingStream) Flush() error {
+	if err := s.Stream.Flush(); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
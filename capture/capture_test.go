@@ -0,0 +1,254 @@
+package capture
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// A captured session: startup, one query and Terminate
+func sessionRecords() []Record {
+	var records []Record
+	add := func(dir Direction, init func(m *core.Message)) {
+		records = append(records, Record{Dir: dir, Time: time.Now()})
+		init(&records[len(records)-1].Msg)
+	}
+	add(FromFrontend, func(m *core.Message) {
+		proto.InitStartupMessage(m, map[string]string{"user": "test"})
+	})
+	add(FromBackend, proto.InitAuthenticationOk)
+	add(FromBackend, func(m *core.Message) {
+		proto.InitParameterStatus(m, "server_version", "9.4.0")
+	})
+	add(FromBackend, func(m *core.Message) {
+		proto.InitReadyForQuery(m, proto.RfqIdle)
+	})
+	add(FromFrontend, func(m *core.Message) {
+		proto.InitQuery(m, "SELECT 1")
+	})
+	add(FromBackend, func(m *core.Message) {
+		proto.InitCommandComplete(m, "SELECT 1")
+	})
+	add(FromBackend, func(m *core.Message) {
+		proto.InitReadyForQuery(m, proto.RfqIdle)
+	})
+	add(FromFrontend, proto.InitTerminate)
+	return records
+}
+
+func TestWriteRead(t *testing.T) {
+	records := sessionRecords()
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for i := range records {
+		if err := w.WriteAt(records[i].Dir, records[i].Time,
+			&records[i].Msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadAll(NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %v records; want %v", len(got), len(records))
+	}
+	for i := range got {
+		if got[i].Dir != records[i].Dir ||
+			!got[i].Time.Equal(records[i].Time) ||
+			!same(&got[i].Msg, &records[i].Msg) {
+			t.Errorf("record %v: got %v message %q at %v; want %v %q at %v",
+				i, got[i].Dir, got[i].Msg.MsgType(), got[i].Time,
+				records[i].Dir, records[i].Msg.MsgType(), records[i].Time)
+		}
+	}
+
+	if _, err = ReadAll(NewReader(bytes.NewBufferString("nope"))); err != ErrBadCapture {
+		t.Errorf("got error %v reading garbage; want ErrBadCapture", err)
+	}
+}
+
+func TestRecordingStream(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	client := NewRecordingStream(core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(clientConn)), w, FromBackend)
+	server := core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(serverConn))
+
+	done := make(chan error, 1)
+	go func() {
+		var m core.Message
+		if err := server.Next(&m); err != nil {
+			done <- err
+			return
+		}
+		if _, err := m.Force(); err != nil {
+			done <- err
+			return
+		}
+		proto.InitCommandComplete(&m, "SELECT 1")
+		server.Send(&m)
+		done <- server.Flush()
+	}()
+
+	var m core.Message
+	proto.InitQuery(&m, "SELECT 1")
+	if err := client.Send(&m); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Next(&m); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// The recorded message can still be read
+	cc, err := proto.ReadCommandComplete(&m)
+	if err != nil || cc.Tag != "SELECT" {
+		t.Errorf("got %#v, %v; want SELECT", cc, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadAll(NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 ||
+		records[0].Dir != FromFrontend ||
+		records[0].Msg.MsgType() != proto.MsgQueryQ ||
+		records[1].Dir != FromBackend ||
+		records[1].Msg.MsgType() != proto.MsgCommandCompleteC {
+		t.Errorf("unexpected records %#v", records)
+	}
+}
+
+// A backend that answers every query with a CommandComplete carrying
+// the query text.
+func runEchoQueryBackend(conn net.Conn) {
+	be := core.NewFrontendStream(util.NewBufferedReadWriteCloser(conn))
+	defer be.Close()
+	var m core.Message
+	if err := be.Next(&m); err != nil || m.Discard() != nil {
+		return
+	}
+	proto.InitAuthenticationOk(&m)
+	be.Send(&m)
+	proto.InitParameterStatus(&m, "server_version", "10.0")
+	be.Send(&m)
+	proto.InitReadyForQuery(&m, proto.RfqIdle)
+	be.Send(&m)
+	be.Flush()
+	for {
+		if err := be.Next(&m); err != nil {
+			return
+		}
+		if m.MsgType() != proto.MsgQueryQ {
+			return
+		}
+		q, err := proto.ReadQuery(&m)
+		if err != nil {
+			return
+		}
+		proto.InitCommandComplete(&m, q.Query)
+		be.Send(&m)
+		proto.InitReadyForQuery(&m, proto.RfqIdle)
+		be.Send(&m)
+		be.Flush()
+	}
+}
+
+type echoConnector struct{}
+
+func (echoConnector) Startup() (core.Stream, error) {
+	feConn, beConn := net.Pipe()
+	go runEchoQueryBackend(beConn)
+	fe := core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn))
+	var m core.Message
+	proto.InitStartupMessage(&m, map[string]string{"user": "test"})
+	if err := fe.Send(&m); err != nil {
+		return nil, err
+	}
+	return fe, fe.Flush()
+}
+
+func (echoConnector) Cancel(backendPid, secretKey uint32) error {
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	records := sessionRecords()
+	mismatches, err := Replay(records, echoConnector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The differing server_version is not compared
+	if len(mismatches) != 0 {
+		t.Errorf("got mismatches %v; want none", mismatches)
+	}
+
+	proto.InitCommandComplete(&records[5].Msg, "SELECT 2")
+	mismatches, err = Replay(records, echoConnector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Index != 5 {
+		t.Errorf("got mismatches %v; want one for record 5", mismatches)
+	}
+}
+
+func TestServe(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		// a client for the captured session
+		be := core.NewBackendStream(
+			util.NewBufferedReadWriteCloser(clientConn))
+		defer be.Close()
+		var m core.Message
+		proto.InitStartupMessage(&m, map[string]string{"user": "test"})
+		be.Send(&m)
+		be.Flush()
+		for i := 0; i < 3; i++ {
+			if be.Next(&m) != nil || m.Discard() != nil {
+				return
+			}
+		}
+		proto.InitQuery(&m, "SELECT 1")
+		be.Send(&m)
+		be.Flush()
+		for i := 0; i < 2; i++ {
+			if be.Next(&m) != nil || m.Discard() != nil {
+				return
+			}
+		}
+		proto.InitQuery(&m, "SELECT 2")
+		be.Send(&m)
+		be.Flush()
+	}()
+
+	fe := core.NewFrontendStream(util.NewBufferedReadWriteCloser(serverConn))
+	mismatches, err := Serve(sessionRecords(), fe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client sent another query instead of Terminate
+	if len(mismatches) != 1 || mismatches[0].Index != 7 ||
+		mismatches[0].Got.MsgType() != proto.MsgQueryQ {
+		t.Errorf("got mismatches %v; want Query instead of Terminate",
+			mismatches)
+	}
+}
@@ -0,0 +1,201 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// Mismatch describes a message received during playback that differs
+// from the one in the capture.
+type Mismatch struct {
+	// Index of the captured record
+	Index int
+	Want  *core.Message
+	// The message received instead, or nil if the connection
+	// ended first
+	Got *core.Message
+}
+
+func (m Mismatch) String() string {
+	if m.Got == nil {
+		return fmt.Sprintf("record %v: want message %q, got end of stream",
+			m.Index, m.Want.MsgType())
+	}
+	if m.Want.MsgType() != m.Got.MsgType() {
+		return fmt.Sprintf("record %v: want message %q, got %q",
+			m.Index, m.Want.MsgType(), m.Got.MsgType())
+	}
+	return fmt.Sprintf("record %v: message %q differs",
+		m.Index, m.Want.MsgType())
+}
+
+// Whether m may be sent by the backend at any time, regardless of
+// the queries it is answering. These are left out of comparisons.
+func isAsync(m *core.Message) bool {
+	switch m.MsgType() {
+	case proto.MsgParameterStatusS, proto.MsgNoticeResponseN,
+		proto.MsgNotificationResponseA:
+		return true
+	}
+	return false
+}
+
+func same(a, b *core.Message) bool {
+	if a.MsgType() != b.MsgType() {
+		return false
+	}
+	aBytes, err := a.Force()
+	if err != nil {
+		return false
+	}
+	bBytes, err := b.Force()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// Playback of one side of a capture against a live peer
+type player struct {
+	records []Record
+	// The side being played back
+	played Direction
+	peer   core.Stream
+	// Whether messages have been sent to peer since the last
+	// flush
+	unflushed  bool
+	mismatches []Mismatch
+	skipAsync  bool
+}
+
+// Receive the next relevant message from the peer and compare it
+// with the captured record i. Returns false if the peer is gone.
+func (p *player) expect(i int) (bool, error) {
+	if p.unflushed {
+		if err := p.peer.Flush(); err != nil {
+			return false, err
+		}
+		p.unflushed = false
+	}
+	want := &p.records[i].Msg
+	var got core.Message
+	for {
+		if err := p.peer.Next(&got); err != nil {
+			p.mismatches = append(p.mismatches, Mismatch{i, want, nil})
+			return false, nil
+		}
+		if !p.skipAsync || !isAsync(&got) {
+			break
+		}
+		if err := got.Discard(); err != nil {
+			return false, err
+		}
+	}
+	if !same(want, &got) {
+		var gotCopy core.Message
+		gotCopy.InitFromMessage(&got)
+		p.mismatches = append(p.mismatches, Mismatch{i, want, &gotCopy})
+	}
+	return true, nil
+}
+
+// Play back the records from start on.
+func (p *player) play(start int) ([]Mismatch, error) {
+	for i := start; i < len(p.records); i++ {
+		rec := &p.records[i]
+		if rec.Dir == p.played {
+			var m core.Message
+			m.InitFromMessage(&rec.Msg)
+			if err := p.peer.Send(&m); err != nil {
+				return p.mismatches, err
+			}
+			p.unflushed = true
+			continue
+		}
+		if p.skipAsync && isAsync(&rec.Msg) {
+			continue
+		}
+		ok, err := p.expect(i)
+		if err != nil || !ok {
+			return p.mismatches, err
+		}
+	}
+	if p.unflushed {
+		return p.mismatches, p.peer.Flush()
+	}
+	return p.mismatches, nil
+}
+
+// Replay the frontend side of the captured session records against
+// a live backend reached through c, comparing the backend's
+// responses with the captured ones. The captured startup and
+// authentication exchange is skipped: c performs its own, and
+// playback starts after the first ReadyForQuery on both sides.
+// ParameterStatus, NoticeResponse and NotificationResponse messages
+// are not compared.
+//
+// Messages that differ are returned as Mismatches; an error is only
+// returned if the backend cannot be reached or written to.
+func Replay(records []Record, c femebe.Connector) ([]Mismatch, error) {
+	start := 0
+	for start < len(records) {
+		rec := &records[start]
+		start++
+		if rec.Dir == FromBackend &&
+			rec.Msg.MsgType() == proto.MsgReadyForQueryZ {
+			break
+		}
+	}
+
+	be, err := c.Startup()
+	if err != nil {
+		return nil, err
+	}
+	defer be.Close()
+	var m core.Message
+	for {
+		if err = be.Next(&m); err != nil {
+			return nil, err
+		}
+		if m.MsgType() == proto.MsgErrorResponseE {
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			return nil, er
+		}
+		if err = m.Discard(); err != nil {
+			return nil, err
+		}
+		if m.MsgType() == proto.MsgReadyForQueryZ {
+			break
+		}
+	}
+
+	p := &player{
+		records:   records,
+		played:    FromFrontend,
+		peer:      be,
+		skipAsync: true,
+	}
+	return p.play(start)
+}
+
+// Serve the backend side of the captured session records to the
+// frontend fe, as if it were the backend, comparing the frontend's
+// messages with the captured ones. Playback starts at the beginning
+// of the capture, so fe should be waiting for its StartupMessage
+// (see core.NewFrontendStream). Since authentication salts and
+// nonces change between sessions, password exchanges are likely to
+// show up as Mismatches.
+func Serve(records []Record, fe core.Stream) ([]Mismatch, error) {
+	p := &player{
+		records: records,
+		played:  FromBackend,
+		peer:    fe,
+	}
+	return p.play(0)
+}
@@ -0,0 +1,460 @@
+package femebe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// ErrClientBusy is returned when a Client is used while the Rows of
+// an earlier query are still open.
+var ErrClientBusy = errors.New("client busy: close the open Rows first")
+
+// Client runs queries of its own on a backend connection, such as
+// health checks or catalog lookups. It is not safe for concurrent
+// use, and runs one query at a time: the Rows of a query must be
+// closed before the next.
+type Client struct {
+	// ParameterStatus values reported by the backend, kept up to
+	// date as they change
+	Parameters map[string]string
+	// The backend's cancellation key data
+	BackendPid uint32
+	SecretKey  uint32
+	// The transaction status of the last ReadyForQuery
+	TxnStatus proto.ConnStatus
+
+	stream    core.Stream
+	connector Connector
+	busy      bool
+}
+
+// Connect starts up a backend connection through c and returns a
+// Client for it. If the backend asks for a password, c must supply
+// it, as one made with NewPasswordConnector does.
+func Connect(c Connector) (*Client, error) {
+	be, err := c.Startup()
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewClient(be)
+	if err != nil {
+		be.Close()
+		return nil, err
+	}
+	client.connector = c
+	return client, nil
+}
+
+// NewClient returns a Client for be, a stream to a backend on which
+// a StartupMessage has been sent, as by Connector.Startup, once the
+// backend is ready for queries.
+func NewClient(be core.Stream) (*Client, error) {
+	c := &Client{Parameters: make(map[string]string), stream: be}
+	var m core.Message
+	for {
+		if err := be.Next(&m); err != nil {
+			return nil, err
+		}
+		switch m.MsgType() {
+		case proto.MsgAuthenticationOkR:
+			a, err := proto.ReadAuthentication(&m)
+			if err != nil {
+				return nil, err
+			}
+			if a.Type != proto.AuthOk {
+				return nil, fmt.Errorf("backend requested authentication "+
+					"type %v; use a password Connector", a.Type)
+			}
+		case proto.MsgBackendKeyDataK:
+			kd, err := proto.ReadBackendKeyData(&m)
+			if err != nil {
+				return nil, err
+			}
+			c.BackendPid = kd.BackendPid
+			c.SecretKey = kd.SecretKey
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			return nil, er
+		case proto.MsgReadyForQueryZ:
+			if err := c.readyForQuery(&m); err != nil {
+				return nil, err
+			}
+			return c, nil
+		default:
+			if err := c.asyncMessage(&m); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Handle a message the backend may send at any time
+func (c *Client) asyncMessage(m *core.Message) error {
+	if m.MsgType() == proto.MsgParameterStatusS {
+		ps, err := proto.ReadParameterStatus(m)
+		if err != nil {
+			return err
+		}
+		c.Parameters[ps.Name] = ps.Value
+		return nil
+	}
+	return m.Discard()
+}
+
+func (c *Client) readyForQuery(m *core.Message) error {
+	rfq, err := proto.ReadReadyForQuery(m)
+	if err != nil {
+		return err
+	}
+	c.TxnStatus = rfq.ConnStatus
+	return nil
+}
+
+// Read the rest of the response to a request, up to ReadyForQuery,
+// and return the last CommandComplete and the first ErrorResponse
+func (c *Client) finish() (*proto.CommandComplete, error) {
+	var m core.Message
+	var cc *proto.CommandComplete
+	var result error
+	for {
+		if err := c.stream.Next(&m); err != nil {
+			return nil, err
+		}
+		switch m.MsgType() {
+		case proto.MsgCommandCompleteC:
+			var err error
+			if cc, err = proto.ReadCommandComplete(&m); err != nil {
+				return nil, err
+			}
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			if result == nil {
+				result = er
+			}
+		case proto.MsgReadyForQueryZ:
+			if err := c.readyForQuery(&m); err != nil {
+				return nil, err
+			}
+			if result != nil {
+				return nil, result
+			}
+			return cc, nil
+		default:
+			if err := c.asyncMessage(&m); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Send the messages initialized by the given functions and flush
+func (c *Client) send(init ...func(m *core.Message)) error {
+	var m core.Message
+	for _, fn := range init {
+		fn(&m)
+		if err := c.stream.Send(&m); err != nil {
+			return err
+		}
+	}
+	return c.stream.Flush()
+}
+
+// Exec runs the statement sql and returns its CommandComplete;
+// any rows are discarded. Without args, sql is sent as a simple
+// query, and may hold several statements; the last CommandComplete
+// is returned. With args, it is run through the extended protocol
+// as a single statement with the args as its $1, $2, ... parameters.
+// An error reported by the backend is returned as a
+// *proto.ErrorResponse.
+func (c *Client) Exec(sql string, args ...interface{}) (*proto.CommandComplete, error) {
+	if err := c.request(sql, args); err != nil {
+		return nil, err
+	}
+	c.busy = false
+	return c.finish()
+}
+
+// Query runs the statement sql as for Exec, and returns its rows. With
+// several statements in sql, only the rows of the first are returned.
+func (c *Client) Query(sql string, args ...interface{}) (*Rows, error) {
+	if err := c.request(sql, args); err != nil {
+		return nil, err
+	}
+	return &Rows{c: c}, nil
+}
+
+// Send a simple query, or an unnamed statement with its parameters
+func (c *Client) request(sql string, args []interface{}) error {
+	if c.busy {
+		return ErrClientBusy
+	}
+	if len(args) == 0 {
+		err := c.send(func(m *core.Message) { proto.InitQuery(m, sql) })
+		c.busy = err == nil
+		return err
+	}
+	params, err := encodeParams(args, nil)
+	if err != nil {
+		return err
+	}
+	err = c.send(
+		func(m *core.Message) { proto.InitParse(m, "", sql, nil) },
+		func(m *core.Message) { proto.InitBind(m, "", "", nil, params, nil) },
+		func(m *core.Message) { proto.InitDescribe(m, proto.IsPortal, "") },
+		func(m *core.Message) { proto.InitExecute(m, "", 0) },
+		proto.InitSync)
+	c.busy = err == nil
+	return err
+}
+
+// Encode the args as text parameter values for Bind, as the given
+// types if known
+func encodeParams(args []interface{}, types []proto.Oid) ([][]byte, error) {
+	params := make([][]byte, len(args))
+	for i, arg := range args {
+		if arg == nil {
+			continue
+		}
+		var b bytes.Buffer
+		var err error
+		if i < len(types) && types[i] != 0 {
+			err = codec.EncodeTypedValue(&b, arg, types[i], proto.EncFmtTxt)
+		} else {
+			err = codec.EncodeValue(&b, arg, proto.EncFmtTxt)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parameter $%v: %v", i+1, err)
+		}
+		// Bind takes values without their length prefix
+		params[i] = b.Bytes()[4:]
+	}
+	return params, nil
+}
+
+// Stmt is a statement prepared on a Client's backend.
+type Stmt struct {
+	Name string
+	// The types of the parameters, as the backend resolved them
+	ParamOids []proto.Oid
+	// The columns of the result, or nil if there are none
+	Fields []proto.FieldDescription
+
+	c *Client
+}
+
+// Prepare prepares sql as the statement with the given name, which
+// may be empty for the unnamed statement.
+func (c *Client) Prepare(name, sql string) (*Stmt, error) {
+	if c.busy {
+		return nil, ErrClientBusy
+	}
+	err := c.send(
+		func(m *core.Message) { proto.InitParse(m, name, sql, nil) },
+		func(m *core.Message) { proto.InitDescribe(m, proto.IsStmt, name) },
+		proto.InitSync)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &Stmt{Name: name, c: c}
+	var m core.Message
+	for {
+		if err := c.stream.Next(&m); err != nil {
+			return nil, err
+		}
+		switch m.MsgType() {
+		case proto.MsgParameterDescriptionT:
+			pd, err := proto.ReadParameterDescription(&m)
+			if err != nil {
+				return nil, err
+			}
+			stmt.ParamOids = pd.ParamOids
+		case proto.MsgRowDescriptionT:
+			rd, err := proto.ReadRowDescription(&m)
+			if err != nil {
+				return nil, err
+			}
+			stmt.Fields = rd.Fields
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			if _, err = c.finish(); err != nil {
+				return nil, err
+			}
+			return nil, er
+		case proto.MsgReadyForQueryZ:
+			if err := c.readyForQuery(&m); err != nil {
+				return nil, err
+			}
+			return stmt, nil
+		default:
+			if err := c.asyncMessage(&m); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Exec runs the statement with the given parameters, as for
+// Client.Exec.
+func (s *Stmt) Exec(args ...interface{}) (*proto.CommandComplete, error) {
+	if err := s.request(args); err != nil {
+		return nil, err
+	}
+	s.c.busy = false
+	return s.c.finish()
+}
+
+// Query runs the statement with the given parameters and returns its
+// rows.
+func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
+	if err := s.request(args); err != nil {
+		return nil, err
+	}
+	rows := &Rows{c: s.c}
+	rows.reader.Fields = s.Fields
+	return rows, nil
+}
+
+func (s *Stmt) request(args []interface{}) error {
+	if s.c.busy {
+		return ErrClientBusy
+	}
+	if len(args) != len(s.ParamOids) {
+		return fmt.Errorf("statement takes %v parameters; got %v",
+			len(s.ParamOids), len(args))
+	}
+	params, err := encodeParams(args, s.ParamOids)
+	if err != nil {
+		return err
+	}
+	err = s.c.send(
+		func(m *core.Message) { proto.InitBind(m, "", s.Name, nil, params, nil) },
+		func(m *core.Message) { proto.InitExecute(m, "", 0) },
+		proto.InitSync)
+	s.c.busy = err == nil
+	return err
+}
+
+// Close closes the statement on the backend.
+func (s *Stmt) Close() error {
+	if s.c.busy {
+		return ErrClientBusy
+	}
+	err := s.c.send(
+		func(m *core.Message) { proto.InitClose(m, proto.IsStmt, s.Name) },
+		proto.InitSync)
+	if err != nil {
+		return err
+	}
+	_, err = s.c.finish()
+	return err
+}
+
+// Rows reads the rows of a query. Next must be called before each
+// row, including the first; the Client is usable again once Next has
+// returned false or Close has been called.
+type Rows struct {
+	c      *Client
+	reader codec.ResultReader
+	err    error
+	closed bool
+}
+
+// Next reads the next row, and returns whether there is one. When it
+// returns false, Err reports any error.
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+	ok, err := r.reader.Next(r.c.stream)
+	if err != nil {
+		r.err = err
+		if _, isResponse := err.(*proto.ErrorResponse); !isResponse {
+			// the stream is broken; don't read any further
+			r.closed = true
+			return false
+		}
+	}
+	if !ok {
+		r.Close()
+	}
+	return ok
+}
+
+// Err returns the error, if any, that ended the rows.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close discards any remaining rows, and returns Err.
+func (r *Rows) Close() error {
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+	r.c.busy = false
+	if _, err := r.c.finish(); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// Fields returns the columns of the rows.
+func (r *Rows) Fields() []proto.FieldDescription {
+	return r.reader.Fields
+}
+
+// Complete returns the CommandComplete ending the rows, once Next has
+// returned false.
+func (r *Rows) Complete() *proto.CommandComplete {
+	return r.reader.Complete
+}
+
+// Values returns the decoded values of the current row, with NULLs as
+// nil.
+func (r *Rows) Values() ([]interface{}, error) {
+	return r.reader.Values()
+}
+
+// Map returns the decoded values of the current row by column name.
+func (r *Rows) Map() (map[string]interface{}, error) {
+	return r.reader.Map()
+}
+
+// Scan stores the current row in dst, as codec.ResultReader.Scan
+// does.
+func (r *Rows) Scan(dst interface{}) error {
+	return r.reader.Scan(dst)
+}
+
+// Cancel asks the backend to cancel the running query. It needs the
+// Connector the Client was made with by Connect.
+func (c *Client) Cancel() error {
+	if c.connector == nil {
+		return errors.New("client has no Connector to cancel through")
+	}
+	return c.connector.Cancel(c.BackendPid, c.SecretKey)
+}
+
+// Close terminates the session and closes the stream.
+func (c *Client) Close() error {
+	var m core.Message
+	proto.InitTerminate(&m)
+	if c.stream.Send(&m) == nil {
+		c.stream.Flush()
+	}
+	return c.stream.Close()
+}
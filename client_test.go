@@ -0,0 +1,211 @@
+package femebe
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/server"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A server.Handler answering "SELECT n" simple queries, SET, and
+// prepared statements that sum their int4 parameters
+type sumHandler struct {
+	cancelled chan uint32
+}
+
+func (h *sumHandler) Query(s *server.Session, query string) error {
+	var n int32
+	var name, value string
+	if _, err := fmt.Sscanf(query, "SELECT %d", &n); err == nil {
+		return codec.WriteRows(s.Stream, []string{"n"},
+			[][]interface{}{{n}}, nil)
+	}
+	if _, err := fmt.Sscanf(query, "SET %s TO %s", &name, &value); err == nil {
+		if err = s.SetParameter(name, value); err != nil {
+			return err
+		}
+		return s.Complete("SET")
+	}
+	return server.Error("42601", "syntax error at or near %q", query)
+}
+
+func (h *sumHandler) Parse(s *server.Session, stmt *server.Statement) error {
+	if !strings.HasPrefix(stmt.Query, "SELECT $") {
+		return server.Error("42601", "syntax error")
+	}
+	stmt.ParamOids = make([]proto.Oid, strings.Count(stmt.Query, "$"))
+	for i := range stmt.ParamOids {
+		stmt.ParamOids[i] = proto.OidInt4
+	}
+	stmt.Fields = []proto.FieldDescription{
+		*codec.DefaultRegistry.NewField("sum", proto.OidInt4),
+	}
+	return nil
+}
+
+func (h *sumHandler) Bind(s *server.Session, portal *server.Portal) error {
+	var sum int64
+	for i := range portal.Params {
+		val, err := portal.Param(i)
+		if err != nil {
+			return err
+		}
+		sum += val.(int64)
+	}
+	portal.Data = sum
+	return nil
+}
+
+func (h *sumHandler) Execute(s *server.Session, portal *server.Portal, maxRows uint32) error {
+	w := portal.Writer()
+	if err := w.WriteRow(s.Stream, []interface{}{portal.Data}); err != nil {
+		return err
+	}
+	return w.WriteComplete(s.Stream)
+}
+
+func (h *sumHandler) Cancel(s *server.Session) {
+	h.cancelled <- s.BackendPid
+}
+
+// A Connector to a server over in-memory pipes
+type serverConnector struct {
+	srv *server.Server
+}
+
+func (c *serverConnector) dial() core.Stream {
+	feConn, beConn := net.Pipe()
+	go c.srv.ServeConn(beConn)
+	return core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn))
+}
+
+func (c *serverConnector) Startup() (core.Stream, error) {
+	be := c.dial()
+	var m core.Message
+	proto.InitStartupMessage(&m, map[string]string{"user": "alice"})
+	if err := be.Send(&m); err != nil {
+		return nil, err
+	}
+	return be, be.Flush()
+}
+
+func (c *serverConnector) Cancel(backendPid, secretKey uint32) error {
+	be := c.dial()
+	defer be.Close()
+	var m core.Message
+	proto.InitCancelRequest(&m, backendPid, secretKey)
+	if err := be.Send(&m); err != nil {
+		return err
+	}
+	return be.Flush()
+}
+
+func TestClient(t *testing.T) {
+	h := &sumHandler{cancelled: make(chan uint32, 1)}
+	client, err := Connect(&serverConnector{&server.Server{Handler: h}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.Parameters["server_encoding"] != "UTF8" || client.BackendPid == 0 ||
+		client.TxnStatus != proto.RfqIdle {
+		t.Errorf("got client %#v", client)
+	}
+
+	rows, err := client.Query("SELECT 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for rows.Next() {
+		var row struct{ N int }
+		if err = rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row.N)
+	}
+	if rows.Err() != nil || len(got) != 1 || got[0] != 7 ||
+		rows.Complete().AffectedCount != 1 {
+		t.Errorf("got %v, %v, %#v", got, rows.Err(), rows.Complete())
+	}
+
+	cc, err := client.Exec("SET search_path TO x")
+	if err != nil || cc.Tag != "SET" || client.Parameters["search_path"] != "x" {
+		t.Errorf("got %#v, %v, %v", cc, err, client.Parameters)
+	}
+	if _, err = client.Exec("nope"); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*proto.ErrorResponse); !ok {
+		t.Errorf("got %T; want an ErrorResponse", err)
+	}
+
+	rows, err = client.Query("SELECT $1 + $2", 1, int64(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Exec("SELECT 1"); err != ErrClientBusy {
+		t.Errorf("got %v; want ErrClientBusy", err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	if vals, _ := rows.Values(); len(vals) != 1 || vals[0] != int64(3) {
+		t.Errorf("got %#v", vals)
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = client.Query("SELECT $1", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.Next() || rows.Err() == nil {
+		t.Errorf("expected an error")
+	}
+
+	stmt, err := client.Prepare("add", "SELECT $1 + $2 + $3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmt.ParamOids) != 3 || len(stmt.Fields) != 1 {
+		t.Errorf("got %#v", stmt)
+	}
+	for i := 0; i < 2; i++ {
+		rows, err = stmt.Query(1, 2, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rows.Next() {
+			t.Fatal(rows.Err())
+		}
+		if m, _ := rows.Map(); m["sum"] != int64(3+i) {
+			t.Errorf("got %#v", m)
+		}
+		rows.Close()
+	}
+	if cc, err = stmt.Exec(1, 1, 1); err != nil || cc.AffectedCount != 1 {
+		t.Errorf("got %#v, %v", cc, err)
+	}
+	if _, err = stmt.Exec(1); err == nil {
+		t.Errorf("expected an error for too few parameters")
+	}
+	if err = stmt.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = client.Prepare("", "DELETE"); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	if err = client.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if pid := <-h.cancelled; pid != client.BackendPid {
+		t.Errorf("cancelled %v; want %v", pid, client.BackendPid)
+	}
+}
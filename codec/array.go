@@ -0,0 +1,582 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Array is a Postgres array of any number of dimensions.
+type Array struct {
+	// The type of the elements
+	Elem proto.Oid
+	// The length and lower bound of each dimension, outermost
+	// first; an empty array has none
+	Dims []ArrayDim
+	// The elements in row-major order, nil for NULL
+	Elems []interface{}
+}
+
+type ArrayDim struct {
+	Len   int32
+	Lower int32
+}
+
+// NewArray makes an Array of the elements of the Go slice val, which
+// is nested one level deeper for each dimension after the first,
+// such as a [][]int32. A []interface{} may contain nil elements for
+// NULLs. Lower bounds are 1. If elem is 0, the element type is
+// chosen by MappedOid.
+func NewArray(val interface{}, elem proto.Oid) (Array, error) {
+	a := Array{Elem: elem}
+	v := reflect.ValueOf(val)
+	if !isArraySlice(v) {
+		return a, fmt.Errorf("Can't make an array of %T", val)
+	}
+	for d := v; isArraySlice(d); {
+		if d.Len() == 0 {
+			if len(a.Dims) > 0 {
+				// Postgres has no empty sub-arrays
+				return a, fmt.Errorf("Can't make an array of %#v: "+
+					"empty sub-array", val)
+			}
+			return a, nil
+		}
+		a.Dims = append(a.Dims, ArrayDim{int32(d.Len()), 1})
+		d = unwrap(d.Index(0))
+	}
+	if err := a.flatten(v, 0); err != nil {
+		return a, fmt.Errorf("Can't make an array of %#v: %v", val, err)
+	}
+	if a.Elem == 0 {
+		a.Elem = proto.OidUnknown
+		for _, elem := range a.Elems {
+			if elem != nil {
+				a.Elem = MappedOid(elem)
+				break
+			}
+		}
+	}
+	return a, nil
+}
+
+// Whether v is a slice or array that makes a Postgres array (a
+// []byte is a bytea instead)
+func isArraySlice(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	}
+	return false
+}
+
+// The value inside an interface{}
+func unwrap(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		return v.Elem()
+	}
+	return v
+}
+
+func (a *Array) flatten(v reflect.Value, dim int) error {
+	if v.Len() != int(a.Dims[dim].Len) {
+		return fmt.Errorf("sub-arrays of dimension %v differ in length",
+			dim+1)
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := unwrap(v.Index(i))
+		if dim+1 < len(a.Dims) {
+			if !isArraySlice(elem) {
+				return fmt.Errorf("element %v of dimension %v is not an array",
+					i, dim+1)
+			}
+			if err := a.flatten(elem, dim+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if isArraySlice(elem) {
+			return fmt.Errorf("too many dimensions")
+		}
+		if elem.Kind() == reflect.Interface {
+			// a nil interface{}
+			a.Elems = append(a.Elems, nil)
+		} else {
+			a.Elems = append(a.Elems, elem.Interface())
+		}
+	}
+	return nil
+}
+
+// Nested returns the elements of a as nested []interface{} slices,
+// one level for each dimension.
+func (a Array) Nested() []interface{} {
+	if len(a.Dims) == 0 {
+		return []interface{}{}
+	}
+	result, _ := a.nest(0, 0)
+	return result
+}
+
+func (a Array) nest(dim, offset int) ([]interface{}, int) {
+	result := make([]interface{}, a.Dims[dim].Len)
+	for i := range result {
+		if dim+1 < len(a.Dims) {
+			result[i], offset = a.nest(dim+1, offset)
+		} else {
+			result[i] = a.Elems[offset]
+			offset++
+		}
+	}
+	return result, offset
+}
+
+// The number of elements the dimensions call for
+func (a Array) size() int {
+	if len(a.Dims) == 0 {
+		return 0
+	}
+	n := 1
+	for _, d := range a.Dims {
+		n *= int(d.Len)
+	}
+	return n
+}
+
+// Encode a single element without its length prefix; nil is NULL.
+func encodeElem(elem interface{}, typ proto.Oid,
+	format proto.EncFmt) ([]byte, error) {
+	if elem == nil {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if err := EncodeTypedValue(&b, elem, typ, format); err != nil {
+		return nil, err
+	}
+	return b.Bytes()[4:], nil
+}
+
+// Whether an element must be quoted in the text form of an array
+func needsQuotes(s string) bool {
+	if s == "" || strings.EqualFold(s, "NULL") {
+		return true
+	}
+	return strings.IndexAny(s, "{},\"\\ \t\n\r\v\f") >= 0
+}
+
+// The text form of a, without its length prefix
+func (a Array) text() ([]byte, error) {
+	var b bytes.Buffer
+	if len(a.Dims) == 0 {
+		return []byte("{}"), nil
+	}
+	for _, d := range a.Dims {
+		if d.Lower != 1 {
+			for _, d := range a.Dims {
+				fmt.Fprintf(&b, "[%d:%d]", d.Lower, d.Lower+d.Len-1)
+			}
+			b.WriteByte('=')
+			break
+		}
+	}
+
+	// Open and close braces as the index into each dimension
+	// rolls over
+	counts := make([]int32, len(a.Dims))
+	for i, elem := range a.Elems {
+		for dim := len(a.Dims) - 1; dim >= 0; dim-- {
+			if counts[dim] != 0 {
+				break
+			}
+			b.WriteByte('{')
+		}
+		if i > 0 && counts[len(counts)-1] != 0 {
+			b.WriteByte(',')
+		}
+		text, err := encodeElem(elem, a.Elem, proto.EncFmtTxt)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case elem == nil:
+			b.WriteString("NULL")
+		case needsQuotes(string(text)):
+			b.WriteByte('"')
+			for _, c := range text {
+				if c == '"' || c == '\\' {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(c)
+			}
+			b.WriteByte('"')
+		default:
+			b.Write(text)
+		}
+		for dim := len(a.Dims) - 1; dim >= 0; dim-- {
+			counts[dim]++
+			if counts[dim] < a.Dims[dim].Len {
+				break
+			}
+			counts[dim] = 0
+			b.WriteByte('}')
+			if dim > 0 && counts[dim-1]+1 < a.Dims[dim-1].Len {
+				b.WriteByte(',')
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// The binary form of a, without its length prefix
+func (a Array) binary() ([]byte, error) {
+	var b bytes.Buffer
+	var elems bytes.Buffer
+	hasNulls := int32(0)
+	for _, elem := range a.Elems {
+		if elem == nil {
+			hasNulls = 1
+		}
+		if err := EncodeTypedValue(&elems, elem, a.Elem,
+			proto.EncFmtBinary); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteInt32(&b, int32(len(a.Dims)))
+	buf.WriteInt32(&b, hasNulls)
+	buf.WriteUint32(&b, uint32(a.Elem))
+	for _, d := range a.Dims {
+		buf.WriteInt32(&b, d.Len)
+		buf.WriteInt32(&b, d.Lower)
+	}
+	b.Write(elems.Bytes())
+	return b.Bytes(), nil
+}
+
+// Write the array val, an Array or a Go slice, as an array of
+// elements of type elem.
+func encodeArray(buff *bytes.Buffer, val interface{}, elem proto.Oid,
+	format proto.EncFmt) error {
+	a, ok := val.(Array)
+	if !ok {
+		var err error
+		if a, err = NewArray(val, elem); err != nil {
+			return err
+		}
+	}
+	if a.size() != len(a.Elems) {
+		return fmt.Errorf("Can't encode array: dimensions call for %v "+
+			"elements, but there are %v", a.size(), len(a.Elems))
+	}
+	a.Elem = elem
+	var encoded []byte
+	var err error
+	switch format {
+	case proto.EncFmtTxt:
+		encoded, err = a.text()
+	case proto.EncFmtBinary:
+		encoded, err = a.binary()
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	buf.WriteInt32(buff, int32(len(encoded)))
+	buff.Write(encoded)
+	return nil
+}
+
+// Parses the text form of arrays
+type arrayParser struct {
+	s    string
+	pos  int
+	elem proto.Oid
+	a    Array
+	// The number of dimensions, once an element has been seen,
+	// and the length of each
+	depth int
+	lens  []int32
+}
+
+func (p *arrayParser) fail(format string, args ...interface{}) error {
+	return e.Decode("could not parse array %q at %v: %v", p.s, p.pos,
+		fmt.Sprintf(format, args...))
+}
+
+func (p *arrayParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n\r\v\f", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *arrayParser) expect(c byte) error {
+	if p.pos >= len(p.s) || p.s[p.pos] != c {
+		return p.fail("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *arrayParser) int() (int32, error) {
+	start := p.pos
+	if p.pos < len(p.s) && p.s[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	i, err := strconv.ParseInt(p.s[start:p.pos], 10, 32)
+	if err != nil {
+		return 0, p.fail("bad dimension bound")
+	}
+	return int32(i), nil
+}
+
+// Parse the optional "[lower:upper]..." prefix.
+func (p *arrayParser) bounds() error {
+	if p.pos >= len(p.s) || p.s[p.pos] != '[' {
+		return nil
+	}
+	for p.pos < len(p.s) && p.s[p.pos] == '[' {
+		p.pos++
+		lower, err := p.int()
+		if err != nil {
+			return err
+		}
+		if err = p.expect(':'); err != nil {
+			return err
+		}
+		upper, err := p.int()
+		if err != nil {
+			return err
+		}
+		if err = p.expect(']'); err != nil {
+			return err
+		}
+		if upper < lower {
+			return p.fail("upper bound below lower bound")
+		}
+		p.a.Dims = append(p.a.Dims, ArrayDim{upper - lower + 1, lower})
+	}
+	return p.expect('=')
+}
+
+// Parse a brace-enclosed sub-array of the given dimension.
+func (p *arrayParser) sub(dim int) error {
+	if err := p.expect('{'); err != nil {
+		return err
+	}
+	if p.depth > 0 && dim >= p.depth {
+		return p.fail("too many dimensions")
+	}
+	var n int32
+	for {
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == '{' {
+			if err := p.sub(dim + 1); err != nil {
+				return err
+			}
+		} else {
+			if p.depth == 0 {
+				p.depth = dim + 1
+			} else if dim+1 != p.depth {
+				return p.fail("expected sub-array")
+			}
+			if err := p.element(); err != nil {
+				return err
+			}
+		}
+		n++
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if err := p.expect('}'); err != nil {
+			return err
+		}
+		break
+	}
+
+	for len(p.lens) <= dim {
+		p.lens = append(p.lens, 0)
+	}
+	if p.lens[dim] == 0 {
+		p.lens[dim] = n
+	} else if p.lens[dim] != n {
+		return p.fail("sub-arrays of dimension %v differ in length", dim+1)
+	}
+	return nil
+}
+
+// Parse a single element, quoted or not.
+func (p *arrayParser) element() error {
+	var b bytes.Buffer
+	quoted := false
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		quoted = true
+		p.pos++
+	}
+	for {
+		if p.pos >= len(p.s) {
+			return p.fail("unterminated element")
+		}
+		c := p.s[p.pos]
+		if quoted && c == '"' {
+			p.pos++
+			break
+		}
+		if !quoted && (c == ',' || c == '}') {
+			break
+		}
+		if !quoted && (c == '{' || c == '"') {
+			return p.fail("unexpected %q", c)
+		}
+		if c == '\\' {
+			p.pos++
+			if p.pos >= len(p.s) {
+				return p.fail("unterminated escape")
+			}
+			c = p.s[p.pos]
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+
+	text := b.String()
+	if !quoted {
+		text = strings.TrimRight(text, " \t\n\r\v\f")
+		if text == "" {
+			return p.fail("empty element")
+		}
+		if strings.EqualFold(text, "NULL") {
+			p.a.Elems = append(p.a.Elems, nil)
+			return nil
+		}
+	}
+	val, err := Decode([]byte(text), p.elem)
+	if err != nil {
+		return err
+	}
+	p.a.Elems = append(p.a.Elems, val)
+	return nil
+}
+
+// DecodeArray decodes the text form of an array of elements of type
+// elem.
+func DecodeArray(s []byte, elem proto.Oid) (Array, error) {
+	p := &arrayParser{s: string(s), elem: elem, a: Array{Elem: elem}}
+	p.skipSpace()
+	if err := p.bounds(); err != nil {
+		return Array{}, err
+	}
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], "{}") && len(p.a.Dims) == 0 {
+		// the empty array
+		p.pos += 2
+	} else if err := p.sub(0); err != nil {
+		return Array{}, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return Array{}, p.fail("trailing characters")
+	}
+	if len(p.a.Dims) == 0 {
+		for _, n := range p.lens {
+			p.a.Dims = append(p.a.Dims, ArrayDim{n, 1})
+		}
+	} else {
+		if len(p.a.Dims) != len(p.lens) {
+			return Array{}, p.fail("dimensions do not match the bounds")
+		}
+		for i, n := range p.lens {
+			if p.a.Dims[i].Len != n {
+				return Array{}, p.fail("dimensions do not match the bounds")
+			}
+		}
+	}
+	return p.a, nil
+}
+
+// DecodeBinaryArray decodes the binary form of an array. The element
+// type is taken from the encoding.
+func DecodeBinaryArray(s []byte) (Array, error) {
+	fail := func(format string, args ...interface{}) (Array, error) {
+		return Array{}, e.Decode("bad binary array: "+format, args...)
+	}
+	if len(s) < 12 {
+		return fail("only %v bytes", len(s))
+	}
+	ndims := int(int32(binary.BigEndian.Uint32(s)))
+	a := Array{Elem: proto.Oid(binary.BigEndian.Uint32(s[8:]))}
+	s = s[12:]
+	if ndims < 0 || len(s) < 8*ndims {
+		return fail("%v dimensions", ndims)
+	}
+	for i := 0; i < ndims; i++ {
+		d := ArrayDim{
+			Len:   int32(binary.BigEndian.Uint32(s)),
+			Lower: int32(binary.BigEndian.Uint32(s[4:])),
+		}
+		if d.Len < 0 {
+			return fail("dimension of length %v", d.Len)
+		}
+		a.Dims = append(a.Dims, d)
+		s = s[8:]
+	}
+	// Every element takes at least its length, so there can be no
+	// more than len(s)/4 of them; check that before multiplying out
+	// the dimensions, which may overflow
+	n := 0
+	if ndims > 0 {
+		n = 1
+	}
+	for _, d := range a.Dims {
+		if d.Len == 0 {
+			n = 0
+		}
+	}
+	if n != 0 {
+		limit := len(s) / 4
+		for _, d := range a.Dims {
+			if n > limit/int(d.Len) {
+				return fail("dimensions %v too large for %v bytes", a.Dims,
+					len(s))
+			}
+			n *= int(d.Len)
+		}
+	}
+	if n > 0 {
+		a.Elems = make([]interface{}, 0, n)
+	}
+	for i := 0; i < n; i++ {
+		if len(s) < 4 {
+			return fail("truncated")
+		}
+		size := int(int32(binary.BigEndian.Uint32(s)))
+		s = s[4:]
+		if size == -1 {
+			a.Elems = append(a.Elems, nil)
+			continue
+		}
+		if size < 0 || size > len(s) {
+			return fail("truncated")
+		}
+		val, err := DecodeBinary(s[:size], a.Elem)
+		if err != nil {
+			return Array{}, err
+		}
+		a.Elems = append(a.Elems, val)
+		s = s[size:]
+	}
+	if len(s) != 0 {
+		return fail("%v trailing bytes", len(s))
+	}
+	return a, nil
+}
@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"testing"
+)
+
+func TestArrayText(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		typ  proto.Oid
+		text string
+		want []interface{}
+	}{
+		{[]int32{1, 2, 3}, proto.OidInt4Array, "{1,2,3}",
+			[]interface{}{int64(1), int64(2), int64(3)}},
+		{[][]int64{{1, 2}, {3, 4}}, proto.OidInt8Array, "{{1,2},{3,4}}",
+			[]interface{}{
+				[]interface{}{int64(1), int64(2)},
+				[]interface{}{int64(3), int64(4)},
+			}},
+		{[]interface{}{"a b", nil, `q"\`, "", "NULL", "plain"},
+			proto.OidTextArray, `{"a b",NULL,"q\"\\","","NULL",plain}`,
+			[]interface{}{"a b", nil, `q"\`, "", "NULL", "plain"}},
+		{[]string{}, proto.OidTextArray, "{}", []interface{}{}},
+		{[][][]bool{{{true}, {false}}}, proto.OidBoolArray,
+			"{{{true},{false}}}", []interface{}{
+				[]interface{}{[]interface{}{true}, []interface{}{false}},
+			}},
+	}
+	for _, test := range tests {
+		if oid := MappedOid(test.val); oid != test.typ {
+			t.Errorf("got oid %v for %#v; want %v", oid, test.val, test.typ)
+		}
+		var b bytes.Buffer
+		if err := EncodeValue(&b, test.val, proto.EncFmtTxt); err != nil {
+			t.Errorf("encoding %#v: %v", test.val, err)
+			continue
+		}
+		text := b.Bytes()[4:]
+		if string(text) != test.text {
+			t.Errorf("encoding %#v: got %s; want %s", test.val, text, test.text)
+		}
+		got, err := Decode(text, test.typ)
+		if err != nil {
+			t.Errorf("decoding %s: %v", text, err)
+		} else if nested := got.(Array).Nested(); !reflect.DeepEqual(nested, test.want) {
+			t.Errorf("decoding %s: got %#v; want %#v", text, nested, test.want)
+		}
+	}
+}
+
+func TestArrayTextParsing(t *testing.T) {
+	got, err := Decode([]byte(` [0:1][-1:0]={ { 1 , NULL } ,{"3",4}} `),
+		proto.OidInt2Array)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := got.(Array)
+	want := Array{
+		Elem:  proto.OidInt2,
+		Dims:  []ArrayDim{{2, 0}, {2, -1}},
+		Elems: []interface{}{int64(1), nil, int64(3), int64(4)},
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("got %#v; want %#v", a, want)
+	}
+	var b bytes.Buffer
+	if err = EncodeValue(&b, a, proto.EncFmtTxt); err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b.Bytes()[4:]); s != "[0:1][-1:0]={{1,NULL},{3,4}}" {
+		t.Errorf("got %v", s)
+	}
+
+	for _, s := range []string{"{1,2", "{{1},{2,3}}", "{{1},2}", "{1,{2}}",
+		"{1,}", "[1:3]={1,2}", "{{}}", "{1} x", `{"1}`} {
+		if _, err := Decode([]byte(s), proto.OidInt4Array); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		}
+	}
+}
+
+func TestArrayBinary(t *testing.T) {
+	vals := []interface{}{
+		[]interface{}{int32(1), nil, int32(3)},
+		[][]string{{"a", "b"}, {"c", "d"}},
+		[]float64{},
+		Array{
+			Elem:  proto.OidInt4,
+			Dims:  []ArrayDim{{2, 5}},
+			Elems: []interface{}{int64(7), int64(8)},
+		},
+	}
+	for _, val := range vals {
+		typ := MappedOid(val)
+		var b bytes.Buffer
+		if err := EncodeValue(&b, val, proto.EncFmtBinary); err != nil {
+			t.Errorf("encoding %#v: %v", val, err)
+			continue
+		}
+		got, err := DecodeBinary(b.Bytes()[4:], typ)
+		if err != nil {
+			t.Errorf("decoding %#v: %v", val, err)
+			continue
+		}
+		a := got.(Array)
+		want, ok := val.(Array)
+		if !ok {
+			want, _ = NewArray(val, proto.ElementType(typ))
+		}
+		if a.Elem != want.Elem || !reflect.DeepEqual(a.Dims, want.Dims) ||
+			len(a.Elems) != len(want.Elems) {
+			t.Errorf("decoding %#v: got %#v", val, a)
+		}
+	}
+
+	if _, err := DecodeBinary([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 23,
+		0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 1}, proto.OidInt4Array); err == nil {
+		t.Errorf("expected error decoding truncated array")
+	}
+
+	// dimensions far beyond the data, including ones whose product
+	// overflows, are rejected before anything is allocated
+	for _, dims := range [][]byte{
+		{0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 1},
+		{0, 1, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 1},
+		{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 1},
+	} {
+		enc := append([]byte{0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 23}, dims...)
+		enc = append(enc, 0, 0, 0, 4, 0, 0, 0, 1)
+		if _, err := DecodeBinary(enc, proto.OidInt4Array); err == nil {
+			t.Errorf("expected error decoding array with dimensions %v", dims)
+		}
+	}
+}
+
+func TestGuessArrayOids(t *testing.T) {
+	rows := [][]interface{}{
+		{nil, []interface{}{nil}, [][]byte{{1}}},
+		{[]int16{1}, []interface{}{nil, "x"}, nil},
+	}
+	want := []proto.Oid{proto.OidInt2Array, proto.OidTextArray,
+		proto.OidByteaArray}
+	if got := GuessOids(rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
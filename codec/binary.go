@@ -0,0 +1,533 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"math"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Postgres counts dates and times from the start of 2000 (UTC)
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Address families in the binary form of inet and cidr
+const (
+	pgAfInet  = 2
+	pgAfInet6 = 3
+)
+
+// The jsonb binary format version
+const jsonbVersion = 1
+
+// Binary numeric sign values
+const (
+	numericPos    = 0x0000
+	numericNeg    = 0x4000
+	numericNaN    = 0xc000
+	numericPosInf = 0xd000
+	numericNegInf = 0xf000
+)
+
+func BinEncodeInt32(buff *bytes.Buffer, val int32) {
+	buf.WriteInt32(buff, 4)
+	buf.WriteInt32(buff, val)
+}
+
+func BinEncodeInt64(buff *bytes.Buffer, val int64) {
+	buf.WriteInt32(buff, 8)
+	writeInt64(buff, val)
+}
+
+func BinEncodeOid(buff *bytes.Buffer, val proto.Oid) {
+	buf.WriteInt32(buff, 4)
+	buf.WriteUint32(buff, uint32(val))
+}
+
+func BinEncodeFloat32(buff *bytes.Buffer, val float32) {
+	buf.WriteInt32(buff, 4)
+	buf.WriteUint32(buff, math.Float32bits(val))
+}
+
+func BinEncodeFloat64(buff *bytes.Buffer, val float64) {
+	buf.WriteInt32(buff, 8)
+	writeInt64(buff, int64(math.Float64bits(val)))
+}
+
+func BinEncodeBool(buff *bytes.Buffer, val bool) {
+	buf.WriteInt32(buff, 1)
+	if val {
+		buff.WriteByte(1)
+	} else {
+		buff.WriteByte(0)
+	}
+}
+
+func BinEncodeString(buff *bytes.Buffer, val string) {
+	buf.WriteInt32(buff, int32(len(val)))
+	buff.WriteString(val)
+}
+
+func BinEncodeBytea(buff *bytes.Buffer, val []byte) {
+	buf.WriteInt32(buff, int32(len(val)))
+	buff.Write(val)
+}
+
+// BinEncodeDate encodes the date of val, ignoring its time of day.
+func BinEncodeDate(buff *bytes.Buffer, val time.Time) {
+	buf.WriteInt32(buff, 4)
+	switch infinity(val) {
+	case 1:
+		buf.WriteInt32(buff, dateInfinity)
+	case -1:
+		buf.WriteInt32(buff, dateNegativeInfinity)
+	default:
+		y, m, d := val.Date()
+		midnight := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		buf.WriteInt32(buff, int32(pgMicros(midnight)/(24*3600*1000000)))
+	}
+}
+
+// BinEncodeTime encodes the time of day of val, in its own location.
+func BinEncodeTime(buff *bytes.Buffer, val time.Time) {
+	h, m, s := val.Clock()
+	micros := (int64(h)*3600+int64(m)*60+int64(s))*1000000 +
+		int64(val.Nanosecond()/1000)
+	BinEncodeInt64(buff, micros)
+}
+
+// BinEncodeTimetz encodes the time of day of val with its offset
+// from UTC.
+func BinEncodeTimetz(buff *bytes.Buffer, val time.Time) {
+	h, m, s := val.Clock()
+	micros := (int64(h)*3600+int64(m)*60+int64(s))*1000000 +
+		int64(val.Nanosecond()/1000)
+	_, offset := val.Zone()
+	buf.WriteInt32(buff, 12)
+	writeInt64(buff, micros)
+	// Postgres counts seconds west of UTC
+	buf.WriteInt32(buff, int32(-offset))
+}
+
+// BinEncodeTimestamp encodes the wall clock time of val, in its own
+// location, as a timestamp without time zone.
+func BinEncodeTimestamp(buff *bytes.Buffer, val time.Time) {
+	_, offset := val.Zone()
+	BinEncodeInt64(buff, timestampMicros(val, offset))
+}
+
+func BinEncodeTimestamptz(buff *bytes.Buffer, val time.Time) {
+	BinEncodeInt64(buff, timestampMicros(val, 0))
+}
+
+// The binary form of a timestamp, with the offset in seconds added
+func timestampMicros(val time.Time, offset int) int64 {
+	switch infinity(val) {
+	case 1:
+		return timestampInfinity
+	case -1:
+		return timestampNegInfinity
+	}
+	return pgMicros(val) + int64(offset)*1000000
+}
+
+func BinEncodeInterval(buff *bytes.Buffer, val Interval) {
+	buf.WriteInt32(buff, 16)
+	writeInt64(buff, val.Microseconds)
+	buf.WriteInt32(buff, val.Days)
+	buf.WriteInt32(buff, val.Months)
+}
+
+func BinEncodeUUID(buff *bytes.Buffer, val UUID) {
+	buf.WriteInt32(buff, 16)
+	buff.Write(val[:])
+}
+
+func BinEncodeNumeric(buff *bytes.Buffer, val Numeric) {
+	var sign uint16
+	switch {
+	case val.NaN:
+		sign = numericNaN
+	case val.Inf > 0:
+		sign = numericPosInf
+	case val.Inf < 0:
+		sign = numericNegInf
+	}
+	if sign != 0 {
+		buf.WriteInt32(buff, 8)
+		buf.WriteInt16(buff, 0)
+		buf.WriteInt16(buff, 0)
+		buf.WriteInt16(buff, int16(sign))
+		buf.WriteInt16(buff, 0)
+		return
+	}
+
+	// Regroup the decimal digits into base-10000 ones, aligned on
+	// the decimal point.
+	digits, scale := val.digits()
+	intPart := digits[:len(digits)-min(scale, len(digits))]
+	fracPart := strings.Repeat("0", max(scale-len(digits), 0)) +
+		digits[len(intPart):]
+	intPart = strings.Repeat("0", (4-len(intPart)%4)%4) + intPart
+	fracPart += strings.Repeat("0", (4-len(fracPart)%4)%4)
+	all := intPart + fracPart
+	groups := make([]int16, len(all)/4)
+	for i := range groups {
+		for _, c := range all[i*4 : i*4+4] {
+			groups[i] = groups[i]*10 + int16(c-'0')
+		}
+	}
+	weight := len(intPart)/4 - 1
+	for len(groups) > 0 && groups[0] == 0 {
+		groups = groups[1:]
+		weight--
+	}
+	for len(groups) > 0 && groups[len(groups)-1] == 0 {
+		groups = groups[:len(groups)-1]
+	}
+	if len(groups) == 0 {
+		weight = 0
+	}
+	if val.Sign() < 0 {
+		sign = numericNeg
+	}
+
+	buf.WriteInt32(buff, int32(8+2*len(groups)))
+	buf.WriteInt16(buff, int16(len(groups)))
+	buf.WriteInt16(buff, int16(weight))
+	buf.WriteInt16(buff, int16(sign))
+	buf.WriteInt16(buff, int16(scale))
+	for _, g := range groups {
+		buf.WriteInt16(buff, g)
+	}
+}
+
+// BinEncodeJSON encodes the JSON text val as a jsonb if jsonb is
+// set, and as a json otherwise.
+func BinEncodeJSON(buff *bytes.Buffer, val []byte, jsonb bool) {
+	if !jsonb {
+		BinEncodeBytea(buff, val)
+		return
+	}
+	buf.WriteInt32(buff, int32(len(val)+1))
+	buff.WriteByte(jsonbVersion)
+	buff.Write(val)
+}
+
+// BinEncodeInet encodes val as a cidr if cidr is set, and as an inet
+// otherwise.
+func BinEncodeInet(buff *bytes.Buffer, val *net.IPNet, cidr bool) {
+	ip := val.IP
+	family := byte(pgAfInet6)
+	if ip4 := ip.To4(); ip4 != nil && len(val.Mask) == net.IPv4len {
+		ip = ip4
+		family = pgAfInet
+	}
+	ones, _ := val.Mask.Size()
+	buf.WriteInt32(buff, int32(4+len(ip)))
+	buff.WriteByte(family)
+	buff.WriteByte(byte(ones))
+	if cidr {
+		buff.WriteByte(1)
+	} else {
+		buff.WriteByte(0)
+	}
+	buff.WriteByte(byte(len(ip)))
+	buff.Write(ip)
+}
+
+func BinEncodeMoney(buff *bytes.Buffer, val Money) {
+	BinEncodeInt64(buff, int64(val))
+}
+
+func BinEncodeBitString(buff *bytes.Buffer, val BitString) {
+	n := (val.Len + 7) / 8
+	buf.WriteInt32(buff, int32(4+n))
+	buf.WriteInt32(buff, int32(val.Len))
+	buff.Write(val.Bytes[:n])
+}
+
+func writeInt64(buff *bytes.Buffer, val int64) {
+	var be [8]byte
+	binary.BigEndian.PutUint64(be[:], uint64(val))
+	buff.Write(be[:])
+}
+
+// Microseconds from the Postgres epoch to t
+func pgMicros(t time.Time) int64 {
+	return (t.Unix()-pgEpoch.Unix())*1000000 + int64(t.Nanosecond()/1000)
+}
+
+// The time the given number of microseconds after the Postgres epoch
+func fromPgMicros(micros int64) time.Time {
+	return time.Unix(pgEpoch.Unix()+micros/1000000,
+		micros%1000000*1000).UTC()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func checkLen(s []byte, want int, typ proto.Oid) error {
+	if len(s) != want {
+		return e.Decode("binary value of type %v is %v bytes; expected %v",
+			typ, len(s), want)
+	}
+	return nil
+}
+
+// DecodeBinary decodes the Postgres binary encoding s of a value of
+// type typ into the same Go type Decode uses for the text encoding.
+// Values of other types are returned as they are.
+func DecodeBinary(s []byte, typ proto.Oid) (interface{}, error) {
+	switch typ {
+	case proto.OidText, proto.OidVarchar, proto.OidBpchar, proto.OidName:
+		return string(s), nil
+	case proto.OidBytea:
+		return s, nil
+	case proto.OidBool:
+		if err := checkLen(s, 1, typ); err != nil {
+			return nil, err
+		}
+		return s[0] != 0, nil
+	case proto.OidInt2:
+		if err := checkLen(s, 2, typ); err != nil {
+			return nil, err
+		}
+		return int64(int16(binary.BigEndian.Uint16(s))), nil
+	case proto.OidInt4:
+		if err := checkLen(s, 4, typ); err != nil {
+			return nil, err
+		}
+		return int64(int32(binary.BigEndian.Uint32(s))), nil
+	case proto.OidInt8:
+		if err := checkLen(s, 8, typ); err != nil {
+			return nil, err
+		}
+		return int64(binary.BigEndian.Uint64(s)), nil
+	case proto.OidOid:
+		if err := checkLen(s, 4, typ); err != nil {
+			return nil, err
+		}
+		return proto.Oid(binary.BigEndian.Uint32(s)), nil
+	case proto.OidFloat4:
+		if err := checkLen(s, 4, typ); err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(s))), nil
+	case proto.OidFloat8:
+		if err := checkLen(s, 8, typ); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(s)), nil
+	case proto.OidDate:
+		if err := checkLen(s, 4, typ); err != nil {
+			return nil, err
+		}
+		switch days := int32(binary.BigEndian.Uint32(s)); days {
+		case dateInfinity:
+			return InfinityTime, nil
+		case dateNegativeInfinity:
+			return NegativeInfinityTime, nil
+		default:
+			return fromPgMicros(int64(days) * 24 * 3600 * 1000000), nil
+		}
+	case proto.OidTime:
+		if err := checkLen(s, 8, typ); err != nil {
+			return nil, err
+		}
+		micros := int64(binary.BigEndian.Uint64(s))
+		return time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Add(
+			time.Duration(micros) * time.Microsecond), nil
+	case proto.OidTimetz:
+		if err := checkLen(s, 12, typ); err != nil {
+			return nil, err
+		}
+		micros := int64(binary.BigEndian.Uint64(s))
+		// the offset is in seconds west of UTC
+		offset := -int(int32(binary.BigEndian.Uint32(s[8:])))
+		return time.Date(0, 1, 1, 0, 0, 0, 0, time.FixedZone("", offset)).Add(
+			time.Duration(micros) * time.Microsecond), nil
+	case proto.OidTimestamp, proto.OidTimestamptz:
+		if err := checkLen(s, 8, typ); err != nil {
+			return nil, err
+		}
+		switch micros := int64(binary.BigEndian.Uint64(s)); micros {
+		case timestampInfinity:
+			return InfinityTime, nil
+		case timestampNegInfinity:
+			return NegativeInfinityTime, nil
+		default:
+			return fromPgMicros(micros), nil
+		}
+	case proto.OidInterval:
+		if err := checkLen(s, 16, typ); err != nil {
+			return nil, err
+		}
+		return Interval{
+			Microseconds: int64(binary.BigEndian.Uint64(s)),
+			Days:         int32(binary.BigEndian.Uint32(s[8:])),
+			Months:       int32(binary.BigEndian.Uint32(s[12:])),
+		}, nil
+	case proto.OidUuid:
+		if err := checkLen(s, 16, typ); err != nil {
+			return nil, err
+		}
+		var u UUID
+		copy(u[:], s)
+		return u, nil
+	case proto.OidNumeric:
+		return decodeBinaryNumeric(s)
+	case proto.OidJson:
+		return json.RawMessage(s), nil
+	case proto.OidJsonb:
+		if len(s) == 0 || s[0] != jsonbVersion {
+			return nil, e.Decode("unsupported binary jsonb format")
+		}
+		return json.RawMessage(s[1:]), nil
+	case proto.OidInet, proto.OidCidr:
+		return decodeBinaryInet(s)
+	case proto.OidMacaddr, proto.OidMacaddr8:
+		want := 6
+		if typ == proto.OidMacaddr8 {
+			want = 8
+		}
+		if err := checkLen(s, want, typ); err != nil {
+			return nil, err
+		}
+		return net.HardwareAddr(s), nil
+	case proto.OidMoney:
+		if err := checkLen(s, 8, typ); err != nil {
+			return nil, err
+		}
+		return Money(binary.BigEndian.Uint64(s)), nil
+	case proto.OidBit, proto.OidVarbit:
+		if len(s) < 4 {
+			return nil, e.Decode("binary bit string is only %v bytes", len(s))
+		}
+		n := int(int32(binary.BigEndian.Uint32(s)))
+		if n < 0 {
+			return nil, e.Decode("bad binary bit string length %v", n)
+		}
+		if err := checkLen(s[4:], (n+7)/8, typ); err != nil {
+			return nil, err
+		}
+		return BitString{Bytes: s[4:], Len: n}, nil
+	case proto.OidRecord:
+		return DecodeBinaryComposite(s)
+	default:
+		if proto.ElementType(typ) != 0 {
+			return DecodeBinaryArray(s)
+		}
+		if sub := proto.RangeSubtype(typ); sub != 0 {
+			return DecodeBinaryRange(s, sub)
+		}
+		if sub := proto.MultirangeSubtype(typ); sub != 0 {
+			return DecodeBinaryMultirange(s, sub)
+		}
+		if d, ok := DefaultRegistry.custom(typ); ok {
+			return d.Decode(s, proto.EncFmtBinary)
+		}
+		return s, nil
+	}
+}
+
+func decodeBinaryNumeric(s []byte) (interface{}, error) {
+	if len(s) < 8 {
+		return nil, e.Decode("binary numeric is only %v bytes", len(s))
+	}
+	ndigits := int(binary.BigEndian.Uint16(s))
+	weight := int(int16(binary.BigEndian.Uint16(s[2:])))
+	sign := binary.BigEndian.Uint16(s[4:])
+	dscale := int(binary.BigEndian.Uint16(s[6:]))
+	switch sign {
+	case numericNaN:
+		return Numeric{NaN: true}, nil
+	case numericPosInf:
+		return Numeric{Inf: 1}, nil
+	case numericNegInf:
+		return Numeric{Inf: -1}, nil
+	case numericPos, numericNeg:
+	default:
+		return nil, e.Decode("bad binary numeric sign %#x", sign)
+	}
+	if err := checkLen(s, 8+2*ndigits, proto.OidNumeric); err != nil {
+		return nil, err
+	}
+	digit := func(i int) int16 {
+		if i < 0 || i >= ndigits {
+			return 0
+		}
+		return int16(binary.BigEndian.Uint16(s[8+2*i:]))
+	}
+
+	// Digit i is worth 10000^(weight-i); write out the integer
+	// part, then enough of the fraction to cover dscale digits.
+	var b bytes.Buffer
+	for i := 0; i <= weight; i++ {
+		fmt.Fprintf(&b, "%04d", digit(i))
+	}
+	var frac bytes.Buffer
+	for i := weight + 1; frac.Len() < dscale; i++ {
+		fmt.Fprintf(&frac, "%04d", digit(i))
+	}
+	b.Write(frac.Bytes()[:dscale])
+	i, ok := new(big.Int).SetString("0"+b.String(), 10)
+	if !ok {
+		return nil, e.Decode("bad binary numeric digits")
+	}
+	if sign == numericNeg {
+		i.Neg(i)
+	}
+	return Numeric{Int: i, Scale: int16(dscale)}, nil
+}
+
+func decodeBinaryInet(s []byte) (interface{}, error) {
+	if len(s) < 4 {
+		return nil, e.Decode("binary inet is only %v bytes", len(s))
+	}
+	family, bits, n := s[0], int(s[1]), int(s[3])
+	var size int
+	switch family {
+	case pgAfInet:
+		size = net.IPv4len
+	case pgAfInet6:
+		size = net.IPv6len
+	default:
+		return nil, e.Decode("bad binary inet family %v", family)
+	}
+	if n != size || len(s) != 4+n || bits > 8*size {
+		return nil, e.Decode("bad binary inet of %v bytes", len(s))
+	}
+	ip := make(net.IP, n)
+	copy(ip, s[4:])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, 8*size)}, nil
+}
+
+// DecodeValue decodes s, a value of type typ in the given format.
+func DecodeValue(s []byte, typ proto.Oid, format proto.EncFmt) (interface{}, error) {
+	switch format {
+	case proto.EncFmtTxt:
+		return Decode(s, typ)
+	case proto.EncFmtBinary:
+		return DecodeBinary(s, typ)
+	}
+	return nil, e.Decode("Can't decode format %v", format)
+}
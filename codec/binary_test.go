@@ -0,0 +1,152 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Encode val as typ in binary and return the encoding without its
+// length prefix.
+func binEncode(t *testing.T, val interface{}, typ proto.Oid) []byte {
+	var b bytes.Buffer
+	if err := EncodeTypedValue(&b, val, typ, proto.EncFmtBinary); err != nil {
+		t.Fatalf("encoding %#v: %v", val, err)
+	}
+	encoded := b.Bytes()
+	if n := int(int32(encoded[0])<<24 | int32(encoded[1])<<16 |
+		int32(encoded[2])<<8 | int32(encoded[3])); n != len(encoded)-4 {
+		t.Fatalf("encoding %#v: length prefix %v for %v bytes",
+			val, n, len(encoded)-4)
+	}
+	return encoded[4:]
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	ts := time.Date(2014, 5, 1, 12, 30, 15, 123456000, time.UTC)
+	tests := []struct {
+		val  interface{}
+		typ  proto.Oid
+		want interface{}
+		hex  string
+	}{
+		{int16(-2), proto.OidInt2, int64(-2), "fffe"},
+		{int32(1), proto.OidInt4, int64(1), "00000001"},
+		{int64(1) << 40, proto.OidInt8, int64(1) << 40, "0000010000000000"},
+		{7, proto.OidInt4, int64(7), "00000007"},
+		{proto.Oid(25), proto.OidOid, proto.Oid(25), "00000019"},
+		{float32(1.5), proto.OidFloat4, float64(1.5), "3fc00000"},
+		{2.5, proto.OidFloat8, 2.5, "4004000000000000"},
+		{true, proto.OidBool, true, "01"},
+		{"héllo", proto.OidText, "héllo", "68c3a96c6c6f"},
+		{[]byte{0, 1}, proto.OidBytea, []byte{0, 1}, "0001"},
+		{ts, proto.OidTimestamptz, ts, ""},
+		{ts, proto.OidTimestamp, ts, ""},
+		{time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC), proto.OidDate,
+			time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC), "ffffffff"},
+		{ts, proto.OidTime,
+			time.Date(0, 1, 1, 12, 30, 15, 123456000, time.UTC), ""},
+		{Interval{Months: 14, Days: -3, Microseconds: 1500000}, proto.OidInterval,
+			Interval{Months: 14, Days: -3, Microseconds: 1500000},
+			"000000000016e360fffffffd0000000e"},
+		{UUID{0xa0, 0xee, 15: 0x11}, proto.OidUuid, UUID{0xa0, 0xee, 15: 0x11},
+			"a0ee0000000000000000000000000011"},
+	}
+	for _, test := range tests {
+		encoded := binEncode(t, test.val, test.typ)
+		if test.hex != "" && hex.EncodeToString(encoded) != test.hex {
+			t.Errorf("encoding %#v: got %x; want %v", test.val, encoded, test.hex)
+		}
+		got, err := DecodeBinary(encoded, test.typ)
+		if err != nil {
+			t.Errorf("decoding %#v: %v", test.val, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decoding %#v: got %#v; want %#v", test.val, got, test.want)
+		}
+	}
+}
+
+func TestBinaryNumeric(t *testing.T) {
+	tests := []struct {
+		num Numeric
+		str string
+		hex string
+	}{
+		{Numeric{Int: big.NewInt(12340), Scale: 3}, "12.340",
+			"0002000000000003000c0d48"},
+		{Numeric{Int: big.NewInt(-5), Scale: 4}, "-0.0005",
+			"0001ffff400000040005"},
+		{Numeric{Int: big.NewInt(1000000)}, "1000000",
+			"00010001000000000064"},
+		{Numeric{Int: big.NewInt(0), Scale: 2}, "0.00", "0000000000000002"},
+		{Numeric{NaN: true}, "NaN", "00000000c0000000"},
+		{Numeric{Inf: -1}, "-Infinity", "00000000f0000000"},
+	}
+	for _, test := range tests {
+		if s := test.num.String(); s != test.str {
+			t.Errorf("got %v; want %v", s, test.str)
+		}
+		encoded := binEncode(t, test.num, proto.OidNumeric)
+		if hex.EncodeToString(encoded) != test.hex {
+			t.Errorf("encoding %v: got %x; want %v", test.str, encoded, test.hex)
+		}
+		got, err := DecodeBinary(encoded, proto.OidNumeric)
+		if err != nil {
+			t.Errorf("decoding %v: %v", test.str, err)
+		} else if s := got.(Numeric).String(); s != test.str {
+			t.Errorf("decoding %v: got %v", test.str, s)
+		}
+	}
+}
+
+func TestEncodeTypedValueErrors(t *testing.T) {
+	var b bytes.Buffer
+	if err := EncodeTypedValue(&b, 70000, proto.OidInt2,
+		proto.EncFmtBinary); err == nil {
+		t.Errorf("expected error encoding out-of-range int2")
+	}
+	if err := EncodeValue(&b, struct{}{}, proto.EncFmtBinary); err == nil {
+		t.Errorf("expected error encoding unmapped type")
+	}
+	b.Reset()
+	if err := EncodeValue(&b, nil, proto.EncFmtBinary); err != nil ||
+		!bytes.Equal(b.Bytes(), []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("got %x, %v encoding NULL", b.Bytes(), err)
+	}
+	if _, err := DecodeBinary([]byte{1, 2, 3}, proto.OidInt4); err == nil {
+		t.Errorf("expected error decoding short int4")
+	}
+}
+
+func TestTextEncodeTyped(t *testing.T) {
+	ts := time.Date(2014, 5, 1, 12, 30, 15, 500000000, time.UTC)
+	tests := []struct {
+		val  interface{}
+		typ  proto.Oid
+		want string
+	}{
+		{ts, proto.OidDate, "2014-05-01"},
+		{ts, proto.OidTimestamptz, "2014-05-01 12:30:15.5+00:00"},
+		{[]byte{0xde, 0xad}, proto.OidBytea, `\xdead`},
+		{Interval{Months: 14, Days: 1, Microseconds: -3723500000},
+			proto.OidInterval, "1 year 2 mons 1 day -01:02:03.5"},
+		{UUID{0xa0, 0xee, 15: 0x11}, proto.OidUuid,
+			"a0ee0000-0000-0000-0000-000000000011"},
+		{int64(5), proto.OidNumeric, "5"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := EncodeTypedValue(&b, test.val, test.typ,
+			proto.EncFmtTxt); err != nil {
+			t.Errorf("encoding %#v: %v", test.val, err)
+			continue
+		}
+		if got := string(b.Bytes()[4:]); got != test.want {
+			t.Errorf("encoding %#v: got %q; want %q", test.val, got, test.want)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package codec
 
 import (
+	"encoding/json"
 	"github.com/uhoh-itsmaciek/femebe/proto"
+	"net"
+	"reflect"
+	"time"
 )
 
 // GuessOids attemps to guess the Postgres oids for the given data
@@ -35,7 +39,7 @@ func GuessOids(rows [][]interface{}) (oids []proto.Oid) {
 // Mappedproto.Oid returns the Postgres oid mapped to the type of the given
 // value in femebe, or OID_UNKNOWN if no mapping exists.
 func MappedOid(val interface{}) proto.Oid {
-	switch val.(type) {
+	switch v := val.(type) {
 	case nil:
 		// we can't determine a type here
 		return proto.OidUnknown
@@ -43,7 +47,7 @@ func MappedOid(val interface{}) proto.Oid {
 		return proto.OidInt2
 	case int32:
 		return proto.OidInt4
-	case int64:
+	case int64, int:
 		return proto.OidInt8
 	case float32:
 		return proto.OidFloat4
@@ -53,7 +57,96 @@ func MappedOid(val interface{}) proto.Oid {
 		return proto.OidText
 	case bool:
 		return proto.OidBool
+	case json.RawMessage:
+		return proto.OidJson
+	case []byte:
+		return proto.OidBytea
+	case time.Time:
+		return proto.OidTimestamptz
+	case Interval:
+		return proto.OidInterval
+	case UUID:
+		return proto.OidUuid
+	case Numeric:
+		return proto.OidNumeric
+	case proto.Oid:
+		return proto.OidOid
+	case *net.IPNet, net.IP:
+		return proto.OidInet
+	case net.HardwareAddr:
+		if len(v) == 8 {
+			return proto.OidMacaddr8
+		}
+		return proto.OidMacaddr
+	case Money:
+		return proto.OidMoney
+	case BitString:
+		return proto.OidVarbit
+	case Array:
+		return arrayOid(v.Elem)
+	case Range:
+		return rangeOid(proto.RangeType, v)
+	case Multirange:
+		for _, r := range v {
+			if oid := rangeOid(proto.MultirangeType, r); oid != proto.OidUnknown {
+				return oid
+			}
+		}
+		return proto.OidUnknown
+	case Composite:
+		return proto.OidRecord
+	case Hstore:
+		// an extension type, so its oid varies
+		if d, ok := DefaultRegistry.LookupName("hstore"); ok {
+			return d.Oid
+		}
+		return proto.OidUnknown
 	default:
+		return mappedArrayOid(val)
+	}
+}
+
+func arrayOid(elem proto.Oid) proto.Oid {
+	if oid := proto.ArrayType(elem); oid != 0 {
+		return oid
+	}
+	return proto.OidUnknown
+}
+
+// The oid of the range or multirange type, as given by the lookup
+// function, over the type of the bounds of r
+func rangeOid(lookup func(proto.Oid) proto.Oid, r Range) proto.Oid {
+	for _, bound := range []interface{}{r.Lower, r.Upper} {
+		if bound == nil {
+			continue
+		}
+		if oid := lookup(MappedOid(bound)); oid != 0 {
+			return oid
+		}
+		break
+	}
+	return proto.OidUnknown
+}
+
+// The array oid for a Go slice (nested for more dimensions), by the
+// type of its elements
+func mappedArrayOid(val interface{}) proto.Oid {
+	v := reflect.ValueOf(val)
+	if !isArraySlice(v) {
+		return proto.OidUnknown
+	}
+	t := v.Type()
+	for (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) &&
+		t.Elem().Kind() != reflect.Uint8 {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Interface {
+		return arrayOid(MappedOid(reflect.Zero(t).Interface()))
+	}
+	// go by the first element that is not NULL
+	a, err := NewArray(val, 0)
+	if err != nil {
 		return proto.OidUnknown
 	}
+	return arrayOid(a.Elem)
 }
@@ -0,0 +1,227 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"strings"
+)
+
+// Composite is a value of a composite type, or of an anonymous
+// record.
+type Composite struct {
+	// The fields; those of anonymous records have no names, and
+	// in the text format, no types either (the values are then
+	// decoded as strings)
+	Fields []Field
+	// The value of each field, nil for NULL
+	Values []interface{}
+}
+
+// Get returns the value of the named field, and whether there is
+// such a field.
+func (c Composite) Get(name string) (interface{}, bool) {
+	for i, f := range c.Fields {
+		if f.Name == name && i < len(c.Values) {
+			return c.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+// The type to encode field i as
+func (c Composite) fieldType(i int) proto.Oid {
+	if i < len(c.Fields) && c.Fields[i].Type != 0 &&
+		c.Fields[i].Type != proto.OidUnknown {
+		return c.Fields[i].Type
+	}
+	return MappedOid(c.Values[i])
+}
+
+// An item in the text form of a range or composite
+type textItem struct {
+	text string
+	// an unquoted empty item: NULL, or an unbounded side of a
+	// range
+	null bool
+}
+
+// Split s, the text form of a range or composite without its
+// enclosing brackets, into its comma-separated items. Items may be
+// quoted; backslashes, and inside quotes doubled quotes, escape the
+// next character.
+func splitItems(s string) ([]textItem, error) {
+	var items []textItem
+	var b bytes.Buffer
+	quoted, inQuotes := false, false
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || (!inQuotes && s[i] == ',') {
+			if inQuotes {
+				return nil, e.Decode("unterminated quote in %q", s)
+			}
+			items = append(items, textItem{
+				text: b.String(),
+				null: !quoted && b.Len() == 0,
+			})
+			b.Reset()
+			quoted = false
+			continue
+		}
+		switch c := s[i]; {
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, e.Decode("unterminated escape in %q", s)
+			}
+			i++
+			b.WriteByte(s[i])
+		case c == '"' && inQuotes && i+1 < len(s) && s[i+1] == '"':
+			b.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+			quoted = true
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return items, nil
+}
+
+// Write text as an item of the text form of a range or composite,
+// quoting it if needed.
+func writeItem(b *bytes.Buffer, text []byte) {
+	if len(text) > 0 && bytes.IndexAny(text, "\"\\,()[]{} \t\n\r\v\f") < 0 {
+		b.Write(text)
+		return
+	}
+	b.WriteByte('"')
+	for _, c := range text {
+		if c == '"' || c == '\\' {
+			b.WriteByte(c)
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+}
+
+// DecodeComposite decodes the text form of a composite with the
+// given fields. With no fields, it is decoded as an anonymous
+// record, with each value a string.
+func DecodeComposite(s []byte, fields []Field) (Composite, error) {
+	str := strings.TrimSpace(string(s))
+	if len(str) < 2 || str[0] != '(' || str[len(str)-1] != ')' {
+		return Composite{}, e.Decode("could not parse %q as a composite", s)
+	}
+	items, err := splitItems(str[1 : len(str)-1])
+	if err != nil {
+		return Composite{}, err
+	}
+	if len(fields) == 0 {
+		fields = make([]Field, len(items))
+		for i := range fields {
+			fields[i].Type = proto.OidUnknown
+		}
+	} else if len(items) != len(fields) {
+		return Composite{}, e.Decode("composite %q has %v fields; expected %v",
+			s, len(items), len(fields))
+	}
+	c := Composite{Fields: fields, Values: make([]interface{}, len(items))}
+	for i, item := range items {
+		switch {
+		case item.null:
+		case fields[i].Type == proto.OidUnknown:
+			c.Values[i] = item.text
+		default:
+			if c.Values[i], err = Decode([]byte(item.text), fields[i].Type); err != nil {
+				return Composite{}, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// DecodeBinaryComposite decodes the binary form of a composite or
+// record, which carries the type of each field. The fields have no
+// names.
+func DecodeBinaryComposite(s []byte) (Composite, error) {
+	fail := func(format string, args ...interface{}) (Composite, error) {
+		return Composite{}, e.Decode("bad binary composite: "+format, args...)
+	}
+	if len(s) < 4 {
+		return fail("only %v bytes", len(s))
+	}
+	n := int(int32(binary.BigEndian.Uint32(s)))
+	s = s[4:]
+	if n < 0 || len(s) < 8*n {
+		return fail("%v fields", n)
+	}
+	c := Composite{Fields: make([]Field, n), Values: make([]interface{}, n)}
+	for i := 0; i < n; i++ {
+		if len(s) < 8 {
+			return fail("truncated")
+		}
+		c.Fields[i].Type = proto.Oid(binary.BigEndian.Uint32(s))
+		size := int(int32(binary.BigEndian.Uint32(s[4:])))
+		s = s[8:]
+		if size == -1 {
+			continue
+		}
+		if size < 0 || size > len(s) {
+			return fail("truncated")
+		}
+		val, err := DecodeBinary(s[:size], c.Fields[i].Type)
+		if err != nil {
+			return Composite{}, err
+		}
+		c.Values[i] = val
+		s = s[size:]
+	}
+	if len(s) != 0 {
+		return fail("%v trailing bytes", len(s))
+	}
+	return c, nil
+}
+
+// Write c in the given format, preceded by its length.
+func encodeComposite(buff *bytes.Buffer, c Composite, format proto.EncFmt) error {
+	if len(c.Fields) != 0 && len(c.Fields) != len(c.Values) {
+		return fmt.Errorf("Can't encode composite: %v fields, but %v values",
+			len(c.Fields), len(c.Values))
+	}
+	var b bytes.Buffer
+	switch format {
+	case proto.EncFmtTxt:
+		b.WriteByte('(')
+		for i, val := range c.Values {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if val == nil {
+				continue
+			}
+			text, err := encodeElem(val, c.fieldType(i), format)
+			if err != nil {
+				return err
+			}
+			writeItem(&b, text)
+		}
+		b.WriteByte(')')
+	case proto.EncFmtBinary:
+		buf.WriteInt32(&b, int32(len(c.Values)))
+		for i, val := range c.Values {
+			typ := c.fieldType(i)
+			buf.WriteUint32(&b, uint32(typ))
+			if err := EncodeTypedValue(&b, val, typ, format); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	buf.WriteInt32(buff, int32(b.Len()))
+	buff.Write(b.Bytes())
+	return nil
+}
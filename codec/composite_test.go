@@ -0,0 +1,118 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestCompositeText(t *testing.T) {
+	desc := TypeDesc{
+		Oid:  16390,
+		Name: "item",
+		Kind: KindComposite,
+		Fields: []Field{
+			{"id", proto.OidInt4},
+			{"name", proto.OidText},
+			{"tags", proto.OidTextArray},
+			{"price", proto.OidNumeric},
+		},
+	}
+	tests := []struct {
+		text   string
+		values []interface{}
+	}{
+		{`(1,"a ""b"", \\c",{},)`, []interface{}{int64(1), `a "b", \c`,
+			Array{Elem: proto.OidText}, nil}},
+		{`(2,"","{x,""y z""}",1.50)`, []interface{}{int64(2), "",
+			Array{Elem: proto.OidText, Dims: []ArrayDim{{2, 1}},
+				Elems: []interface{}{"x", "y z"}},
+			Numeric{Int: big.NewInt(150), Scale: 2}}},
+	}
+	for _, test := range tests {
+		got, err := desc.Decode([]byte(test.text), proto.EncFmtTxt)
+		if err != nil {
+			t.Errorf("decoding %q: %v", test.text, err)
+			continue
+		}
+		c := got.(Composite)
+		if !reflect.DeepEqual(c.Values, test.values) {
+			t.Errorf("decoding %q: got %#v; want %#v", test.text, c.Values, test.values)
+		}
+		if id, _ := c.Get("id"); id != test.values[0] {
+			t.Errorf("decoding %q: got id %v", test.text, id)
+		}
+
+		for _, format := range []proto.EncFmt{proto.EncFmtTxt, proto.EncFmtBinary} {
+			var b bytes.Buffer
+			if err := desc.Encode(&b, Composite{Values: c.Values}, format); err != nil {
+				t.Errorf("encoding %#v: %v", c.Values, err)
+				continue
+			}
+			again, err := desc.Decode(b.Bytes()[4:], format)
+			if err != nil {
+				t.Errorf("decoding %q: %v", b.Bytes()[4:], err)
+			} else if !reflect.DeepEqual(again.(Composite).Values, test.values) {
+				t.Errorf("round trip of %q: got %#v", test.text, again)
+			}
+		}
+	}
+
+	for _, s := range []string{"", "1,2", "(1,2)", `(1,"x,{},)`, "(x,a,{},1)"} {
+		if _, err := desc.Decode([]byte(s), proto.EncFmtTxt); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	got, err := Decode([]byte(`(1,,"x y")`), proto.OidRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vals := got.(Composite).Values; !reflect.DeepEqual(vals,
+		[]interface{}{"1", nil, "x y"}) {
+		t.Errorf("got %#v", vals)
+	}
+
+	rec := Composite{Values: []interface{}{int32(7), nil, "z"}}
+	if oid := MappedOid(rec); oid != proto.OidRecord {
+		t.Errorf("got oid %v; want record", oid)
+	}
+	var b bytes.Buffer
+	if err := EncodeValue(&b, rec, proto.EncFmtBinary); err != nil {
+		t.Fatal(err)
+	}
+	got, err = DecodeBinary(b.Bytes()[4:], proto.OidRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Composite{
+		Fields: []Field{{"", proto.OidInt4}, {"", proto.OidUnknown},
+			{"", proto.OidText}},
+		Values: []interface{}{int64(7), nil, "z"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestTypeDescDomainAndEnum(t *testing.T) {
+	domain := TypeDesc{Oid: 16400, Name: "posint", Kind: KindDomain,
+		Elem: proto.OidInt4}
+	if got, err := domain.Decode([]byte("5"), proto.EncFmtTxt); err != nil ||
+		got != int64(5) {
+		t.Errorf("got %#v, %v", got, err)
+	}
+	enum := TypeDesc{Oid: 16401, Name: "mood", Kind: KindEnum}
+	var b bytes.Buffer
+	if err := enum.Encode(&b, "happy", proto.EncFmtBinary); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := enum.Decode(b.Bytes()[4:], proto.EncFmtBinary); err != nil ||
+		got != "happy" {
+		t.Errorf("got %#v, %v", got, err)
+	}
+}
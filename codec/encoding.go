@@ -3,40 +3,406 @@ package codec
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
 	"github.com/uhoh-itsmaciek/femebe/proto"
-	"log"
+	"math"
+	"math/big"
+	"net"
 	"strconv"
 	"time"
 )
 
+// EncodeValue writes val to buff in the given format as the
+// Postgres type MappedOid picks for it, preceded by its length, as
+// it appears in a DataRow or Bind message. A nil val is written as
+// NULL.
 func EncodeValue(buff *bytes.Buffer, val interface{}, format proto.EncFmt) (err error) {
-	if format == proto.EncFmtTxt {
-		switch val.(type) {
-		case int16:
-			TextEncodeInt16(buff, val.(int16))
-		case int32:
-			TextEncodeInt32(buff, val.(int32))
-		case int64:
-			TextEncodeInt64(buff, val.(int64))
-		case float32:
-			TextEncodeFloat32(buff, val.(float32))
-		case float64:
-			TextEncodeFloat64(buff, val.(float64))
-		case string:
-			TextEncodeString(buff, val.(string))
-		case bool:
-			TextEncodeBool(buff, val.(bool))
-		default:
+	return EncodeTypedValue(buff, val, MappedOid(val), format)
+}
+
+// EncodeTypedValue is like EncodeValue, but encodes val as a value
+// of the Postgres type typ, such as a time.Time as a date or an int
+// as an int4. The value must fit the type.
+func EncodeTypedValue(buff *bytes.Buffer, val interface{}, typ proto.Oid,
+	format proto.EncFmt) error {
+	if val == nil {
+		buf.WriteInt32(buff, -1)
+		return nil
+	}
+	if elem := proto.ElementType(typ); elem != 0 {
+		return encodeArray(buff, val, elem, format)
+	}
+	if sub := proto.RangeSubtype(typ); sub != 0 {
+		return encodeRange(buff, val, sub, format)
+	}
+	if sub := proto.MultirangeSubtype(typ); sub != 0 {
+		return encodeMultirange(buff, val, sub, format)
+	}
+	if c, ok := val.(Composite); ok && typ == proto.OidRecord {
+		return encodeComposite(buff, c, format)
+	}
+	var ok bool
+	switch format {
+	case proto.EncFmtTxt:
+		ok = textEncodeTyped(buff, val, typ)
+	case proto.EncFmtBinary:
+		ok = binEncodeTyped(buff, val, typ)
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	if !ok {
+		if d, found := DefaultRegistry.custom(typ); found {
+			return d.Encode(buff, val, format)
+		}
+		if typ == proto.OidUnknown {
 			return fmt.Errorf("Can't encode value %#v of type %T", val, val)
 		}
-	} else {
-		return fmt.Errorf("Can't encode in format %v", format)
+		return fmt.Errorf("Can't encode value %#v of type %T as type %v",
+			val, val, typ)
 	}
 	return nil
 }
 
+// Convert any Go integer type to an int64, if it fits in the given
+// number of bits.
+func toInt(val interface{}, bits uint) (int64, bool) {
+	var i int64
+	switch v := val.(type) {
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case proto.Oid:
+		i = int64(v)
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return 0, false
+		}
+		i = int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		i = int64(v)
+	default:
+		return 0, false
+	}
+	if bits < 64 && (i < -1<<(bits-1) || i >= 1<<(bits-1)) {
+		return 0, false
+	}
+	return i, true
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	if i, ok := toInt(val, 64); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+func toNumeric(val interface{}) (Numeric, bool) {
+	if n, ok := val.(Numeric); ok {
+		return n, true
+	}
+	if i, ok := toInt(val, 64); ok {
+		return Numeric{Int: big.NewInt(i)}, true
+	}
+	return Numeric{}, false
+}
+
+func toInet(val interface{}) (*net.IPNet, bool) {
+	switch v := val.(type) {
+	case *net.IPNet:
+		return v, v != nil
+	case net.IP:
+		if ip4 := v.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+		}
+		if len(v) == net.IPv6len {
+			return &net.IPNet{IP: v, Mask: net.CIDRMask(128, 128)}, true
+		}
+	}
+	return nil, false
+}
+
+func toBitString(val interface{}) (BitString, bool) {
+	switch v := val.(type) {
+	case BitString:
+		return v, len(v.Bytes) >= (v.Len+7)/8
+	case string:
+		b, err := ParseBitString(v)
+		return b, err == nil
+	}
+	return BitString{}, false
+}
+
+func toBytes(val interface{}) ([]byte, bool) {
+	switch v := val.(type) {
+	case []byte:
+		return v, true
+	case json.RawMessage:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+func binEncodeTyped(buff *bytes.Buffer, val interface{}, typ proto.Oid) bool {
+	switch typ {
+	case proto.OidInt2:
+		i, ok := toInt(val, 16)
+		if ok {
+			BinEncodeInt16(buff, int16(i))
+		}
+		return ok
+	case proto.OidInt4:
+		i, ok := toInt(val, 32)
+		if ok {
+			BinEncodeInt32(buff, int32(i))
+		}
+		return ok
+	case proto.OidInt8:
+		i, ok := toInt(val, 64)
+		if ok {
+			BinEncodeInt64(buff, i)
+		}
+		return ok
+	case proto.OidOid:
+		i, ok := toInt(val, 64)
+		ok = ok && i >= 0 && i <= math.MaxUint32
+		if ok {
+			BinEncodeOid(buff, proto.Oid(i))
+		}
+		return ok
+	case proto.OidFloat4:
+		f, ok := toFloat(val)
+		if ok {
+			BinEncodeFloat32(buff, float32(f))
+		}
+		return ok
+	case proto.OidFloat8:
+		f, ok := toFloat(val)
+		if ok {
+			BinEncodeFloat64(buff, f)
+		}
+		return ok
+	case proto.OidNumeric:
+		n, ok := toNumeric(val)
+		if ok {
+			BinEncodeNumeric(buff, n)
+		}
+		return ok
+	case proto.OidBool:
+		b, ok := val.(bool)
+		if ok {
+			BinEncodeBool(buff, b)
+		}
+		return ok
+	case proto.OidText, proto.OidVarchar, proto.OidBpchar, proto.OidName,
+		proto.OidBytea:
+		b, ok := toBytes(val)
+		if ok {
+			BinEncodeBytea(buff, b)
+		}
+		return ok
+	case proto.OidDate, proto.OidTime, proto.OidTimetz, proto.OidTimestamp,
+		proto.OidTimestamptz:
+		t, ok := val.(time.Time)
+		if !ok {
+			return false
+		}
+		switch typ {
+		case proto.OidDate:
+			BinEncodeDate(buff, t)
+		case proto.OidTime:
+			BinEncodeTime(buff, t)
+		case proto.OidTimetz:
+			BinEncodeTimetz(buff, t)
+		case proto.OidTimestamp:
+			BinEncodeTimestamp(buff, t)
+		default:
+			BinEncodeTimestamptz(buff, t)
+		}
+		return true
+	case proto.OidInterval:
+		iv, ok := val.(Interval)
+		if ok {
+			BinEncodeInterval(buff, iv)
+		}
+		return ok
+	case proto.OidUuid:
+		u, ok := val.(UUID)
+		if ok {
+			BinEncodeUUID(buff, u)
+		}
+		return ok
+	case proto.OidJson, proto.OidJsonb:
+		b, ok := toBytes(val)
+		if ok {
+			BinEncodeJSON(buff, b, typ == proto.OidJsonb)
+		}
+		return ok
+	case proto.OidInet, proto.OidCidr:
+		n, ok := toInet(val)
+		if ok {
+			BinEncodeInet(buff, n, typ == proto.OidCidr)
+		}
+		return ok
+	case proto.OidMacaddr, proto.OidMacaddr8:
+		a, ok := val.(net.HardwareAddr)
+		if typ == proto.OidMacaddr {
+			ok = ok && len(a) == 6
+		} else {
+			ok = ok && len(a) == 8
+		}
+		if ok {
+			BinEncodeBytea(buff, a)
+		}
+		return ok
+	case proto.OidMoney:
+		m, ok := val.(Money)
+		if ok {
+			BinEncodeMoney(buff, m)
+		}
+		return ok
+	case proto.OidBit, proto.OidVarbit:
+		b, ok := toBitString(val)
+		if ok {
+			BinEncodeBitString(buff, b)
+		}
+		return ok
+	}
+	return false
+}
+
+func textEncodeTyped(buff *bytes.Buffer, val interface{}, typ proto.Oid) bool {
+	switch typ {
+	case proto.OidInt2, proto.OidInt4, proto.OidInt8:
+		i, ok := toInt(val, 8*uint(proto.TypSize(typ)))
+		if ok {
+			TextEncodeInt64(buff, i)
+		}
+		return ok
+	case proto.OidOid:
+		i, ok := toInt(val, 64)
+		ok = ok && i >= 0 && i <= math.MaxUint32
+		if ok {
+			TextEncodeInt64(buff, i)
+		}
+		return ok
+	case proto.OidFloat4, proto.OidFloat8:
+		switch v := val.(type) {
+		case float32:
+			TextEncodeFloat32(buff, v)
+			return true
+		case float64:
+			TextEncodeFloat64(buff, v)
+			return true
+		}
+		f, ok := toFloat(val)
+		if ok {
+			TextEncodeFloat64(buff, f)
+		}
+		return ok
+	case proto.OidNumeric:
+		n, ok := toNumeric(val)
+		if ok {
+			TextEncodeString(buff, n.String())
+		}
+		return ok
+	case proto.OidBool:
+		b, ok := val.(bool)
+		if ok {
+			TextEncodeBool(buff, b)
+		}
+		return ok
+	case proto.OidText, proto.OidVarchar, proto.OidBpchar, proto.OidName:
+		b, ok := toBytes(val)
+		if ok {
+			TextEncodeString(buff, string(b))
+		}
+		return ok
+	case proto.OidBytea:
+		b, ok := toBytes(val)
+		if ok {
+			TextEncodeBytea(buff, b)
+		}
+		return ok
+	case proto.OidDate, proto.OidTime, proto.OidTimetz, proto.OidTimestamp,
+		proto.OidTimestamptz:
+		t, ok := val.(time.Time)
+		if ok {
+			TextEncodeString(buff, FormatTime(t, typ))
+		}
+		return ok
+	case proto.OidInterval:
+		iv, ok := val.(Interval)
+		if ok {
+			TextEncodeString(buff, iv.String())
+		}
+		return ok
+	case proto.OidUuid:
+		u, ok := val.(UUID)
+		if ok {
+			TextEncodeString(buff, u.String())
+		}
+		return ok
+	case proto.OidJson, proto.OidJsonb:
+		b, ok := toBytes(val)
+		if ok {
+			TextEncodeString(buff, string(b))
+		}
+		return ok
+	case proto.OidInet, proto.OidCidr:
+		n, ok := toInet(val)
+		if ok {
+			TextEncodeString(buff, FormatInet(n))
+		}
+		return ok
+	case proto.OidMacaddr, proto.OidMacaddr8:
+		a, ok := val.(net.HardwareAddr)
+		if ok {
+			TextEncodeString(buff, a.String())
+		}
+		return ok
+	case proto.OidMoney:
+		m, ok := val.(Money)
+		if ok {
+			TextEncodeString(buff, m.String())
+		}
+		return ok
+	case proto.OidBit, proto.OidVarbit:
+		b, ok := toBitString(val)
+		if ok {
+			TextEncodeString(buff, b.String())
+		}
+		return ok
+	}
+	return false
+}
+
 func BinEncodeInt16(buff *bytes.Buffer, val int16) {
 	buf.WriteInt32(buff, 2)
 	buf.WriteInt16(buff, val)
@@ -55,11 +421,25 @@ func TextEncodeInt64(buff *bytes.Buffer, val int64) {
 }
 
 func TextEncodeFloat32(buff *bytes.Buffer, val float32) {
-	encodeValText(buff, val, "%e")
+	encodeValText(buff, formatFloat(float64(val), 32), "%s")
 }
 
 func TextEncodeFloat64(buff *bytes.Buffer, val float64) {
-	encodeValText(buff, val, "%e")
+	encodeValText(buff, formatFloat(val, 64), "%s")
+}
+
+// Format val in the fewest digits that read back as the same value
+// at the given precision, spelling special values as Postgres does
+func formatFloat(val float64, bits int) string {
+	switch {
+	case math.IsNaN(val):
+		return "NaN"
+	case math.IsInf(val, 1):
+		return "Infinity"
+	case math.IsInf(val, -1):
+		return "-Infinity"
+	}
+	return strconv.FormatFloat(val, 'g', -1, bits)
 }
 
 func TextEncodeString(buff *bytes.Buffer, val string) {
@@ -70,6 +450,11 @@ func TextEncodeBool(buff *bytes.Buffer, val bool) {
 	encodeValText(buff, val, "%t")
 }
 
+// TextEncodeBytea encodes val in the hex format.
+func TextEncodeBytea(buff *bytes.Buffer, val []byte) {
+	TextEncodeString(buff, "\\x"+hex.EncodeToString(val))
+}
+
 func encodeValText(b *bytes.Buffer,
 	val interface{}, format string) {
 	result := fmt.Sprintf(format, val)
@@ -78,38 +463,31 @@ func encodeValText(b *bytes.Buffer,
 }
 
 // Decode Postgres (text) encoding into a reasonably corresponding Go
-// type (lifted from pq)
-func Decode(s []byte, typ proto.Oid) interface{} {
+// type (lifted from pq). Malformed values result in an
+// error.ErrDecode.
+func Decode(s []byte, typ proto.Oid) (interface{}, error) {
 	switch typ {
-	case proto.OidText, proto.OidVarchar:
-		return string(s)
+	case proto.OidText, proto.OidVarchar, proto.OidBpchar, proto.OidName:
+		return string(s), nil
 	case proto.OidBytea:
-		// N.B.: assumes hex bytea output
-		s = s[2:] // trim off "\\x"
-		d := make([]byte, hex.DecodedLen(len(s)))
-		_, err := hex.Decode(d, s)
-		if err != nil {
-			log.Fatalf("femebe: %s", err)
-		}
-		return d
-	case proto.OidTimestamp:
-		return mustParse("2006-01-02 15:04:05", typ, s)
-	case proto.OidTimestamptz:
-		return mustParse("2006-01-02 15:04:05-07", typ, s)
-	case proto.OidTime:
-		return mustParse("15:04:05", typ, s)
-	case proto.OidTimetz:
-		return mustParse("15:04:05-07", typ, s)
-	case proto.OidDate:
-		return mustParse("2006-01-02", typ, s)
+		return DecodeBytea(s)
+	case proto.OidTimestamp, proto.OidTimestamptz, proto.OidTime,
+		proto.OidTimetz, proto.OidDate:
+		return DecodeTime(s, typ)
 	case proto.OidBool:
-		return s[0] == 't'
+		switch string(s) {
+		case "t", "true":
+			return true, nil
+		case "f", "false":
+			return false, nil
+		}
+		return nil, e.Decode("could not parse %q as type bool", s)
 	case proto.OidInt8, proto.OidInt4, proto.OidInt2:
 		i, err := strconv.ParseInt(string(s), 10, 64)
 		if err != nil {
-			log.Fatalf("femebe: %s", err)
+			return nil, e.Decode("could not parse %q as type %v", s, typ)
 		}
-		return i
+		return i, nil
 	case proto.OidFloat4, proto.OidFloat8:
 		var bits int
 		if typ == proto.OidFloat4 {
@@ -119,40 +497,98 @@ func Decode(s []byte, typ proto.Oid) interface{} {
 		}
 		f, err := strconv.ParseFloat(string(s), bits)
 		if err != nil {
-			log.Fatalf("femebe: %s", err)
+			return nil, e.Decode("could not parse %q as type %v", s, typ)
+		}
+		return f, nil
+	case proto.OidOid:
+		i, err := strconv.ParseUint(string(s), 10, 32)
+		if err != nil {
+			return nil, e.Decode("could not parse %q as type %v", s, typ)
 		}
-		return f
+		return proto.Oid(i), nil
+	case proto.OidNumeric:
+		return ParseNumeric(string(s))
+	case proto.OidInterval:
+		return ParseInterval(string(s))
+	case proto.OidUuid:
+		return ParseUUID(string(s))
+	case proto.OidJson, proto.OidJsonb:
+		return json.RawMessage(s), nil
+	case proto.OidInet, proto.OidCidr:
+		return ParseInet(string(s))
+	case proto.OidMacaddr, proto.OidMacaddr8:
+		a, err := net.ParseMAC(string(s))
+		if err != nil {
+			return nil, e.Decode("could not parse %q as type %v", s, typ)
+		}
+		return a, nil
+	case proto.OidMoney:
+		return ParseMoney(string(s))
+	case proto.OidBit, proto.OidVarbit:
+		return ParseBitString(string(s))
+	case proto.OidRecord:
+		return DecodeComposite(s, nil)
 	default:
-		return s
+		if elem := proto.ElementType(typ); elem != 0 {
+			return DecodeArray(s, elem)
+		}
+		if sub := proto.RangeSubtype(typ); sub != 0 {
+			return DecodeRange(s, sub)
+		}
+		if sub := proto.MultirangeSubtype(typ); sub != 0 {
+			return DecodeMultirange(s, sub)
+		}
+		if d, ok := DefaultRegistry.custom(typ); ok {
+			return d.Decode(s, proto.EncFmtTxt)
+		}
+		return s, nil
 	}
 }
 
-func mustParse(f string, typ proto.Oid, s []byte) time.Time {
-	str := string(s)
-
-	// Special case until time.Parse bug is fixed:
-	// http://code.google.com/p/go/issues/detail?id=3487
-	if str[len(str)-2] == '.' {
-		str += "0"
+// DecodeBytea decodes the text output of a bytea value, in either
+// the hex format or the older escape format (see the bytea_output
+// setting).
+func DecodeBytea(s []byte) ([]byte, error) {
+	if bytes.HasPrefix(s, []byte("\\x")) {
+		s = s[2:]
+		d := make([]byte, hex.DecodedLen(len(s)))
+		if _, err := hex.Decode(d, s); err != nil {
+			return nil, e.Decode("bad hex bytea: %v", err)
+		}
+		return d, nil
 	}
 
-	// check for a 30-minute-offset timezone
-	if (typ == proto.OidTimestamptz || typ == proto.OidTimetz) &&
-		str[len(str)-3] == ':' {
-		f += ":00"
-	}
-	t, err := time.Parse(f, str)
-	if err != nil {
-		log.Fatalf("femebe: decode: %s", err)
+	// In the escape format, backslashes are doubled and other
+	// bytes may be written as a backslash and three octal digits.
+	d := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			d = append(d, s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			d = append(d, '\\')
+			i++
+			continue
+		}
+		if i+4 > len(s) {
+			return nil, e.Decode("truncated escape in bytea at byte %v", i)
+		}
+		b, err := strconv.ParseUint(string(s[i+1:i+4]), 8, 8)
+		if err != nil {
+			return nil, e.Decode("bad escape %q in bytea", s[i:i+4])
+		}
+		d = append(d, byte(b))
+		i += 3
 	}
-	return t
+	return d, nil
 }
 
 // Describe which Go type this Postgres OID will map to in the scheme
 // above
 func DescribeType(typ proto.Oid) string {
 	switch typ {
-	case proto.OidText, proto.OidVarchar:
+	case proto.OidText, proto.OidVarchar, proto.OidBpchar, proto.OidName:
 		return "string"
 	case proto.OidBytea:
 		return "[]byte"
@@ -164,7 +600,39 @@ func DescribeType(typ proto.Oid) string {
 		return "int64"
 	case proto.OidFloat4, proto.OidFloat8:
 		return "float64"
+	case proto.OidOid:
+		return "proto.Oid"
+	case proto.OidNumeric:
+		return "codec.Numeric"
+	case proto.OidInterval:
+		return "codec.Interval"
+	case proto.OidUuid:
+		return "codec.UUID"
+	case proto.OidJson, proto.OidJsonb:
+		return "json.RawMessage"
+	case proto.OidInet, proto.OidCidr:
+		return "*net.IPNet"
+	case proto.OidMacaddr, proto.OidMacaddr8:
+		return "net.HardwareAddr"
+	case proto.OidMoney:
+		return "codec.Money"
+	case proto.OidBit, proto.OidVarbit:
+		return "codec.BitString"
+	case proto.OidRecord:
+		return "codec.Composite"
 	default:
+		if proto.ElementType(typ) != 0 {
+			return "codec.Array"
+		}
+		if proto.RangeSubtype(typ) != 0 {
+			return "codec.Range"
+		}
+		if proto.MultirangeSubtype(typ) != 0 {
+			return "codec.Multirange"
+		}
+		if d, ok := DefaultRegistry.custom(typ); ok {
+			return d.describe()
+		}
 		return "unknown"
 	}
 }
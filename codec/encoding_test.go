@@ -0,0 +1,119 @@
+package codec
+
+import (
+	"bytes"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"testing"
+	"time"
+)
+
+func TestDecodeBytea(t *testing.T) {
+	want := []byte{0xde, 0xad, '\\', 'a', 0}
+	for _, s := range []string{`\xdead5c6100`, `\336\255\\a\000`} {
+		got, err := Decode([]byte(s), proto.OidBytea)
+		if err != nil {
+			t.Errorf("decoding %q: %v", s, err)
+		} else if !bytes.Equal(got.([]byte), want) {
+			t.Errorf("decoding %q: got %q; want %q", s, got, want)
+		}
+	}
+	for _, s := range []string{`\xdeadz`, `\33`, `\9ab`} {
+		if _, err := Decode([]byte(s), proto.OidBytea); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		} else if _, ok := err.(e.ErrDecode); !ok {
+			t.Errorf("decoding %q: got %T; want ErrDecode", s, err)
+		}
+	}
+}
+
+func TestDecodeTime(t *testing.T) {
+	plus2 := time.FixedZone("", 2*3600)
+	tests := []struct {
+		s    string
+		typ  proto.Oid
+		want time.Time
+	}{
+		{"2014-05-01", proto.OidDate, time.Date(2014, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"0044-03-15 BC", proto.OidDate, time.Date(-43, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"infinity", proto.OidDate, InfinityTime},
+		{"2014-05-01 12:30:15", proto.OidTimestamp,
+			time.Date(2014, 5, 1, 12, 30, 15, 0, time.UTC)},
+		{"2014-05-01 12:30:15.25", proto.OidTimestamp,
+			time.Date(2014, 5, 1, 12, 30, 15, 250000000, time.UTC)},
+		{"12345-01-01 00:00:00", proto.OidTimestamp,
+			time.Date(12345, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"-infinity", proto.OidTimestamptz, NegativeInfinityTime},
+		{"2014-05-01 12:30:15.123456+02", proto.OidTimestamptz,
+			time.Date(2014, 5, 1, 12, 30, 15, 123456000, plus2)},
+		{"0001-01-01 00:00:00-05:30 BC", proto.OidTimestamptz,
+			time.Date(0, 1, 1, 0, 0, 0, 0, time.FixedZone("", -5*3600-1800))},
+		{"12:30:15.5", proto.OidTime,
+			time.Date(0, 1, 1, 12, 30, 15, 500000000, time.UTC)},
+		{"12:30:15+02", proto.OidTimetz, time.Date(0, 1, 1, 12, 30, 15, 0, plus2)},
+	}
+	for _, test := range tests {
+		got, err := Decode([]byte(test.s), test.typ)
+		if err != nil {
+			t.Errorf("decoding %q: %v", test.s, err)
+			continue
+		}
+		tm := got.(time.Time)
+		_, gotOffset := tm.Zone()
+		_, wantOffset := test.want.Zone()
+		if !tm.Equal(test.want) || gotOffset != wantOffset {
+			t.Errorf("decoding %q: got %v; want %v", test.s, tm, test.want)
+		}
+	}
+
+	for _, s := range []string{"2014-05-01 12:30", "2014-13-01",
+		"2014-05-01 12:30:15 AD", "yesterday"} {
+		if _, err := Decode([]byte(s), proto.OidTimestamp); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		}
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tm := time.Date(-43, 3, 15, 12, 0, 0, 500000000,
+		time.FixedZone("", -5*3600-1800))
+	tests := []struct {
+		typ  proto.Oid
+		want string
+	}{
+		{proto.OidDate, "0044-03-15 BC"},
+		{proto.OidTime, "12:00:00.5"},
+		{proto.OidTimestamp, "0044-03-15 12:00:00.5 BC"},
+		{proto.OidTimestamptz, "0044-03-15 12:00:00.5-05:30 BC"},
+	}
+	for _, test := range tests {
+		if got := FormatTime(tm, test.typ); got != test.want {
+			t.Errorf("formatting as %v: got %q; want %q", test.typ, got, test.want)
+		}
+		decoded, err := Decode([]byte(test.want), test.typ)
+		if err != nil {
+			t.Errorf("decoding %q: %v", test.want, err)
+		} else if got := FormatTime(decoded.(time.Time), test.typ); got != test.want {
+			t.Errorf("round trip of %q: got %q", test.want, got)
+		}
+	}
+	if got := FormatTime(InfinityTime.AddDate(1, 0, 0), proto.OidTimestamp); got != "infinity" {
+		t.Errorf("got %q; want infinity", got)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		s   string
+		typ proto.Oid
+	}{
+		{"", proto.OidBool},
+		{"12x", proto.OidInt4},
+		{"1.5.1", proto.OidFloat8},
+	}
+	for _, test := range tests {
+		if _, err := Decode([]byte(test.s), test.typ); err == nil {
+			t.Errorf("expected error decoding %q as %v", test.s, test.typ)
+		}
+	}
+}
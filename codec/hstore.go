@@ -0,0 +1,215 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"sort"
+	"strings"
+)
+
+// Hstore is a value of the hstore extension type: a set of keys, each
+// with a string value or NULL (nil).
+type Hstore map[string]*string
+
+// The keys of h in order, so encodings are stable
+func (h Hstore) keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHstoreString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte('"')
+}
+
+// Write h in the given format, preceded by its length.
+func encodeHstore(buff *bytes.Buffer, h Hstore, format proto.EncFmt) error {
+	var b bytes.Buffer
+	switch format {
+	case proto.EncFmtTxt:
+		for i, k := range h.keys() {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeHstoreString(&b, k)
+			b.WriteString("=>")
+			if v := h[k]; v == nil {
+				b.WriteString("NULL")
+			} else {
+				writeHstoreString(&b, *v)
+			}
+		}
+	case proto.EncFmtBinary:
+		buf.WriteInt32(&b, int32(len(h)))
+		for _, k := range h.keys() {
+			BinEncodeString(&b, k)
+			if v := h[k]; v == nil {
+				buf.WriteInt32(&b, -1)
+			} else {
+				BinEncodeString(&b, *v)
+			}
+		}
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	buf.WriteInt32(buff, int32(b.Len()))
+	buff.Write(b.Bytes())
+	return nil
+}
+
+// Parses the text form of hstores
+type hstoreParser struct {
+	s   string
+	pos int
+}
+
+func (p *hstoreParser) fail(what string) error {
+	return e.Decode("could not parse hstore %q at %v: %v", p.s, p.pos, what)
+}
+
+func (p *hstoreParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n\r\v\f", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// Parse a key or value, quoted or not; null is set for an unquoted
+// NULL.
+func (p *hstoreParser) word() (s string, null bool, err error) {
+	var b bytes.Buffer
+	quoted := p.pos < len(p.s) && p.s[p.pos] == '"'
+	if quoted {
+		p.pos++
+	}
+	for {
+		if p.pos >= len(p.s) {
+			if quoted {
+				return "", false, p.fail("unterminated string")
+			}
+			break
+		}
+		c := p.s[p.pos]
+		if quoted && c == '"' {
+			p.pos++
+			break
+		}
+		if !quoted && (c == ',' || c == '=' || c == '"' ||
+			strings.IndexByte(" \t\n\r\v\f", c) >= 0) {
+			break
+		}
+		if c == '\\' {
+			p.pos++
+			if p.pos >= len(p.s) {
+				return "", false, p.fail("unterminated escape")
+			}
+			c = p.s[p.pos]
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	if !quoted && b.Len() == 0 {
+		return "", false, p.fail("expected a string")
+	}
+	return b.String(), !quoted && strings.EqualFold(b.String(), "NULL"), nil
+}
+
+// DecodeHstore decodes the text form of an hstore, such as
+// `"a"=>"1", "b"=>NULL`.
+func DecodeHstore(s []byte) (Hstore, error) {
+	p := &hstoreParser{s: string(s)}
+	h := make(Hstore)
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return h, nil
+		}
+		if len(h) > 0 {
+			if p.s[p.pos] != ',' {
+				return nil, p.fail("expected ','")
+			}
+			p.pos++
+			p.skipSpace()
+		}
+		k, _, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !strings.HasPrefix(p.s[p.pos:], "=>") {
+			return nil, p.fail("expected '=>'")
+		}
+		p.pos += 2
+		p.skipSpace()
+		v, null, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			h[k] = nil
+		} else {
+			h[k] = &v
+		}
+	}
+}
+
+// DecodeBinaryHstore decodes the binary form of an hstore.
+func DecodeBinaryHstore(s []byte) (Hstore, error) {
+	fail := func(format string, args ...interface{}) (Hstore, error) {
+		return nil, e.Decode("bad binary hstore: "+format, args...)
+	}
+	// Read a length-prefixed string; -1 is NULL
+	next := func() (*string, bool) {
+		if len(s) < 4 {
+			return nil, false
+		}
+		size := int(int32(binary.BigEndian.Uint32(s)))
+		s = s[4:]
+		if size == -1 {
+			return nil, true
+		}
+		if size < 0 || size > len(s) {
+			return nil, false
+		}
+		str := string(s[:size])
+		s = s[size:]
+		return &str, true
+	}
+	if len(s) < 4 {
+		return fail("only %v bytes", len(s))
+	}
+	n := int(int32(binary.BigEndian.Uint32(s)))
+	s = s[4:]
+	if n < 0 || len(s) < 8*n {
+		return fail("%v pairs", n)
+	}
+	h := make(Hstore, n)
+	for i := 0; i < n; i++ {
+		k, ok := next()
+		if !ok || k == nil {
+			return fail("bad key")
+		}
+		v, ok := next()
+		if !ok {
+			return fail("truncated")
+		}
+		h[*k] = v
+	}
+	if len(s) != 0 {
+		return fail("%v trailing bytes", len(s))
+	}
+	return h, nil
+}
@@ -0,0 +1,338 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"strings"
+)
+
+// Binary range flags
+const (
+	rangeEmpty    = 0x01
+	rangeLowerInc = 0x02
+	rangeUpperInc = 0x04
+	rangeLowerInf = 0x08
+	rangeUpperInf = 0x10
+)
+
+// Range is a value of a Postgres range type, such as a tstzrange.
+type Range struct {
+	// The bounds, of the subtype of the range; nil for an
+	// unbounded side
+	Lower, Upper interface{}
+	// Whether each bound is itself in the range
+	LowerInc, UpperInc bool
+	// Whether the range is empty, in which case the other fields
+	// are unused
+	Empty bool
+}
+
+// Multirange is a value of a Postgres multirange type: an ordered
+// list of ranges that do not overlap.
+type Multirange []Range
+
+// The text form of r, without its length prefix
+func (r Range) text(subtype proto.Oid) ([]byte, error) {
+	if r.Empty {
+		return []byte("empty"), nil
+	}
+	var b bytes.Buffer
+	if r.LowerInc && r.Lower != nil {
+		b.WriteByte('[')
+	} else {
+		b.WriteByte('(')
+	}
+	for i, bound := range []interface{}{r.Lower, r.Upper} {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if bound == nil {
+			continue
+		}
+		text, err := encodeElem(bound, subtype, proto.EncFmtTxt)
+		if err != nil {
+			return nil, err
+		}
+		writeItem(&b, text)
+	}
+	if r.UpperInc && r.Upper != nil {
+		b.WriteByte(']')
+	} else {
+		b.WriteByte(')')
+	}
+	return b.Bytes(), nil
+}
+
+// The binary form of r, without its length prefix
+func (r Range) binary(subtype proto.Oid) ([]byte, error) {
+	if r.Empty {
+		return []byte{rangeEmpty}, nil
+	}
+	var flags byte
+	if r.Lower == nil {
+		flags |= rangeLowerInf
+	} else if r.LowerInc {
+		flags |= rangeLowerInc
+	}
+	if r.Upper == nil {
+		flags |= rangeUpperInf
+	} else if r.UpperInc {
+		flags |= rangeUpperInc
+	}
+	var b bytes.Buffer
+	b.WriteByte(flags)
+	for _, bound := range []interface{}{r.Lower, r.Upper} {
+		if bound == nil {
+			continue
+		}
+		if err := EncodeTypedValue(&b, bound, subtype, proto.EncFmtBinary); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Write val, a Range, as a range over subtype, preceded by its
+// length.
+func encodeRange(buff *bytes.Buffer, val interface{}, subtype proto.Oid,
+	format proto.EncFmt) error {
+	r, ok := val.(Range)
+	if !ok {
+		return fmt.Errorf("Can't encode value %#v of type %T as a range", val, val)
+	}
+	var encoded []byte
+	var err error
+	switch format {
+	case proto.EncFmtTxt:
+		encoded, err = r.text(subtype)
+	case proto.EncFmtBinary:
+		encoded, err = r.binary(subtype)
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	buf.WriteInt32(buff, int32(len(encoded)))
+	buff.Write(encoded)
+	return nil
+}
+
+// Write val, a Multirange, as a multirange over subtype, preceded by
+// its length.
+func encodeMultirange(buff *bytes.Buffer, val interface{}, subtype proto.Oid,
+	format proto.EncFmt) error {
+	m, ok := val.(Multirange)
+	if !ok {
+		return fmt.Errorf("Can't encode value %#v of type %T as a multirange",
+			val, val)
+	}
+	var b bytes.Buffer
+	switch format {
+	case proto.EncFmtTxt:
+		b.WriteByte('{')
+		for i, r := range m {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			text, err := r.text(subtype)
+			if err != nil {
+				return err
+			}
+			b.Write(text)
+		}
+		b.WriteByte('}')
+	case proto.EncFmtBinary:
+		buf.WriteInt32(&b, int32(len(m)))
+		for _, r := range m {
+			if err := encodeRange(&b, r, subtype, format); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Can't encode in format %v", format)
+	}
+	buf.WriteInt32(buff, int32(b.Len()))
+	buff.Write(b.Bytes())
+	return nil
+}
+
+// DecodeRange decodes the text form of a range over subtype, such as
+// "[1,10)" or "empty".
+func DecodeRange(s []byte, subtype proto.Oid) (Range, error) {
+	str := strings.TrimSpace(string(s))
+	if strings.EqualFold(str, "empty") {
+		return Range{Empty: true}, nil
+	}
+	fail := func() (Range, error) {
+		return Range{}, e.Decode("could not parse %q as a range", s)
+	}
+	if len(str) < 2 {
+		return fail()
+	}
+	var r Range
+	switch str[0] {
+	case '[':
+		r.LowerInc = true
+	case '(':
+	default:
+		return fail()
+	}
+	switch str[len(str)-1] {
+	case ']':
+		r.UpperInc = true
+	case ')':
+	default:
+		return fail()
+	}
+	items, err := splitItems(str[1 : len(str)-1])
+	if err != nil {
+		return Range{}, err
+	}
+	if len(items) != 2 {
+		return fail()
+	}
+	bounds := []*interface{}{&r.Lower, &r.Upper}
+	for i, item := range items {
+		if item.null {
+			continue
+		}
+		if *bounds[i], err = Decode([]byte(item.text), subtype); err != nil {
+			return Range{}, err
+		}
+	}
+	// an unbounded side is never inclusive
+	r.LowerInc = r.LowerInc && r.Lower != nil
+	r.UpperInc = r.UpperInc && r.Upper != nil
+	return r, nil
+}
+
+// DecodeBinaryRange decodes the binary form of a range over subtype.
+func DecodeBinaryRange(s []byte, subtype proto.Oid) (Range, error) {
+	fail := func(format string, args ...interface{}) (Range, error) {
+		return Range{}, e.Decode("bad binary range: "+format, args...)
+	}
+	if len(s) < 1 {
+		return fail("no flags")
+	}
+	flags := s[0]
+	s = s[1:]
+	if flags&rangeEmpty != 0 {
+		if len(s) != 0 {
+			return fail("%v trailing bytes", len(s))
+		}
+		return Range{Empty: true}, nil
+	}
+	r := Range{
+		LowerInc: flags&rangeLowerInc != 0,
+		UpperInc: flags&rangeUpperInc != 0,
+	}
+	bounds := []*interface{}{&r.Lower, &r.Upper}
+	for i, inf := range []byte{rangeLowerInf, rangeUpperInf} {
+		if flags&inf != 0 {
+			continue
+		}
+		if len(s) < 4 {
+			return fail("truncated")
+		}
+		size := int(int32(binary.BigEndian.Uint32(s)))
+		s = s[4:]
+		if size < 0 || size > len(s) {
+			return fail("truncated")
+		}
+		val, err := DecodeBinary(s[:size], subtype)
+		if err != nil {
+			return Range{}, err
+		}
+		*bounds[i] = val
+		s = s[size:]
+	}
+	if len(s) != 0 {
+		return fail("%v trailing bytes", len(s))
+	}
+	return r, nil
+}
+
+// DecodeMultirange decodes the text form of a multirange over
+// subtype, such as "{[1,3),[5,7)}".
+func DecodeMultirange(s []byte, subtype proto.Oid) (Multirange, error) {
+	str := strings.TrimSpace(string(s))
+	if len(str) < 2 || str[0] != '{' || str[len(str)-1] != '}' {
+		return nil, e.Decode("could not parse %q as a multirange", s)
+	}
+	str = str[1 : len(str)-1]
+	m := Multirange{}
+	for i := 0; i < len(str); {
+		if c := str[i]; c == ' ' || c == ',' {
+			i++
+			continue
+		}
+		if len(str)-i >= 5 && strings.EqualFold(str[i:i+5], "empty") {
+			// multiranges leave out empty ranges
+			i += 5
+			continue
+		}
+		// the range ends at the first closing bracket outside quotes
+		end, inQuotes := i, false
+		for ; end < len(str); end++ {
+			if c := str[end]; c == '\\' {
+				end++
+			} else if c == '"' {
+				inQuotes = !inQuotes
+			} else if !inQuotes && (c == ']' || c == ')') {
+				break
+			}
+		}
+		if end >= len(str) {
+			return nil, e.Decode("could not parse %q as a multirange", s)
+		}
+		r, err := DecodeRange([]byte(str[i:end+1]), subtype)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, r)
+		i = end + 1
+	}
+	return m, nil
+}
+
+// DecodeBinaryMultirange decodes the binary form of a multirange over
+// subtype.
+func DecodeBinaryMultirange(s []byte, subtype proto.Oid) (Multirange, error) {
+	fail := func(format string, args ...interface{}) (Multirange, error) {
+		return nil, e.Decode("bad binary multirange: "+format, args...)
+	}
+	if len(s) < 4 {
+		return fail("only %v bytes", len(s))
+	}
+	n := int(int32(binary.BigEndian.Uint32(s)))
+	s = s[4:]
+	if n < 0 || len(s) < 4*n {
+		return fail("%v ranges", n)
+	}
+	m := make(Multirange, n)
+	for i := range m {
+		if len(s) < 4 {
+			return fail("truncated")
+		}
+		size := int(int32(binary.BigEndian.Uint32(s)))
+		s = s[4:]
+		if size < 0 || size > len(s) {
+			return fail("truncated")
+		}
+		r, err := DecodeBinaryRange(s[:size], subtype)
+		if err != nil {
+			return nil, err
+		}
+		m[i] = r
+		s = s[size:]
+	}
+	if len(s) != 0 {
+		return fail("%v trailing bytes", len(s))
+	}
+	return m, nil
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRangeRoundTrip(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2014, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		val  interface{}
+		typ  proto.Oid
+		text string
+	}{
+		{Range{Lower: int64(1), Upper: int64(10), LowerInc: true},
+			proto.OidInt8range, "[1,10)"},
+		{Range{Lower: int64(1), LowerInc: true}, proto.OidInt4range, "[1,)"},
+		{Range{Upper: int64(-3), UpperInc: true}, proto.OidInt4range, "(,-3]"},
+		{Range{}, proto.OidInt4range, "(,)"},
+		{Range{Empty: true}, proto.OidDaterange, "empty"},
+		{Range{Lower: day(1), Upper: day(2), LowerInc: true}, proto.OidDaterange,
+			"[2014-05-01,2014-05-02)"},
+		{Range{Lower: day(1), Upper: day(2), LowerInc: true}, proto.OidTsrange,
+			`["2014-05-01 00:00:00","2014-05-02 00:00:00")`},
+		{Multirange{}, proto.OidInt4multirange, "{}"},
+		{Multirange{
+			{Lower: int64(1), Upper: int64(3), LowerInc: true},
+			{Lower: int64(5)},
+		}, proto.OidInt8multirange, "{[1,3),(5,)}"},
+	}
+	for _, test := range tests {
+		for _, format := range []proto.EncFmt{proto.EncFmtTxt, proto.EncFmtBinary} {
+			var b bytes.Buffer
+			if err := EncodeTypedValue(&b, test.val, test.typ, format); err != nil {
+				t.Errorf("encoding %#v: %v", test.val, err)
+				continue
+			}
+			encoded := b.Bytes()[4:]
+			if format == proto.EncFmtTxt && string(encoded) != test.text {
+				t.Errorf("encoding %#v: got %s; want %s", test.val, encoded, test.text)
+			}
+			got, err := DecodeValue(encoded, test.typ, format)
+			if err != nil {
+				t.Errorf("decoding %q as %v: %v", encoded, test.typ, err)
+			} else if !reflect.DeepEqual(got, test.val) {
+				t.Errorf("decoding %q as %v: got %#v; want %#v",
+					encoded, test.typ, got, test.val)
+			}
+		}
+	}
+}
+
+func TestRangeTextParsing(t *testing.T) {
+	got, err := DecodeMultirange([]byte(` {["1",2], empty ,("3",)} `),
+		proto.OidInt4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Multirange{
+		{Lower: int64(1), Upper: int64(2), LowerInc: true, UpperInc: true},
+		{Lower: int64(3)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+
+	for _, s := range []string{"", "[1,2", "1,2)", "[1,2,3)", "[x,2)", `["1,2)`} {
+		if _, err := DecodeRange([]byte(s), proto.OidInt4); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		}
+	}
+	for _, s := range []string{"", "[1,2)", "{[1,2)", "{[1,2),[3}"} {
+		if _, err := DecodeMultirange([]byte(s), proto.OidInt4); err == nil {
+			t.Errorf("expected error decoding %q", s)
+		}
+	}
+}
+
+func TestMappedRangeOids(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want proto.Oid
+	}{
+		{Range{Lower: int32(1)}, proto.OidInt4range},
+		{Range{Upper: time.Now()}, proto.OidTstzrange},
+		{Range{Empty: true}, proto.OidUnknown},
+		{Multirange{{Empty: true}, {Lower: Numeric{}}}, proto.OidNummultirange},
+	}
+	for _, test := range tests {
+		if got := MappedOid(test.val); got != test.want {
+			t.Errorf("got %v for %#v; want %v", got, test.val, test.want)
+		}
+	}
+}
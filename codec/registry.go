@@ -0,0 +1,362 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"strconv"
+	"sync"
+)
+
+// Registry describes the types of a Postgres database by their oids.
+// It starts out knowing the built-in types, and can learn the rest,
+// such as domains, enums, composites and extension types like
+// citext, from the catalogs of a running server. It is safe for
+// concurrent use.
+type Registry struct {
+	lock     sync.RWMutex
+	types    map[proto.Oid]TypeDesc
+	names    map[string]proto.Oid
+	builtins map[proto.Oid]bool
+}
+
+// DefaultRegistry is the registry Decode, DecodeBinary and
+// EncodeTypedValue consult for the types the codec has no built-in
+// support for.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns a registry of the built-in types.
+func NewRegistry() *Registry {
+	r := &Registry{
+		types:    make(map[proto.Oid]TypeDesc),
+		names:    make(map[string]proto.Oid),
+		builtins: make(map[proto.Oid]bool),
+	}
+	for _, d := range builtinTypes() {
+		r.Register(d)
+		r.builtins[d.Oid] = true
+	}
+	return r
+}
+
+// Register adds the type d to r, replacing any type with the same oid.
+func (r *Registry) Register(d TypeDesc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if old, ok := r.types[d.Oid]; ok && r.names[old.Name] == d.Oid {
+		delete(r.names, old.Name)
+	}
+	r.types[d.Oid] = d
+	r.names[d.Name] = d.Oid
+}
+
+// Lookup returns the description of the type with the given oid, and
+// whether there is one.
+func (r *Registry) Lookup(typ proto.Oid) (TypeDesc, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	d, ok := r.types[typ]
+	return d, ok
+}
+
+// LookupName returns the description of the type with the given
+// name, such as "int4" or "_int4", and whether there is one. Names
+// are not qualified by schema; if several types share a name, the
+// last one registered wins.
+func (r *Registry) LookupName(name string) (TypeDesc, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	typ, ok := r.names[name]
+	if !ok {
+		return TypeDesc{}, false
+	}
+	return r.types[typ], true
+}
+
+// The description of typ, if it is not a built-in type and needs
+// more than the built-in codecs
+func (r *Registry) custom(typ proto.Oid) (TypeDesc, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.builtins[typ] {
+		return TypeDesc{}, false
+	}
+	d, ok := r.types[typ]
+	return d, ok && d.special()
+}
+
+// TypSize returns the size in bytes of the type typ, -1 for a
+// variable-length type, or -2 for a null-terminated one. Unknown
+// types are assumed to be variable-length.
+func (r *Registry) TypSize(typ proto.Oid) int16 {
+	if d, ok := r.Lookup(typ); ok {
+		return d.Len
+	}
+	return -1
+}
+
+// NewField returns the description of a text-format column of type
+// typ, for a RowDescription message.
+func (r *Registry) NewField(name string, typ proto.Oid) *proto.FieldDescription {
+	return &proto.FieldDescription{
+		Name:      name,
+		TypeOid:   typ,
+		TypLen:    r.TypSize(typ),
+		Atttypmod: -1,
+		Format:    proto.EncFmtTxt,
+	}
+}
+
+const loadTypesQuery = `SELECT t.oid, t.typname, t.typtype, t.typcategory,
+	t.typlen, CASE t.typtype WHEN 'd' THEN t.typbasetype
+		WHEN 'r' THEN COALESCE(r.rngsubtype, 0::oid)
+		ELSE t.typelem END, t.typrelid
+	FROM pg_type t LEFT JOIN pg_range r ON r.rngtypid = t.oid`
+
+// Multiranges appeared with pg_range.rngmultitypid in Postgres 14,
+// so this is only run if there are any.
+const loadMultirangesQuery = `SELECT rngmultitypid, rngsubtype FROM pg_range`
+
+const loadFieldsQuery = `SELECT a.attrelid, a.attname, a.atttypid
+	FROM pg_attribute a JOIN pg_type t ON t.typrelid = a.attrelid
+	WHERE t.typtype = 'c' AND a.attnum > 0 AND NOT a.attisdropped
+	ORDER BY a.attrelid, a.attnum`
+
+// Load registers the types in the pg_type catalog of the database
+// the stream s is connected to. The connection must have completed
+// startup and be ready for a query; Load runs its queries with the
+// simple query protocol and leaves it ready for the next one.
+func (r *Registry) Load(s core.Stream) error {
+	rows, err := simpleQuery(s, loadTypesQuery)
+	if err != nil {
+		return err
+	}
+	// allocated up front, since the maps below point into it
+	descs := make([]TypeDesc, 0, len(rows))
+	// composite types by the oid of their pg_class entry
+	byRelid := make(map[proto.Oid]*TypeDesc)
+	multiranges := make(map[proto.Oid]*TypeDesc)
+	for _, row := range rows {
+		if len(row) != 7 || len(row[2]) != 1 || len(row[3]) != 1 {
+			return fmt.Errorf("unexpected pg_type row %q", row)
+		}
+		oid, err1 := parseOid(row[0])
+		typlen, err2 := strconv.ParseInt(row[4], 10, 16)
+		elem, err3 := parseOid(row[5])
+		relid, err4 := parseOid(row[6])
+		for _, err := range []error{err1, err2, err3, err4} {
+			if err != nil {
+				return fmt.Errorf("unexpected pg_type row %q: %v", row, err)
+			}
+		}
+		descs = append(descs, TypeDesc{
+			Oid:      oid,
+			Name:     row[1],
+			Kind:     TypeKind(row[2][0]),
+			Category: row[3][0],
+			Len:      int16(typlen),
+			Elem:     elem,
+		})
+		d := &descs[len(descs)-1]
+		switch d.Kind {
+		case KindComposite:
+			byRelid[relid] = d
+		case KindMultirange:
+			multiranges[oid] = d
+		}
+	}
+
+	if len(multiranges) > 0 {
+		rows, err = simpleQuery(s, loadMultirangesQuery)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if len(row) != 2 {
+				return fmt.Errorf("unexpected pg_range row %q", row)
+			}
+			multi, err1 := parseOid(row[0])
+			sub, err2 := parseOid(row[1])
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("unexpected pg_range row %q", row)
+			}
+			if d, ok := multiranges[multi]; ok {
+				d.Elem = sub
+			}
+		}
+	}
+
+	if len(byRelid) > 0 {
+		rows, err = simpleQuery(s, loadFieldsQuery)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if len(row) != 3 {
+				return fmt.Errorf("unexpected pg_attribute row %q", row)
+			}
+			relid, err1 := parseOid(row[0])
+			typ, err2 := parseOid(row[2])
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("unexpected pg_attribute row %q", row)
+			}
+			if d, ok := byRelid[relid]; ok {
+				d.Fields = append(d.Fields, Field{row[1], typ})
+			}
+		}
+	}
+
+	for _, d := range descs {
+		r.Register(d)
+	}
+	return nil
+}
+
+func parseOid(s string) (proto.Oid, error) {
+	oid, err := strconv.ParseUint(s, 10, 32)
+	return proto.Oid(oid), err
+}
+
+// Run the query sql on s, returning the text of the values of the
+// rows, with NULLs as empty strings, or the ErrorResponse if the
+// query fails.
+func simpleQuery(s core.Stream, sql string) ([][]string, error) {
+	var m core.Message
+	proto.InitQuery(&m, sql)
+	if err := s.Send(&m); err != nil {
+		return nil, err
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	var queryErr error
+	for {
+		if err := s.Next(&m); err != nil {
+			return nil, err
+		}
+		switch m.MsgType() {
+		case proto.MsgDataRowD:
+			dr, err := proto.ReadDataRow(&m)
+			if err != nil {
+				return nil, err
+			}
+			row := make([]string, len(dr.Values))
+			for i, val := range dr.Values {
+				row[i] = string(val)
+			}
+			rows = append(rows, row)
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			queryErr = er
+		case proto.MsgReadyForQueryZ:
+			if err := m.Discard(); err != nil {
+				return nil, err
+			}
+			return rows, queryErr
+		default:
+			// RowDescription, CommandComplete, notices and the like
+			if err := m.Discard(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// DecodeRow decodes the values of a DataRow, each according to the
+// type and format of its column in fields, as read from the
+// preceding RowDescription. NULLs are decoded as nil.
+func DecodeRow(fields []proto.FieldDescription, row *proto.DataRow) ([]interface{}, error) {
+	if len(fields) != len(row.Values) {
+		return nil, fmt.Errorf("DataRow has %v values for %v columns",
+			len(row.Values), len(fields))
+	}
+	vals := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if row.Values[i] == nil {
+			continue
+		}
+		val, err := DecodeValue(row.Values[i], f.TypeOid, f.Format)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+// The descriptions of the built-in types, and their array types
+func builtinTypes() []TypeDesc {
+	base := func(oid proto.Oid, name string, category byte, size int16) TypeDesc {
+		return TypeDesc{Oid: oid, Name: name, Kind: KindBase,
+			Category: category, Len: size}
+	}
+	types := []TypeDesc{
+		base(proto.OidBool, "bool", 'B', 1),
+		base(proto.OidBytea, "bytea", 'U', -1),
+		base(proto.OidChar, "char", 'Z', 1),
+		base(proto.OidName, "name", 'S', 64),
+		base(proto.OidInt8, "int8", 'N', 8),
+		base(proto.OidInt2, "int2", 'N', 2),
+		base(proto.OidInt4, "int4", 'N', 4),
+		base(proto.OidText, "text", 'S', -1),
+		base(proto.OidOid, "oid", 'N', 4),
+		base(proto.OidJson, "json", 'U', -1),
+		base(proto.OidXml, "xml", 'U', -1),
+		base(proto.OidPoint, "point", 'G', 16),
+		base(proto.OidFloat4, "float4", 'N', 4),
+		base(proto.OidFloat8, "float8", 'N', 8),
+		base(proto.OidUnknown, "unknown", 'X', -2),
+		base(proto.OidMoney, "money", 'N', 8),
+		base(proto.OidMacaddr, "macaddr", 'U', 6),
+		base(proto.OidMacaddr8, "macaddr8", 'U', 8),
+		base(proto.OidInet, "inet", 'I', -1),
+		base(proto.OidCidr, "cidr", 'I', -1),
+		base(proto.OidBpchar, "bpchar", 'S', -1),
+		base(proto.OidVarchar, "varchar", 'S', -1),
+		base(proto.OidDate, "date", 'D', 4),
+		base(proto.OidTime, "time", 'D', 8),
+		base(proto.OidTimestamp, "timestamp", 'D', 8),
+		base(proto.OidTimestamptz, "timestamptz", 'D', 8),
+		base(proto.OidInterval, "interval", 'T', 16),
+		base(proto.OidTimetz, "timetz", 'D', 12),
+		base(proto.OidBit, "bit", 'V', -1),
+		base(proto.OidVarbit, "varbit", 'V', -1),
+		base(proto.OidNumeric, "numeric", 'N', -1),
+		base(proto.OidUuid, "uuid", 'U', 16),
+		base(proto.OidJsonb, "jsonb", 'U', -1),
+		{Oid: proto.OidRecord, Name: "record", Kind: KindPseudo,
+			Category: 'P', Len: -1},
+		{Oid: proto.OidCstring, Name: "cstring", Kind: KindPseudo,
+			Category: 'P', Len: -2},
+	}
+	ranges := []struct {
+		sub  proto.Oid
+		name string
+	}{
+		{proto.OidInt4, "int4"},
+		{proto.OidNumeric, "num"},
+		{proto.OidTimestamp, "ts"},
+		{proto.OidTimestamptz, "tstz"},
+		{proto.OidDate, "date"},
+		{proto.OidInt8, "int8"},
+	}
+	for _, rng := range ranges {
+		types = append(types,
+			TypeDesc{Oid: proto.RangeType(rng.sub), Name: rng.name + "range",
+				Kind: KindRange, Category: 'R', Len: -1, Elem: rng.sub},
+			TypeDesc{Oid: proto.MultirangeType(rng.sub),
+				Name: rng.name + "multirange", Kind: KindMultirange,
+				Category: 'R', Len: -1, Elem: rng.sub})
+	}
+	for _, d := range types {
+		if array := proto.ArrayType(d.Oid); array != 0 {
+			types = append(types, TypeDesc{Oid: array, Name: "_" + d.Name,
+				Kind: KindBase, Category: categoryArray, Len: -1, Elem: d.Oid})
+		}
+	}
+	return types
+}
@@ -0,0 +1,196 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// A fake backend that answers each simple query with the given rows,
+// or with an error if it has none for the query
+func serveCatalog(conn net.Conn, results map[string][][]string) {
+	be := core.NewBackendStream(conn)
+	defer be.Close()
+	var m core.Message
+	for {
+		if err := be.Next(&m); err != nil {
+			return
+		}
+		q, err := proto.ReadQuery(&m)
+		if err != nil {
+			return
+		}
+		rows, ok := results[q.Query]
+		if !ok {
+			proto.InitErrorResponse(&m, map[byte]string{
+				'S': "ERROR", 'C': "42P01", 'M': "no such catalog",
+			})
+			be.Send(&m)
+		}
+		for _, row := range rows {
+			vals := make([][]byte, len(row))
+			for i, val := range row {
+				var b bytes.Buffer
+				EncodeValue(&b, val, proto.EncFmtTxt)
+				vals[i] = b.Bytes()
+			}
+			proto.InitDataRow(&m, vals)
+			be.Send(&m)
+		}
+		if ok {
+			proto.InitCommandComplete(&m, "SELECT")
+			be.Send(&m)
+		}
+		proto.InitReadyForQuery(&m, proto.RfqIdle)
+		be.Send(&m)
+	}
+}
+
+func TestRegistryLoad(t *testing.T) {
+	feConn, beConn := net.Pipe()
+	go serveCatalog(beConn, map[string][][]string{
+		loadTypesQuery: {
+			{"16500", "citext", "b", "S", "-1", "0", "0"},
+			{"16501", "mood", "e", "E", "4", "0", "0"},
+			{"16502", "posint", "d", "N", "4", "23", "0"},
+			{"16503", "item", "c", "C", "-1", "0", "16504"},
+			{"16505", "_item", "b", "A", "-1", "16503", "0"},
+			{"16506", "hstore", "b", "U", "-1", "0", "0"},
+			{"16507", "floatrange", "r", "R", "-1", "701", "0"},
+			{"16508", "floatmultirange", "m", "R", "-1", "0", "0"},
+		},
+		loadMultirangesQuery: {{"16508", "701"}},
+		loadFieldsQuery: {
+			{"16504", "id", "16502"},
+			{"16504", "tags", "1009"},
+			{"16504", "attrs", "16506"},
+		},
+	})
+	fe := core.NewBackendStream(feConn)
+	defer fe.Close()
+
+	r := NewRegistry()
+	if err := r.Load(fe); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := r.LookupName("item"); !ok || !reflect.DeepEqual(d.Fields,
+		[]Field{{"id", 16502}, {"tags", proto.OidTextArray}, {"attrs", 16506}}) {
+		t.Errorf("got %#v", d)
+	}
+	if d, _ := r.Lookup(16508); d.Elem != proto.OidFloat8 {
+		t.Errorf("got multirange subtype %v", d.Elem)
+	}
+	if size := r.TypSize(16502); size != 4 {
+		t.Errorf("got size %v for posint", size)
+	}
+	if f := r.NewField("n", proto.OidInt8); f.TypLen != 8 {
+		t.Errorf("got %#v", f)
+	}
+
+	// Decode and Encode go through DefaultRegistry
+	saved := DefaultRegistry
+	DefaultRegistry = r
+	defer func() { DefaultRegistry = saved }()
+
+	one := "1"
+	tests := []struct {
+		text string
+		typ  proto.Oid
+		want interface{}
+	}{
+		{"Hello", 16500, "Hello"},
+		{"happy", 16501, "happy"},
+		{"5", 16502, int64(5)},
+		{`{"(5,{a},\"\\\"k\\\"=>NULL\")","(6,{},)"}`, 16505, Array{
+			Elem: 16503,
+			Dims: []ArrayDim{{2, 1}},
+			Elems: []interface{}{
+				Composite{
+					Fields: r.types[16503].Fields,
+					Values: []interface{}{int64(5), Array{
+						Elem:  proto.OidText,
+						Dims:  []ArrayDim{{1, 1}},
+						Elems: []interface{}{"a"},
+					}, Hstore{"k": nil}},
+				},
+				Composite{
+					Fields: r.types[16503].Fields,
+					Values: []interface{}{int64(6),
+						Array{Elem: proto.OidText}, nil},
+				},
+			},
+		}},
+		{`"a"=>"1"`, 16506, Hstore{"a": &one}},
+		{"[1.5,2)", 16507, Range{Lower: 1.5, Upper: float64(2), LowerInc: true}},
+		{"{(,0)}", 16508, Multirange{{Upper: float64(0)}}},
+	}
+	for _, test := range tests {
+		got, err := Decode([]byte(test.text), test.typ)
+		if err != nil {
+			t.Errorf("decoding %q: %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decoding %q: got %#v; want %#v", test.text, got, test.want)
+		}
+		for _, format := range []proto.EncFmt{proto.EncFmtTxt, proto.EncFmtBinary} {
+			var b bytes.Buffer
+			if err := EncodeTypedValue(&b, got, test.typ, format); err != nil {
+				t.Errorf("encoding %#v: %v", got, err)
+				continue
+			}
+			again, err := DecodeValue(b.Bytes()[4:], test.typ, format)
+			if err != nil {
+				t.Errorf("decoding %q: %v", b.Bytes()[4:], err)
+				continue
+			}
+			// binary composites carry no field names, so they
+			// only round-trip through text
+			if format == proto.EncFmtTxt && !reflect.DeepEqual(again, got) {
+				t.Errorf("round trip of %q: got %#v", test.text, again)
+			}
+		}
+	}
+
+	if err := r.Load(fe); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simpleQuery(fe, "SELECT nothing"); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*proto.ErrorResponse); !ok {
+		t.Errorf("got %T; want an ErrorResponse", err)
+	}
+}
+
+func TestDecodeRow(t *testing.T) {
+	fields := []proto.FieldDescription{
+		*NewRegistry().NewField("a", proto.OidInt4),
+		*NewRegistry().NewField("b", proto.OidText),
+		{Name: "c", TypeOid: proto.OidBool, Format: proto.EncFmtBinary},
+	}
+	row := &proto.DataRow{Values: [][]byte{[]byte("42"), nil, {1}}}
+	got, err := DecodeRow(fields, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(42), nil, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+	if _, err := DecodeRow(fields[:2], row); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestBuiltinTypSize(t *testing.T) {
+	for _, d := range builtinTypes() {
+		if d.Kind != KindBase && d.Kind != KindPseudo {
+			continue
+		}
+		if size := proto.TypSize(d.Oid); size != d.Len {
+			t.Errorf("got size %v for %v; want %v", size, d.Name, d.Len)
+		}
+	}
+}
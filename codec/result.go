@@ -0,0 +1,286 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"strings"
+)
+
+// ResultReader reads the result of a query, as a RowDescription,
+// DataRows and a CommandComplete, and decodes its rows.
+//
+// Messages can be fed to it one at a time with Accept, as in a proxy,
+// or it can read them from a stream itself with Next. Either way,
+// after each DataRow the row can be had with Values, Map or Scan.
+type ResultReader struct {
+	// The columns of the result, once its RowDescription has been
+	// read
+	Fields []proto.FieldDescription
+	// The CommandComplete ending the result, once read
+	Complete *proto.CommandComplete
+
+	row  *proto.DataRow
+	vals []interface{}
+}
+
+// SetFormats sets the formats of the columns from the result format
+// codes of a Bind message: none for all text, one for all columns,
+// or one per column. This is needed when the RowDescription came
+// from a Describe of a statement rather than of a portal, since that
+// reports all columns as text.
+func (r *ResultReader) SetFormats(formats []proto.EncFmt) error {
+	formats, err := columnFormats(formats, len(r.Fields))
+	if err != nil {
+		return err
+	}
+	for i := range r.Fields {
+		r.Fields[i].Format = formats[i]
+	}
+	return nil
+}
+
+// Accept reads m, if it is part of a result, and returns whether it
+// was a DataRow. Other messages are left unread. Reading consumes the
+// payload of an unbuffered message, so a proxy that also forwards m
+// should Force it first.
+func (r *ResultReader) Accept(m *core.Message) (bool, error) {
+	switch m.MsgType() {
+	case proto.MsgRowDescriptionT:
+		rd, err := proto.ReadRowDescription(m)
+		if err != nil {
+			return false, err
+		}
+		r.Fields = rd.Fields
+		r.Complete = nil
+	case proto.MsgDataRowD:
+		row, err := proto.ReadDataRow(m)
+		if err != nil {
+			return false, err
+		}
+		if r.Fields == nil {
+			return false, fmt.Errorf("DataRow without a RowDescription")
+		}
+		r.row = row
+		r.vals = nil
+		return true, nil
+	case proto.MsgCommandCompleteC:
+		cc, err := proto.ReadCommandComplete(m)
+		if err != nil {
+			return false, err
+		}
+		r.Complete = cc
+		r.row = nil
+	}
+	return false, nil
+}
+
+// Next reads messages from s up to the next row of the result, and
+// returns whether there is one. It returns false once it has read the
+// CommandComplete or an EmptyQueryResponse; an ErrorResponse is
+// returned as an error. Messages that may come before or among the
+// rows, such as BindComplete or NoticeResponse, are skipped. When a
+// RowDescription is expected, it should already have been read, or
+// be the next message (a portal executed in the extended protocol
+// has its RowDescription read with Accept after a Describe).
+func (r *ResultReader) Next(s core.Stream) (bool, error) {
+	var m core.Message
+	for {
+		if err := s.Next(&m); err != nil {
+			return false, err
+		}
+		switch m.MsgType() {
+		case proto.MsgRowDescriptionT:
+			if _, err := r.Accept(&m); err != nil {
+				return false, err
+			}
+		case proto.MsgDataRowD, proto.MsgCommandCompleteC:
+			return r.Accept(&m)
+		case proto.MsgEmptyQueryResponseI:
+			return false, m.Discard()
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return false, err
+			}
+			return false, er
+		case proto.MsgReadyForQueryZ:
+			return false, fmt.Errorf("unexpected ReadyForQuery in result")
+		default:
+			if err := m.Discard(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// Values returns the decoded values of the current row, with NULLs
+// as nil.
+func (r *ResultReader) Values() ([]interface{}, error) {
+	if r.row == nil {
+		return nil, fmt.Errorf("no current row")
+	}
+	if r.vals == nil {
+		vals, err := DecodeRow(r.Fields, r.row)
+		if err != nil {
+			return nil, err
+		}
+		r.vals = vals
+	}
+	return r.vals, nil
+}
+
+// Map returns the decoded values of the current row by column name.
+// If several columns share a name, the last one wins.
+func (r *ResultReader) Map() (map[string]interface{}, error) {
+	vals, err := r.Values()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(vals))
+	for i, f := range r.Fields {
+		m[f.Name] = vals[i]
+	}
+	return m, nil
+}
+
+// Scan stores the current row in dst, which must be a pointer to a
+// []interface{}, a map[string]interface{} or a struct. Each column
+// goes to the struct field whose `femebe:"name"` tag gives its name,
+// or failing that, the field whose name matches it ignoring case;
+// fields tagged `femebe:"-"` and columns with no field are skipped.
+// Values are converted to the type of the field where that loses
+// nothing, such as an int64 to an int32 in range. NULLs can only be
+// stored in pointer, interface, slice and map fields, and set them
+// to nil; pointer fields are otherwise set to point to the value.
+func (r *ResultReader) Scan(dst interface{}) error {
+	vals, err := r.Values()
+	if err != nil {
+		return err
+	}
+	switch d := dst.(type) {
+	case *[]interface{}:
+		*d = append((*d)[:0], vals...)
+		return nil
+	case *map[string]interface{}:
+		m, err := r.Map()
+		if err != nil {
+			return err
+		}
+		*d = m
+		return nil
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Can't scan into %T", dst)
+	}
+	v = v.Elem()
+	fields := structFields(v.Type())
+	for i, f := range r.Fields {
+		idx, ok := fields[f.Name]
+		if !ok {
+			idx, ok = fields[strings.ToLower(f.Name)]
+		}
+		if !ok {
+			continue
+		}
+		if err := assign(v.Field(idx), vals[i]); err != nil {
+			return fmt.Errorf("Can't scan column %v into field %v: %v",
+				f.Name, v.Type().Field(idx).Name, err)
+		}
+	}
+	return nil
+}
+
+// The indexes of the exported fields of the struct type t, by tag
+// name, and by field name in lower case
+func structFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int, t.NumField())
+	byName := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		switch tag := f.Tag.Get("femebe"); tag {
+		case "-":
+		case "":
+			byName[strings.ToLower(f.Name)] = i
+		default:
+			fields[tag] = i
+		}
+	}
+	for name, i := range byName {
+		if _, ok := fields[name]; !ok {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// Store the decoded value val in the field dst.
+func assign(dst reflect.Value, val interface{}) error {
+	if val == nil {
+		switch dst.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			dst.Set(reflect.Zero(dst.Type()))
+			return nil
+		}
+		return fmt.Errorf("NULL into %v", dst.Type())
+	}
+	if dst.Kind() == reflect.Ptr {
+		p := reflect.New(dst.Type().Elem())
+		if err := assign(p.Elem(), val); err != nil {
+			return err
+		}
+		dst.Set(p)
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(dst.Type()) {
+		dst.Set(v)
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := toInt(val, 64)
+		if ok && !dst.OverflowInt(i) {
+			dst.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		i, ok := toInt(val, 64)
+		if ok && i >= 0 && !dst.OverflowUint(uint64(i)) {
+			dst.SetUint(uint64(i))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toFloat(val); ok {
+			dst.SetFloat(f)
+			return nil
+		}
+	case reflect.String:
+		switch v := val.(type) {
+		case []byte:
+			dst.SetString(string(v))
+			return nil
+		case fmt.Stringer:
+			dst.SetString(v.String())
+			return nil
+		}
+	case reflect.Slice:
+		if s, ok := val.(string); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes([]byte(s))
+			return nil
+		}
+	}
+	if v.Type().ConvertibleTo(dst.Type()) && v.Kind() == dst.Kind() {
+		dst.Set(v.Convert(dst.Type()))
+		return nil
+	}
+	return fmt.Errorf("%T into %v", val, dst.Type())
+}
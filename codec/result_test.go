@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A stream that reads the given messages
+type msgBuffer struct {
+	bytes.Buffer
+}
+
+func (b *msgBuffer) Close() error { return nil }
+
+func streamOf(msgs ...*core.Message) core.Stream {
+	var b msgBuffer
+	for _, m := range msgs {
+		m.WriteTo(&b)
+	}
+	return core.NewBackendStream(&b)
+}
+
+func encodeRow(t *testing.T, format proto.EncFmt, vals ...interface{}) *core.Message {
+	encoded := make([][]byte, len(vals))
+	for i, val := range vals {
+		var b bytes.Buffer
+		if err := EncodeValue(&b, val, format); err != nil {
+			t.Fatal(err)
+		}
+		encoded[i] = b.Bytes()
+	}
+	var m core.Message
+	proto.InitDataRow(&m, encoded)
+	return &m
+}
+
+type account struct {
+	ID      int32 `femebe:"id"`
+	Name    string
+	Balance *float64
+	Created time.Time `femebe:"created_at"`
+	Note    string    `femebe:"-"`
+	hidden  string
+}
+
+func TestResultReader(t *testing.T) {
+	var rd, cc, notice, rfq core.Message
+	proto.InitRowDescription(&rd, []proto.FieldDescription{
+		*proto.NewField("id", proto.OidInt4),
+		*proto.NewField("NAME", proto.OidText),
+		*proto.NewField("balance", proto.OidFloat8),
+		*proto.NewField("created_at", proto.OidTimestamptz),
+		*proto.NewField("note", proto.OidText),
+	})
+	proto.InitCommandComplete(&cc, "SELECT 2")
+	proto.InitNoticeResponse(&notice, map[byte]string{'M': "hi"})
+	proto.InitReadyForQuery(&rfq, proto.RfqIdle)
+	created := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := streamOf(&rd,
+		encodeRow(t, proto.EncFmtTxt, int32(1), "alice", 2.5, created, "x"),
+		&notice,
+		encodeRow(t, proto.EncFmtTxt, int32(2), "bob", nil, created, nil),
+		&cc, &rfq)
+
+	var r ResultReader
+	var got []account
+	for {
+		ok, err := r.Next(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		a := account{Note: "kept", hidden: "kept"}
+		if err := r.Scan(&a); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, a)
+	}
+	balance := 2.5
+	want := []account{
+		{1, "alice", &balance, created, "kept", "kept"},
+		{2, "bob", nil, created, "kept", "kept"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %#v; want %#v", got, want)
+	}
+	for i, a := range got {
+		w := want[i]
+		if a.ID != w.ID || a.Name != w.Name || !a.Created.Equal(w.Created) ||
+			a.Note != w.Note || a.hidden != w.hidden ||
+			(a.Balance == nil) != (w.Balance == nil) ||
+			(a.Balance != nil && *a.Balance != *w.Balance) {
+			t.Errorf("got %#v; want %#v", a, w)
+		}
+	}
+	if r.Complete == nil || r.Complete.AffectedCount != 2 {
+		t.Errorf("got CommandComplete %#v", r.Complete)
+	}
+}
+
+func TestResultReaderAccept(t *testing.T) {
+	var r ResultReader
+	var rd core.Message
+	proto.InitRowDescription(&rd, []proto.FieldDescription{
+		*proto.NewField("n", proto.OidInt8),
+		*proto.NewField("s", proto.OidText),
+	})
+	if ok, err := r.Accept(&rd); ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if err := r.SetFormats([]proto.EncFmt{proto.EncFmtBinary}); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := r.Accept(encodeRow(t, proto.EncFmtBinary, int64(7), nil))
+	if !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+
+	var vals []interface{}
+	if err := r.Scan(&vals); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(7), nil}; !reflect.DeepEqual(vals, want) {
+		t.Errorf("got %#v; want %#v", vals, want)
+	}
+	var m map[string]interface{}
+	if err := r.Scan(&m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"n": int64(7), "s": nil}; !reflect.DeepEqual(m, want) {
+		t.Errorf("got %#v; want %#v", m, want)
+	}
+
+	var small struct{ N int8 }
+	if err := r.Scan(&small); err != nil || small.N != 7 {
+		t.Errorf("got %v, %v", small.N, err)
+	}
+	var notNull struct{ S string }
+	if err := r.Scan(&notNull); err == nil {
+		t.Errorf("expected an error scanning NULL into a string")
+	}
+	var wrong struct{ N time.Time }
+	if err := r.Scan(&wrong); err == nil {
+		t.Errorf("expected an error scanning an int into a time")
+	}
+	if err := r.Scan(small); err == nil {
+		t.Errorf("expected an error scanning into a non-pointer")
+	}
+	if err := r.SetFormats(make([]proto.EncFmt, 3)); err == nil {
+		t.Errorf("expected an error for too many formats")
+	}
+}
+
+func TestResultReaderError(t *testing.T) {
+	var er core.Message
+	proto.InitErrorResponse(&er, map[byte]string{'S': "ERROR", 'M': "oops"})
+	var r ResultReader
+	if _, err := r.Next(streamOf(&er)); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*proto.ErrorResponse); !ok {
+		t.Errorf("got %T; want an ErrorResponse", err)
+	}
+	if _, err := r.Values(); err == nil {
+		t.Errorf("expected an error with no current row")
+	}
+}
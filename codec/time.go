@@ -0,0 +1,250 @@
+package codec
+
+import (
+	"fmt"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The times the special date and timestamp values infinity and
+// -infinity decode to. They lie just outside the range Postgres can
+// store, and any time.Time at or beyond them encodes as infinity or
+// -infinity again.
+var (
+	InfinityTime         = time.Date(294277, 1, 1, 0, 0, 0, 0, time.UTC)
+	NegativeInfinityTime = time.Date(-4713, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Whether t stands for infinity (1), -infinity (-1), or neither (0)
+func infinity(t time.Time) int {
+	if !t.Before(InfinityTime) {
+		return 1
+	}
+	if !t.After(NegativeInfinityTime) {
+		return -1
+	}
+	return 0
+}
+
+// Parse a number of exactly n digits, or at least n if atLeast is
+// set, from the start of s, returning the rest.
+func parseDigits(s string, n int, atLeast bool) (int, string, bool) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' && (atLeast || i < n) {
+		i++
+	}
+	if i < n {
+		return 0, s, false
+	}
+	v, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, s, false
+	}
+	return v, s[i:], true
+}
+
+// Parse "YYYY-MM-DD", where the year may have more digits.
+func parseDate(s string) (y, m, d int, rest string, ok bool) {
+	if y, s, ok = parseDigits(s, 4, true); !ok || !strings.HasPrefix(s, "-") {
+		return 0, 0, 0, s, false
+	}
+	if m, s, ok = parseDigits(s[1:], 2, false); !ok ||
+		!strings.HasPrefix(s, "-") {
+		return 0, 0, 0, s, false
+	}
+	if d, s, ok = parseDigits(s[1:], 2, false); !ok {
+		return 0, 0, 0, s, false
+	}
+	return y, m, d, s, true
+}
+
+// Parse "HH:MM:SS[.ffffff]" into the time since midnight.
+func parseClock(s string) (time.Duration, string, bool) {
+	h, s, ok := parseDigits(s, 2, false)
+	if !ok || !strings.HasPrefix(s, ":") {
+		return 0, s, false
+	}
+	m, s, ok := parseDigits(s[1:], 2, false)
+	if !ok || !strings.HasPrefix(s, ":") {
+		return 0, s, false
+	}
+	sec, s, ok := parseDigits(s[1:], 2, false)
+	if !ok {
+		return 0, s, false
+	}
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second
+	if strings.HasPrefix(s, ".") {
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		frac := s[1:i]
+		if frac == "" || len(frac) > 9 {
+			return 0, s, false
+		}
+		nanos, _ := strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+		d += time.Duration(nanos)
+		s = s[i:]
+	}
+	return d, s, true
+}
+
+// Parse a UTC offset of the form "+HH[:MM[:SS]]" into seconds east
+// of UTC.
+func parseOffset(s string) (int, string, bool) {
+	if s == "" || (s[0] != '+' && s[0] != '-') {
+		return 0, s, false
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	offset := 0
+	rest := s[1:]
+	for i, unit := range []int{3600, 60, 1} {
+		if i > 0 {
+			if !strings.HasPrefix(rest, ":") {
+				break
+			}
+			rest = rest[1:]
+		}
+		n, r, ok := parseDigits(rest, 2, false)
+		if !ok {
+			return 0, s, false
+		}
+		offset += n * unit
+		rest = r
+	}
+	return sign * offset, rest, true
+}
+
+// DecodeTime parses the text output of a value of one of the date and
+// time types: date, time, timetz, timestamp and timestamptz. It
+// understands the ISO DateStyle, fractional seconds, BC dates and
+// years past 9999, and infinity and -infinity for dates and
+// timestamps, which are returned as InfinityTime and
+// NegativeInfinityTime. Values without a time zone are returned in
+// UTC; times without a date are on January 1 of year 0.
+func DecodeTime(s []byte, typ proto.Oid) (time.Time, error) {
+	str := string(s)
+	fail := func() (time.Time, error) {
+		return time.Time{}, e.Decode("could not parse %q as type %v", str, typ)
+	}
+	hasDate := typ == proto.OidDate || typ == proto.OidTimestamp ||
+		typ == proto.OidTimestamptz
+	hasClock := typ != proto.OidDate
+	hasZone := typ == proto.OidTimetz || typ == proto.OidTimestamptz
+	if !hasDate && !hasClock {
+		return fail()
+	}
+	if hasDate {
+		switch str {
+		case "infinity":
+			return InfinityTime, nil
+		case "-infinity":
+			return NegativeInfinityTime, nil
+		}
+	}
+
+	rest := str
+	bc := false
+	if hasDate && strings.HasSuffix(rest, " BC") {
+		bc = true
+		rest = rest[:len(rest)-3]
+	}
+	y, m, d := 0, 1, 1
+	var ok bool
+	if hasDate {
+		if y, m, d, rest, ok = parseDate(rest); !ok {
+			return fail()
+		}
+		if bc {
+			// there is no year 0 AD: 1 BC is year 0
+			y = 1 - y
+		}
+	}
+	var clock time.Duration
+	if hasClock {
+		if hasDate {
+			if !strings.HasPrefix(rest, " ") {
+				return fail()
+			}
+			rest = rest[1:]
+		}
+		if clock, rest, ok = parseClock(rest); !ok {
+			return fail()
+		}
+	}
+	loc := time.UTC
+	if hasZone {
+		var offset int
+		if offset, rest, ok = parseOffset(rest); !ok {
+			return fail()
+		}
+		loc = time.FixedZone("", offset)
+	}
+	if rest != "" || m < 1 || m > 12 || d < 1 || d > 31 {
+		return fail()
+	}
+	return time.Date(y, time.Month(m), d, 0, 0, 0, 0, loc).Add(clock), nil
+}
+
+// FormatTime formats t as the text input of a value of type typ,
+// one of the date and time types. Times of a day are formatted in
+// t's location; timestamptz values keep its offset.
+func FormatTime(t time.Time, typ proto.Oid) string {
+	if typ == proto.OidDate || typ == proto.OidTimestamp ||
+		typ == proto.OidTimestamptz {
+		switch infinity(t) {
+		case 1:
+			return "infinity"
+		case -1:
+			return "-infinity"
+		}
+	}
+
+	var s string
+	y := t.Year()
+	bc := y <= 0
+	if bc {
+		y = 1 - y
+	}
+	date := fmt.Sprintf("%04d-%02d-%02d", y, t.Month(), t.Day())
+	switch typ {
+	case proto.OidDate:
+		s = date
+	case proto.OidTime, proto.OidTimetz:
+		s = t.Format("15:04:05.999999")
+	default:
+		s = date + " " + t.Format("15:04:05.999999")
+	}
+	if typ == proto.OidTimetz || typ == proto.OidTimestamptz {
+		_, offset := t.Zone()
+		sign := '+'
+		if offset < 0 {
+			sign = '-'
+			offset = -offset
+		}
+		s += fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset/60%60)
+		if offset%60 != 0 {
+			s += fmt.Sprintf(":%02d", offset%60)
+		}
+	}
+	if bc && typ != proto.OidTime && typ != proto.OidTimetz {
+		s += " BC"
+	}
+	return s
+}
+
+// The binary forms of infinity and -infinity
+const (
+	dateInfinity         = math.MaxInt32
+	dateNegativeInfinity = math.MinInt32
+	timestampInfinity    = math.MaxInt64
+	timestampNegInfinity = math.MinInt64
+)
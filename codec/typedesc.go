@@ -0,0 +1,167 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+)
+
+// TypeKind is the kind of a Postgres type, as in pg_type.typtype.
+type TypeKind byte
+
+const (
+	KindBase       TypeKind = 'b'
+	KindComposite  TypeKind = 'c'
+	KindDomain     TypeKind = 'd'
+	KindEnum       TypeKind = 'e'
+	KindPseudo     TypeKind = 'p'
+	KindRange      TypeKind = 'r'
+	KindMultirange TypeKind = 'm'
+)
+
+// The pg_type.typcategory of array and string types
+const (
+	categoryArray  = 'A'
+	categoryString = 'S'
+)
+
+// TypeDesc describes a Postgres type, as found in the pg_type,
+// pg_range and pg_attribute catalogs, so that values of types the
+// codec does not know, such as user-defined composites, can be
+// encoded and decoded.
+type TypeDesc struct {
+	Oid  proto.Oid
+	Name string
+	Kind TypeKind
+	// The pg_type.typcategory, such as 'A' for arrays
+	Category byte
+	// The size in bytes (pg_type.typlen), -1 for variable-length
+	// types and -2 for null-terminated ones
+	Len int16
+	// The element type of an array (pg_type.typelem), the subtype
+	// of a range or multirange (pg_range.rngsubtype) or the base
+	// type of a domain (pg_type.typbasetype)
+	Elem proto.Oid
+	// The attributes of a composite type, in order
+	Fields []Field
+}
+
+// Field is an attribute of a composite type.
+type Field struct {
+	Name string
+	Type proto.Oid
+}
+
+func (d TypeDesc) String() string {
+	return fmt.Sprintf("%v (%v)", d.Name, d.Oid)
+}
+
+// Whether values of type d need more than the codec for the type's
+// own oid: those of all but base and pseudo-types, arrays, types
+// in the string category, such as citext, which are decoded as
+// strings, and hstore.
+func (d TypeDesc) special() bool {
+	switch {
+	case d.Kind != KindBase && d.Kind != KindPseudo:
+		return true
+	case d.Category == categoryArray, d.Category == categoryString:
+		return true
+	}
+	return d.Name == "hstore"
+}
+
+// Describe the Go type values of type d decode to
+func (d TypeDesc) describe() string {
+	switch {
+	case d.Kind == KindComposite:
+		return "codec.Composite"
+	case d.Kind == KindRange:
+		return "codec.Range"
+	case d.Kind == KindMultirange:
+		return "codec.Multirange"
+	case d.Kind == KindDomain:
+		return DescribeType(d.Elem)
+	case d.Kind == KindEnum, d.Category == categoryString:
+		return "string"
+	case d.Category == categoryArray:
+		return "codec.Array"
+	case d.Name == "hstore":
+		return "codec.Hstore"
+	}
+	return "unknown"
+}
+
+// Decode decodes s, a value of the type d in the given format.
+func (d TypeDesc) Decode(s []byte, format proto.EncFmt) (interface{}, error) {
+	binary := format == proto.EncFmtBinary
+	switch {
+	case d.Kind == KindComposite && binary:
+		return DecodeBinaryComposite(s)
+	case d.Kind == KindComposite:
+		return DecodeComposite(s, d.Fields)
+	case d.Kind == KindRange && binary:
+		return DecodeBinaryRange(s, d.Elem)
+	case d.Kind == KindRange:
+		return DecodeRange(s, d.Elem)
+	case d.Kind == KindMultirange && binary:
+		return DecodeBinaryMultirange(s, d.Elem)
+	case d.Kind == KindMultirange:
+		return DecodeMultirange(s, d.Elem)
+	case d.Kind == KindDomain:
+		return DecodeValue(s, d.Elem, format)
+	case d.Kind == KindEnum:
+		return string(s), nil
+	case d.Category == categoryArray && binary:
+		return DecodeBinaryArray(s)
+	case d.Category == categoryArray:
+		return DecodeArray(s, d.Elem)
+	case d.Category == categoryString:
+		return string(s), nil
+	case d.Name == "hstore" && binary:
+		return DecodeBinaryHstore(s)
+	case d.Name == "hstore":
+		return DecodeHstore(s)
+	}
+	return DecodeValue(s, d.Oid, format)
+}
+
+// Encode writes val to buff as a value of the type d in the given
+// format, preceded by its length.
+func (d TypeDesc) Encode(buff *bytes.Buffer, val interface{},
+	format proto.EncFmt) error {
+	if val == nil {
+		return EncodeTypedValue(buff, nil, d.Oid, format)
+	}
+	switch {
+	case d.Kind == KindComposite:
+		c, ok := val.(Composite)
+		if !ok {
+			return fmt.Errorf("Can't encode value %#v of type %T as type %v",
+				val, val, d)
+		}
+		if c.Fields == nil {
+			c.Fields = d.Fields
+		}
+		return encodeComposite(buff, c, format)
+	case d.Kind == KindRange:
+		return encodeRange(buff, val, d.Elem, format)
+	case d.Kind == KindMultirange:
+		return encodeMultirange(buff, val, d.Elem, format)
+	case d.Kind == KindDomain:
+		return EncodeTypedValue(buff, val, d.Elem, format)
+	case d.Kind == KindEnum:
+		return EncodeTypedValue(buff, val, proto.OidText, format)
+	case d.Category == categoryArray:
+		return encodeArray(buff, val, d.Elem, format)
+	case d.Category == categoryString:
+		return EncodeTypedValue(buff, val, proto.OidText, format)
+	case d.Name == "hstore":
+		h, ok := val.(Hstore)
+		if !ok {
+			return fmt.Errorf("Can't encode value %#v of type %T as type %v",
+				val, val, d)
+		}
+		return encodeHstore(buff, h, format)
+	}
+	return EncodeTypedValue(buff, val, d.Oid, format)
+}
@@ -0,0 +1,445 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Interval is a Postgres interval. Postgres keeps months, days and
+// smaller units apart, since their lengths vary: a month is not
+// always 30 days, nor a day always 24 hours.
+type Interval struct {
+	Months       int32
+	Days         int32
+	Microseconds int64
+}
+
+// String formats the interval like Postgres does with the default
+// IntervalStyle, e.g. "1 year 2 mons 3 days 04:05:06.5".
+func (iv Interval) String() string {
+	var parts []string
+	unit := func(n int64, singular, plural string) {
+		if n == 1 || n == -1 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, singular))
+		} else if n != 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, plural))
+		}
+	}
+	unit(int64(iv.Months/12), "year", "years")
+	unit(int64(iv.Months%12), "mon", "mons")
+	unit(int64(iv.Days), "day", "days")
+	if iv.Microseconds != 0 || len(parts) == 0 {
+		micros := iv.Microseconds
+		sign := ""
+		if micros < 0 {
+			sign = "-"
+			micros = -micros
+		}
+		clock := fmt.Sprintf("%s%02d:%02d:%02d", sign, micros/3600000000,
+			micros/60000000%60, micros/1000000%60)
+		if frac := micros % 1000000; frac != 0 {
+			clock += strings.TrimRight(fmt.Sprintf(".%06d", frac), "0")
+		}
+		parts = append(parts, clock)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseInterval parses an interval in the format Postgres outputs
+// with the default IntervalStyle, as produced by Interval.String.
+func ParseInterval(s string) (Interval, error) {
+	var iv Interval
+	fail := func() (Interval, error) {
+		return Interval{}, e.Decode("could not parse %q as an interval", s)
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return fail()
+	}
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if strings.Contains(f, ":") {
+			if i != len(fields)-1 {
+				return fail()
+			}
+			neg := strings.HasPrefix(f, "-")
+			f = strings.TrimLeft(f, "+-")
+			parts := strings.Split(f, ":")
+			if len(parts) != 3 {
+				return fail()
+			}
+			h, err1 := strconv.ParseInt(parts[0], 10, 64)
+			m, err2 := strconv.ParseInt(parts[1], 10, 64)
+			sec, err3 := strconv.ParseFloat(parts[2], 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				return fail()
+			}
+			whole := int64(sec)
+			// parse the fraction as digits to avoid rounding
+			frac := int64(0)
+			if dot := strings.Index(parts[2], "."); dot >= 0 {
+				digits := (parts[2][dot+1:] + "000000")[:6]
+				frac, _ = strconv.ParseInt(digits, 10, 64)
+			}
+			micros := ((h*60+m)*60+whole)*1000000 + frac
+			if neg {
+				micros = -micros
+			}
+			iv.Microseconds = micros
+			continue
+		}
+		if i+1 >= len(fields) {
+			return fail()
+		}
+		n, err := strconv.ParseInt(f, 10, 32)
+		if err != nil {
+			return fail()
+		}
+		i++
+		switch fields[i] {
+		case "year", "years":
+			iv.Months += int32(n) * 12
+		case "mon", "mons":
+			iv.Months += int32(n)
+		case "day", "days":
+			iv.Days += int32(n)
+		default:
+			return fail()
+		}
+	}
+	return iv, nil
+}
+
+// UUID is a Postgres uuid.
+type UUID [16]byte
+
+// String formats the UUID in the usual hyphenated form.
+func (u UUID) String() string {
+	var b bytes.Buffer
+	for i, group := range [][]byte{u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]} {
+		if i > 0 {
+			b.WriteByte('-')
+		}
+		b.WriteString(hex.EncodeToString(group))
+	}
+	return b.String()
+}
+
+// ParseUUID parses a UUID in any of the forms Postgres accepts: with
+// or without hyphens between groups of four digits, and optionally in
+// braces.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	str := s
+	if strings.HasPrefix(str, "{") && strings.HasSuffix(str, "}") {
+		str = str[1 : len(str)-1]
+	}
+	var digits []byte
+	for i := 0; i < len(str); i++ {
+		if str[i] == '-' && len(digits) > 0 && len(digits)%4 == 0 &&
+			i+1 < len(str) && str[i+1] != '-' {
+			continue
+		}
+		digits = append(digits, str[i])
+	}
+	if len(digits) != 32 {
+		return u, e.Decode("could not parse %q as a uuid", s)
+	}
+	if _, err := hex.Decode(u[:], digits); err != nil {
+		return u, e.Decode("could not parse %q as a uuid", s)
+	}
+	return u, nil
+}
+
+// Numeric is an arbitrary-precision Postgres numeric: Int × 10^-Scale,
+// or one of the special values NaN, Infinity and -Infinity.
+type Numeric struct {
+	// The unscaled value; nil is zero
+	Int *big.Int
+	// The number of digits after the decimal point
+	Scale int16
+	NaN   bool
+	// 1 for Infinity, -1 for -Infinity and 0 otherwise
+	Inf int
+}
+
+// The digits of the absolute value of n, with the decimal point at
+// len(digits) - scale, where scale is not negative
+func (n Numeric) digits() (string, int) {
+	i := n.Int
+	if i == nil {
+		i = new(big.Int)
+	}
+	i = new(big.Int).Abs(i)
+	scale := int(n.Scale)
+	if scale < 0 {
+		i.Mul(i, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-scale)), nil))
+		scale = 0
+	}
+	return i.String(), scale
+}
+
+// Sign returns -1, 0 or 1 depending on the sign of n; NaN has sign 0.
+func (n Numeric) Sign() int {
+	switch {
+	case n.NaN:
+		return 0
+	case n.Inf != 0:
+		return n.Inf
+	case n.Int == nil:
+		return 0
+	}
+	return n.Int.Sign()
+}
+
+// String formats n like Postgres does, e.g. "-12.340".
+func (n Numeric) String() string {
+	switch {
+	case n.NaN:
+		return "NaN"
+	case n.Inf > 0:
+		return "Infinity"
+	case n.Inf < 0:
+		return "-Infinity"
+	}
+	digits, scale := n.digits()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	point := len(digits) - scale
+	s := digits[:point]
+	if scale > 0 {
+		s += "." + digits[point:]
+	}
+	if n.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+// Rat returns the value of n as a rational number, or nil if n is
+// NaN or infinite.
+func (n Numeric) Rat() *big.Rat {
+	if n.NaN || n.Inf != 0 {
+		return nil
+	}
+	digits, scale := n.digits()
+	r, _ := new(big.Rat).SetString(digits)
+	r.Quo(r, new(big.Rat).SetInt(
+		new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	if n.Sign() < 0 {
+		r.Neg(r)
+	}
+	return r
+}
+
+// ParseNumeric parses a decimal number, optionally with an exponent,
+// or NaN, Infinity or -Infinity.
+func ParseNumeric(s string) (Numeric, error) {
+	str := strings.TrimSpace(s)
+	switch strings.ToLower(str) {
+	case "nan":
+		return Numeric{NaN: true}, nil
+	case "infinity", "+infinity", "inf", "+inf":
+		return Numeric{Inf: 1}, nil
+	case "-infinity", "-inf":
+		return Numeric{Inf: -1}, nil
+	}
+	fail := func() (Numeric, error) {
+		return Numeric{}, e.Decode("could not parse %q as a numeric", s)
+	}
+
+	exp := 0
+	if i := strings.IndexAny(str, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(str[i+1:]); err != nil {
+			return fail()
+		}
+		str = str[:i]
+	}
+	neg := false
+	if str != "" && (str[0] == '-' || str[0] == '+') {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+	intPart, fracPart := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		intPart, fracPart = str[:i], str[i+1:]
+	}
+	digits := intPart + fracPart
+	if digits == "" {
+		return fail()
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return fail()
+		}
+	}
+	scale := len(fracPart) - exp
+	if scale < -32768 || scale > 32767 {
+		return fail()
+	}
+	i, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		i.Neg(i)
+	}
+	n := Numeric{Int: i, Scale: int16(scale)}
+	if scale < 0 {
+		// Postgres keeps no negative scales
+		digits, scale := n.digits()
+		n.Int, _ = new(big.Int).SetString(digits, 10)
+		if neg {
+			n.Int.Neg(n.Int)
+		}
+		n.Scale = int16(scale)
+	}
+	return n, nil
+}
+
+// Money is a Postgres money amount in the smallest unit of the
+// currency, such as cents. Postgres formats money according to its
+// lc_monetary setting; the codec assumes two decimal places.
+type Money int64
+
+// String formats m as a plain number, which Postgres accepts as
+// money input whatever its locale.
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+	}
+	abs := uint64(v)
+	if v < 0 {
+		abs = uint64(-v)
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, abs/100, abs%100)
+}
+
+// ParseMoney parses a money amount as Postgres outputs it, ignoring
+// currency symbols and thousands separators: "$1,234.56",
+// "-$1.00" and "($1.00)" are all understood.
+func ParseMoney(s string) (Money, error) {
+	neg := false
+	var digits []byte
+	fracDigits := -1
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+			if fracDigits >= 0 {
+				fracDigits++
+			}
+		case c == '.':
+			if fracDigits >= 0 {
+				return 0, e.Decode("could not parse %q as money", s)
+			}
+			fracDigits = 0
+		case c == '-' || c == '(':
+			neg = true
+		}
+	}
+	if len(digits) == 0 || fracDigits > 2 {
+		return 0, e.Decode("could not parse %q as money", s)
+	}
+	if fracDigits < 0 {
+		fracDigits = 0
+	}
+	for ; fracDigits < 2; fracDigits++ {
+		digits = append(digits, '0')
+	}
+	v, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, e.Decode("could not parse %q as money", s)
+	}
+	if neg {
+		v = -v
+	}
+	return Money(v), nil
+}
+
+// BitString is a Postgres bit or bit varying value: Len bits, packed
+// most significant first into Bytes.
+type BitString struct {
+	Bytes []byte
+	Len   int
+}
+
+// String formats b as a string of 0s and 1s.
+func (b BitString) String() string {
+	s := make([]byte, b.Len)
+	for i := range s {
+		if b.Bytes[i/8]&(0x80>>uint(i%8)) != 0 {
+			s[i] = '1'
+		} else {
+			s[i] = '0'
+		}
+	}
+	return string(s)
+}
+
+// ParseBitString parses a string of 0s and 1s.
+func ParseBitString(s string) (BitString, error) {
+	b := BitString{Bytes: make([]byte, (len(s)+7)/8), Len: len(s)}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '1':
+			b.Bytes[i/8] |= 0x80 >> uint(i%8)
+		case '0':
+		default:
+			return BitString{}, e.Decode("could not parse %q as a bit string", s)
+		}
+	}
+	return b, nil
+}
+
+// ParseInet parses an inet or cidr value: an IPv4 or IPv6 address,
+// optionally followed by a slash and the number of bits in the
+// netmask. The address is kept whole, even if it has bits set
+// outside the netmask. Without a netmask, the whole address is
+// covered.
+func ParseInet(s string) (*net.IPNet, error) {
+	addr, bits := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		addr, bits = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, e.Decode("could not parse %q as an inet", s)
+	}
+	size := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		size = 8 * net.IPv4len
+	}
+	ones := size
+	if bits != "" {
+		var err error
+		if ones, err = strconv.Atoi(bits); err != nil || ones < 0 ||
+			ones > size {
+			return nil, e.Decode("could not parse %q as an inet", s)
+		}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, size)}, nil
+}
+
+// FormatInet formats n like Postgres formats an inet, leaving off the
+// netmask if it covers the whole address.
+func FormatInet(n *net.IPNet) string {
+	ones, size := n.Mask.Size()
+	ip := n.IP
+	if ip4 := ip.To4(); ip4 != nil && size == 8*net.IPv4len {
+		ip = ip4
+	}
+	if ones == size {
+		return ip.String()
+	}
+	return fmt.Sprintf("%v/%v", ip, ones)
+}
@@ -0,0 +1,195 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseNumeric(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"0", "0"},
+		{"-12.340", "-12.340"},
+		{"+.5", "0.5"},
+		{"1.5e3", "1500"},
+		{"12e-2", "0.12"},
+		{"NaN", "NaN"},
+		{"-Infinity", "-Infinity"},
+		{"123456789012345678901234567890.0001", "123456789012345678901234567890.0001"},
+	}
+	for _, test := range tests {
+		n, err := ParseNumeric(test.s)
+		if err != nil {
+			t.Errorf("parsing %q: %v", test.s, err)
+		} else if got := n.String(); got != test.want {
+			t.Errorf("parsing %q: got %v; want %v", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "-", "1.2.3", "1e", "abc", "1e99999"} {
+		if _, err := ParseNumeric(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, iv := range []Interval{
+		{},
+		{Months: 14, Days: 1, Microseconds: -3723500000},
+		{Months: -1, Days: -2},
+		{Microseconds: 1},
+	} {
+		got, err := ParseInterval(iv.String())
+		if err != nil {
+			t.Errorf("parsing %q: %v", iv.String(), err)
+		} else if got != iv {
+			t.Errorf("parsing %q: got %#v; want %#v", iv.String(), got, iv)
+		}
+	}
+	for _, s := range []string{"", "1", "1 fortnight", "01:02", "01:02:03 1 day"} {
+		if _, err := ParseInterval(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	want := UUID{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8,
+		0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11}
+	for _, s := range []string{
+		"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+		"A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11",
+		"{a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11}",
+		"a0eebc999c0b4ef8bb6d6bb9bd380a11",
+		"a0ee-bc99-9c0b-4ef8-bb6d-6bb9-bd38-0a11",
+	} {
+		got, err := ParseUUID(s)
+		if err != nil {
+			t.Errorf("parsing %q: %v", s, err)
+		} else if got != want {
+			t.Errorf("parsing %q: got %v", s, got)
+		}
+	}
+	for _, s := range []string{"a0eebc99", "a0eebc99--9c0b-4ef8-bb6d-6bb9bd380a11",
+		"g0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"} {
+		if _, err := ParseUUID(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Money
+	}{
+		{"$1,234.56", 123456},
+		{"-$1.00", -100},
+		{"($0.05)", -5},
+		{"12", 1200},
+		{"12.3", 1230},
+	}
+	for _, test := range tests {
+		got, err := ParseMoney(test.s)
+		if err != nil {
+			t.Errorf("parsing %q: %v", test.s, err)
+		} else if got != test.want {
+			t.Errorf("parsing %q: got %v; want %v", test.s, got, test.want)
+		}
+	}
+	if s := Money(-123456).String(); s != "-1234.56" {
+		t.Errorf("got %q", s)
+	}
+	for _, s := range []string{"", "$", "1.234", "1.2.3"} {
+		if _, err := ParseMoney(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestTypesRoundTrip(t *testing.T) {
+	ipnet := func(s string) *net.IPNet {
+		n, err := ParseInet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	mac, _ := net.ParseMAC("08:00:2b:01:02:03")
+	mac8, _ := net.ParseMAC("08:00:2b:01:02:03:04:05")
+	num, _ := ParseNumeric("-1234.5670")
+	tests := []struct {
+		val  interface{}
+		typ  proto.Oid
+		text string
+	}{
+		{num, proto.OidNumeric, "-1234.5670"},
+		{Numeric{NaN: true}, proto.OidNumeric, "NaN"},
+		{Numeric{Inf: 1}, proto.OidNumeric, "Infinity"},
+		{Interval{Months: 13, Microseconds: 1500000}, proto.OidInterval,
+			"1 year 1 mon 00:00:01.5"},
+		{UUID{0xa0, 15: 0x11}, proto.OidUuid,
+			"a0000000-0000-0000-0000-000000000011"},
+		{json.RawMessage(`{"a": [1, 2]}`), proto.OidJson, `{"a": [1, 2]}`},
+		{json.RawMessage(`{"a": [1, 2]}`), proto.OidJsonb, `{"a": [1, 2]}`},
+		{ipnet("192.168.0.1"), proto.OidInet, "192.168.0.1"},
+		{ipnet("192.168.0.1/24"), proto.OidInet, "192.168.0.1/24"},
+		{ipnet("10.0.0.0/8"), proto.OidCidr, "10.0.0.0/8"},
+		{ipnet("2001:db8::1/64"), proto.OidInet, "2001:db8::1/64"},
+		{ipnet("::ffff:1.2.3.4"), proto.OidInet, "1.2.3.4"},
+		{mac, proto.OidMacaddr, "08:00:2b:01:02:03"},
+		{mac8, proto.OidMacaddr8, "08:00:2b:01:02:03:04:05"},
+		{Money(-123456), proto.OidMoney, "-1234.56"},
+		{BitString{Bytes: []byte{0xa8}, Len: 5}, proto.OidVarbit, "10101"},
+		{BitString{Bytes: []byte{0xff, 0x80}, Len: 9}, proto.OidBit, "111111111"},
+		{proto.Oid(4294967295), proto.OidOid, "4294967295"},
+	}
+	for _, test := range tests {
+		for _, format := range []proto.EncFmt{proto.EncFmtTxt, proto.EncFmtBinary} {
+			var b bytes.Buffer
+			if err := EncodeTypedValue(&b, test.val, test.typ, format); err != nil {
+				t.Errorf("encoding %#v: %v", test.val, err)
+				continue
+			}
+			encoded := b.Bytes()[4:]
+			if format == proto.EncFmtTxt && string(encoded) != test.text {
+				t.Errorf("encoding %#v: got %q; want %q", test.val, encoded, test.text)
+			}
+			got, err := DecodeValue(encoded, test.typ, format)
+			if err != nil {
+				t.Errorf("decoding %q as %v: %v", encoded, test.typ, err)
+			} else if !reflect.DeepEqual(got, test.val) {
+				t.Errorf("decoding %q as %v: got %#v; want %#v",
+					encoded, test.typ, got, test.val)
+			}
+		}
+	}
+}
+
+func TestMappedOidTypes(t *testing.T) {
+	mac, _ := net.ParseMAC("08:00:2b:01:02:03")
+	tests := []struct {
+		val  interface{}
+		want proto.Oid
+	}{
+		{Numeric{}, proto.OidNumeric},
+		{json.RawMessage("{}"), proto.OidJson},
+		{&net.IPNet{}, proto.OidInet},
+		{net.ParseIP("::1"), proto.OidInet},
+		{mac, proto.OidMacaddr},
+		{Money(0), proto.OidMoney},
+		{BitString{}, proto.OidVarbit},
+		{[]UUID{}, proto.OidUuidArray},
+	}
+	for _, test := range tests {
+		if got := MappedOid(test.val); got != test.want {
+			t.Errorf("got %v for %#v; want %v", got, test.val, test.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"reflect"
+	"strings"
+)
+
+// ResultWriter writes the result of a query to a stream: a
+// RowDescription, DataRows and a CommandComplete. WriteRows and
+// WriteStructs write a whole result at once; ResultWriter itself is
+// for results written a row at a time, or executed portals, whose
+// RowDescription goes out in response to Describe rather than with
+// the rows.
+type ResultWriter struct {
+	// The columns of the result
+	Fields []proto.FieldDescription
+	// The number of rows written
+	Count int
+}
+
+// NewResultWriter returns a writer of a result with the named columns
+// of the given types. The column formats follow the result format
+// codes of a Bind message: none for all text, one for all columns, or
+// one per column.
+func NewResultWriter(names []string, types []proto.Oid,
+	formats []proto.EncFmt) (*ResultWriter, error) {
+	if len(names) != len(types) {
+		return nil, fmt.Errorf("%v column names for %v types", len(names),
+			len(types))
+	}
+	formats, err := columnFormats(formats, len(names))
+	if err != nil {
+		return nil, err
+	}
+	w := &ResultWriter{Fields: make([]proto.FieldDescription, len(names))}
+	for i, name := range names {
+		w.Fields[i] = *DefaultRegistry.NewField(name, types[i])
+		w.Fields[i].Format = formats[i]
+	}
+	return w, nil
+}
+
+// The format of each of n columns, given the result format codes of
+// a Bind message
+func columnFormats(formats []proto.EncFmt, n int) ([]proto.EncFmt, error) {
+	switch len(formats) {
+	case n:
+		return formats, nil
+	case 0:
+		return make([]proto.EncFmt, n), nil
+	case 1:
+		all := make([]proto.EncFmt, n)
+		for i := range all {
+			all[i] = formats[0]
+		}
+		return all, nil
+	}
+	return nil, fmt.Errorf("%v result formats for %v columns", len(formats), n)
+}
+
+// WriteDescription sends the RowDescription of the result to s.
+func (w *ResultWriter) WriteDescription(s core.Stream) error {
+	var m core.Message
+	proto.InitRowDescription(&m, w.Fields)
+	return s.Send(&m)
+}
+
+// WriteRow sends a DataRow of the values vals, one for each column,
+// to s. Each value is encoded as the type and in the format of its
+// column; nil is NULL.
+func (w *ResultWriter) WriteRow(s core.Stream, vals []interface{}) error {
+	if len(vals) != len(w.Fields) {
+		return fmt.Errorf("%v values for %v columns", len(vals), len(w.Fields))
+	}
+	encoded := make([][]byte, len(vals))
+	for i, val := range vals {
+		var b bytes.Buffer
+		f := w.Fields[i]
+		if err := EncodeTypedValue(&b, val, f.TypeOid, f.Format); err != nil {
+			return fmt.Errorf("column %v: %v", f.Name, err)
+		}
+		encoded[i] = b.Bytes()
+	}
+	var m core.Message
+	proto.InitDataRow(&m, encoded)
+	if err := s.Send(&m); err != nil {
+		return err
+	}
+	w.Count++
+	return nil
+}
+
+// WriteComplete sends the CommandComplete ending the result to s,
+// tagged "SELECT n" with the number of rows written.
+func (w *ResultWriter) WriteComplete(s core.Stream) error {
+	var m core.Message
+	proto.InitCommandComplete(&m, fmt.Sprintf("SELECT %d", w.Count))
+	return s.Send(&m)
+}
+
+// WriteRows sends a whole result, with the named columns and the
+// given rows, to s. The types of the columns are guessed from the
+// values with GuessOids; columns of only NULLs are text. The formats
+// are as for NewResultWriter. The stream is not flushed.
+func WriteRows(s core.Stream, names []string, rows [][]interface{},
+	formats []proto.EncFmt) error {
+	types := GuessOids(rows)
+	if len(rows) == 0 {
+		types = make([]proto.Oid, len(names))
+	}
+	for i, typ := range types {
+		if typ == 0 || (typ == proto.OidUnknown && allNull(rows, i)) {
+			types[i] = proto.OidText
+		}
+	}
+	return writeResult(s, names, types, rows, formats)
+}
+
+func allNull(rows [][]interface{}, col int) bool {
+	for _, row := range rows {
+		if row[col] != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func writeResult(s core.Stream, names []string, types []proto.Oid,
+	rows [][]interface{}, formats []proto.EncFmt) error {
+	w, err := NewResultWriter(names, types, formats)
+	if err != nil {
+		return err
+	}
+	if err = w.WriteDescription(s); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err = w.WriteRow(s, row); err != nil {
+			return err
+		}
+	}
+	return w.WriteComplete(s)
+}
+
+// WriteStructs sends a whole result to s with a row for each element
+// of rows, a slice of structs or of pointers to structs. The columns
+// are the exported fields, named as for ResultReader.Scan: by their
+// `femebe:"name"` tags, or else their names in lower case, with
+// fields tagged `femebe:"-"` left out. Nil pointer fields are NULL.
+// The formats are as for NewResultWriter. The stream is not flushed.
+func WriteStructs(s core.Stream, rows interface{}, formats []proto.EncFmt) error {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("Can't write a result of %T", rows)
+	}
+	t := v.Type().Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("Can't write a result of %T", rows)
+	}
+
+	var names []string
+	var types []proto.Oid
+	var indexes []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("femebe")
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = strings.ToLower(f.Name)
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		names = append(names, tag)
+		types = append(types, MappedOid(reflect.Zero(ft).Interface()))
+		indexes = append(indexes, i)
+	}
+
+	vals := make([][]interface{}, v.Len())
+	for i := range vals {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				return fmt.Errorf("Can't write nil row %v", i)
+			}
+			elem = elem.Elem()
+		}
+		row := make([]interface{}, len(indexes))
+		for j, idx := range indexes {
+			f := elem.Field(idx)
+			if f.Kind() == reflect.Ptr || f.Kind() == reflect.Interface {
+				if f.IsNil() {
+					continue
+				}
+				f = f.Elem()
+			}
+			row[j] = f.Interface()
+		}
+		vals[i] = row
+	}
+
+	// Fields such as interface{} ones can only be typed by their
+	// values
+	guessed := GuessOids(vals)
+	for i, typ := range types {
+		if typ != proto.OidUnknown {
+			continue
+		}
+		if len(vals) > 0 {
+			typ = guessed[i]
+		}
+		if typ == proto.OidUnknown && allNull(vals, i) {
+			typ = proto.OidText
+		}
+		types[i] = typ
+	}
+	return writeResult(s, names, types, vals, formats)
+}
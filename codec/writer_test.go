@@ -0,0 +1,202 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type item struct {
+	ID    int64 `femebe:"item_id"`
+	Name  string
+	Price *float64
+	Extra interface{}
+	Skip  bool `femebe:"-"`
+	notes string
+}
+
+func TestWriteStructs(t *testing.T) {
+	var b msgBuffer
+	s := core.NewBackendStream(&b)
+	price := 9.5
+	rows := []*item{
+		{ID: 1, Name: "pen", Price: &price, Extra: nil},
+		{ID: 2, Name: "ink", Extra: int32(3)},
+	}
+	if err := WriteStructs(s, rows, []proto.EncFmt{proto.EncFmtBinary}); err != nil {
+		t.Fatal(err)
+	}
+
+	var r ResultReader
+	var got []item
+	for {
+		ok, err := r.Next(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		var it item
+		if err := r.Scan(&it); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, it)
+	}
+
+	var names []string
+	var types []proto.Oid
+	for _, f := range r.Fields {
+		names = append(names, f.Name)
+		types = append(types, f.TypeOid)
+		if f.Format != proto.EncFmtBinary {
+			t.Errorf("got format %v for %v", f.Format, f.Name)
+		}
+	}
+	if want := []string{"item_id", "name", "price", "extra"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got columns %v; want %v", names, want)
+	}
+	if want := []proto.Oid{proto.OidInt8, proto.OidText, proto.OidFloat8,
+		proto.OidInt4}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got types %v; want %v", types, want)
+	}
+	if len(got) != 2 || got[0].ID != 1 || got[0].Name != "pen" ||
+		*got[0].Price != 9.5 || got[0].Extra != nil || got[1].Price != nil ||
+		got[1].Extra != int64(3) {
+		t.Errorf("got %#v", got)
+	}
+	if r.Complete == nil || r.Complete.Tag != "SELECT" ||
+		r.Complete.AffectedCount != 2 {
+		t.Errorf("got %#v", r.Complete)
+	}
+}
+
+func TestWriteRows(t *testing.T) {
+	var b msgBuffer
+	s := core.NewBackendStream(&b)
+	rows := [][]interface{}{
+		{int32(1), nil, "a"},
+		{int32(2), nil, "b"},
+	}
+	formats := []proto.EncFmt{proto.EncFmtTxt, proto.EncFmtTxt, proto.EncFmtBinary}
+	if err := WriteRows(s, []string{"n", "z", "s"}, rows, formats); err != nil {
+		t.Fatal(err)
+	}
+	var r ResultReader
+	var got [][]interface{}
+	for {
+		ok, err := r.Next(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		vals, _ := r.Values()
+		got = append(got, vals)
+	}
+	want := [][]interface{}{{int64(1), nil, "a"}, {int64(2), nil, "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+	if typ := r.Fields[1].TypeOid; typ != proto.OidText {
+		t.Errorf("got type %v for a NULL column", typ)
+	}
+	if r.Fields[0].TypLen != 4 || r.Fields[2].Format != proto.EncFmtBinary {
+		t.Errorf("got %#v", r.Fields)
+	}
+
+	if err := WriteRows(s, []string{"n"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := r.Next(s); ok || err != nil || r.Complete.AffectedCount != 0 {
+		t.Errorf("got %v, %v, %#v", ok, err, r.Complete)
+	}
+
+	for _, bad := range []func() error{
+		func() error { return WriteRows(s, []string{"n"}, rows, nil) },
+		func() error { return WriteRows(s, []string{"n", "z", "s"}, rows, make([]proto.EncFmt, 2)) },
+		func() error { return WriteStructs(s, []int{1}, nil) },
+		func() error { return WriteStructs(s, []*item{nil}, nil) },
+	} {
+		if err := bad(); err == nil {
+			t.Errorf("expected an error")
+		}
+	}
+}
+
+func TestWriteFloatsText(t *testing.T) {
+	var b msgBuffer
+	s := core.NewBackendStream(&b)
+	w, err := NewResultWriter([]string{"f4", "f8"},
+		[]proto.Oid{proto.OidFloat4, proto.OidFloat8}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]interface{}{
+		{float32(1.1), 0.1},
+		{float32(3.4e38), 1e300},
+		{float32(math.NaN()), math.Inf(1)},
+		{float32(math.Inf(-1)), -2.5e-300},
+	}
+	if err = w.WriteDescription(s); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err = w.WriteRow(s, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.WriteComplete(s); err != nil {
+		t.Fatal(err)
+	}
+
+	var r ResultReader
+	for i := 0; ; i++ {
+		ok, err := r.Next(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		vals, err := r.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, val := range vals {
+			want := rows[i][j]
+			if f, ok := want.(float32); ok {
+				want = float64(f)
+			}
+			got := val.(float64)
+			if math.IsNaN(got) && math.IsNaN(want.(float64)) {
+				continue
+			}
+			if got != want {
+				t.Errorf("row %v column %v: got %v; want %v", i, j, got, want)
+			}
+		}
+	}
+
+	var buff bytes.Buffer
+	for val, want := range map[float64]string{
+		0.1:          "0.1",
+		1e300:        "1e+300",
+		math.Inf(-1): "-Infinity",
+	} {
+		buff.Reset()
+		TextEncodeFloat64(&buff, val)
+		if got := buff.String()[4:]; got != want {
+			t.Errorf("got %q for %v; want %q", got, val, want)
+		}
+	}
+	buff.Reset()
+	TextEncodeFloat32(&buff, float32(math.NaN()))
+	if got := buff.String()[4:]; got != "NaN" {
+		t.Errorf("got %q for NaN; want %q", got, "NaN")
+	}
+}
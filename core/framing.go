@@ -68,6 +68,9 @@ func (m *Message) Force() ([]byte, error) {
 
 	m.buffered.InitReader(payload)
 	m.future = nil
+	// The old union has been drained; the payload is now
+	// entirely in the buffer.
+	m.union = &m.buffered
 
 	return m.buffered.Bytes(), err
 }
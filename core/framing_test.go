@@ -0,0 +1,46 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestForcePromise(t *testing.T) {
+	var m Message
+	rest := bytes.NewReader([]byte{3, 4, 5, 6, 7, 8})
+	m.InitPromise('D', 4+6, []byte{1, 2}, rest)
+
+	want := []byte{1, 2, 3, 4, 5, 6}
+	forced, err := m.Force()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forced, want) || !m.IsBuffered() {
+		t.Errorf("got %v from Force; want %v", forced, want)
+	}
+	if rest.Len() != 2 {
+		t.Errorf("Force read %v bytes past the message", 4-rest.Len())
+	}
+
+	// the payload is still there to be read after forcing
+	payload, err := ioutil.ReadAll(m.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, want) {
+		t.Errorf("got payload %v after Force; want %v", payload, want)
+	}
+
+	var out bytes.Buffer
+	m.InitPromise('D', 4+6, []byte{1, 2}, bytes.NewReader(want[2:]))
+	if _, err = m.Force(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{'D', 0, 0, 0, 10, 1, 2, 3, 4, 5, 6}) {
+		t.Errorf("got %v written after Force", out.Bytes())
+	}
+}
@@ -2,11 +2,13 @@ package core
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"github.com/uhoh-itsmaciek/femebe/buf"
 	"github.com/uhoh-itsmaciek/femebe/util"
 	"io"
+	"net"
 )
 
 // A duplex stream of FEBE messages
@@ -38,8 +40,9 @@ const startupMessageRequestCode uint32 = 196608
 // dissatisfied with the response.
 const RejectSSLRequest = 'N'
 
-// AcceptSSLRequest accepts an SSLRequest from the frontend.  However, SSL is not
-// yet supported for frontend streams, so its usefulness is questionable.
+// AcceptSSLRequest accepts an SSLRequest from the frontend.  Rather than
+// sending this directly, see AcceptTLS, which also performs the TLS
+// handshake.
 const AcceptSSLRequest = 'S'
 
 // State of the stream connection
@@ -90,6 +93,20 @@ func NewBackendStream(rw io.ReadWriteCloser) *MessageStream {
 	return baseNewMessageStream(rw, ConnNormal)
 }
 
+// Accept an SSLRequest received on the frontend connection conn and
+// perform the server side of the TLS handshake using config, which
+// must include a certificate. The returned MessageStream wraps the
+// encrypted connection and is ready to read the StartupMessage that
+// follows; any stream previously created for conn must no longer be
+// used.
+func AcceptTLS(conn net.Conn, config *tls.Config) (*MessageStream, error) {
+	tlsConn, err := util.AcceptTLS(conn, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewFrontendStream(util.NewBufferedReadWriteCloser(tlsConn)), nil
+}
+
 func (c *MessageStream) HasNext() bool {
 	return c.msgRemainder.Len() >= MsgHeaderMinSize
 }
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func selfSignedConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "femebe test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func TestAcceptTLS(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	startup := []byte{0x00, 0x03, 0x00, 0x00, 'u', 0, 'x', 0, 0}
+
+	clientErr := make(chan error, 1)
+	go func() {
+		conn, err := util.NegotiateTLS(clientConn, &util.SSLConfig{
+			Mode:   util.SSLRequire,
+			Config: tls.Config{InsecureSkipVerify: true},
+		})
+		if err != nil {
+			clientErr <- err
+			return
+		}
+		var m Message
+		m.InitFromBytes(MsgTypeFirst, startup)
+		clientErr <- NewBackendStream(conn).Send(&m)
+	}()
+
+	var m Message
+	plain := NewFrontendStream(serverConn)
+	if err := plain.Next(&m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Force(); err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := AcceptTLS(serverConn, selfSignedConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Next(&m); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := m.Force()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, startup) {
+		t.Errorf("got startup payload %v; want %v", payload, startup)
+	}
+	if err := <-clientErr; err != nil {
+		t.Errorf("client error: %v", err)
+	}
+}
+
+func TestAcceptTLSWithoutCertificate(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	if _, err := AcceptTLS(serverConn, &tls.Config{}); err == nil {
+		t.Errorf("expected error accepting TLS without a certificate")
+	}
+}
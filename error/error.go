@@ -24,6 +24,22 @@ type ErrBadTypeCode struct {
 	error
 }
 
+type ErrAuth struct {
+	error
+}
+
+type ErrProtocol struct {
+	error
+}
+
+type ErrDecode struct {
+	error
+}
+
+type ErrCopyFail struct {
+	error
+}
+
 func TooBig(format string, args ...interface{}) ErrTooBig {
 	return ErrTooBig{fmt.Errorf(format, args...)}
 }
@@ -43,3 +59,19 @@ func StartupFmt(format string, args ...interface{}) ErrStartupFmt {
 func BadTypeCode(code byte) ErrBadTypeCode {
 	return ErrBadTypeCode{fmt.Errorf("Invalid message type %v", code)}
 }
+
+func Auth(format string, args ...interface{}) ErrAuth {
+	return ErrAuth{fmt.Errorf(format, args...)}
+}
+
+func Protocol(format string, args ...interface{}) ErrProtocol {
+	return ErrProtocol{fmt.Errorf(format, args...)}
+}
+
+func Decode(format string, args ...interface{}) ErrDecode {
+	return ErrDecode{fmt.Errorf(format, args...)}
+}
+
+func CopyFail(format string, args ...interface{}) ErrCopyFail {
+	return ErrCopyFail{fmt.Errorf(format, args...)}
+}
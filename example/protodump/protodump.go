@@ -0,0 +1,703 @@
+// Command protodump prints every message of Postgres sessions in a
+// readable form, either by sitting between clients and a server as
+// a proxy, or by reading sessions recorded with the capture package
+// or by tcpdump.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe"
+	"github.com/uhoh-itsmaciek/femebe/buf"
+	"github.com/uhoh-itsmaciek/femebe/capture"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/pcap"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n"+
+		"  protodump [-json] LISTENADDR SERVERADDR\n"+
+		"  protodump [-json] -capture FILE\n"+
+		"  protodump [-json] -pcap FILE [-port PORT]\n")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	jsonOut := flag.Bool("json", false, "print one JSON object per line")
+	captureFile := flag.String("capture", "",
+		"read a session recorded with the capture package")
+	pcapFile := flag.String("pcap", "", "read sessions from a pcap file")
+	port := flag.Int("port", pcap.DefaultPort,
+		"the server port of sessions in the pcap file")
+	flag.Usage = usage
+	flag.Parse()
+
+	p := &printer{out: os.Stdout, json: *jsonOut}
+	var err error
+	switch {
+	case *captureFile != "" && flag.NArg() == 0:
+		err = dumpCapture(p, *captureFile)
+	case *pcapFile != "" && flag.NArg() == 0:
+		err = dumpPcap(p, *pcapFile, *port)
+	case *captureFile == "" && *pcapFile == "" && flag.NArg() == 2:
+		err = runProxy(p, flag.Arg(0), flag.Arg(1))
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func dumpCapture(p *printer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c := &conn{id: 1}
+	r := capture.NewReader(f)
+	var rec capture.Record
+	for {
+		if err = r.Next(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p.print(c, rec.Time, rec.Dir, &rec.Msg)
+	}
+}
+
+func dumpPcap(p *printer, path string, port int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	conns, err := pcap.Read(f, port)
+	if err != nil {
+		return err
+	}
+	for i, pc := range conns {
+		c := &conn{id: i + 1}
+		log.Printf("C-%v: %v connection from %v to %v", c.id, pc.First,
+			&pc.Client, &pc.Server)
+		for j := range pc.Records {
+			rec := &pc.Records[j]
+			p.print(c, rec.Time, rec.Dir, &rec.Msg)
+		}
+		if pc.Encrypted {
+			log.Printf("C-%v: encrypted from here on", c.id)
+		}
+		if pc.Err != nil {
+			log.Printf("C-%v: %v", c.id, pc.Err)
+		}
+	}
+	return nil
+}
+
+// Proxy connections from clients at listenAddr to the server at
+// serverAddr, printing the messages as they go by. TLS is refused.
+func runProxy(p *printer, listenAddr, serverAddr string) error {
+	ln, err := util.AutoListen(listenAddr)
+	if err != nil {
+		return err
+	}
+	manager := femebe.NewSimpleSessionManager()
+	for id := 1; ; id++ {
+		netConn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error: %v", err)
+			continue
+		}
+		go func(c *conn, netConn net.Conn) {
+			err := proxySession(p, c, netConn, serverAddr, manager)
+			if err != nil && err != io.EOF {
+				log.Printf("C-%v: session exits with error: %v", c.id, err)
+			} else {
+				log.Printf("C-%v: session exits cleanly", c.id)
+			}
+		}(&conn{id: id}, netConn)
+	}
+}
+
+func proxySession(p *printer, c *conn, netConn net.Conn, serverAddr string,
+	manager femebe.SessionManager) error {
+	fe := core.NewFrontendStream(util.NewBufferedReadWriteCloser(netConn))
+	defer fe.Close()
+
+	var m core.Message
+	for {
+		if err := fe.Next(&m); err != nil {
+			return err
+		}
+		if _, err := m.Force(); err != nil {
+			return err
+		}
+		p.print(c, time.Now(), capture.FromFrontend, &m)
+		if !proto.IsSSLRequest(&m) {
+			break
+		}
+		if err := fe.SendSSLRequestResponse(core.RejectSSLRequest); err != nil {
+			return err
+		}
+		if err := fe.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if proto.IsCancelRequest(&m) {
+		cancel, err := proto.ReadCancelRequest(&m)
+		if err != nil {
+			return err
+		}
+		return manager.Cancel(cancel.BackendPid, cancel.SecretKey)
+	}
+	startup, err := proto.ReadStartupMessage(&m)
+	if err != nil {
+		return err
+	}
+	connector := femebe.NewSimpleConnector(serverAddr, startup.Params)
+	be, err := connector.Startup()
+	if err != nil {
+		return err
+	}
+	defer be.Close()
+
+	router := femebe.NewChainRouter(fe, be)
+	router.InterceptFrontend(p.interceptor(c, capture.FromFrontend))
+	router.InterceptBackend(p.interceptor(c, capture.FromBackend))
+	return manager.RunSession(femebe.NewSimpleSession(router, connector))
+}
+
+// The state of a connection needed to decode its messages
+type conn struct {
+	id int
+
+	// The last authentication request, which determines what a
+	// frontend 'p' message is; the two directions of a connection
+	// are decoded concurrently, so it is guarded by the lock
+	lock sync.Mutex
+	auth proto.AuthType
+}
+
+func (c *conn) lastAuth() proto.AuthType {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.auth
+}
+
+func (c *conn) setAuth(auth proto.AuthType) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.auth = auth
+}
+
+// A named, decoded part of a message. Values are strings, numbers,
+// nil for NULLs, or slices of values or fields.
+type field struct {
+	name  string
+	value interface{}
+}
+
+// The JSON form of a message
+type entry struct {
+	Time   time.Time              `json:"time"`
+	Conn   int                    `json:"conn"`
+	Dir    string                 `json:"dir"`
+	Type   string                 `json:"type"`
+	Name   string                 `json:"name"`
+	Size   uint32                 `json:"size"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// Prints messages from any number of connections, one per line
+type printer struct {
+	lock sync.Mutex
+	out  io.Writer
+	json bool
+}
+
+func (p *printer) interceptor(c *conn, dir capture.Direction) femebe.Interceptor {
+	return func(m *core.Message) (femebe.Action, error) {
+		if _, err := m.Force(); err != nil {
+			return femebe.Forward, err
+		}
+		p.print(c, time.Now(), dir, m)
+		return femebe.Forward, nil
+	}
+}
+
+// Print m, which must be buffered. Its payload is consumed.
+func (p *printer) print(c *conn, t time.Time, dir capture.Direction,
+	m *core.Message) {
+	name, fields, err := c.decode(dir, m)
+	if name == "" {
+		name = "Unknown"
+	}
+	typ := string(m.MsgType())
+	size := m.Size()
+	if m.MsgType() == core.MsgTypeFirst {
+		typ = ""
+	} else {
+		// count the type byte too
+		size++
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.json {
+		en := entry{
+			Time: t,
+			Conn: c.id,
+			Dir:  dir.String(),
+			Type: typ,
+			Name: name,
+			Size: size,
+		}
+		if len(fields) > 0 {
+			en.Fields = jsonFields(fields)
+		}
+		if err != nil {
+			en.Error = err.Error()
+		}
+		line, jsonErr := json.Marshal(en)
+		if jsonErr != nil {
+			log.Printf("could not encode message: %v", jsonErr)
+			return
+		}
+		p.out.Write(append(line, '\n'))
+		return
+	}
+
+	arrow := "->"
+	if dir == capture.FromBackend {
+		arrow = "<-"
+	}
+	line := fmt.Sprintf("%v C-%v %v %v (%v bytes)",
+		t.Format("2006-01-02 15:04:05.000"), c.id, arrow, name, size)
+	if len(fields) > 0 {
+		line += ": " + formatFields(fields)
+	}
+	if err != nil {
+		line += fmt.Sprintf(" [could not decode: %v]", err)
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+func formatFields(fields []field) string {
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f.name + "=" + formatValue(f.value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []field:
+		return "{" + formatFields(v) + "}"
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = formatValue(elem)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+func jsonFields(fields []field) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		result[f.name] = jsonValue(f.value)
+	}
+	return result
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []field:
+		return jsonFields(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = jsonValue(elem)
+		}
+		return result
+	}
+	return v
+}
+
+// A parameter or column value: text if it looks like text, hex
+// otherwise, and nil for NULL
+func datum(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return `\x` + hex.EncodeToString(b)
+}
+
+func oids(oids []proto.Oid) []interface{} {
+	result := make([]interface{}, len(oids))
+	for i, oid := range oids {
+		result[i] = uint32(oid)
+	}
+	return result
+}
+
+func formats(formats []proto.EncFmt) []interface{} {
+	result := make([]interface{}, len(formats))
+	for i, f := range formats {
+		result[i] = int16(f)
+	}
+	return result
+}
+
+// The order of ErrorResponse and NoticeResponse fields, as the
+// server sends them
+const noticeFieldOrder = "SVCMDHPpqWstcdnFLR"
+
+type byFieldOrder []byte
+
+func fieldRank(code byte) int {
+	if i := strings.IndexByte(noticeFieldOrder, code); i >= 0 {
+		return i
+	}
+	return len(noticeFieldOrder) + int(code)
+}
+
+func (c byFieldOrder) Len() int      { return len(c) }
+func (c byFieldOrder) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byFieldOrder) Less(i, j int) bool {
+	return fieldRank(c[i]) < fieldRank(c[j])
+}
+
+func noticeFields(details map[byte]string) []field {
+	codes := make([]byte, 0, len(details))
+	for code := range details {
+		codes = append(codes, code)
+	}
+	sort.Sort(byFieldOrder(codes))
+	fields := make([]field, len(codes))
+	for i, code := range codes {
+		fields[i] = field{proto.DescribeStatusCode(code), details[code]}
+	}
+	return fields
+}
+
+func authName(t proto.AuthType) string {
+	switch t {
+	case proto.AuthOk:
+		return "Ok"
+	case proto.AuthKerberosV5:
+		return "KerberosV5"
+	case proto.AuthCleartextPassword:
+		return "CleartextPassword"
+	case proto.AuthMD5Password:
+		return "MD5Password"
+	case proto.AuthSCMCredential:
+		return "SCMCredential"
+	case proto.AuthGSS:
+		return "GSS"
+	case proto.AuthGSSContinue:
+		return "GSSContinue"
+	case proto.AuthSSPI:
+		return "SSPI"
+	case proto.AuthSASL:
+		return "SASL"
+	case proto.AuthSASLContinue:
+		return "SASLContinue"
+	case proto.AuthSASLFinal:
+		return "SASLFinal"
+	}
+	return fmt.Sprintf("unknown (%v)", int32(t))
+}
+
+// Name m and decode its fields. The name is returned even if the
+// fields cannot be decoded.
+func (c *conn) decode(dir capture.Direction, m *core.Message) (
+	string, []field, error) {
+	if dir == capture.FromFrontend {
+		return c.decodeFrontend(m)
+	}
+	return c.decodeBackend(m)
+}
+
+func (c *conn) decodeFrontend(m *core.Message) (string, []field, error) {
+	name := proto.FrontendMessageName(m.MsgType())
+	switch m.MsgType() {
+	case core.MsgTypeFirst:
+		switch {
+		case proto.IsSSLRequest(m):
+			return "SSLRequest", nil, nil
+		case proto.IsCancelRequest(m):
+			cr, err := proto.ReadCancelRequest(m)
+			if err != nil {
+				return "CancelRequest", nil, err
+			}
+			return "CancelRequest", []field{
+				{"pid", cr.BackendPid},
+				{"key", cr.SecretKey},
+			}, nil
+		case proto.IsStartupMessage(m):
+			sm, err := proto.ReadStartupMessage(m)
+			if err != nil {
+				return name, nil, err
+			}
+			keys := make([]string, 0, len(sm.Params))
+			for k := range sm.Params {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fields := make([]field, len(keys))
+			for i, k := range keys {
+				fields[i] = field{k, sm.Params[k]}
+			}
+			return name, fields, nil
+		}
+		// GSSENCRequest, or something newer
+		return "StartupPacket", nil, nil
+	case proto.MsgQueryQ:
+		q, err := proto.ReadQuery(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{{"query", q.Query}}, nil
+	case proto.MsgParseP:
+		parse, err := proto.ReadParse(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"statement", parse.Name},
+			{"query", parse.Query},
+			{"param_types", oids(parse.ParamOids)},
+		}, nil
+	case proto.MsgBindB:
+		bind, err := proto.ReadBind(m)
+		if err != nil {
+			return name, nil, err
+		}
+		params := make([]interface{}, len(bind.Params))
+		for i, param := range bind.Params {
+			params[i] = datum(param)
+		}
+		return name, []field{
+			{"portal", bind.Portal},
+			{"statement", bind.Statement},
+			{"param_formats", formats(bind.ParamFormats)},
+			{"params", params},
+			{"result_formats", formats(bind.ResultFormats)},
+		}, nil
+	case proto.MsgDescribeD:
+		d, err := proto.ReadDescribe(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"kind", string(d.Kind)},
+			{"name", d.Name},
+		}, nil
+	case proto.MsgCloseC:
+		cl, err := proto.ReadClose(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"kind", string(cl.Kind)},
+			{"name", cl.Name},
+		}, nil
+	case proto.MsgExecuteE:
+		ex, err := proto.ReadExecute(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"portal", ex.Portal},
+			{"max_rows", ex.MaxRows},
+		}, nil
+	case proto.MsgCopyFailF:
+		msg, err := buf.ReadCString(m.Payload())
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{{"message", msg}}, nil
+	case proto.MsgPasswordMessageP:
+		// Passwords are never printed, only their presence
+		switch c.lastAuth() {
+		case proto.AuthSASL:
+			resp, err := proto.ReadSASLInitialResponse(m)
+			if err != nil {
+				return "SASLInitialResponse", nil, err
+			}
+			return "SASLInitialResponse", []field{
+				{"mechanism", resp.Mechanism},
+				{"data_size", len(resp.Data)},
+			}, nil
+		case proto.AuthSASLContinue:
+			resp, err := proto.ReadSASLResponse(m)
+			if err != nil {
+				return "SASLResponse", nil, err
+			}
+			return "SASLResponse", []field{
+				{"data_size", len(resp.Data)},
+			}, nil
+		case proto.AuthGSS, proto.AuthGSSContinue, proto.AuthSSPI:
+			return "GSSResponse", nil, m.Discard()
+		}
+		pw, err := proto.ReadPasswordMessage(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{{"password_size", len(pw.Password)}}, nil
+	}
+	return name, nil, nil
+}
+
+func (c *conn) decodeBackend(m *core.Message) (string, []field, error) {
+	name := proto.BackendMessageName(m.MsgType())
+	switch m.MsgType() {
+	case proto.MsgAuthenticationOkR:
+		auth, err := proto.ReadAuthentication(m)
+		if err != nil {
+			return name, nil, err
+		}
+		c.setAuth(auth.Type)
+		fields := []field{{"type", authName(auth.Type)}}
+		switch auth.Type {
+		case proto.AuthMD5Password:
+			fields = append(fields,
+				field{"salt", hex.EncodeToString(auth.Salt[:])})
+		case proto.AuthSASL:
+			mechs := make([]interface{}, len(auth.Mechanisms))
+			for i, mech := range auth.Mechanisms {
+				mechs[i] = mech
+			}
+			fields = append(fields, field{"mechanisms", mechs})
+		}
+		return name, fields, nil
+	case proto.MsgBackendKeyDataK:
+		kd, err := proto.ReadBackendKeyData(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"pid", kd.BackendPid},
+			{"key", kd.SecretKey},
+		}, nil
+	case proto.MsgParameterStatusS:
+		ps, err := proto.ReadParameterStatus(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"name", ps.Name},
+			{"value", ps.Value},
+		}, nil
+	case proto.MsgReadyForQueryZ:
+		rfq, err := proto.ReadReadyForQuery(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{{"status", string(rfq.ConnStatus)}}, nil
+	case proto.MsgRowDescriptionT:
+		rd, err := proto.ReadRowDescription(m)
+		if err != nil {
+			return name, nil, err
+		}
+		columns := make([]interface{}, len(rd.Fields))
+		for i, fd := range rd.Fields {
+			columns[i] = []field{
+				{"name", fd.Name},
+				{"type", uint32(fd.TypeOid)},
+				{"format", int16(fd.Format)},
+			}
+		}
+		return name, []field{{"columns", columns}}, nil
+	case proto.MsgParameterDescriptionT:
+		pd, err := proto.ReadParameterDescription(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{{"param_types", oids(pd.ParamOids)}}, nil
+	case proto.MsgDataRowD:
+		dr, err := proto.ReadDataRow(m)
+		if err != nil {
+			return name, nil, err
+		}
+		values := make([]interface{}, len(dr.Values))
+		for i, v := range dr.Values {
+			values[i] = datum(v)
+		}
+		return name, []field{{"values", values}}, nil
+	case proto.MsgCommandCompleteC:
+		cc, err := proto.ReadCommandComplete(m)
+		if err != nil {
+			return name, nil, err
+		}
+		fields := []field{{"tag", cc.Tag}}
+		switch cc.Tag {
+		case "INSERT", "DELETE", "UPDATE", "SELECT", "MOVE", "FETCH", "COPY":
+			fields = append(fields, field{"rows", cc.AffectedCount})
+		}
+		return name, fields, nil
+	case proto.MsgErrorResponseE:
+		er, err := proto.ReadErrorResponse(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, noticeFields(er.Details), nil
+	case proto.MsgNoticeResponseN:
+		nr, err := proto.ReadNoticeResponse(m)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, noticeFields(nr.Details), nil
+	case proto.MsgNotificationResponseA:
+		p := m.Payload()
+		pid, err := buf.ReadUint32(p)
+		if err != nil {
+			return name, nil, err
+		}
+		channel, err := buf.ReadCString(p)
+		if err != nil {
+			return name, nil, err
+		}
+		payload, err := buf.ReadCString(p)
+		if err != nil {
+			return name, nil, err
+		}
+		return name, []field{
+			{"pid", pid},
+			{"channel", channel},
+			{"payload", payload},
+		}, nil
+	}
+	return name, nil, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/uhoh-itsmaciek/femebe"
 	"github.com/uhoh-itsmaciek/femebe/core"
@@ -15,11 +16,23 @@ import (
 
 // Startup and main client acceptance loop
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Printf("Usage: simpleproxy LISTENADDR SERVERADDR\n")
+	if len(os.Args) != 3 && len(os.Args) != 5 {
+		fmt.Printf("Usage: simpleproxy LISTENADDR SERVERADDR [CERTFILE KEYFILE]\n")
 		os.Exit(1)
 	}
 
+	// Client TLS support is enabled only when a certificate is
+	// given
+	var tlsConfig *tls.Config
+	if len(os.Args) == 5 {
+		cert, err := tls.LoadX509KeyPair(os.Args[3], os.Args[4])
+		if err != nil {
+			fmt.Printf("Could not load certificate: %v\n", err)
+			os.Exit(1)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
 	ln, err := util.AutoListen(os.Args[1])
 	if err != nil {
 		fmt.Printf("Could not listen on address: %v\n", err)
@@ -30,8 +43,9 @@ func main() {
 	// can exit cleanly on an interrupt. N.B.: this currently does
 	// not correctly capture SIGTERM on Linux (and possibly
 	// elsewhere)--it just kills the process directly without
-	// involving the signal handler.
-	sigch := make(chan os.Signal)
+	// involving the signal handler. The channel is buffered since
+	// signal.Notify drops signals it cannot deliver right away.
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, os.Interrupt, os.Kill)
 	watchSigs := func() {
 		for sig := range sigch {
@@ -48,7 +62,7 @@ func main() {
 	target := os.Args[2]
 	resolver := &fixedResolver{target}
 	manager := femebe.NewSimpleSessionManager()
-	p := &proxy{resolver, manager}
+	p := &proxy{resolver, manager, tlsConfig}
 
 	for {
 		conn, err := ln.Accept()
@@ -65,8 +79,9 @@ func main() {
 }
 
 type proxy struct {
-	resolver femebe.Resolver
-	manager  femebe.SessionManager
+	resolver  femebe.Resolver
+	manager   femebe.SessionManager
+	tlsConfig *tls.Config
 }
 
 type fixedResolver struct {
@@ -105,6 +120,28 @@ func (p *proxy) handleConnection(conn net.Conn, serverAddr string) {
 	if err != nil {
 		panic(fmt.Errorf("could not read client startup message: %v", err))
 	}
+	if proto.IsSSLRequest(&m) {
+		if p.tlsConfig != nil {
+			feStream, err = core.AcceptTLS(conn, p.tlsConfig)
+			if err != nil {
+				panic(fmt.Errorf("could not negotiate TLS: %v", err))
+			}
+		} else {
+			log.Print("SSL not configured; rejecting SSL request")
+			err = feStream.SendSSLRequestResponse(core.RejectSSLRequest)
+			if err == nil {
+				err = feStream.Flush()
+			}
+			if err != nil {
+				panic(fmt.Errorf("could not reject SSL request: %v", err))
+			}
+		}
+		// the client follows up with its real startup message
+		err = feStream.Next(&m)
+		if err != nil {
+			panic(fmt.Errorf("could not read client startup message: %v", err))
+		}
+	}
 	if proto.IsStartupMessage(&m) {
 		startup, err := proto.ReadStartupMessage(&m)
 		if err != nil {
@@ -118,8 +155,6 @@ func (p *proxy) handleConnection(conn net.Conn, serverAddr string) {
 		router := femebe.NewSimpleRouter(feStream, beStream)
 		session := femebe.NewSimpleSession(router, connector)
 		err = p.manager.RunSession(session)
-	} else if proto.IsSSLRequest(&m) {
-		log.Print("SSL not supported; try with PGSSLMODE=disable")
 	} else if proto.IsCancelRequest(&m) {
 		cancel, err := proto.ReadCancelRequest(&m)
 		if err != nil {
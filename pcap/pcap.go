@@ -0,0 +1,283 @@
+// Package pcap reads Postgres protocol traffic from libpcap capture
+// files, such as those written by tcpdump, reassembling the TCP
+// streams and decoding them into messages for each connection.
+//
+// Only the classic pcap format is supported, not pcapng (tcpdump
+// writes the former by default; convert with "editcap -F pcap"
+// otherwise). Packets may be captured on Ethernet (with or without
+// VLAN tags), Linux cooked (SLL and SLL2), BSD loopback or raw IP
+// links, carrying IPv4 or IPv6. IP fragments are ignored.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The port Postgres listens on by default
+const DefaultPort = 5432
+
+var ErrPcapNG = errors.New("pcapng files are not supported; " +
+	"convert to pcap first")
+
+// Link-layer header types, from http://www.tcpdump.org/linktypes.html
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRawAlt   = 12
+	linkRawAlt2  = 14
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+)
+
+// A TCP segment from a captured packet
+type segment struct {
+	time     time.Time
+	src, dst net.TCPAddr
+	seq      uint32
+	syn      bool
+	fin      bool
+	rst      bool
+	payload  []byte
+}
+
+// Reads the packets of a pcap file
+type packetReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+	hdr      [16]byte
+}
+
+func newPacketReader(r io.Reader) (*packetReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("could not read pcap header: %v", err)
+	}
+
+	p := &packetReader{r: r}
+	switch magic := binary.LittleEndian.Uint32(hdr[:4]); magic {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, ErrPcapNG
+	default:
+		return nil, fmt.Errorf("not a pcap file: bad magic number %#x", magic)
+	}
+	p.linkType = p.order.Uint32(hdr[20:24]) & 0xffff
+	switch p.linkType {
+	case linkNull, linkEthernet, linkRawAlt, linkRawAlt2, linkRaw,
+		linkLoop, linkSLL, linkSLL2:
+	default:
+		return nil, fmt.Errorf("unsupported link type %v", p.linkType)
+	}
+	return p, nil
+}
+
+// Read the next packet, returning its capture time and captured
+// bytes. Returns io.EOF at the end of the file.
+func (p *packetReader) next() (time.Time, []byte, error) {
+	if _, err := io.ReadFull(p.r, p.hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// a capture cut short
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+	sec := int64(p.order.Uint32(p.hdr[0:4]))
+	frac := int64(p.order.Uint32(p.hdr[4:8]))
+	if !p.nanos {
+		frac *= 1000
+	}
+	inclLen := p.order.Uint32(p.hdr[8:12])
+	if inclLen > 1<<24 {
+		return time.Time{}, nil, fmt.Errorf("bad packet length %v", inclLen)
+	}
+	data := make([]byte, inclLen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+	return time.Unix(sec, frac), data, nil
+}
+
+// Find the IP packet in a link-layer frame, returning nil if it does
+// not carry IP.
+func (p *packetReader) network(frame []byte) []byte {
+	var etherType uint16
+	switch p.linkType {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(frame) < 4 {
+				return nil
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+	case linkSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+		frame = frame[16:]
+	case linkSLL2:
+		if len(frame) < 20 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[0:2])
+		frame = frame[20:]
+	case linkNull, linkLoop:
+		if len(frame) < 4 {
+			return nil
+		}
+		// The address family is in the byte order of the
+		// capturing host for null links, and in network
+		// order for loop links; it is small either way.
+		family := binary.BigEndian.Uint32(frame[0:4])
+		if p.linkType == linkNull && family > 0xffff {
+			family = binary.LittleEndian.Uint32(frame[0:4])
+		}
+		frame = frame[4:]
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30:
+			// AF_INET6 on Linux, and on the BSDs and OS X
+			etherType = etherTypeIPv6
+		default:
+			return nil
+		}
+	default:
+		// raw IP: tell the version from the packet itself
+		if len(frame) == 0 {
+			return nil
+		}
+		switch frame[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil
+	}
+	return frame
+}
+
+// Parse the TCP segment in an IPv4 or IPv6 packet, returning false
+// if the packet does not carry a whole TCP header.
+func parseTCP(t time.Time, packet []byte) (*segment, bool) {
+	if len(packet) == 0 {
+		return nil, false
+	}
+	var srcIP, dstIP net.IP
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil, false
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+		fragOffset := binary.BigEndian.Uint16(packet[6:8]) & 0x1fff
+		moreFrags := packet[6]&0x20 != 0
+		if packet[9] != 6 || fragOffset != 0 || moreFrags ||
+			ihl < 20 || totalLen < ihl {
+			return nil, false
+		}
+		srcIP = net.IP(packet[12:16])
+		dstIP = net.IP(packet[16:20])
+		if totalLen > len(packet) {
+			// truncated by the capture's snap length
+			totalLen = len(packet)
+		}
+		if ihl > totalLen {
+			return nil, false
+		}
+		tcp = packet[ihl:totalLen]
+	case 6:
+		if len(packet) < 40 {
+			return nil, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if end > len(packet) {
+			end = len(packet)
+		}
+		srcIP = net.IP(packet[8:24])
+		dstIP = net.IP(packet[24:40])
+		next := packet[6]
+		rest := packet[40:end]
+		// skip extension headers
+		for next == 0 || next == 43 || next == 60 {
+			if len(rest) < 8 {
+				return nil, false
+			}
+			hdrLen := (int(rest[1]) + 1) * 8
+			if hdrLen > len(rest) {
+				return nil, false
+			}
+			next = rest[0]
+			rest = rest[hdrLen:]
+		}
+		if next != 6 {
+			return nil, false
+		}
+		tcp = rest
+	default:
+		return nil, false
+	}
+
+	if len(tcp) < 20 {
+		return nil, false
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return nil, false
+	}
+	flags := tcp[13]
+	return &segment{
+		time: t,
+		src: net.TCPAddr{
+			IP:   srcIP,
+			Port: int(binary.BigEndian.Uint16(tcp[0:2])),
+		},
+		dst: net.TCPAddr{
+			IP:   dstIP,
+			Port: int(binary.BigEndian.Uint16(tcp[2:4])),
+		},
+		seq:     binary.BigEndian.Uint32(tcp[4:8]),
+		fin:     flags&0x01 != 0,
+		syn:     flags&0x02 != 0,
+		rst:     flags&0x04 != 0,
+		payload: tcp[dataOffset:],
+	}, true
+}
@@ -0,0 +1,257 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uhoh-itsmaciek/femebe/capture"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+// Builds pcap files of TCP traffic for tests
+type pcapBuilder struct {
+	buf      bytes.Buffer
+	linkType uint32
+	now      time.Time
+}
+
+func newPcapBuilder(linkType uint32) *pcapBuilder {
+	b := &pcapBuilder{linkType: linkType, now: time.Unix(1400000000, 0)}
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkType)
+	b.buf.Write(hdr[:])
+	return b
+}
+
+const (
+	synFlag = 0x02
+	ackFlag = 0x10
+)
+
+// Add a TCP segment from src to dst, a millisecond after the last
+func (b *pcapBuilder) segment(src, dst *net.TCPAddr, seq uint32,
+	flags byte, payload []byte) {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	var frame []byte
+	if ip4 := src.IP.To4(); ip4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:16], ip4)
+		copy(ip[16:20], dst.IP.To4())
+		frame = append(ip, tcp...)
+		if b.linkType == linkEthernet {
+			eth := make([]byte, 14)
+			binary.BigEndian.PutUint16(eth[12:14], etherTypeIPv4)
+			frame = append(eth, frame...)
+		}
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:24], src.IP.To16())
+		copy(ip[24:40], dst.IP.To16())
+		frame = append(ip, tcp...)
+	}
+
+	b.now = b.now.Add(time.Millisecond)
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(b.now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(b.now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(frame)))
+	b.buf.Write(hdr[:])
+	b.buf.Write(frame)
+}
+
+// One side of a TCP connection being built
+type tcpSide struct {
+	b        *pcapBuilder
+	src, dst *net.TCPAddr
+	seq      uint32
+}
+
+func (s *tcpSide) syn() {
+	s.b.segment(s.src, s.dst, s.seq, synFlag, nil)
+	s.seq++
+}
+
+func (s *tcpSide) send(data []byte) {
+	s.b.segment(s.src, s.dst, s.seq, ackFlag, data)
+	s.seq += uint32(len(data))
+}
+
+func wire(init ...func(m *core.Message)) []byte {
+	var buf bytes.Buffer
+	for _, i := range init {
+		var m core.Message
+		i(&m)
+		m.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+func startup(m *core.Message) {
+	proto.InitStartupMessage(m, map[string]string{"user": "test"})
+}
+
+func rfq(m *core.Message) {
+	proto.InitReadyForQuery(m, proto.RfqIdle)
+}
+
+func sslRequest(m *core.Message) {
+	m.InitFromBytes(core.MsgTypeFirst, []byte{0x04, 0xd2, 0x16, 0x2f})
+}
+
+func messageTypes(records []capture.Record) string {
+	var types []byte
+	for _, rec := range records {
+		t := rec.Msg.MsgType()
+		if t == core.MsgTypeFirst {
+			t = '0'
+		}
+		types = append(types, byte(rec.Dir), t, ' ')
+	}
+	return string(bytes.TrimSpace(types))
+}
+
+func TestReadEthernet(t *testing.T) {
+	b := newPcapBuilder(linkEthernet)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	serverAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5432}
+	client := &tcpSide{b, clientAddr, serverAddr, 1000}
+	server := &tcpSide{b, serverAddr, clientAddr, 5000}
+
+	client.syn()
+	server.syn()
+	// The startup packet arrives out of order, with a
+	// retransmission
+	s := wire(startup)
+	b.segment(clientAddr, serverAddr, client.seq+5, ackFlag, s[5:])
+	b.segment(clientAddr, serverAddr, client.seq, ackFlag, s[:5])
+	client.send(s)
+	server.send(wire(proto.InitAuthenticationOk, rfq))
+	client.send(wire(func(m *core.Message) {
+		proto.InitQuery(m, "SELECT 1")
+	}))
+	server.send(wire(func(m *core.Message) {
+		proto.InitCommandComplete(m, "SELECT 1")
+	}, rfq))
+
+	// A connection that negotiates TLS away, and is then cut off
+	// mid-message
+	clientAddr2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40001}
+	client2 := &tcpSide{b, clientAddr2, serverAddr, 7000}
+	server2 := &tcpSide{b, serverAddr, clientAddr2, 9000}
+	client2.syn()
+	server2.syn()
+	client2.send(wire(sslRequest))
+	server2.send([]byte{'N'})
+	client2.send(wire(startup))
+	auth := wire(proto.InitAuthenticationOk)
+	server2.send(auth[:len(auth)-1])
+
+	// A connection already underway when the capture started
+	clientAddr3 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40002}
+	client3 := &tcpSide{b, clientAddr3, serverAddr, 100}
+	client3.send(wire(func(m *core.Message) {
+		proto.InitQuery(m, "SELECT 1")
+	}))
+
+	conns, err := Read(&b.buf, DefaultPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 3 {
+		t.Fatalf("got %v connections; want 3", len(conns))
+	}
+
+	c := conns[0]
+	if c.Err != nil {
+		t.Errorf("unexpected error %v", c.Err)
+	}
+	if c.First != FirstStartupMessage || c.Client.Port != 40000 ||
+		c.Server.Port != 5432 {
+		t.Errorf("got %v connection from %v to %v", c.First, c.Client, c.Server)
+	}
+	want := "F0 BR BZ FQ BC BZ"
+	if got := messageTypes(c.Records); got != want {
+		t.Errorf("got messages %v; want %v", got, want)
+	}
+	for i := 1; i < len(c.Records); i++ {
+		if c.Records[i].Time.Before(c.Records[i-1].Time) {
+			t.Errorf("records out of order at %v", i)
+		}
+	}
+
+	c = conns[1]
+	if c.First != FirstSSLRequest || c.Encrypted {
+		t.Errorf("got %v connection, encrypted %v; want unencrypted SSLRequest",
+			c.First, c.Encrypted)
+	}
+	if c.Err == nil {
+		t.Errorf("expected error for truncated message")
+	}
+	if got := messageTypes(c.Records); got != "F0 F0" {
+		t.Errorf("got messages %v; want F0 F0", got)
+	}
+
+	if conns[2].Err != ErrNoStart {
+		t.Errorf("got error %v; want ErrNoStart", conns[2].Err)
+	}
+}
+
+func TestReadRawIPv6TLS(t *testing.T) {
+	b := newPcapBuilder(linkRaw)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 40000}
+	serverAddr := &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 6432}
+	client := &tcpSide{b, clientAddr, serverAddr, 1}
+	server := &tcpSide{b, serverAddr, clientAddr, 1}
+	client.syn()
+	server.syn()
+	client.send(wire(sslRequest))
+	server.send([]byte{'S'})
+	client.send([]byte("\x16\x03\x01 TLS handshake"))
+
+	conns, err := Read(&b.buf, 6432)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("got %v connections; want 1", len(conns))
+	}
+	c := conns[0]
+	if c.First != FirstSSLRequest || !c.Encrypted || len(c.Records) != 1 {
+		t.Errorf("got %v connection, encrypted %v, %v records; "+
+			"want encrypted SSLRequest", c.First, c.Encrypted, len(c.Records))
+	}
+	if !c.Client.IP.Equal(clientAddr.IP) {
+		t.Errorf("got client %v; want %v", c.Client, clientAddr)
+	}
+}
+
+func TestReadPcapNG(t *testing.T) {
+	ng := []byte{0x0a, 0x0d, 0x0d, 0x0a}
+	ng = append(ng, make([]byte, 20)...)
+	if _, err := Read(bytes.NewReader(ng), DefaultPort); err != ErrPcapNG {
+		t.Errorf("got error %v; want ErrPcapNG", err)
+	}
+}
@@ -0,0 +1,360 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/capture"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// FirstMessage identifies the packet a frontend starts a connection
+// with.
+type FirstMessage int
+
+const (
+	// Nothing could be decoded
+	FirstUnknown FirstMessage = iota
+	FirstStartupMessage
+	FirstSSLRequest
+	FirstGSSENCRequest
+	FirstCancelRequest
+)
+
+func (f FirstMessage) String() string {
+	switch f {
+	case FirstStartupMessage:
+		return "StartupMessage"
+	case FirstSSLRequest:
+		return "SSLRequest"
+	case FirstGSSENCRequest:
+		return "GSSENCRequest"
+	case FirstCancelRequest:
+		return "CancelRequest"
+	}
+	return "unknown"
+}
+
+var ErrNoStart = errors.New("the start of the connection was not captured")
+
+// Conn is a single Postgres connection found in a capture.
+type Conn struct {
+	Client net.TCPAddr
+	Server net.TCPAddr
+	// The time of the first packet
+	Start time.Time
+	First FirstMessage
+	// Whether the connection switched to TLS or GSSAPI
+	// encryption, after which nothing more can be decoded
+	Encrypted bool
+	// The messages sent in both directions, in the order they
+	// were captured
+	Records []capture.Record
+	// Why decoding stopped early, if it did: packets were missing
+	// or truncated, the start of the connection was not
+	// captured, or the data did not make sense as protocol
+	// messages.
+	Err error
+}
+
+// One direction of a TCP connection
+type halfStream struct {
+	// Sequence number of the first byte, known once the SYN is
+	// seen
+	base     uint32
+	haveBase bool
+	segs     []*segment
+}
+
+// Byte offsets into a reassembled stream paired with the time at
+// which all bytes up to them had been captured
+type chunkTime struct {
+	end  int
+	time time.Time
+}
+
+type bySeq struct {
+	segs []*segment
+	base uint32
+}
+
+func (s bySeq) Len() int      { return len(s.segs) }
+func (s bySeq) Swap(i, j int) { s.segs[i], s.segs[j] = s.segs[j], s.segs[i] }
+func (s bySeq) Less(i, j int) bool {
+	return s.segs[i].seq-s.base < s.segs[j].seq-s.base
+}
+
+// Put the stream back together from its segments, up to the first
+// missing byte.
+func (h *halfStream) assemble() ([]byte, []chunkTime, error) {
+	if len(h.segs) == 0 {
+		return nil, nil, nil
+	}
+	if !h.haveBase {
+		h.base = h.segs[0].seq
+	}
+	sort.Stable(bySeq{h.segs, h.base})
+
+	var data []byte
+	var times []chunkTime
+	var latest time.Time
+	for _, seg := range h.segs {
+		rel := seg.seq - h.base
+		if rel >= 1<<31 {
+			// from before the start of the stream
+			continue
+		}
+		start := int(rel)
+		if start > len(data) {
+			return data, times, fmt.Errorf("missing data after byte %v",
+				len(data))
+		}
+		if start+len(seg.payload) <= len(data) {
+			// retransmitted
+			continue
+		}
+		data = append(data, seg.payload[len(data)-start:]...)
+		if seg.time.After(latest) {
+			latest = seg.time
+		}
+		times = append(times, chunkTime{len(data), latest})
+	}
+	return data, times, nil
+}
+
+// The time by which the first end bytes had been captured
+func timeAt(times []chunkTime, end int) time.Time {
+	i := sort.Search(len(times), func(i int) bool {
+		return times[i].end >= end
+	})
+	if i == len(times) {
+		i--
+	}
+	return times[i].time
+}
+
+type readOnly struct {
+	io.Reader
+}
+
+func (readOnly) Write(p []byte) (int, error) {
+	return 0, errors.New("captured streams are read-only")
+}
+
+func (readOnly) Close() error {
+	return nil
+}
+
+// Decode messages from s, whose first byte is at offset in its
+// stream, until the end of the data or the first error, appending
+// them to records. If limit is positive, stop after that many
+// messages. Returns the records, the offset just past the last
+// message and the error, which is nil at the end of the data.
+func decode(s core.Stream, dir capture.Direction, offset int,
+	times []chunkTime, limit int,
+	records []capture.Record) ([]capture.Record, int, error) {
+	var m core.Message
+	for n := 0; limit <= 0 || n < limit; n++ {
+		if err := s.Next(&m); err == io.EOF {
+			return records, offset, nil
+		} else if err != nil {
+			return records, offset, err
+		}
+		if _, err := m.Force(); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				err = errors.New("message cut short")
+			}
+			return records, offset, err
+		}
+		if m.MsgType() != core.MsgTypeFirst {
+			offset++
+		}
+		offset += int(m.Size())
+		records = append(records, capture.Record{
+			Dir:  dir,
+			Time: timeAt(times, offset),
+		})
+		records[len(records)-1].Msg.InitFromMessage(&m)
+	}
+	return records, offset, nil
+}
+
+func startupCode(m *core.Message) uint32 {
+	payload, _ := m.Force()
+	if len(payload) < 4 {
+		return 0
+	}
+	return uint32(payload[0])<<24 | uint32(payload[1])<<16 |
+		uint32(payload[2])<<8 | uint32(payload[3])
+}
+
+const gssEncRequestCode = 80877104
+
+type tcpConn struct {
+	conn   *Conn
+	client halfStream
+	server halfStream
+	// Whether the client's SYN was captured
+	started bool
+}
+
+// Reassemble and decode the connection.
+func (c *tcpConn) decode() {
+	conn := c.conn
+	if !c.started {
+		conn.Err = ErrNoStart
+		return
+	}
+	feData, feTimes, feErr := c.client.assemble()
+	beData, beTimes, beErr := c.server.assemble()
+	if feErr != nil {
+		conn.Err = fmt.Errorf("frontend stream: %v", feErr)
+	} else if beErr != nil {
+		conn.Err = fmt.Errorf("backend stream: %v", beErr)
+	}
+
+	fe := core.NewFrontendStream(readOnly{bytes.NewReader(feData)})
+	feRecords, feOffset, err := decode(fe, capture.FromFrontend, 0,
+		feTimes, 1, nil)
+	if err != nil && conn.Err == nil {
+		conn.Err = fmt.Errorf("frontend stream: %v", err)
+	}
+	if len(feRecords) == 0 {
+		return
+	}
+
+	first := &feRecords[0].Msg
+	beStart := 0
+	switch {
+	case proto.IsStartupMessage(first):
+		conn.First = FirstStartupMessage
+	case proto.IsSSLRequest(first), startupCode(first) == gssEncRequestCode:
+		conn.First = FirstSSLRequest
+		if startupCode(first) == gssEncRequestCode {
+			conn.First = FirstGSSENCRequest
+		}
+		// The backend answers with a single byte, not a
+		// message: 'N' to go on unencrypted.
+		if len(beData) > 0 {
+			if beData[0] != 'N' {
+				conn.Encrypted = true
+				conn.Records = feRecords
+				return
+			}
+			beStart = 1
+		}
+	case proto.IsCancelRequest(first):
+		conn.First = FirstCancelRequest
+	}
+
+	feRecords, _, err = decode(fe, capture.FromFrontend, feOffset,
+		feTimes, 0, feRecords)
+	if err != nil && conn.Err == nil {
+		conn.Err = fmt.Errorf("frontend stream: %v", err)
+	}
+
+	var beRecords []capture.Record
+	if len(beData) > beStart {
+		be := core.NewBackendStream(readOnly{bytes.NewReader(beData[beStart:])})
+		beRecords, _, err = decode(be, capture.FromBackend, beStart,
+			beTimes, 0, nil)
+		if err != nil && conn.Err == nil {
+			conn.Err = fmt.Errorf("backend stream: %v", err)
+		}
+	}
+
+	conn.Records = append(feRecords, beRecords...)
+	sort.Stable(byTime(conn.Records))
+}
+
+type byTime []capture.Record
+
+func (r byTime) Len() int           { return len(r) }
+func (r byTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byTime) Less(i, j int) bool { return r[i].Time.Before(r[j].Time) }
+
+// Read the pcap file in r and return the Postgres connections to the
+// given server port found in it, in the order they started. Errors
+// in individual connections are reported in their Err fields; an
+// error is only returned if r cannot be read as a pcap file.
+func Read(r io.Reader, port int) ([]*Conn, error) {
+	p, err := newPacketReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []*tcpConn
+	open := make(map[string]*tcpConn)
+	for {
+		t, frame, err := p.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		packet := p.network(frame)
+		if packet == nil {
+			continue
+		}
+		seg, ok := parseTCP(t, packet)
+		if !ok {
+			continue
+		}
+
+		var client, server net.TCPAddr
+		fromClient := seg.dst.Port == port
+		if fromClient {
+			client, server = seg.src, seg.dst
+		} else if seg.src.Port == port {
+			client, server = seg.dst, seg.src
+		} else {
+			continue
+		}
+
+		key := client.String() + " " + server.String()
+		c := open[key]
+		if fromClient && seg.syn && c != nil &&
+			(c.started || len(c.client.segs) > 0) &&
+			(!c.client.haveBase || seg.seq+1 != c.client.base) {
+			// the client port was reused for a new
+			// connection
+			c = nil
+		}
+		if c == nil {
+			c = &tcpConn{conn: &Conn{
+				Client: client,
+				Server: server,
+				Start:  t,
+			}}
+			open[key] = c
+			conns = append(conns, c)
+		}
+
+		half := &c.server
+		if fromClient {
+			half = &c.client
+		}
+		if seg.syn {
+			half.base = seg.seq + 1
+			half.haveBase = true
+			if fromClient {
+				c.started = true
+			}
+		}
+		if len(seg.payload) > 0 {
+			half.segs = append(half.segs, seg)
+		}
+	}
+
+	result := make([]*Conn, len(conns))
+	for i, c := range conns {
+		c.decode()
+		result[i] = c.conn
+	}
+	return result, nil
+}
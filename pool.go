@@ -0,0 +1,954 @@
+package femebe
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/auth"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PoolConfig controls how backend connections are pooled.
+type PoolConfig struct {
+	// The maximum number of backend connections per pool key,
+	// whether idle or in use. Frontends needing a backend when
+	// the limit is reached wait for one to be returned. Zero
+	// means no limit.
+	MaxSize int
+	// Authenticates frontends before they are handed to the
+	// pool. If nil, every frontend is let in.
+	Authenticator auth.Authenticator
+	// The query run on a backend to clean up after a frontend in
+	// session pooling mode. Defaults to DISCARD ALL.
+	ResetQuery string
+	// How long a backend may sit idle in the pool before it is
+	// closed. Zero means forever.
+	IdleTimeout time.Duration
+	// How long a backend may be used in total: once exceeded, it
+	// is closed rather than returned to the pool. Zero means no
+	// limit.
+	MaxLifetime time.Duration
+}
+
+const defaultResetQuery = "DISCARD ALL"
+
+// A backend connection owned by a pool, along with the state it
+// reported when it started up.
+type pooledBackend struct {
+	stream core.Stream
+	key    string
+	// ParameterStatus values reported at startup
+	params     map[string]string
+	backendPid uint32
+	secretKey  uint32
+	connector  Connector
+	created    time.Time
+	idleSince  time.Time
+}
+
+// The backends for a single pool key
+type keyPool struct {
+	idle  []*pooledBackend
+	total int
+}
+
+// backendPool keeps a bounded set of started-up backend connections
+// per pool key, connecting through the Resolver as needed.
+type backendPool struct {
+	resolver Resolver
+	config   PoolConfig
+
+	lock  sync.Mutex
+	avail *sync.Cond
+	pools map[string]*keyPool
+	// Pending check for expired idle backends, if any
+	reaper *time.Timer
+}
+
+func newBackendPool(resolver Resolver, config PoolConfig) *backendPool {
+	p := &backendPool{
+		resolver: resolver,
+		config:   config,
+		pools:    make(map[string]*keyPool),
+	}
+	p.avail = sync.NewCond(&p.lock)
+	return p
+}
+
+// Identify the pool for a set of startup parameters by user and
+// database, which is what Postgres itself uses to set up a session.
+func userDatabaseKey(params map[string]string) string {
+	db, ok := params["database"]
+	if !ok {
+		db = params["user"]
+	}
+	return params["user"] + "\000" + db
+}
+
+// Identify the pool for a set of startup parameters by all of them,
+// since any of them may affect the session.
+func startupParamsKey(params map[string]string) string {
+	pairs := make([]string, 0, len(params))
+	for name, value := range params {
+		pairs = append(pairs, name+"\000"+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\000")
+}
+
+// Whether be has outlived the pool's limits as of now
+func (p *backendPool) expired(be *pooledBackend, now time.Time) bool {
+	c := p.config
+	return (c.MaxLifetime > 0 && now.Sub(be.created) >= c.MaxLifetime) ||
+		(c.IdleTimeout > 0 && now.Sub(be.idleSince) >= c.IdleTimeout)
+}
+
+// Take an idle backend from the pool for key, or connect a new one
+// using params, waiting for one to become available if the pool is
+// full.
+func (p *backendPool) acquire(key string, params map[string]string) (*pooledBackend, error) {
+	p.lock.Lock()
+	kp, ok := p.pools[key]
+	if !ok {
+		kp = &keyPool{}
+		p.pools[key] = kp
+	}
+	for {
+		if n := len(kp.idle); n > 0 {
+			be := kp.idle[n-1]
+			kp.idle[n-1] = nil
+			kp.idle = kp.idle[:n-1]
+			if p.expired(be, time.Now()) {
+				p.lock.Unlock()
+				p.discard(be)
+				p.lock.Lock()
+				continue
+			}
+			p.lock.Unlock()
+			return be, nil
+		}
+		if p.config.MaxSize == 0 || kp.total < p.config.MaxSize {
+			break
+		}
+		p.avail.Wait()
+	}
+	// Reserve a slot before connecting without the lock held
+	kp.total++
+	p.lock.Unlock()
+
+	be, err := p.connect(key, params)
+	if err != nil {
+		p.lock.Lock()
+		kp.total--
+		p.avail.Broadcast()
+		p.lock.Unlock()
+		return nil, err
+	}
+	return be, nil
+}
+
+func (p *backendPool) connect(key string, params map[string]string) (*pooledBackend, error) {
+	connector := p.resolver.Resolve(params)
+	stream, err := connector.Startup()
+	if err != nil {
+		return nil, err
+	}
+	be := &pooledBackend{
+		stream:    stream,
+		key:       key,
+		params:    make(map[string]string),
+		connector: connector,
+		created:   time.Now(),
+	}
+	if err = be.readStartup(); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return be, nil
+}
+
+// Consume the rest of the backend's startup sequence, up to the
+// first ReadyForQuery, recording its parameters and key data.
+func (be *pooledBackend) readStartup() error {
+	var m core.Message
+	for {
+		if err := be.stream.Next(&m); err != nil {
+			return err
+		}
+		switch m.MsgType() {
+		case proto.MsgAuthenticationOkR:
+			a, err := proto.ReadAuthentication(&m)
+			if err != nil {
+				return err
+			}
+			if a.Type != proto.AuthOk {
+				return fmt.Errorf("backend requested authentication "+
+					"type %v; use a password Connector", a.Type)
+			}
+		case proto.MsgParameterStatusS:
+			if err := be.recordParameter(&m); err != nil {
+				return err
+			}
+		case proto.MsgBackendKeyDataK:
+			kd, err := proto.ReadBackendKeyData(&m)
+			if err != nil {
+				return err
+			}
+			be.backendPid = kd.BackendPid
+			be.secretKey = kd.SecretKey
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return err
+			}
+			return er
+		case proto.MsgReadyForQueryZ:
+			return m.Discard()
+		default:
+			if err := m.Discard(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Note the value reported by the ParameterStatus message m.
+func (be *pooledBackend) recordParameter(m *core.Message) error {
+	ps, err := proto.ReadParameterStatus(m)
+	if err != nil {
+		return err
+	}
+	be.params[ps.Name] = ps.Value
+	return nil
+}
+
+// Return a backend that is idle and outside any transaction to the
+// pool, or close it if it has outlived MaxLifetime.
+func (p *backendPool) release(be *pooledBackend) {
+	be.idleSince = time.Now()
+	if p.expired(be, be.idleSince) {
+		p.discard(be)
+		return
+	}
+	p.lock.Lock()
+	kp := p.pools[be.key]
+	kp.idle = append(kp.idle, be)
+	p.avail.Signal()
+	p.scheduleReap()
+	p.lock.Unlock()
+}
+
+// Arrange for expired idle backends to be closed, unless that is
+// already arranged or backends never expire. Called with the lock
+// held.
+func (p *backendPool) scheduleReap() {
+	interval := p.config.IdleTimeout
+	if l := p.config.MaxLifetime; l > 0 && (interval == 0 || l < interval) {
+		interval = l
+	}
+	if p.reaper != nil || interval == 0 {
+		return
+	}
+	p.reaper = time.AfterFunc(interval, p.reap)
+}
+
+// Close expired idle backends, checking again later while any idle
+// ones remain.
+func (p *backendPool) reap() {
+	var expired []*pooledBackend
+	now := time.Now()
+	p.lock.Lock()
+	p.reaper = nil
+	remaining := false
+	for _, kp := range p.pools {
+		idle := kp.idle[:0]
+		for _, be := range kp.idle {
+			if p.expired(be, now) {
+				expired = append(expired, be)
+			} else {
+				idle = append(idle, be)
+			}
+		}
+		for i := len(idle); i < len(kp.idle); i++ {
+			kp.idle[i] = nil
+		}
+		kp.idle = idle
+		remaining = remaining || len(idle) > 0
+	}
+	if remaining {
+		p.scheduleReap()
+	}
+	p.lock.Unlock()
+
+	for _, be := range expired {
+		p.discard(be)
+	}
+}
+
+func (p *backendPool) resetQuery() string {
+	if p.config.ResetQuery == "" {
+		return defaultResetQuery
+	}
+	return p.config.ResetQuery
+}
+
+// Close a backend that cannot be reused and free its slot in the
+// pool.
+func (p *backendPool) discard(be *pooledBackend) {
+	var m core.Message
+	proto.InitTerminate(&m)
+	if be.stream.Send(&m) == nil {
+		be.stream.Flush()
+	}
+	be.stream.Close()
+
+	p.lock.Lock()
+	p.pools[be.key].total--
+	p.avail.Broadcast()
+	p.lock.Unlock()
+}
+
+// PoolingSessionManager is a SessionManager that makes its own
+// Sessions, sharing a pool of backend connections between them.
+type PoolingSessionManager interface {
+	SessionManager
+	// Make a Session for the frontend fe, which has sent a
+	// StartupMessage with the given parameters and is waiting
+	// for the authentication exchange.
+	NewSession(fe core.Stream, params map[string]string) Session
+}
+
+type txnPoolManager struct {
+	pool    *backendPool
+	cancels *CancelRegistry
+}
+
+// Return a PoolingSessionManager that multiplexes frontends over a
+// pool of backend connections per (user, database): a frontend is
+// given a backend when it starts sending a request and keeps it only
+// until the backend reports it is idle again outside a transaction,
+// as pgbouncer does in transaction pooling mode. Session state
+// (SET, named prepared statements, advisory locks and the like)
+// therefore does not carry over between transactions.
+//
+// Frontends see the ParameterStatus values of the backend they
+// were first given. Since the backend they are talking to changes
+// over the life of the session, they are sent BackendKeyData made up
+// for the session, and their cancellation requests go to whichever
+// backend the session is using at the time.
+func NewTransactionPoolingSessionManager(resolver Resolver,
+	config PoolConfig) PoolingSessionManager {
+	return &txnPoolManager{
+		pool:    newBackendPool(resolver, config),
+		cancels: NewCancelRegistry(),
+	}
+}
+
+func (t *txnPoolManager) NewSession(fe core.Stream,
+	params map[string]string) Session {
+	return &txnPoolSession{
+		pool:    t.pool,
+		cancels: t.cancels,
+		fe:      fe,
+		params:  params,
+		key:     userDatabaseKey(params),
+	}
+}
+
+func (t *txnPoolManager) RunSession(session Session) error {
+	return session.Run()
+}
+
+func (t *txnPoolManager) Cancel(backendPid, secretKey uint32) error {
+	return t.cancels.Cancel(backendPid, secretKey)
+}
+
+// Authenticate the frontend and get it a backend from the pool,
+// sending (but not flushing) everything a backend would after
+// authentication: the parameters the backend reported, the given
+// key data and ReadyForQuery.
+func greetFrontend(fe core.Stream, pool *backendPool, key string,
+	params map[string]string, backendPid, secretKey uint32) (*pooledBackend, error) {
+	a := pool.config.Authenticator
+	if a == nil {
+		a = auth.NewTrustAuthenticator()
+	}
+	if err := a.Authenticate(fe, params["user"]); err != nil {
+		return nil, err
+	}
+
+	be, err := pool.acquire(key, params)
+	if err != nil {
+		sendFatal(fe, err)
+		return nil, err
+	}
+
+	var m core.Message
+	for name, value := range be.params {
+		proto.InitParameterStatus(&m, name, value)
+		if err = fe.Send(&m); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		proto.InitBackendKeyData(&m, backendPid, secretKey)
+		err = fe.Send(&m)
+	}
+	if err == nil {
+		proto.InitReadyForQuery(&m, proto.RfqIdle)
+		err = fe.Send(&m)
+	}
+	if err != nil {
+		// the backend has not been used yet
+		pool.release(be)
+		return nil, err
+	}
+	return be, nil
+}
+
+// Report err to the frontend as a FATAL ErrorResponse, passing
+// along backend errors as they are.
+func sendFatal(fe core.Stream, err error) {
+	var m core.Message
+	if er, ok := err.(*proto.ErrorResponse); ok {
+		proto.InitErrorResponse(&m, er.Details)
+	} else {
+		proto.InitErrorResponse(&m, map[byte]string{
+			'S': "FATAL",
+			'V': "FATAL",
+			// connection_failure
+			'C': "08006",
+			'M': err.Error(),
+		})
+	}
+	if fe.Send(&m) == nil {
+		fe.Flush()
+	}
+}
+
+type txnPoolSession struct {
+	pool    *backendPool
+	cancels *CancelRegistry
+	fe      core.Stream
+	params  map[string]string
+	key     string
+	feBuf   core.Message
+
+	// Guards the fields below, which are shared with the
+	// goroutine routing messages from the bound backend
+	lock sync.Mutex
+	// The key data issued to the frontend
+	backendPid uint32
+	secretKey  uint32
+	be         *pooledBackend
+	// ReadyForQuery messages the bound backend still owes
+	pending int
+	// Whether messages have been sent since the last Sync or
+	// Query, in which case the backend cannot be given up yet
+	unsynced bool
+	// Set once the frontend is gone, so backend routing knows
+	// its errors are expected
+	closing bool
+	beErr   error
+
+	routing sync.WaitGroup
+}
+
+func (s *txnPoolSession) Run() (err error) {
+	pid, key, err := s.issueKeyData()
+	if err != nil {
+		return err
+	}
+	defer s.cancels.Unregister(pid, key)
+	be, err := greetFrontend(s.fe, s.pool, s.key, s.params, pid, key)
+	if err != nil {
+		return err
+	}
+	// Backends are only bound once the frontend sends a request,
+	// so give this one back before the frontend can send one
+	s.pool.release(be)
+	if err = s.fe.Flush(); err != nil {
+		return err
+	}
+	defer func() {
+		s.lock.Lock()
+		s.closing = true
+		if s.be != nil {
+			// Still bound, perhaps mid-transaction: the
+			// backend cannot be reused, and closing it
+			// stops its routing goroutine.
+			s.be.stream.Close()
+		}
+		s.lock.Unlock()
+		s.routing.Wait()
+		if err == nil {
+			err = s.beErr
+		}
+	}()
+
+	for {
+		if err = s.fe.Next(&s.feBuf); err != nil {
+			return err
+		}
+		if s.feBuf.MsgType() == proto.MsgTerminateX {
+			return nil
+		}
+		var be *pooledBackend
+		be, err = s.bind()
+		if err != nil {
+			return err
+		}
+		if be == nil {
+			// nothing for a backend to do
+			if err = s.feBuf.Discard(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = be.stream.Send(&s.feBuf); err != nil {
+			return err
+		}
+		if !s.fe.HasNext() {
+			if err = be.stream.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Get the backend for the message in feBuf, acquiring one from the
+// pool if none is bound, and account for the response it will
+// produce. The backend is checked and the response accounted for
+// under a single lock hold, so that it cannot be released between
+// the two. Returns a nil backend for a message that no backend
+// needs: a Flush, or the rest of a COPY the backend gave up on,
+// when none is bound.
+func (s *txnPoolSession) bind() (*pooledBackend, error) {
+	s.lock.Lock()
+	be := s.be
+	if be != nil {
+		s.expectResponse()
+		s.lock.Unlock()
+		return be, nil
+	}
+	s.lock.Unlock()
+	switch s.feBuf.MsgType() {
+	case proto.MsgFlushH, proto.MsgCopyDataD, proto.MsgCopyDoneC,
+		proto.MsgCopyFailF:
+		return nil, nil
+	}
+
+	// Only this goroutine binds backends, so it is safe to wait on
+	// the pool without the lock held.
+	be, err := s.pool.acquire(s.key, s.params)
+	if err != nil {
+		sendFatal(s.fe, err)
+		return nil, err
+	}
+	s.lock.Lock()
+	s.be = be
+	s.expectResponse()
+	s.lock.Unlock()
+	// The goroutine routing the previous backend may still be
+	// flushing to the frontend
+	s.routing.Wait()
+	s.routing.Add(1)
+	go s.routeBackend(be)
+	return be, nil
+}
+
+// Account for the response to the message in feBuf. Called with the
+// lock held.
+func (s *txnPoolSession) expectResponse() {
+	switch s.feBuf.MsgType() {
+	case proto.MsgQueryQ, proto.MsgSyncS, proto.MsgFunctionCallF:
+		s.pending++
+		s.unsynced = false
+	case proto.MsgParseP, proto.MsgBindB, proto.MsgDescribeD,
+		proto.MsgExecuteE, proto.MsgCloseC:
+		s.unsynced = true
+	}
+}
+
+// Forward messages from be to the frontend until be is released or
+// fails.
+func (s *txnPoolSession) routeBackend(be *pooledBackend) {
+	defer s.routing.Done()
+	var m core.Message
+	for {
+		err := be.stream.Next(&m)
+		if err == nil && m.MsgType() == proto.MsgReadyForQueryZ {
+			var rfq *proto.ReadyForQuery
+			rfq, err = proto.ReadReadyForQuery(&m)
+			if err == nil && s.finishRequest(rfq.ConnStatus) {
+				// Give the backend up before telling the
+				// frontend it is ready, so that its next
+				// request can be served from the pool
+				// right away.
+				s.pool.release(be)
+				proto.InitReadyForQuery(&m, rfq.ConnStatus)
+				if s.fe.Send(&m) == nil {
+					s.fe.Flush()
+				}
+				return
+			}
+			if err == nil {
+				// The payload has been consumed; send a
+				// fresh copy
+				proto.InitReadyForQuery(&m, rfq.ConnStatus)
+			}
+		}
+		if err == nil {
+			err = s.fe.Send(&m)
+		}
+		if err != nil {
+			s.lock.Lock()
+			if s.be == be {
+				s.be = nil
+			}
+			if !s.closing {
+				// The frontend cannot continue its
+				// transaction elsewhere
+				s.beErr = err
+				s.fe.Close()
+			}
+			s.lock.Unlock()
+			s.pool.discard(be)
+			return
+		}
+		if !be.stream.HasNext() {
+			s.fe.Flush()
+		}
+	}
+}
+
+// Account for a ReadyForQuery with the given status from the bound
+// backend, and unbind it if it has nothing left to do for this
+// session.
+func (s *txnPoolSession) finishRequest(status proto.ConnStatus) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending--
+	if s.pending > 0 || s.unsynced || status != proto.RfqIdle {
+		return false
+	}
+	s.be = nil
+	s.pending = 0
+	return true
+}
+
+// Make up key data for the frontend to cancel the session's requests
+// with
+func (s *txnPoolSession) issueKeyData() (uint32, uint32, error) {
+	pid, key, err := s.cancels.Issue(0, 0, s)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.lock.Lock()
+	s.backendPid, s.secretKey = pid, key
+	s.lock.Unlock()
+	return pid, key, nil
+}
+
+func (s *txnPoolSession) BackendKeyData() (uint32, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backendPid, s.secretKey
+}
+
+func (s *txnPoolSession) Cancel(backendPid, secretKey uint32) error {
+	s.lock.Lock()
+	be := s.be
+	s.lock.Unlock()
+	if be == nil {
+		// nothing is running
+		return nil
+	}
+	return be.connector.Cancel(be.backendPid, be.secretKey)
+}
+
+type sessionPoolManager struct {
+	pool    *backendPool
+	cancels *CancelRegistry
+}
+
+// Return a PoolingSessionManager that gives each frontend a backend
+// of its own for the whole session, as pgbouncer does in session
+// pooling mode. Backends are pooled by the full set of startup
+// parameters. When a frontend disconnects, its backend is cleaned
+// up with PoolConfig.ResetQuery and returned to the pool, unless the
+// frontend left it mid-request or mid-transaction, in which case it
+// is closed.
+//
+// As with transaction pooling, frontends are sent BackendKeyData made
+// up for the session, since a backend's own key data would outlive
+// the session.
+func NewSessionPoolingSessionManager(resolver Resolver,
+	config PoolConfig) PoolingSessionManager {
+	return &sessionPoolManager{
+		pool:    newBackendPool(resolver, config),
+		cancels: NewCancelRegistry(),
+	}
+}
+
+func (m *sessionPoolManager) NewSession(fe core.Stream,
+	params map[string]string) Session {
+	return &sessionPoolSession{
+		pool:    m.pool,
+		cancels: m.cancels,
+		fe:      fe,
+		params:  params,
+		key:     startupParamsKey(params),
+		status:  proto.RfqIdle,
+	}
+}
+
+func (m *sessionPoolManager) RunSession(session Session) error {
+	return session.Run()
+}
+
+func (m *sessionPoolManager) Cancel(backendPid, secretKey uint32) error {
+	return m.cancels.Cancel(backendPid, secretKey)
+}
+
+type sessionPoolSession struct {
+	pool    *backendPool
+	cancels *CancelRegistry
+	fe      core.Stream
+	params  map[string]string
+	key     string
+	feBuf   core.Message
+
+	// Guards the fields below, which are shared with the
+	// goroutine routing messages from the backend and with
+	// cancellation
+	lock sync.Mutex
+	// Set once, before routing starts
+	be *pooledBackend
+	// The key data issued to the frontend
+	backendPid uint32
+	secretKey  uint32
+	// ReadyForQuery messages the backend still owes
+	pending int
+	// Whether messages have been sent since the last Sync or
+	// Query
+	unsynced bool
+	// Status reported by the last ReadyForQuery
+	status proto.ConnStatus
+	// Set once the frontend is gone
+	closing bool
+	// Set once the frontend is gone and left the backend in a
+	// state where it can be reset and reused
+	resetting bool
+	beErr     error
+
+	routing sync.WaitGroup
+}
+
+func (s *sessionPoolSession) Run() (err error) {
+	pid, key, err := s.cancels.Issue(0, 0, s)
+	if err != nil {
+		return err
+	}
+	defer s.cancels.Unregister(pid, key)
+	s.lock.Lock()
+	s.backendPid, s.secretKey = pid, key
+	s.lock.Unlock()
+	be, err := greetFrontend(s.fe, s.pool, s.key, s.params, pid, key)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.be = be
+	s.lock.Unlock()
+	if err = s.fe.Flush(); err != nil {
+		s.pool.release(s.be)
+		return err
+	}
+	s.routing.Add(1)
+	go s.routeBackend()
+	defer func() {
+		s.lock.Lock()
+		s.closing = true
+		s.resetting = s.beErr == nil && s.pending == 0 &&
+			!s.unsynced && s.status == proto.RfqIdle
+		resetting := s.resetting
+		s.lock.Unlock()
+
+		if resetting {
+			// The routing goroutine takes it from here
+			var m core.Message
+			proto.InitQuery(&m, s.pool.resetQuery())
+			if s.be.stream.Send(&m) != nil || s.be.stream.Flush() != nil {
+				s.be.stream.Close()
+			}
+		} else {
+			// Stops the routing goroutine
+			s.be.stream.Close()
+		}
+		s.routing.Wait()
+		if !resetting {
+			s.pool.discard(s.be)
+		}
+		if err == nil {
+			err = s.beErr
+		}
+	}()
+
+	for {
+		if err = s.fe.Next(&s.feBuf); err != nil {
+			return err
+		}
+		if s.feBuf.MsgType() == proto.MsgTerminateX {
+			return nil
+		}
+		s.lock.Lock()
+		switch s.feBuf.MsgType() {
+		case proto.MsgQueryQ, proto.MsgSyncS, proto.MsgFunctionCallF:
+			s.pending++
+			s.unsynced = false
+		default:
+			s.unsynced = true
+		}
+		s.lock.Unlock()
+		if err = s.be.stream.Send(&s.feBuf); err != nil {
+			return err
+		}
+		if !s.fe.HasNext() {
+			if err = s.be.stream.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Forward messages from the backend to the frontend until the
+// frontend is done with it.
+func (s *sessionPoolSession) routeBackend() {
+	defer s.routing.Done()
+	var m core.Message
+	for {
+		err := s.be.stream.Next(&m)
+		s.lock.Lock()
+		resetting := s.resetting
+		s.lock.Unlock()
+		if resetting {
+			s.finishReset(&m, err)
+			return
+		}
+
+		if err == nil {
+			switch m.MsgType() {
+			case proto.MsgParameterStatusS:
+				// Keep track of settings for the next
+				// frontend; the reset query reports any
+				// it puts back.
+				var payload []byte
+				if payload, err = m.Force(); err == nil {
+					err = s.be.recordParameter(&m)
+				}
+				if err == nil {
+					m.InitFromBytes(proto.MsgParameterStatusS, payload)
+				}
+			case proto.MsgReadyForQueryZ:
+				err = s.finishRequest(&m)
+			}
+		}
+		sendErr := false
+		if err == nil {
+			err = s.fe.Send(&m)
+			sendErr = err != nil
+		}
+		if err != nil {
+			s.lock.Lock()
+			resetting = s.resetting
+			if !s.closing {
+				s.beErr = err
+				s.fe.Close()
+			}
+			s.lock.Unlock()
+			if resetting && sendErr {
+				// The frontend left while m was on its way
+				// to it; the backend is still fine, and
+				// the response to the reset query follows.
+				if err = m.Discard(); err == nil {
+					continue
+				}
+			}
+			if resetting {
+				s.finishReset(&m, err)
+			}
+			return
+		}
+		if !s.be.stream.HasNext() {
+			s.fe.Flush()
+		}
+	}
+}
+
+// Account for the ReadyForQuery m, leaving a fresh copy in m for the
+// frontend.
+func (s *sessionPoolSession) finishRequest(m *core.Message) error {
+	rfq, err := proto.ReadReadyForQuery(m)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.pending--
+	s.status = rfq.ConnStatus
+	s.lock.Unlock()
+	proto.InitReadyForQuery(m, rfq.ConnStatus)
+	return nil
+}
+
+// Consume the backend's response to the reset query, starting with
+// m (or the error reading it), and return the backend to the pool
+// if it is idle and clean, or close it otherwise. ParameterStatus
+// changes are recorded for the next frontend.
+func (s *sessionPoolSession) finishReset(m *core.Message, err error) {
+	failed := false
+	for err == nil {
+		switch m.MsgType() {
+		case proto.MsgErrorResponseE:
+			failed = true
+			err = m.Discard()
+		case proto.MsgParameterStatusS:
+			err = s.be.recordParameter(m)
+		case proto.MsgReadyForQueryZ:
+			var rfq *proto.ReadyForQuery
+			rfq, err = proto.ReadReadyForQuery(m)
+			if err == nil && !failed && rfq.ConnStatus == proto.RfqIdle {
+				s.pool.release(s.be)
+				return
+			}
+			err = errors.New("reset query failed")
+		default:
+			err = m.Discard()
+		}
+		if err == nil {
+			err = s.be.stream.Next(m)
+		}
+	}
+	s.pool.discard(s.be)
+}
+
+func (s *sessionPoolSession) BackendKeyData() (uint32, uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.backendPid, s.secretKey
+}
+
+func (s *sessionPoolSession) Cancel(backendPid, secretKey uint32) error {
+	s.lock.Lock()
+	be := s.be
+	s.lock.Unlock()
+	if be == nil {
+		// not started yet
+		return nil
+	}
+	return be.connector.Cancel(be.backendPid, be.secretKey)
+}
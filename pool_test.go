@@ -0,0 +1,502 @@
+package femebe
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fake backend that answers every simple query with a
+// CommandComplete tagged with its own id, and tracks transaction
+// state from BEGIN, COMMIT and ROLLBACK. A COPY query reads COPY
+// data until the frontend ends it, and a NOTICE query is followed by
+// a large asynchronous NoticeResponse. Queries are logged to c.
+func runFakeBackend(id string, conn net.Conn, c *fakeConnector) {
+	be := core.NewFrontendStream(conn)
+	defer be.Close()
+	var m core.Message
+	if err := be.Next(&m); err != nil || m.Discard() != nil {
+		return
+	}
+	proto.InitAuthenticationOk(&m)
+	be.Send(&m)
+	proto.InitParameterStatus(&m, "server_version", "9.4.0")
+	be.Send(&m)
+	proto.InitBackendKeyData(&m, uint32(id[0]), 7)
+	be.Send(&m)
+	proto.InitReadyForQuery(&m, proto.RfqIdle)
+	be.Send(&m)
+
+	status := proto.RfqIdle
+	for {
+		if err := be.Next(&m); err != nil {
+			return
+		}
+		switch m.MsgType() {
+		case proto.MsgQueryQ:
+			q, err := proto.ReadQuery(&m)
+			if err != nil {
+				return
+			}
+			c.lock.Lock()
+			c.queries = append(c.queries, id+": "+q.Query)
+			c.lock.Unlock()
+			switch strings.ToUpper(q.Query) {
+			case "BEGIN":
+				status = proto.RfqInTrans
+			case "COMMIT", "ROLLBACK":
+				status = proto.RfqIdle
+			case "COPY":
+				proto.InitCopyInResponse(&m, proto.EncFmtTxt, nil)
+				be.Send(&m)
+				for m.MsgType() != proto.MsgCopyDoneC {
+					if be.Next(&m) != nil || m.Discard() != nil {
+						return
+					}
+				}
+			}
+			proto.InitCommandComplete(&m, id)
+			be.Send(&m)
+			proto.InitReadyForQuery(&m, status)
+			be.Send(&m)
+			if strings.ToUpper(q.Query) == "NOTICE" {
+				proto.InitNoticeResponse(&m, map[byte]string{
+					'S': "NOTICE",
+					'M': strings.Repeat("x", 16384),
+				})
+				be.Send(&m)
+			}
+		case proto.MsgTerminateX:
+			return
+		default:
+			m.Discard()
+		}
+	}
+}
+
+type fakeConnector struct {
+	lock    sync.Mutex
+	started int
+	queries []string
+	// the backend pids of cancellation requests
+	cancelled []uint32
+}
+
+func (c *fakeConnector) Resolve(params map[string]string) Connector {
+	return c
+}
+
+func (c *fakeConnector) Startup() (core.Stream, error) {
+	c.lock.Lock()
+	c.started++
+	id := string('a' + byte(c.started-1))
+	c.lock.Unlock()
+
+	feConn, beConn := net.Pipe()
+	go runFakeBackend(id, beConn, c)
+	fe := core.NewBackendStream(feConn)
+	var m core.Message
+	proto.InitStartupMessage(&m, map[string]string{"user": "test"})
+	if err := fe.Send(&m); err != nil {
+		return nil, err
+	}
+	return fe, nil
+}
+
+func (c *fakeConnector) Cancel(backendPid, secretKey uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if secretKey == 7 {
+		c.cancelled = append(c.cancelled, backendPid)
+	}
+	return nil
+}
+
+type fakeClient struct {
+	t  *testing.T
+	be core.Stream
+	// the key data the session sent
+	backendPid uint32
+	secretKey  uint32
+}
+
+// Connect a client to a new session of manager, consuming the
+// startup sequence.
+func newFakeClient(t *testing.T, manager PoolingSessionManager,
+	params map[string]string) *fakeClient {
+	feConn, beConn := net.Pipe()
+	// Buffer like a real connection would, so that the session
+	// controls when the client sees its messages
+	session := manager.NewSession(core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(feConn)), params)
+	go manager.RunSession(session)
+
+	c := &fakeClient{t: t, be: core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(beConn))}
+	var m core.Message
+	for {
+		if err := c.be.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType() == proto.MsgBackendKeyDataK {
+			kd, err := proto.ReadBackendKeyData(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.backendPid, c.secretKey = kd.BackendPid, kd.SecretKey
+			continue
+		}
+		if err := m.Discard(); err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType() == proto.MsgReadyForQueryZ {
+			return c
+		}
+	}
+}
+
+func (c *fakeClient) disconnect() {
+	if err := c.be.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Run a query and return the tag of the backend that answered it.
+func (c *fakeClient) query(q string) string {
+	c.send(q)
+	return c.receive()
+}
+
+// Send a query without waiting for its result
+func (c *fakeClient) send(q string) {
+	var m core.Message
+	proto.InitQuery(&m, q)
+	if err := c.be.Send(&m); err != nil {
+		c.t.Fatal(err)
+	}
+	// in a single write, as a real client would
+	if err := c.be.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Read the result of a query up to its ReadyForQuery and return the
+// tag of the backend that answered it.
+func (c *fakeClient) receive() string {
+	return c.await(proto.MsgReadyForQueryZ)
+}
+
+// Read messages up to one of type msgType, returning the tag of the
+// last CommandComplete read.
+func (c *fakeClient) await(msgType byte) string {
+	var m core.Message
+	var tag string
+	for {
+		if err := c.be.Next(&m); err != nil {
+			c.t.Fatal(err)
+		}
+		if m.MsgType() == proto.MsgCommandCompleteC {
+			cc, err := proto.ReadCommandComplete(&m)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			tag = cc.Tag
+		} else {
+			m.Discard()
+		}
+		if m.MsgType() == msgType {
+			return tag
+		}
+	}
+}
+
+func TestTransactionPooling(t *testing.T) {
+	connector := &fakeConnector{}
+	manager := NewTransactionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 2})
+
+	params := map[string]string{"user": "test"}
+	c1 := newFakeClient(t, manager, params)
+	c2 := newFakeClient(t, manager, params)
+
+	// Outside of transactions, a single backend serves both
+	// clients
+	if c1.query("SELECT 1") != "a" || c2.query("SELECT 1") != "a" {
+		t.Errorf("expected the first backend to be reused")
+	}
+
+	// A transaction keeps its backend, so the other client
+	// needs a new one
+	if be := c1.query("BEGIN"); be != "a" {
+		t.Errorf("got backend %v; want a", be)
+	}
+	if be := c2.query("SELECT 1"); be != "b" {
+		t.Errorf("got backend %v; want b", be)
+	}
+	if be := c1.query("SELECT 1"); be != "a" {
+		t.Errorf("transaction moved to backend %v", be)
+	}
+	c1.query("COMMIT")
+
+	connector.lock.Lock()
+	started := connector.started
+	connector.lock.Unlock()
+	if started != 2 {
+		t.Errorf("started %v backends; want 2", started)
+	}
+}
+
+func TestTransactionPoolingPipelined(t *testing.T) {
+	connector := &fakeConnector{}
+	manager := NewTransactionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 2})
+	params := map[string]string{"user": "test"}
+	c1 := newFakeClient(t, manager, params)
+	c2 := newFakeClient(t, manager, params)
+
+	// c1 sends each query as soon as the one before completes, so
+	// it arrives just as the backend sends ReadyForQuery and may be
+	// given up; it must still go to a backend bound to c1, while c2
+	// keeps the other backend busy.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c2.query("SELECT 2")
+		}
+	}()
+	result := make(chan bool)
+	go func() {
+		c1.send("SELECT 1")
+		c1.await(proto.MsgCommandCompleteC)
+		for i := 1; i < 1000; i++ {
+			c1.send("SELECT 1")
+			c1.await(proto.MsgReadyForQueryZ)
+			c1.await(proto.MsgCommandCompleteC)
+		}
+		c1.await(proto.MsgReadyForQueryZ)
+		close(result)
+	}()
+	select {
+	case <-result:
+	case <-time.After(10 * time.Second):
+		t.Fatal("pipelined queries went unanswered")
+	}
+	<-done
+
+	connector.lock.Lock()
+	defer connector.lock.Unlock()
+	if len(connector.queries) != 2000 {
+		t.Errorf("backends got %v queries; want 2000", len(connector.queries))
+	}
+}
+
+func TestTransactionPoolingCopy(t *testing.T) {
+	connector := &fakeConnector{}
+	manager := NewTransactionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 1})
+	params := map[string]string{"user": "test"}
+	c1 := newFakeClient(t, manager, params)
+	c2 := newFakeClient(t, manager, params)
+
+	// The backend is given up once COPY is over, and neither a
+	// Flush nor COPY messages sent outside it bind one, so c2 gets
+	// the only backend.
+	result := make(chan string)
+	go func() {
+		c1.send("COPY")
+		c1.await(proto.MsgCopyInResponseG)
+		var m core.Message
+		proto.InitCopyData(&m, []byte("1\n"))
+		c1.be.Send(&m)
+		proto.InitCopyDone(&m)
+		c1.be.Send(&m)
+		c1.be.Flush()
+		tag := c1.receive()
+		proto.InitFlush(&m)
+		c1.be.Send(&m)
+		proto.InitCopyData(&m, []byte("2\n"))
+		c1.be.Send(&m)
+		c1.be.Flush()
+		result <- tag + c2.query("SELECT 1")
+	}()
+	select {
+	case tags := <-result:
+		if tags != "aa" {
+			t.Errorf("got backends %q; want aa", tags)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the backend was never given up after COPY")
+	}
+}
+
+func TestSessionPooling(t *testing.T) {
+	connector := &fakeConnector{}
+	manager := NewSessionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 1, IdleTimeout: 50 * time.Millisecond})
+
+	params := map[string]string{"user": "test"}
+	c1 := newFakeClient(t, manager, params)
+	if be := c1.query("SELECT 1"); be != "a" {
+		t.Errorf("got backend %v; want a", be)
+	}
+	// Different parameters need a different backend
+	other := newFakeClient(t, manager,
+		map[string]string{"user": "test", "application_name": "other"})
+	if be := other.query("SELECT 1"); be != "b" {
+		t.Errorf("got backend %v; want b", be)
+	}
+
+	// The pool is full, so c2 waits for c1 to give its backend
+	// back
+	c2ready := make(chan *fakeClient)
+	go func() { c2ready <- newFakeClient(t, manager, params) }()
+	c1.disconnect()
+	c2 := <-c2ready
+	if be := c2.query("SELECT 2"); be != "a" {
+		t.Errorf("got backend %v; want a", be)
+	}
+
+	connector.lock.Lock()
+	queries := strings.Join(connector.queries, "; ")
+	connector.lock.Unlock()
+	want := "a: SELECT 1; b: SELECT 1; a: DISCARD ALL; a: SELECT 2"
+	if queries != want {
+		t.Errorf("got queries %q; want %q", queries, want)
+	}
+
+	// Once idle for too long, the backend is replaced
+	c2.disconnect()
+	pool := manager.(*sessionPoolManager).pool
+	reaped := func() bool {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		return pool.pools[startupParamsKey(params)].total == 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); !reaped(); {
+		if time.Now().After(deadline) {
+			t.Fatal("idle backend was never closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c3 := newFakeClient(t, manager, params)
+	if be := c3.query("SELECT 3"); be != "c" {
+		t.Errorf("got backend %v; want c", be)
+	}
+	// A backend left mid-transaction is closed rather than reset
+	c3.query("BEGIN")
+	c3.disconnect()
+	c4 := newFakeClient(t, manager, params)
+	if be := c4.query("SELECT 4"); be != "d" {
+		t.Errorf("got backend %v; want d", be)
+	}
+}
+
+// A connection whose large writes wait for gate and then fail, as if
+// the other end went away mid-write
+type gatedConn struct {
+	net.Conn
+	gate func()
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	if len(b) >= 4096 {
+		c.gate()
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSessionPoolingNoticeOnDisconnect(t *testing.T) {
+	connector := &fakeConnector{}
+	manager := NewSessionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 1})
+	params := map[string]string{"user": "test"}
+
+	// The frontend leaves while a notice is on its way to it, and
+	// the notice only fails to arrive once the backend is being
+	// reset; the backend must still go back to the pool for the
+	// next client to get one.
+	feConn, clientConn := net.Pipe()
+	var s *sessionPoolSession
+	conn := &gatedConn{feConn, func() {
+		for {
+			s.lock.Lock()
+			resetting := s.resetting
+			s.lock.Unlock()
+			if resetting {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}}
+	s = manager.NewSession(core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(conn)), params).(*sessionPoolSession)
+	go manager.RunSession(s)
+	c := &fakeClient{t: t, be: core.NewBackendStream(
+		util.NewBufferedReadWriteCloser(clientConn))}
+	c.receive()
+	c.query("NOTICE")
+	c.disconnect()
+
+	connected := make(chan string)
+	go func() {
+		connected <- newFakeClient(t, manager, params).query("SELECT 1")
+	}()
+	select {
+	case be := <-connected:
+		if be != "a" {
+			t.Errorf("got backend %v; want a", be)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the backend was lost when its frontend left")
+	}
+}
+
+func TestPooledCancel(t *testing.T) {
+	connector := &fakeConnector{}
+	params := map[string]string{"user": "test"}
+	txnManager := NewTransactionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 2})
+	sessionManager := NewSessionPoolingSessionManager(connector,
+		PoolConfig{MaxSize: 2})
+
+	c1 := newFakeClient(t, txnManager, params)
+	c2 := newFakeClient(t, sessionManager, params)
+	if c1.backendPid == 0 || c2.backendPid == 0 {
+		t.Fatalf("expected key data for both sessions")
+	}
+	// c1 has no backend outside of a transaction
+	if err := txnManager.Cancel(c1.backendPid, c1.secretKey); err != nil {
+		t.Error(err)
+	}
+	c1.query("BEGIN")
+	if err := txnManager.Cancel(c1.backendPid, c1.secretKey); err != nil {
+		t.Error(err)
+	}
+	if err := sessionManager.Cancel(c2.backendPid, c2.secretKey); err != nil {
+		t.Error(err)
+	}
+	if err := txnManager.Cancel(c1.backendPid, c1.secretKey+1); err != ErrUnknownCancelKey {
+		t.Errorf("got %v for the wrong secret key", err)
+	}
+	if err := txnManager.Cancel(c2.backendPid, c2.secretKey); err != ErrUnknownCancelKey {
+		t.Errorf("got %v for another manager's session", err)
+	}
+
+	var cancelled string
+	connector.lock.Lock()
+	for _, pid := range connector.cancelled {
+		cancelled += string(rune(pid))
+	}
+	connector.lock.Unlock()
+	if cancelled != "ab" {
+		t.Errorf("cancelled the requests on backends %q; want ab", cancelled)
+	}
+}
@@ -2,8 +2,8 @@ package femebe
 
 import (
 	"crypto/tls"
-	"errors"
 	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/auth"
 	"github.com/uhoh-itsmaciek/femebe/core"
 	"github.com/uhoh-itsmaciek/femebe/proto"
 	"github.com/uhoh-itsmaciek/femebe/util"
@@ -82,51 +82,105 @@ type Session interface {
 	Run() error
 }
 
+// BackendKeyNotifier is implemented by Routers and Sessions that can
+// tell when they learn their cancellation key data.
+type BackendKeyNotifier interface {
+	// Call f with the key data whenever it is learned, including
+	// right away if it is already known.
+	NotifyBackendKeyData(f func(backendPid, secretKey uint32))
+}
+
 type simpleSessionManager struct {
-	sessions    []Session
-	sessionLock sync.Mutex
+	cancels *CancelRegistry
+
+	lock sync.Mutex
+	// Running sessions that are not BackendKeyNotifiers and have
+	// yet to be registered, with the functions registering them
+	unregistered map[Session]func(backendPid, secretKey uint32)
 }
 
 // Return the default SessionManager, with bookkeeping for
-// cancellation.
+// cancellation. Sessions that are BackendKeyNotifiers are registered
+// for cancellation requests as soon as they learn their key data;
+// other sessions are registered once a request comes in after they
+// have.
 func NewSimpleSessionManager() SessionManager {
-	return &simpleSessionManager{}
+	return &simpleSessionManager{
+		cancels:      NewCancelRegistry(),
+		unregistered: make(map[Session]func(uint32, uint32)),
+	}
 }
 
 func (s *simpleSessionManager) RunSession(session Session) error {
-	s.sessionLock.Lock()
-	s.sessions = append(s.sessions, session)
-	s.sessionLock.Unlock()
+	// The key data the session is registered with, if any, and
+	// whether it has completed; guarded by the lock
+	var key *cancelKey
+	done := false
+	register := func(backendPid, secretKey uint32) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if done {
+			return
+		}
+		if key != nil {
+			s.cancels.Unregister(key.backendPid, key.secretKey)
+		}
+		s.cancels.Register(backendPid, secretKey, session)
+		key = &cancelKey{backendPid, secretKey}
+	}
+	if n, ok := session.(BackendKeyNotifier); ok {
+		n.NotifyBackendKeyData(register)
+	} else {
+		s.lock.Lock()
+		s.unregistered[session] = register
+		s.lock.Unlock()
+	}
 
 	// N.B.: this is a blocking call that will not return until
 	// the session completes
 	err := session.Run()
-	s.sessionLock.Lock()
-	for i, si := range s.sessions {
-		if si == session {
-			// slice out this session
-			copy(s.sessions[i:], s.sessions[i+1:])
-			s.sessions[len(s.sessions)-1] = nil
-			s.sessions = s.sessions[:len(s.sessions)-1]
-			break
-		}
+	s.lock.Lock()
+	done = true
+	delete(s.unregistered, session)
+	if key != nil {
+		s.cancels.Unregister(key.backendPid, key.secretKey)
 	}
-	s.sessionLock.Unlock()
+	s.lock.Unlock()
 	return err
 }
 
 func (s *simpleSessionManager) Cancel(backendPid, secretKey uint32) error {
-	for _, session := range s.sessions {
-		// TODO: we could cache this info once available, but
-		// for a reasonably small number of sessions, there's
-		// probably no point
-		if p, k := session.BackendKeyData(); p == backendPid && k == secretKey {
-			s.sessionLock.Lock()
-			defer s.sessionLock.Unlock()
-			return session.Cancel(backendPid, secretKey)
+	err := s.cancels.Cancel(backendPid, secretKey)
+	if err == ErrUnknownCancelKey && s.registerKnown() {
+		err = s.cancels.Cancel(backendPid, secretKey)
+	}
+	return err
+}
+
+// Register the sessions that are not BackendKeyNotifiers but have
+// learned their key data since last checked, and return whether
+// there were any.
+func (s *simpleSessionManager) registerKnown() bool {
+	type known struct {
+		register   func(uint32, uint32)
+		backendPid uint32
+		secretKey  uint32
+	}
+	var found []known
+	s.lock.Lock()
+	for session, register := range s.unregistered {
+		pid, key := session.BackendKeyData()
+		if pid != 0 || key != 0 {
+			found = append(found, known{register, pid, key})
+			delete(s.unregistered, session)
 		}
 	}
-	return errors.New("not found")
+	s.lock.Unlock()
+	// registering takes the lock itself
+	for _, k := range found {
+		k.register(k.backendPid, k.secretKey)
+	}
+	return len(found) > 0
 }
 
 type simpleConnector struct {
@@ -183,13 +237,44 @@ func (c *simpleConnector) Cancel(backendPid, secretKey uint32) error {
 	return beStream.Send(&cancel)
 }
 
+type passwordConnector struct {
+	Connector
+	user     string
+	password string
+}
+
+// Make a Connector that logs into the backend reached through c
+// with the given credentials, answering its cleartext, MD5 or
+// SCRAM-SHA-256 authentication requests. Streams returned by
+// Startup have completed authentication: the next message is the
+// first ParameterStatus after AuthenticationOk.
+func NewPasswordConnector(c Connector, user, password string) Connector {
+	return &passwordConnector{c, user, password}
+}
+
+func (c *passwordConnector) Startup() (core.Stream, error) {
+	beStream, err := c.Connector.Startup()
+	if err != nil {
+		return nil, err
+	}
+	err = auth.Authenticate(beStream, c.user, c.password)
+	if err != nil {
+		beStream.Close()
+		return nil, err
+	}
+	return beStream, nil
+}
+
 type simpleRouter struct {
+	fe    core.Stream
+	be    core.Stream
+	feBuf core.Message
+	beBuf core.Message
+
+	keyLock    sync.Mutex
 	backendPid uint32
 	secretKey  uint32
-	fe         core.Stream
-	be         core.Stream
-	feBuf      core.Message
-	beBuf      core.Message
+	notify     func(backendPid, secretKey uint32)
 }
 
 // Make a new Router that captures cancellation data and ferries
@@ -197,18 +282,25 @@ type simpleRouter struct {
 // when no more messages are available on the "from" stream, in both
 // directions.
 func NewSimpleRouter(fe, be core.Stream) Router {
-	return &simpleRouter{
-		backendPid: 0,
-		secretKey:  0,
-		fe:         fe,
-		be:         be,
-	}
+	return &simpleRouter{fe: fe, be: be}
 }
 
 func (s *simpleRouter) BackendKeyData() (uint32, uint32) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
 	return s.backendPid, s.secretKey
 }
 
+func (s *simpleRouter) NotifyBackendKeyData(f func(backendPid, secretKey uint32)) {
+	s.keyLock.Lock()
+	s.notify = f
+	pid, secret := s.backendPid, s.secretKey
+	s.keyLock.Unlock()
+	if pid != 0 || secret != 0 {
+		f(pid, secret)
+	}
+}
+
 func (s *simpleRouter) RouteFrontend() (err error) {
 	// route the next message from frontend to backend,
 	// blocking and flushing if necessary
@@ -238,8 +330,14 @@ func (s *simpleRouter) RouteBackend() error {
 		if err != nil {
 			return err
 		}
+		s.keyLock.Lock()
 		s.backendPid = beInfo.BackendPid
 		s.secretKey = beInfo.SecretKey
+		notify := s.notify
+		s.keyLock.Unlock()
+		if notify != nil {
+			notify(beInfo.BackendPid, beInfo.SecretKey)
+		}
 	}
 	err = s.fe.Send(&s.beBuf)
 	if !s.be.HasNext() {
@@ -253,9 +351,18 @@ type simpleSession struct {
 	Canceller
 }
 
+// A simpleSession whose router is a BackendKeyNotifier
+type notifyingSimpleSession struct {
+	simpleSession
+}
+
 // Make a new Session that drives the given router and uses its
-// cancellation data to delegate cancellation requests.
+// cancellation data to delegate cancellation requests. The Session
+// is a BackendKeyNotifier if the router is.
 func NewSimpleSession(r Router, c Canceller) Session {
+	if _, ok := r.(BackendKeyNotifier); ok {
+		return &notifyingSimpleSession{simpleSession{r, c}}
+	}
 	return &simpleSession{r, c}
 }
 
@@ -276,3 +383,7 @@ func (s *simpleSession) Run() (err error) {
 func (s *simpleSession) BackendKeyData() (uint32, uint32) {
 	return s.router.BackendKeyData()
 }
+
+func (s *notifyingSimpleSession) NotifyBackendKeyData(f func(backendPid, secretKey uint32)) {
+	s.router.(BackendKeyNotifier).NotifyBackendKeyData(f)
+}
@@ -0,0 +1,238 @@
+package proto
+
+import (
+	"bytes"
+	. "github.com/uhoh-itsmaciek/femebe/buf"
+	. "github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"io"
+	"io/ioutil"
+)
+
+// The subtype of an Authentication ('R') message
+type AuthType int32
+
+const (
+	AuthOk                AuthType = 0
+	AuthKerberosV5                 = 2
+	AuthCleartextPassword          = 3
+	AuthMD5Password                = 5
+	AuthSCMCredential              = 6
+	AuthGSS                        = 7
+	AuthGSSContinue                = 8
+	AuthSSPI                       = 9
+	AuthSASL                       = 10
+	AuthSASLContinue               = 11
+	AuthSASLFinal                  = 12
+)
+
+// Authentication covers every subtype of the backend's
+// Authentication message; which of the fields beyond Type are
+// meaningful depends on the subtype.
+type Authentication struct {
+	Type AuthType
+	// Salt to use when encrypting the password, for
+	// AuthMD5Password
+	Salt [4]byte
+	// Available mechanisms, in the server's order of preference,
+	// for AuthSASL
+	Mechanisms []string
+	// Mechanism-specific data, for AuthGSSContinue,
+	// AuthSASLContinue and AuthSASLFinal
+	Data []byte
+}
+
+func ReadAuthentication(m *Message) (*Authentication, error) {
+	if t := m.MsgType(); t != MsgAuthenticationOkR {
+		return nil, e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	authType, err := ReadInt32(b)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &Authentication{Type: AuthType(authType)}
+	switch auth.Type {
+	case AuthOk, AuthKerberosV5, AuthCleartextPassword,
+		AuthSCMCredential, AuthGSS, AuthSSPI:
+		if m.Size() != 8 {
+			return nil, e.WrongSize("Authentication type %v is "+
+				"wrong size: expected 8, got %v", auth.Type, m.Size())
+		}
+	case AuthMD5Password:
+		if _, err = io.ReadFull(b, auth.Salt[:]); err != nil {
+			return nil, err
+		}
+	case AuthSASL:
+		for {
+			mech, err := ReadCString(b)
+			if err != nil {
+				return nil, err
+			}
+			if mech == "" {
+				break
+			}
+			auth.Mechanisms = append(auth.Mechanisms, mech)
+		}
+	case AuthGSSContinue, AuthSASLContinue, AuthSASLFinal:
+		auth.Data, err = ioutil.ReadAll(b)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, e.Auth("unknown authentication type %v", auth.Type)
+	}
+
+	return auth, nil
+}
+
+func initAuthentication(m *Message, authType AuthType, data []byte) {
+	buf := bytes.NewBuffer(make([]byte, 0, 4+len(data)))
+	WriteInt32(buf, int32(authType))
+	buf.Write(data)
+
+	m.InitFromBytes(MsgAuthenticationOkR, buf.Bytes())
+}
+
+func InitAuthenticationKerberosV5(m *Message) {
+	initAuthentication(m, AuthKerberosV5, nil)
+}
+
+func InitAuthenticationCleartextPassword(m *Message) {
+	initAuthentication(m, AuthCleartextPassword, nil)
+}
+
+func InitAuthenticationMD5Password(m *Message, salt [4]byte) {
+	initAuthentication(m, AuthMD5Password, salt[:])
+}
+
+func InitAuthenticationSCMCredential(m *Message) {
+	initAuthentication(m, AuthSCMCredential, nil)
+}
+
+func InitAuthenticationGSS(m *Message) {
+	initAuthentication(m, AuthGSS, nil)
+}
+
+func InitAuthenticationGSSContinue(m *Message, data []byte) {
+	initAuthentication(m, AuthGSSContinue, data)
+}
+
+func InitAuthenticationSSPI(m *Message) {
+	initAuthentication(m, AuthSSPI, nil)
+}
+
+func InitAuthenticationSASL(m *Message, mechanisms []string) {
+	var buf bytes.Buffer
+	for _, mech := range mechanisms {
+		WriteCString(&buf, mech)
+	}
+	buf.WriteByte('\000')
+	initAuthentication(m, AuthSASL, buf.Bytes())
+}
+
+func InitAuthenticationSASLContinue(m *Message, data []byte) {
+	initAuthentication(m, AuthSASLContinue, data)
+}
+
+func InitAuthenticationSASLFinal(m *Message, data []byte) {
+	initAuthentication(m, AuthSASLFinal, data)
+}
+
+// The frontend's responses to authentication requests all use the
+// 'p' type code; which one to read depends on the request that was
+// sent.
+
+type PasswordMessage struct {
+	// The password, either in cleartext or MD5-encrypted,
+	// depending on the request
+	Password string
+}
+
+func InitPasswordMessage(m *Message, password string) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(password)+1))
+	WriteCString(buf, password)
+
+	m.InitFromBytes(MsgPasswordMessageP, buf.Bytes())
+}
+
+func ReadPasswordMessage(m *Message) (*PasswordMessage, error) {
+	if t := m.MsgType(); t != MsgPasswordMessageP {
+		return nil, e.BadTypeCode(t)
+	}
+
+	password, err := ReadCString(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordMessage{password}, nil
+}
+
+type SASLInitialResponse struct {
+	Mechanism string
+	// The mechanism-specific initial response, or nil if there
+	// is none
+	Data []byte
+}
+
+func InitSASLInitialResponse(m *Message, mechanism string, data []byte) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(mechanism)+1+4+len(data)))
+	WriteCString(buf, mechanism)
+	if data == nil {
+		WriteInt32(buf, -1)
+	} else {
+		WriteInt32(buf, int32(len(data)))
+		buf.Write(data)
+	}
+
+	m.InitFromBytes(MsgSASLInitialResponseP, buf.Bytes())
+}
+
+func ReadSASLInitialResponse(m *Message) (*SASLInitialResponse, error) {
+	if t := m.MsgType(); t != MsgSASLInitialResponseP {
+		return nil, e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	mech, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	dataLen, err := ReadInt32(b)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if dataLen >= 0 {
+		data = make([]byte, dataLen)
+		if _, err = io.ReadFull(b, data); err != nil {
+			return nil, err
+		}
+	} else if dataLen != -1 {
+		return nil, e.WrongSize("Invalid length %v for SASL response",
+			dataLen)
+	}
+	return &SASLInitialResponse{Mechanism: mech, Data: data}, nil
+}
+
+type SASLResponse struct {
+	Data []byte
+}
+
+func InitSASLResponse(m *Message, data []byte) {
+	m.InitFromBytes(MsgSASLResponseP, data)
+}
+
+func ReadSASLResponse(m *Message) (*SASLResponse, error) {
+	if t := m.MsgType(); t != MsgSASLResponseP {
+		return nil, e.BadTypeCode(t)
+	}
+
+	data, err := ioutil.ReadAll(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &SASLResponse{data}, nil
+}
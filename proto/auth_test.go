@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"testing"
+)
+
+func TestAuthenticationSerDes(t *testing.T) {
+	var m core.Message
+	InitAuthenticationMD5Password(&m, [4]byte{1, 2, 3, 4})
+	auth, err := ReadAuthentication(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Type != AuthMD5Password || auth.Salt != [4]byte{1, 2, 3, 4} {
+		t.Errorf("unexpected Authentication %#v", auth)
+	}
+
+	InitAuthenticationSASL(&m, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"})
+	auth, err = ReadAuthentication(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Type != AuthSASL || len(auth.Mechanisms) != 2 ||
+		auth.Mechanisms[1] != "SCRAM-SHA-256" {
+		t.Errorf("unexpected Authentication %#v", auth)
+	}
+
+	InitAuthenticationSASLContinue(&m, []byte("r=abc"))
+	auth, err = ReadAuthentication(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Type != AuthSASLContinue || string(auth.Data) != "r=abc" {
+		t.Errorf("unexpected Authentication %#v", auth)
+	}
+
+	InitAuthenticationOk(&m)
+	auth, err = ReadAuthentication(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Type != AuthOk {
+		t.Errorf("unexpected Authentication %#v", auth)
+	}
+}
+
+func TestPasswordResponsesSerDes(t *testing.T) {
+	var m core.Message
+	InitPasswordMessage(&m, "md5abc")
+	pw, err := ReadPasswordMessage(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pw.Password != "md5abc" {
+		t.Errorf("got password %v; want md5abc", pw.Password)
+	}
+
+	InitSASLInitialResponse(&m, "SCRAM-SHA-256", []byte("n,,n=,r=x"))
+	initial, err := ReadSASLInitialResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial.Mechanism != "SCRAM-SHA-256" ||
+		!bytes.Equal(initial.Data, []byte("n,,n=,r=x")) {
+		t.Errorf("unexpected SASLInitialResponse %#v", initial)
+	}
+
+	InitSASLInitialResponse(&m, "SCRAM-SHA-256", nil)
+	initial, err = ReadSASLInitialResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial.Data != nil {
+		t.Errorf("got initial response %v; want none", initial.Data)
+	}
+}
+
+func TestErrorResponseSerDes(t *testing.T) {
+	var m core.Message
+	details := map[byte]string{
+		'S': "FATAL",
+		'C': "28P01",
+		'M': "password authentication failed",
+		'Z': "unknown field",
+	}
+	InitErrorResponse(&m, details)
+	er, err := ReadErrorResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range details {
+		if er.Details[k] != v {
+			t.Errorf("got field %c = %v; want %v", k, er.Details[k], v)
+		}
+	}
+	want := "FATAL: password authentication failed (SQLSTATE 28P01)"
+	if er.Error() != want {
+		t.Errorf("got error %q; want %q", er.Error(), want)
+	}
+}
@@ -0,0 +1,313 @@
+package proto
+
+import (
+	"bytes"
+	. "github.com/uhoh-itsmaciek/femebe/buf"
+	. "github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"io"
+	"io/ioutil"
+)
+
+// Messages of the COPY sub-protocol. The backend starts a COPY with
+// a CopyInResponse, CopyOutResponse or CopyBothResponse; then the
+// side sending the data sends CopyData messages, ending with CopyDone
+// or, from the frontend, CopyFail.
+
+type CopyInResponse struct {
+	// The overall format: binary, or text for the text and CSV
+	// formats
+	Format EncFmt
+	// The format of each column; all text unless Format is binary
+	ColumnFormats []EncFmt
+}
+
+type CopyOutResponse struct {
+	Format        EncFmt
+	ColumnFormats []EncFmt
+}
+
+// CopyBothResponse starts streaming replication, with CopyData going
+// both ways.
+type CopyBothResponse struct {
+	Format        EncFmt
+	ColumnFormats []EncFmt
+}
+
+func InitCopyInResponse(m *Message, format EncFmt, columnFormats []EncFmt) {
+	initCopyResponse(m, MsgCopyInResponseG, format, columnFormats)
+}
+
+func ReadCopyInResponse(m *Message) (*CopyInResponse, error) {
+	format, columnFormats, err := readCopyResponse(m, MsgCopyInResponseG)
+	if err != nil {
+		return nil, err
+	}
+	return &CopyInResponse{format, columnFormats}, nil
+}
+
+func InitCopyOutResponse(m *Message, format EncFmt, columnFormats []EncFmt) {
+	initCopyResponse(m, MsgCopyOutResponseH, format, columnFormats)
+}
+
+func ReadCopyOutResponse(m *Message) (*CopyOutResponse, error) {
+	format, columnFormats, err := readCopyResponse(m, MsgCopyOutResponseH)
+	if err != nil {
+		return nil, err
+	}
+	return &CopyOutResponse{format, columnFormats}, nil
+}
+
+func InitCopyBothResponse(m *Message, format EncFmt, columnFormats []EncFmt) {
+	initCopyResponse(m, MsgCopyBothResponseW, format, columnFormats)
+}
+
+func ReadCopyBothResponse(m *Message) (*CopyBothResponse, error) {
+	format, columnFormats, err := readCopyResponse(m, MsgCopyBothResponseW)
+	if err != nil {
+		return nil, err
+	}
+	return &CopyBothResponse{format, columnFormats}, nil
+}
+
+// The three responses share a layout: the overall format as a single
+// byte, followed by the column formats.
+func initCopyResponse(m *Message, msgType byte, format EncFmt,
+	columnFormats []EncFmt) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1+2+2*len(columnFormats)))
+	buf.WriteByte(byte(format))
+	writeFormats(buf, columnFormats)
+	m.InitFromBytes(msgType, buf.Bytes())
+}
+
+func readCopyResponse(m *Message, msgType byte) (EncFmt, []EncFmt, error) {
+	if t := m.MsgType(); t != msgType {
+		return 0, nil, e.BadTypeCode(t)
+	}
+	b := m.Payload()
+	format, err := ReadByte(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	columnFormats, err := readFormats(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return EncFmt(format), columnFormats, nil
+}
+
+type CopyData struct {
+	Data []byte
+}
+
+func InitCopyData(m *Message, data []byte) {
+	m.InitFromBytes(MsgCopyDataD, data)
+}
+
+// ReadCopyData reads the whole of a CopyData message into memory; to
+// stream large ones, see CopyReader.
+func ReadCopyData(m *Message) (*CopyData, error) {
+	if t := m.MsgType(); t != MsgCopyDataD {
+		return nil, e.BadTypeCode(t)
+	}
+	data, err := m.Force()
+	if err != nil {
+		return nil, err
+	}
+	return &CopyData{data}, nil
+}
+
+type CopyDone struct{}
+
+func InitCopyDone(m *Message) {
+	m.InitFromBytes(MsgCopyDoneC, []byte{})
+}
+
+func ReadCopyDone(m *Message) (*CopyDone, error) {
+	if err := checkEmpty(m, MsgCopyDoneC); err != nil {
+		return nil, err
+	}
+	return &CopyDone{}, nil
+}
+
+type CopyFail struct {
+	// Why the frontend gave up on the COPY
+	Message string
+}
+
+func InitCopyFail(m *Message, message string) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(message)+1))
+	WriteCString(buf, message)
+	m.InitFromBytes(MsgCopyFailF, buf.Bytes())
+}
+
+func ReadCopyFail(m *Message) (*CopyFail, error) {
+	if t := m.MsgType(); t != MsgCopyFailF {
+		return nil, e.BadTypeCode(t)
+	}
+	msg, err := ReadCString(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &CopyFail{msg}, nil
+}
+
+// CopyReader reads the data of a COPY from a stream, as the payloads
+// of CopyData messages. The messages are read as Read asks for them
+// rather than each buffered whole, so data of any size can pass
+// through. Read returns io.EOF at CopyDone; at CopyFail it returns an
+// ErrCopyFail, and at ErrorResponse the *ErrorResponse. Other
+// messages, such as NoticeResponse, or the Flush and Sync a frontend
+// may send during a COPY, are skipped. The messages after the end of
+// the data, such as CommandComplete, are left on the stream.
+type CopyReader struct {
+	s   Stream
+	m   Message
+	cur io.Reader
+	err error
+}
+
+func NewCopyReader(s Stream) *CopyReader {
+	return &CopyReader{s: s}
+}
+
+func (r *CopyReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.cur != nil {
+			n, err := r.cur.Read(p)
+			if err == io.EOF {
+				r.cur = nil
+				err = nil
+			}
+			if n > 0 || err != nil || len(p) == 0 {
+				return n, err
+			}
+			continue
+		}
+		r.err = r.next()
+	}
+	return 0, r.err
+}
+
+// Read up to the next CopyData, returning an error at the end of the
+// data
+func (r *CopyReader) next() error {
+	for {
+		if err := r.s.Next(&r.m); err != nil {
+			return err
+		}
+		switch r.m.MsgType() {
+		case MsgCopyDataD:
+			r.cur = r.m.Payload()
+			return nil
+		case MsgCopyDoneC:
+			return io.EOF
+		case MsgCopyFailF:
+			cf, err := ReadCopyFail(&r.m)
+			if err != nil {
+				return err
+			}
+			return e.CopyFail("COPY failed: %v", cf.Message)
+		case MsgErrorResponseE:
+			er, err := ReadErrorResponse(&r.m)
+			if err != nil {
+				return err
+			}
+			return er
+		default:
+			if err := r.m.Discard(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// WriteTo copies the rest of the data to w, a message at a time.
+func (r *CopyReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for r.err == nil {
+		if r.cur != nil {
+			n, err := io.Copy(w, r.cur)
+			total += n
+			if err != nil {
+				// leave the stream readable
+				io.Copy(ioutil.Discard, r.cur)
+				r.err = err
+				return total, err
+			}
+			r.cur = nil
+		}
+		r.err = r.next()
+	}
+	if r.err == io.EOF {
+		return total, nil
+	}
+	return total, r.err
+}
+
+// CopyWriter writes the data of a COPY to a stream, sending each
+// Write as a CopyData message. Close ends the data with CopyDone, or
+// Fail with CopyFail; neither closes the stream, but both flush it.
+type CopyWriter struct {
+	s Stream
+	m Message
+}
+
+func NewCopyWriter(s Stream) *CopyWriter {
+	return &CopyWriter{s: s}
+}
+
+func (w *CopyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	InitCopyData(&w.m, p)
+	if err := w.s.Send(&w.m); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom copies r to the stream, in CopyData messages of up to
+// 64kB.
+func (w *CopyWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 64*1024)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (w *CopyWriter) Flush() error {
+	return w.s.Flush()
+}
+
+// Close sends CopyDone and flushes the stream.
+func (w *CopyWriter) Close() error {
+	InitCopyDone(&w.m)
+	if err := w.s.Send(&w.m); err != nil {
+		return err
+	}
+	return w.s.Flush()
+}
+
+// Fail sends CopyFail with the given reason and flushes the stream.
+// Only a frontend may fail a COPY.
+func (w *CopyWriter) Fail(reason string) error {
+	InitCopyFail(&w.m, reason)
+	if err := w.s.Send(&w.m); err != nil {
+		return err
+	}
+	return w.s.Flush()
+}
@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCopyResponseSerDes(t *testing.T) {
+	var m core.Message
+	formats := []EncFmt{EncFmtBinary, EncFmtBinary}
+	InitCopyInResponse(&m, EncFmtBinary, formats)
+	in, err := ReadCopyInResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Format != EncFmtBinary || !reflect.DeepEqual(in.ColumnFormats, formats) {
+		t.Errorf("unexpected CopyInResponse %#v", in)
+	}
+
+	InitCopyOutResponse(&m, EncFmtTxt, []EncFmt{EncFmtTxt})
+	out, err := ReadCopyOutResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Format != EncFmtTxt || len(out.ColumnFormats) != 1 {
+		t.Errorf("unexpected CopyOutResponse %#v", out)
+	}
+
+	InitCopyBothResponse(&m, EncFmtBinary, nil)
+	both, err := ReadCopyBothResponse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if both.Format != EncFmtBinary || len(both.ColumnFormats) != 0 {
+		t.Errorf("unexpected CopyBothResponse %#v", both)
+	}
+	if _, err = ReadCopyInResponse(&m); err == nil {
+		t.Errorf("expected an error reading the wrong message type")
+	}
+
+	InitCopyFail(&m, "out of coffee")
+	cf, err := ReadCopyFail(roundTrip(t, &m))
+	if err != nil || cf.Message != "out of coffee" {
+		t.Errorf("unexpected CopyFail %#v, %v", cf, err)
+	}
+	InitCopyDone(&m)
+	if _, err = ReadCopyDone(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCopyStream(t *testing.T) {
+	ms := core.NewBackendStream(newInMemRwc())
+	w := NewCopyWriter(ms)
+
+	// large enough to arrive partly buffered
+	big := []byte(strings.Repeat("0123456789abcdef", 4096))
+	rows := []string{"1\tone\n", "", "2\ttwo\n"}
+	for _, row := range rows {
+		if _, err := io.WriteString(w, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.ReadFrom(bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	var m core.Message
+	InitNoticeResponse(&m, map[byte]string{'M': "hi"})
+	ms.Send(&m)
+	if _, err := w.Write([]byte("3\tthree\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	InitCommandComplete(&m, "COPY 3")
+	ms.Send(&m)
+
+	r := NewCopyReader(ms)
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1\tone\n2\ttwo\n" + string(big) + "3\tthree\n"
+	if string(got) != want {
+		t.Errorf("got %v bytes; want %v", len(got), len(want))
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("got %v, %v after CopyDone", n, err)
+	}
+	if err = ms.Next(&m); err != nil || m.MsgType() != MsgCommandCompleteC {
+		t.Errorf("got %q, %v after the COPY", m.MsgType(), err)
+	}
+
+	w.Write([]byte("a"))
+	w.Fail("changed my mind")
+	var b bytes.Buffer
+	n, err := NewCopyReader(ms).WriteTo(&b)
+	if _, ok := err.(e.ErrCopyFail); !ok || n != 1 || b.String() != "a" {
+		t.Errorf("got %v, %q, %#v", n, b.String(), err)
+	}
+
+	InitErrorResponse(&m, map[byte]string{'S': "ERROR", 'M': "disk full"})
+	ms.Send(&m)
+	if _, err = ioutil.ReadAll(NewCopyReader(ms)); err == nil {
+		t.Errorf("expected an error")
+	} else if _, ok := err.(*ErrorResponse); !ok {
+		t.Errorf("got %T; want an ErrorResponse", err)
+	}
+}
@@ -0,0 +1,447 @@
+package proto
+
+import (
+	"bytes"
+	. "github.com/uhoh-itsmaciek/femebe/buf"
+	. "github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"io"
+)
+
+// Messages of the extended query protocol. Frontend messages
+// (Parse, Bind, Describe, Execute, Sync, Close) share type codes
+// with unrelated backend messages, so callers must know which side
+// of the conversation a Message came from before reading it.
+
+type Parse struct {
+	// The name of the prepared statement; the empty string
+	// selects the unnamed statement.
+	Name  string
+	Query string
+	// Parameter types specified by the client; an oid of zero
+	// leaves the type unspecified.
+	ParamOids []Oid
+}
+
+func InitParse(m *Message, name, query string, paramOids []Oid) {
+	msgBytes := make([]byte, 0, len(name)+len(query)+2+2+4*len(paramOids))
+	buf := bytes.NewBuffer(msgBytes)
+	WriteCString(buf, name)
+	WriteCString(buf, query)
+	WriteInt16(buf, int16(len(paramOids)))
+	for _, oid := range paramOids {
+		WriteUint32(buf, uint32(oid))
+	}
+
+	m.InitFromBytes(MsgParseP, buf.Bytes())
+}
+
+func ReadParse(m *Message) (*Parse, error) {
+	if t := m.MsgType(); t != MsgParseP {
+		return nil, e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	name, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	query, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	oids, err := readOids(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Parse{Name: name, Query: query, ParamOids: oids}, nil
+}
+
+type Bind struct {
+	// Destination portal and source prepared statement; the
+	// empty string selects the unnamed portal or statement.
+	Portal    string
+	Statement string
+	// Zero formats means all parameters are text; one format
+	// applies to all parameters; otherwise there is one per
+	// parameter.
+	ParamFormats []EncFmt
+	// Parameter values, without their length prefix. A nil value
+	// is a NULL.
+	Params [][]byte
+	// Result column formats, following the same convention as
+	// ParamFormats.
+	ResultFormats []EncFmt
+}
+
+// ParamFormat returns the format of the i-th parameter, resolving
+// the shorthand forms of the format code list.
+func (b *Bind) ParamFormat(i int) EncFmt {
+	return resolveFormat(b.ParamFormats, i)
+}
+
+// ResultFormat returns the format of the i-th result column,
+// resolving the shorthand forms of the format code list.
+func (b *Bind) ResultFormat(i int) EncFmt {
+	return resolveFormat(b.ResultFormats, i)
+}
+
+func resolveFormat(formats []EncFmt, i int) EncFmt {
+	switch len(formats) {
+	case 0:
+		return EncFmtTxt
+	case 1:
+		return formats[0]
+	default:
+		if i < len(formats) {
+			return formats[i]
+		}
+		return EncFmtUnknown
+	}
+}
+
+// InitBind initializes a Bind message. Unlike InitDataRow, params
+// hold the raw parameter values without a length prefix; a nil
+// value is sent as NULL.
+func InitBind(m *Message, portal, statement string, paramFormats []EncFmt,
+	params [][]byte, resultFormats []EncFmt) {
+	dataSize := 0
+	for _, p := range params {
+		dataSize += 4 + len(p)
+	}
+	msgBytes := make([]byte, 0, len(portal)+len(statement)+2+
+		2+2*len(paramFormats)+2+dataSize+2+2*len(resultFormats))
+	buf := bytes.NewBuffer(msgBytes)
+	WriteCString(buf, portal)
+	WriteCString(buf, statement)
+	writeFormats(buf, paramFormats)
+	WriteInt16(buf, int16(len(params)))
+	for _, p := range params {
+		if p == nil {
+			WriteInt32(buf, -1)
+		} else {
+			WriteInt32(buf, int32(len(p)))
+			buf.Write(p)
+		}
+	}
+	writeFormats(buf, resultFormats)
+
+	m.InitFromBytes(MsgBindB, buf.Bytes())
+}
+
+func ReadBind(m *Message) (*Bind, error) {
+	if t := m.MsgType(); t != MsgBindB {
+		return nil, e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	portal, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	paramFormats, err := readFormats(b)
+	if err != nil {
+		return nil, err
+	}
+	paramCount, err := ReadUint16(b)
+	if err != nil {
+		return nil, err
+	}
+	params := make([][]byte, paramCount)
+	for i := range params {
+		paramLen, err := ReadInt32(b)
+		if err != nil {
+			return nil, err
+		}
+		if paramLen >= 0 {
+			params[i] = make([]byte, paramLen)
+			if _, err = io.ReadFull(b, params[i]); err != nil {
+				return nil, err
+			}
+		} else if paramLen != -1 {
+			return nil, e.WrongSize("Invalid length %v for parameter %v",
+				paramLen, i)
+		}
+	}
+	resultFormats, err := readFormats(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bind{Portal: portal, Statement: statement,
+		ParamFormats: paramFormats, Params: params,
+		ResultFormats: resultFormats}, nil
+}
+
+type Describe struct {
+	// Either IsStmt or IsPortal
+	Kind byte
+	Name string
+}
+
+func InitDescribe(m *Message, kind byte, name string) {
+	initTargetMessage(m, MsgDescribeD, kind, name)
+}
+
+func ReadDescribe(m *Message) (*Describe, error) {
+	kind, name, err := readTargetMessage(m, MsgDescribeD)
+	if err != nil {
+		return nil, err
+	}
+	return &Describe{Kind: kind, Name: name}, nil
+}
+
+type Execute struct {
+	Portal string
+	// Maximum number of rows to return; zero means no limit.
+	MaxRows uint32
+}
+
+func InitExecute(m *Message, portal string, maxRows uint32) {
+	msgBytes := make([]byte, 0, len(portal)+1+4)
+	buf := bytes.NewBuffer(msgBytes)
+	WriteCString(buf, portal)
+	WriteUint32(buf, maxRows)
+
+	m.InitFromBytes(MsgExecuteE, buf.Bytes())
+}
+
+func ReadExecute(m *Message) (*Execute, error) {
+	if t := m.MsgType(); t != MsgExecuteE {
+		return nil, e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	portal, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	maxRows, err := ReadUint32(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Execute{Portal: portal, MaxRows: maxRows}, nil
+}
+
+type Close struct {
+	// Either IsStmt or IsPortal
+	Kind byte
+	Name string
+}
+
+func InitClose(m *Message, kind byte, name string) {
+	initTargetMessage(m, MsgCloseC, kind, name)
+}
+
+func ReadClose(m *Message) (*Close, error) {
+	kind, name, err := readTargetMessage(m, MsgCloseC)
+	if err != nil {
+		return nil, err
+	}
+	return &Close{Kind: kind, Name: name}, nil
+}
+
+type Sync struct{}
+
+func InitSync(m *Message) {
+	m.InitFromBytes(MsgSyncS, []byte{})
+}
+
+func ReadSync(m *Message) (*Sync, error) {
+	if err := checkEmpty(m, MsgSyncS); err != nil {
+		return nil, err
+	}
+	return &Sync{}, nil
+}
+
+type Flush struct{}
+
+func InitFlush(m *Message) {
+	m.InitFromBytes(MsgFlushH, []byte{})
+}
+
+func ReadFlush(m *Message) (*Flush, error) {
+	if err := checkEmpty(m, MsgFlushH); err != nil {
+		return nil, err
+	}
+	return &Flush{}, nil
+}
+
+type ParseComplete struct{}
+
+func InitParseComplete(m *Message) {
+	m.InitFromBytes(MsgParseComplete1, []byte{})
+}
+
+func ReadParseComplete(m *Message) (*ParseComplete, error) {
+	if err := checkEmpty(m, MsgParseComplete1); err != nil {
+		return nil, err
+	}
+	return &ParseComplete{}, nil
+}
+
+type BindComplete struct{}
+
+func InitBindComplete(m *Message) {
+	m.InitFromBytes(MsgBindComplete2, []byte{})
+}
+
+func ReadBindComplete(m *Message) (*BindComplete, error) {
+	if err := checkEmpty(m, MsgBindComplete2); err != nil {
+		return nil, err
+	}
+	return &BindComplete{}, nil
+}
+
+type CloseComplete struct{}
+
+func InitCloseComplete(m *Message) {
+	m.InitFromBytes(MsgCloseComplete3, []byte{})
+}
+
+func ReadCloseComplete(m *Message) (*CloseComplete, error) {
+	if err := checkEmpty(m, MsgCloseComplete3); err != nil {
+		return nil, err
+	}
+	return &CloseComplete{}, nil
+}
+
+type NoData struct{}
+
+func InitNoData(m *Message) {
+	m.InitFromBytes(MsgNoDataN, []byte{})
+}
+
+func ReadNoData(m *Message) (*NoData, error) {
+	if err := checkEmpty(m, MsgNoDataN); err != nil {
+		return nil, err
+	}
+	return &NoData{}, nil
+}
+
+type PortalSuspended struct{}
+
+func InitPortalSuspended(m *Message) {
+	m.InitFromBytes(MsgPortalSuspendedS, []byte{})
+}
+
+func ReadPortalSuspended(m *Message) (*PortalSuspended, error) {
+	if err := checkEmpty(m, MsgPortalSuspendedS); err != nil {
+		return nil, err
+	}
+	return &PortalSuspended{}, nil
+}
+
+type ParameterDescription struct {
+	ParamOids []Oid
+}
+
+func InitParameterDescription(m *Message, paramOids []Oid) {
+	msgBytes := make([]byte, 0, 2+4*len(paramOids))
+	buf := bytes.NewBuffer(msgBytes)
+	WriteInt16(buf, int16(len(paramOids)))
+	for _, oid := range paramOids {
+		WriteUint32(buf, uint32(oid))
+	}
+
+	m.InitFromBytes(MsgParameterDescriptionT, buf.Bytes())
+}
+
+func ReadParameterDescription(m *Message) (*ParameterDescription, error) {
+	if t := m.MsgType(); t != MsgParameterDescriptionT {
+		return nil, e.BadTypeCode(t)
+	}
+
+	oids, err := readOids(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &ParameterDescription{oids}, nil
+}
+
+// Describe and Close share a layout: a statement-or-portal byte
+// followed by the name of the target.
+func initTargetMessage(m *Message, msgType byte, kind byte, name string) {
+	msgBytes := make([]byte, 0, 1+len(name)+1)
+	buf := bytes.NewBuffer(msgBytes)
+	buf.WriteByte(kind)
+	WriteCString(buf, name)
+
+	m.InitFromBytes(msgType, buf.Bytes())
+}
+
+func readTargetMessage(m *Message, msgType byte) (kind byte, name string, err error) {
+	if t := m.MsgType(); t != msgType {
+		return 0, "", e.BadTypeCode(t)
+	}
+
+	b := m.Payload()
+	kind, err = ReadByte(b)
+	if err != nil {
+		return 0, "", err
+	}
+	if kind != IsStmt && kind != IsPortal {
+		return 0, "", e.BadTypeCode(kind)
+	}
+	name, err = ReadCString(b)
+	if err != nil {
+		return 0, "", err
+	}
+	return kind, name, nil
+}
+
+func checkEmpty(m *Message, msgType byte) error {
+	if t := m.MsgType(); t != msgType {
+		return e.BadTypeCode(t)
+	}
+	if m.Size() != 4 {
+		return e.WrongSize("expected empty message; got size %v",
+			m.Size())
+	}
+	return nil
+}
+
+func writeFormats(w io.Writer, formats []EncFmt) {
+	WriteInt16(w, int16(len(formats)))
+	for _, f := range formats {
+		WriteInt16(w, int16(f))
+	}
+}
+
+func readFormats(r io.Reader) ([]EncFmt, error) {
+	count, err := ReadUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	formats := make([]EncFmt, count)
+	for i := range formats {
+		f, err := ReadInt16(r)
+		if err != nil {
+			return nil, err
+		}
+		formats[i] = EncFmt(f)
+	}
+	return formats, nil
+}
+
+func readOids(r io.Reader) ([]Oid, error) {
+	count, err := ReadUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	oids := make([]Oid, count)
+	for i := range oids {
+		oid, err := ReadUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		oids[i] = Oid(oid)
+	}
+	return oids, nil
+}
@@ -0,0 +1,165 @@
+package proto
+
+import (
+	"bytes"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"testing"
+)
+
+// Send a message through a MessageStream and read it back out, so
+// that the readers see it just as they would off the network.
+func roundTrip(t *testing.T, m *core.Message) *core.Message {
+	ms := core.NewBackendStream(newInMemRwc())
+	if err := ms.Send(m); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	var result core.Message
+	if err := ms.Next(&result); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	return &result
+}
+
+func TestParseSerDes(t *testing.T) {
+	var m core.Message
+	InitParse(&m, "stmt1", "SELECT $1::int + $2", []Oid{OidInt4, 0})
+
+	p, err := ReadParse(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "stmt1" || p.Query != "SELECT $1::int + $2" {
+		t.Errorf("unexpected Parse %#v", p)
+	}
+	if len(p.ParamOids) != 2 || p.ParamOids[0] != OidInt4 ||
+		p.ParamOids[1] != 0 {
+		t.Errorf("unexpected parameter oids %v", p.ParamOids)
+	}
+}
+
+func TestBindSerDes(t *testing.T) {
+	var m core.Message
+	params := [][]byte{[]byte("42"), nil, []byte{}}
+	InitBind(&m, "portal", "stmt1", []EncFmt{EncFmtTxt},
+		params, []EncFmt{EncFmtBinary, EncFmtTxt})
+
+	b, err := ReadBind(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Portal != "portal" || b.Statement != "stmt1" {
+		t.Errorf("unexpected Bind targets %#v", b)
+	}
+	if len(b.Params) != 3 {
+		t.Fatalf("got %v params; want 3", len(b.Params))
+	}
+	if !bytes.Equal(b.Params[0], []byte("42")) {
+		t.Errorf("got param %v; want 42", b.Params[0])
+	}
+	if b.Params[1] != nil {
+		t.Errorf("got param %v; want NULL", b.Params[1])
+	}
+	if b.Params[2] == nil || len(b.Params[2]) != 0 {
+		t.Errorf("got param %v; want empty value", b.Params[2])
+	}
+	if b.ParamFormat(2) != EncFmtTxt {
+		t.Errorf("got param format %v; want text", b.ParamFormat(2))
+	}
+	if b.ResultFormat(0) != EncFmtBinary || b.ResultFormat(1) != EncFmtTxt {
+		t.Errorf("unexpected result formats %v", b.ResultFormats)
+	}
+}
+
+func TestDescribeCloseSerDes(t *testing.T) {
+	var m core.Message
+	InitDescribe(&m, IsPortal, "portal")
+	d, err := ReadDescribe(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Kind != IsPortal || d.Name != "portal" {
+		t.Errorf("unexpected Describe %#v", d)
+	}
+
+	InitClose(&m, IsStmt, "stmt1")
+	c, err := ReadClose(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Kind != IsStmt || c.Name != "stmt1" {
+		t.Errorf("unexpected Close %#v", c)
+	}
+
+	InitClose(&m, 'X', "stmt1")
+	if _, err := ReadClose(roundTrip(t, &m)); err == nil {
+		t.Errorf("expected error for invalid Close kind")
+	}
+}
+
+func TestExecuteSerDes(t *testing.T) {
+	var m core.Message
+	InitExecute(&m, "", 100)
+	ex, err := ReadExecute(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Portal != "" || ex.MaxRows != 100 {
+		t.Errorf("unexpected Execute %#v", ex)
+	}
+}
+
+func TestParameterDescriptionSerDes(t *testing.T) {
+	var m core.Message
+	InitParameterDescription(&m, []Oid{OidText, OidInt8})
+	pd, err := ReadParameterDescription(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pd.ParamOids) != 2 || pd.ParamOids[0] != OidText ||
+		pd.ParamOids[1] != OidInt8 {
+		t.Errorf("unexpected ParameterDescription %v", pd.ParamOids)
+	}
+}
+
+func TestEmptyMessages(t *testing.T) {
+	var m core.Message
+	InitSync(&m)
+	if _, err := ReadSync(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+	InitParseComplete(&m)
+	if _, err := ReadParseComplete(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+	InitBindComplete(&m)
+	if _, err := ReadBindComplete(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+	InitCloseComplete(&m)
+	if _, err := ReadCloseComplete(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+	InitNoData(&m)
+	if _, err := ReadNoData(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+	InitPortalSuspended(&m)
+	if _, err := ReadPortalSuspended(roundTrip(t, &m)); err != nil {
+		t.Error(err)
+	}
+
+	InitNoData(&m)
+	if _, err := ReadSync(&m); err == nil {
+		t.Errorf("expected error reading NoData as Sync")
+	} else if _, ok := err.(e.ErrBadTypeCode); !ok {
+		t.Errorf("got error %#v; want ErrBadTypeCode", err)
+	}
+
+	m.InitFromBytes(MsgSyncS, []byte{0})
+	if _, err := ReadSync(&m); err == nil {
+		t.Errorf("expected error reading oversized Sync")
+	} else if _, ok := err.(e.ErrWrongSize); !ok {
+		t.Errorf("got error %#v; want ErrWrongSize", err)
+	}
+}
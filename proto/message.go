@@ -52,6 +52,20 @@ func IsSSLRequest(m *Message) bool {
 	return bytes.HasPrefix(result, []byte{0x04, 0xd2, 0x16, 0x2f})
 }
 
+// IsGSSENCRequest reports whether m asks for GSSAPI encryption, which
+// a server that does not support it declines just as it would an
+// SSLRequest.
+func IsGSSENCRequest(m *Message) bool {
+	if m.MsgType() != MsgTypeFirst {
+		return false
+	}
+	result, err := m.Force()
+	if err != nil {
+		return false
+	}
+	return bytes.HasPrefix(result, []byte{0x04, 0xd2, 0x16, 0x30})
+}
+
 type StartupMessage struct {
 	Params map[string]string
 }
@@ -177,6 +191,58 @@ func InitReadyForQuery(m *Message, connState ConnStatus) {
 	m.InitFromBytes(MsgReadyForQueryZ, []byte{byte(connState)})
 }
 
+type ReadyForQuery struct {
+	ConnStatus ConnStatus
+}
+
+func ReadReadyForQuery(m *Message) (*ReadyForQuery, error) {
+	if t := m.MsgType(); t != MsgReadyForQueryZ {
+		return nil, e.BadTypeCode(t)
+	}
+	if m.Size() != 5 {
+		return nil, e.WrongSize("ReadyForQuery is wrong size: "+
+			"expected 5, got %v", m.Size())
+	}
+	status, err := ReadByte(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+	return &ReadyForQuery{ConnStatus(status)}, nil
+}
+
+func InitParameterStatus(m *Message, name, value string) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(name)+len(value)+2))
+	WriteCString(buf, name)
+	WriteCString(buf, value)
+
+	m.InitFromBytes(MsgParameterStatusS, buf.Bytes())
+}
+
+type ParameterStatus struct {
+	Name  string
+	Value string
+}
+
+func ReadParameterStatus(m *Message) (*ParameterStatus, error) {
+	if t := m.MsgType(); t != MsgParameterStatusS {
+		return nil, e.BadTypeCode(t)
+	}
+	b := m.Payload()
+	name, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ReadCString(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ParameterStatus{Name: name, Value: value}, nil
+}
+
+func InitTerminate(m *Message) {
+	m.InitFromBytes(MsgTerminateX, []byte{})
+}
+
 func NewField(name string, typOid Oid) *FieldDescription {
 	typSize := TypSize(typOid)
 	return &FieldDescription{name, 0, 0, typOid, typSize, -1, EncFmtTxt}
@@ -226,6 +292,10 @@ func InitCommandComplete(m *Message, cmdTag string) {
 	m.InitFromBytes(MsgCommandCompleteC, buf.Bytes())
 }
 
+func InitEmptyQueryResponse(m *Message) {
+	m.InitFromBytes(MsgEmptyQueryResponseI, []byte{})
+}
+
 func InitQuery(m *Message, query string) {
 	msgBytes := make([]byte, 0, len([]byte(query))+1)
 	buf := bytes.NewBuffer(msgBytes)
@@ -402,7 +472,31 @@ func ReadErrorResponse(msg *Message) (*ErrorResponse, error) {
 	if t := msg.MsgType(); t != MsgErrorResponseE {
 		return nil, e.BadTypeCode(t)
 	}
+	details, err := readNoticeOrError(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &ErrorResponse{details}, nil
+}
 
+// NoticeResponse carries the same fields as ErrorResponse, but
+// reports a warning or informational message instead of a failure.
+type NoticeResponse struct {
+	Details map[byte]string
+}
+
+func ReadNoticeResponse(msg *Message) (*NoticeResponse, error) {
+	if t := msg.MsgType(); t != MsgNoticeResponseN {
+		return nil, e.BadTypeCode(t)
+	}
+	details, err := readNoticeOrError(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &NoticeResponse{details}, nil
+}
+
+func readNoticeOrError(msg *Message) (map[byte]string, error) {
 	p := msg.Payload()
 	details := make(map[byte]string)
 	for {
@@ -419,7 +513,56 @@ func ReadErrorResponse(msg *Message) (*ErrorResponse, error) {
 		}
 		details[fieldCode] = fieldValue
 	}
-	return &ErrorResponse{details}, nil
+	return details, nil
+}
+
+// The order in which InitErrorResponse writes the fields it knows
+// about; any other fields follow in byte order.
+var errorFieldOrder = []byte{'S', 'V', 'C', 'M', 'D', 'H', 'P', 'p', 'q',
+	'W', 's', 't', 'c', 'd', 'n', 'F', 'L', 'R'}
+
+func InitErrorResponse(m *Message, details map[byte]string) {
+	initNoticeOrError(m, MsgErrorResponseE, details)
+}
+
+func InitNoticeResponse(m *Message, details map[byte]string) {
+	initNoticeOrError(m, MsgNoticeResponseN, details)
+}
+
+func initNoticeOrError(m *Message, msgType byte, details map[byte]string) {
+	buf := bytes.NewBuffer(make([]byte, 0, 128))
+	written := make(map[byte]bool, len(details))
+	for _, code := range errorFieldOrder {
+		if val, ok := details[code]; ok {
+			buf.WriteByte(code)
+			WriteCString(buf, val)
+			written[code] = true
+		}
+	}
+	for code := 1; code < 256; code++ {
+		val, ok := details[byte(code)]
+		if ok && !written[byte(code)] {
+			buf.WriteByte(byte(code))
+			WriteCString(buf, val)
+		}
+	}
+	buf.WriteByte('\000')
+
+	m.InitFromBytes(msgType, buf.Bytes())
+}
+
+// Error formats the ErrorResponse like libpq does, so that it can be
+// returned as an error when the backend reports one.
+func (er *ErrorResponse) Error() string {
+	severity := er.Details['S']
+	if severity == "" {
+		severity = "ERROR"
+	}
+	msg := severity + ": " + er.Details['M']
+	if code, ok := er.Details['C']; ok {
+		msg += " (SQLSTATE " + code + ")"
+	}
+	return msg
 }
 
 func InitAuthenticationOk(m *Message) {
@@ -431,6 +574,13 @@ type BackendKeyData struct {
 	SecretKey  uint32
 }
 
+func InitBackendKeyData(m *Message, backendPid, secretKey uint32) {
+	buf := bytes.NewBuffer(make([]byte, 0, 8))
+	WriteUint32(buf, backendPid)
+	WriteUint32(buf, secretKey)
+	m.InitFromBytes(MsgBackendKeyDataK, buf.Bytes())
+}
+
 func IsBackendKeyData(msg *Message) bool {
 	return msg.MsgType() == MsgBackendKeyDataK
 }
@@ -523,6 +673,22 @@ func DescribeStatusCode(code byte) string {
 		// the name of the source-code routine reporting the error.
 	case 'R':
 		return "Routine"
+		// The severity, never localized. Present in messages
+		// from 9.6 servers on.
+	case 'V':
+		return "Severity (unlocalized)"
+		// The names of the schema, table, column, data type and
+		// constraint associated with the error, if any.
+	case 's':
+		return "Schema"
+	case 't':
+		return "Table"
+	case 'c':
+		return "Column"
+	case 'd':
+		return "Data type"
+	case 'n':
+		return "Constraint"
 	default:
 		return fmt.Sprintf("[unknown: %v]", code)
 	}
@@ -569,6 +735,10 @@ const (
 	MsgAuthenticationGSSR                    = 'R'
 	MsgAuthenticationSSPIR                   = 'R'
 	MsgAuthenticationGSSContinueR            = 'R'
+	MsgAuthenticationKerberosV5R             = 'R'
+	MsgAuthenticationSASLR                   = 'R'
+	MsgAuthenticationSASLContinueR           = 'R'
+	MsgAuthenticationSASLFinalR              = 'R'
 	MsgBackendKeyDataK                       = 'K'
 	MsgBindB                                 = 'B'
 	MsgBindComplete2                         = '2'
@@ -601,6 +771,8 @@ const (
 	MsgPortalSuspendedS                      = 's'
 	MsgPrimaryKeepaliveK                     = 'k'
 	MsgQueryQ                                = 'Q'
+	MsgSASLInitialResponseP                  = 'p'
+	MsgSASLResponseP                         = 'p'
 	MsgReadyForQueryZ                        = 'Z'
 	MsgRowDescriptionT                       = 'T'
 
@@ -613,3 +785,98 @@ const (
 	MsgTerminateX           = 'X'
 	MsgXLogDataW            = 'w'
 )
+
+// FrontendMessageName returns the name of the message sent by the
+// frontend with the given type code, or "" if there is none. The
+// untyped startup packets are all reported as "StartupMessage".
+func FrontendMessageName(msgType byte) string {
+	switch msgType {
+	case MsgTypeFirst:
+		return "StartupMessage"
+	case MsgBindB:
+		return "Bind"
+	case MsgCloseC:
+		return "Close"
+	case MsgCopyDataD:
+		return "CopyData"
+	case MsgCopyDoneC:
+		return "CopyDone"
+	case MsgCopyFailF:
+		return "CopyFail"
+	case MsgDescribeD:
+		return "Describe"
+	case MsgExecuteE:
+		return "Execute"
+	case MsgFlushH:
+		return "Flush"
+	case MsgFunctionCallF:
+		return "FunctionCall"
+	case MsgParseP:
+		return "Parse"
+	case MsgPasswordMessageP:
+		// also SASLInitialResponse, SASLResponse and
+		// GSSResponse, depending on the authentication request
+		return "PasswordMessage"
+	case MsgQueryQ:
+		return "Query"
+	case MsgSyncS:
+		return "Sync"
+	case MsgTerminateX:
+		return "Terminate"
+	}
+	return ""
+}
+
+// BackendMessageName returns the name of the message sent by the
+// backend with the given type code, or "" if there is none.
+func BackendMessageName(msgType byte) string {
+	switch msgType {
+	case MsgAuthenticationOkR:
+		return "Authentication"
+	case MsgBackendKeyDataK:
+		return "BackendKeyData"
+	case MsgBindComplete2:
+		return "BindComplete"
+	case MsgCloseComplete3:
+		return "CloseComplete"
+	case MsgCommandCompleteC:
+		return "CommandComplete"
+	case MsgCopyDataD:
+		return "CopyData"
+	case MsgCopyDoneC:
+		return "CopyDone"
+	case MsgCopyInResponseG:
+		return "CopyInResponse"
+	case MsgCopyOutResponseH:
+		return "CopyOutResponse"
+	case MsgCopyBothResponseW:
+		return "CopyBothResponse"
+	case MsgDataRowD:
+		return "DataRow"
+	case MsgEmptyQueryResponseI:
+		return "EmptyQueryResponse"
+	case MsgErrorResponseE:
+		return "ErrorResponse"
+	case MsgFunctionCallResponseV:
+		return "FunctionCallResponse"
+	case MsgNoDataN:
+		return "NoData"
+	case MsgNoticeResponseN:
+		return "NoticeResponse"
+	case MsgNotificationResponseA:
+		return "NotificationResponse"
+	case MsgParameterDescriptionT:
+		return "ParameterDescription"
+	case MsgParameterStatusS:
+		return "ParameterStatus"
+	case MsgParseComplete1:
+		return "ParseComplete"
+	case MsgPortalSuspendedS:
+		return "PortalSuspended"
+	case MsgReadyForQueryZ:
+		return "ReadyForQuery"
+	case MsgRowDescriptionT:
+		return "RowDescription"
+	}
+	return ""
+}
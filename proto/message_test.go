@@ -118,6 +118,49 @@ func TestBackendKeyReading(t *testing.T) {
 	}
 }
 
+func TestBackendKeyDataSerDes(t *testing.T) {
+	var m core.Message
+	InitBackendKeyData(&m, 1234, 0xdeadbeef)
+	kd, err := ReadBackendKeyData(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kd.BackendPid != 1234 || kd.SecretKey != 0xdeadbeef {
+		t.Errorf("got %#v", kd)
+	}
+}
+
+func TestNoticeResponse(t *testing.T) {
+	var m core.Message
+	InitNoticeResponse(&m, map[byte]string{'S': "WARNING", 'M': "careful"})
+	if m.MsgType() != MsgNoticeResponseN {
+		t.Fatalf("got message type %q; want %q", m.MsgType(), MsgNoticeResponseN)
+	}
+	nr, err := ReadNoticeResponse(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nr.Details) != 2 || nr.Details['S'] != "WARNING" ||
+		nr.Details['M'] != "careful" {
+		t.Errorf("got details %v", nr.Details)
+	}
+	if _, err = ReadErrorResponse(&m); err == nil {
+		t.Errorf("expected error reading NoticeResponse as ErrorResponse")
+	}
+}
+
+func TestMessageNames(t *testing.T) {
+	if name := FrontendMessageName(MsgDescribeD); name != "Describe" {
+		t.Errorf("got frontend 'D' %v; want Describe", name)
+	}
+	if name := BackendMessageName(MsgDataRowD); name != "DataRow" {
+		t.Errorf("got backend 'D' %v; want DataRow", name)
+	}
+	if name := FrontendMessageName(MsgReadyForQueryZ); name != "" {
+		t.Errorf("got frontend 'Z' %v; want none", name)
+	}
+}
+
 // utility types and functions for these tests
 type inMemRwc struct {
 	io.ReadWriter
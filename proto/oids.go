@@ -1,27 +1,31 @@
 package proto
 
 // TypSize returns the size in bytes of the Postgres type specified by
-// typOid, where undertood by femebe. For variable-length types or if
-// the type is not known, -1 is returned.
+// typOid, where understood by femebe: -1 for variable-length types
+// and -2 for null-terminated ones, as in pg_type.typlen. Types that
+// are not known are assumed to be variable-length.
 func TypSize(typOid Oid) int16 {
-	// TODO: right now, we hardcode the length of the various types
-	// here; ideally, we should have a mapping for the fixed-length
-	// types (although it seems that all the dynamic-length types,
-	// even those with explicit length restrictions, is just -1, so
-	// perhaps we can provide a mapping for that as well).
 	switch typOid {
-	case OidBool:
+	case OidBool, OidChar:
 		return 1
 	case OidInt2:
 		return 2
-	case OidInt4, OidFloat4:
+	case OidInt4, OidOid, OidFloat4, OidDate:
 		return 4
-	case OidInt8, OidFloat8:
+	case OidMacaddr:
+		return 6
+	case OidInt8, OidFloat8, OidMoney, OidMacaddr8, OidTime,
+		OidTimestamp, OidTimestamptz:
 		return 8
-	case OidText:
-		return -1
+	case OidTimetz:
+		return 12
+	case OidPoint, OidInterval, OidUuid:
+		return 16
+	case OidName:
+		return 64
+	case OidUnknown, OidCstring:
+		return -2
 	default:
-		// unknown, assume variable length
 		return -1
 	}
 }
@@ -118,4 +122,179 @@ const (
 	OidAnyenum             = 3500
 	OidFdwHandler          = 3115
 	OidAnyrange            = 3831
+	OidJsonb               = 3802
+	OidMacaddr8            = 774
 )
+
+// The oids of the built-in multirange types (Postgres 14 and later)
+const (
+	OidInt4multirange Oid = 4451
+	OidNummultirange      = 4532
+	OidTsmultirange       = 4533
+	OidTstzmultirange     = 4534
+	OidDatemultirange     = 4535
+	OidInt8multirange     = 4536
+	OidAnymultirange      = 4537
+)
+
+// The oids of the array types of the built-in types above, named
+// after their element types (Postgres calls int4[] _int4)
+const (
+	OidBoolArray        Oid = 1000
+	OidByteaArray           = 1001
+	OidCharArray            = 1002
+	OidNameArray            = 1003
+	OidInt2Array            = 1005
+	OidInt4Array            = 1007
+	OidTextArray            = 1009
+	OidOidArray             = 1028
+	OidBpcharArray          = 1014
+	OidVarcharArray         = 1015
+	OidInt8Array            = 1016
+	OidPointArray           = 1017
+	OidFloat4Array          = 1021
+	OidFloat8Array          = 1022
+	OidJsonArray            = 199
+	OidMoneyArray           = 791
+	OidMacaddrArray         = 1040
+	OidInetArray            = 1041
+	OidCidrArray            = 651
+	OidTimestampArray       = 1115
+	OidDateArray            = 1182
+	OidTimeArray            = 1183
+	OidTimestamptzArray     = 1185
+	OidIntervalArray        = 1187
+	OidNumericArray         = 1231
+	OidCstringArray         = 1263
+	OidTimetzArray          = 1270
+	OidBitArray             = 1561
+	OidVarbitArray          = 1563
+	OidRecordArray          = 2287
+	OidUuidArray            = 2951
+	OidJsonbArray           = 3807
+	OidMacaddr8Array        = 775
+	OidInt4rangeArray       = 3905
+	OidNumrangeArray        = 3907
+	OidTsrangeArray         = 3909
+	OidTstzrangeArray       = 3911
+	OidDaterangeArray       = 3913
+	OidInt8rangeArray       = 3927
+)
+
+var arrayTypes = map[Oid]Oid{
+	OidBool:        OidBoolArray,
+	OidBytea:       OidByteaArray,
+	OidChar:        OidCharArray,
+	OidName:        OidNameArray,
+	OidInt2:        OidInt2Array,
+	OidInt4:        OidInt4Array,
+	OidText:        OidTextArray,
+	OidOid:         OidOidArray,
+	OidBpchar:      OidBpcharArray,
+	OidVarchar:     OidVarcharArray,
+	OidInt8:        OidInt8Array,
+	OidPoint:       OidPointArray,
+	OidFloat4:      OidFloat4Array,
+	OidFloat8:      OidFloat8Array,
+	OidJson:        OidJsonArray,
+	OidMoney:       OidMoneyArray,
+	OidMacaddr:     OidMacaddrArray,
+	OidInet:        OidInetArray,
+	OidCidr:        OidCidrArray,
+	OidTimestamp:   OidTimestampArray,
+	OidDate:        OidDateArray,
+	OidTime:        OidTimeArray,
+	OidTimestamptz: OidTimestamptzArray,
+	OidInterval:    OidIntervalArray,
+	OidNumeric:     OidNumericArray,
+	OidCstring:     OidCstringArray,
+	OidTimetz:      OidTimetzArray,
+	OidBit:         OidBitArray,
+	OidVarbit:      OidVarbitArray,
+	OidRecord:      OidRecordArray,
+	OidUuid:        OidUuidArray,
+	OidJsonb:       OidJsonbArray,
+	OidMacaddr8:    OidMacaddr8Array,
+	OidInt4range:   OidInt4rangeArray,
+	OidNumrange:    OidNumrangeArray,
+	OidTsrange:     OidTsrangeArray,
+	OidTstzrange:   OidTstzrangeArray,
+	OidDaterange:   OidDaterangeArray,
+	OidInt8range:   OidInt8rangeArray,
+}
+
+var elementTypes = make(map[Oid]Oid, len(arrayTypes))
+
+func init() {
+	for elem, array := range arrayTypes {
+		elementTypes[array] = elem
+	}
+}
+
+// ArrayType returns the oid of the array type of the built-in type
+// elem, or 0 if there is none.
+func ArrayType(elem Oid) Oid {
+	return arrayTypes[elem]
+}
+
+// ElementType returns the oid of the element type of the built-in
+// array type array, or 0 if it is not one.
+func ElementType(array Oid) Oid {
+	return elementTypes[array]
+}
+
+// The built-in range types by their subtypes
+var rangeTypes = map[Oid]Oid{
+	OidInt4:        OidInt4range,
+	OidNumeric:     OidNumrange,
+	OidTimestamp:   OidTsrange,
+	OidTimestamptz: OidTstzrange,
+	OidDate:        OidDaterange,
+	OidInt8:        OidInt8range,
+}
+
+// The built-in multirange types by their subtypes
+var multirangeTypes = map[Oid]Oid{
+	OidInt4:        OidInt4multirange,
+	OidNumeric:     OidNummultirange,
+	OidTimestamp:   OidTsmultirange,
+	OidTimestamptz: OidTstzmultirange,
+	OidDate:        OidDatemultirange,
+	OidInt8:        OidInt8multirange,
+}
+
+var rangeSubtypes = make(map[Oid]Oid, len(rangeTypes))
+var multirangeSubtypes = make(map[Oid]Oid, len(multirangeTypes))
+
+func init() {
+	for sub, rng := range rangeTypes {
+		rangeSubtypes[rng] = sub
+	}
+	for sub, multi := range multirangeTypes {
+		multirangeSubtypes[multi] = sub
+	}
+}
+
+// RangeType returns the oid of the built-in range type over subtype,
+// or 0 if there is none.
+func RangeType(subtype Oid) Oid {
+	return rangeTypes[subtype]
+}
+
+// RangeSubtype returns the oid of the subtype of the built-in range
+// type rng, or 0 if it is not one.
+func RangeSubtype(rng Oid) Oid {
+	return rangeSubtypes[rng]
+}
+
+// MultirangeType returns the oid of the built-in multirange type
+// over subtype, or 0 if there is none.
+func MultirangeType(subtype Oid) Oid {
+	return multirangeTypes[subtype]
+}
+
+// MultirangeSubtype returns the oid of the subtype of the ranges in
+// the built-in multirange type multi, or 0 if it is not one.
+func MultirangeSubtype(multi Oid) Oid {
+	return multirangeSubtypes[multi]
+}
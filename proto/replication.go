@@ -0,0 +1,231 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"time"
+)
+
+// Messages of the streaming replication protocol. They travel inside
+// the payloads of CopyData messages once START_REPLICATION has put
+// the connection in CopyBoth mode, each starting with a type code of
+// its own. The Init functions below make the enclosing CopyData
+// message, and the Read functions read it.
+
+// LSN is a position in the write-ahead log.
+type LSN uint64
+
+// String formats the LSN as Postgres does, such as "16/B374D848".
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+// ParseLSN parses an LSN in the form String produces.
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	var rest string
+	if n, _ := fmt.Sscanf(s, "%X/%X%s", &hi, &lo, &rest); n != 2 {
+		return 0, e.Decode("invalid LSN %q", s)
+	}
+	return LSN(hi)<<32 | LSN(lo), nil
+}
+
+// Replication messages carry times as microseconds since the start
+// of 2000.
+var replicationEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ToReplicationTime returns t as a replication message time.
+func ToReplicationTime(t time.Time) int64 {
+	return t.Sub(replicationEpoch).Nanoseconds() / 1000
+}
+
+// FromReplicationTime returns the time of a replication message.
+func FromReplicationTime(us int64) time.Time {
+	return replicationEpoch.Add(time.Duration(us) * time.Microsecond)
+}
+
+// ReplicationMessageType returns the type code of the replication
+// message inside the CopyData message m, such as MsgXLogDataW, or 0
+// if m holds none.
+func ReplicationMessageType(m *Message) byte {
+	if m.MsgType() != MsgCopyDataD {
+		return 0
+	}
+	data, err := m.Force()
+	if err != nil || len(data) == 0 {
+		return 0
+	}
+	return data[0]
+}
+
+// Start the payload of a CopyData message holding a replication
+// message of the given type and size, not counting the type code
+func replicationBuffer(msgType byte, size int) *bytes.Buffer {
+	buf := bytes.NewBuffer(make([]byte, 0, 1+size))
+	buf.WriteByte(msgType)
+	return buf
+}
+
+// Return the fields of the replication message of the given type in
+// the CopyData message m, checking that they are at least size bytes
+func readReplication(m *Message, msgType byte, size int) ([]byte, error) {
+	if t := m.MsgType(); t != MsgCopyDataD {
+		return nil, e.BadTypeCode(t)
+	}
+	data, err := m.Force()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || data[0] != msgType {
+		return nil, e.Protocol("expected replication message %q", msgType)
+	}
+	if len(data)-1 < size {
+		return nil, e.WrongSize("replication message %q is too short: "+
+			"expected %v bytes, got %v", msgType, size, len(data)-1)
+	}
+	return data[1:], nil
+}
+
+type XLogData struct {
+	// The position of the start of Data in the log
+	Start LSN
+	// The end of the log on the server
+	End      LSN
+	SendTime time.Time
+	Data     []byte
+}
+
+func InitXLogData(m *Message, start, end LSN, sendTime time.Time, data []byte) {
+	buf := replicationBuffer(MsgXLogDataW, 24+len(data))
+	binary.Write(buf, binary.BigEndian, uint64(start))
+	binary.Write(buf, binary.BigEndian, uint64(end))
+	binary.Write(buf, binary.BigEndian, ToReplicationTime(sendTime))
+	buf.Write(data)
+	m.InitFromBytes(MsgCopyDataD, buf.Bytes())
+}
+
+// ReadXLogData reads the XLogData in the CopyData message m. Its Data
+// refers to the payload of m.
+func ReadXLogData(m *Message) (*XLogData, error) {
+	b, err := readReplication(m, MsgXLogDataW, 24)
+	if err != nil {
+		return nil, err
+	}
+	return &XLogData{
+		Start:    LSN(binary.BigEndian.Uint64(b)),
+		End:      LSN(binary.BigEndian.Uint64(b[8:])),
+		SendTime: FromReplicationTime(int64(binary.BigEndian.Uint64(b[16:]))),
+		Data:     b[24:],
+	}, nil
+}
+
+type PrimaryKeepalive struct {
+	// The end of the log on the server
+	End      LSN
+	SendTime time.Time
+	// Whether the server wants a StandbyStatusUpdate right away
+	ReplyRequested bool
+}
+
+func InitPrimaryKeepalive(m *Message, end LSN, sendTime time.Time,
+	replyRequested bool) {
+	buf := replicationBuffer(MsgPrimaryKeepaliveK, 17)
+	binary.Write(buf, binary.BigEndian, uint64(end))
+	binary.Write(buf, binary.BigEndian, ToReplicationTime(sendTime))
+	buf.WriteByte(boolByte(replyRequested))
+	m.InitFromBytes(MsgCopyDataD, buf.Bytes())
+}
+
+func ReadPrimaryKeepalive(m *Message) (*PrimaryKeepalive, error) {
+	b, err := readReplication(m, MsgPrimaryKeepaliveK, 17)
+	if err != nil {
+		return nil, err
+	}
+	return &PrimaryKeepalive{
+		End:            LSN(binary.BigEndian.Uint64(b)),
+		SendTime:       FromReplicationTime(int64(binary.BigEndian.Uint64(b[8:]))),
+		ReplyRequested: b[16] != 0,
+	}, nil
+}
+
+type StandbyStatusUpdate struct {
+	// The positions just past the last byte of the log written,
+	// flushed to disk, and applied by the standby
+	Written LSN
+	Flushed LSN
+	Applied LSN
+	// The standby's clock
+	SendTime time.Time
+	// Whether the standby wants a keepalive right away
+	ReplyRequested bool
+}
+
+func InitStandbyStatusUpdate(m *Message, written, flushed, applied LSN,
+	sendTime time.Time, replyRequested bool) {
+	buf := replicationBuffer(MsgStandbyStatusUpdateR, 33)
+	binary.Write(buf, binary.BigEndian, uint64(written))
+	binary.Write(buf, binary.BigEndian, uint64(flushed))
+	binary.Write(buf, binary.BigEndian, uint64(applied))
+	binary.Write(buf, binary.BigEndian, ToReplicationTime(sendTime))
+	buf.WriteByte(boolByte(replyRequested))
+	m.InitFromBytes(MsgCopyDataD, buf.Bytes())
+}
+
+func ReadStandbyStatusUpdate(m *Message) (*StandbyStatusUpdate, error) {
+	b, err := readReplication(m, MsgStandbyStatusUpdateR, 33)
+	if err != nil {
+		return nil, err
+	}
+	return &StandbyStatusUpdate{
+		Written:        LSN(binary.BigEndian.Uint64(b)),
+		Flushed:        LSN(binary.BigEndian.Uint64(b[8:])),
+		Applied:        LSN(binary.BigEndian.Uint64(b[16:])),
+		SendTime:       FromReplicationTime(int64(binary.BigEndian.Uint64(b[24:]))),
+		ReplyRequested: b[32] != 0,
+	}, nil
+}
+
+// HotStandbyFeedback tells the server the oldest transactions a
+// standby still needs, so that their rows are not vacuumed away. Zero
+// xmins turn the feedback off.
+type HotStandbyFeedback struct {
+	SendTime         time.Time
+	Xmin             uint32
+	XminEpoch        uint32
+	CatalogXmin      uint32
+	CatalogXminEpoch uint32
+}
+
+func InitHotStandbyFeedback(m *Message, f *HotStandbyFeedback) {
+	buf := replicationBuffer(MsgHotStandbyFeedbackH, 24)
+	binary.Write(buf, binary.BigEndian, ToReplicationTime(f.SendTime))
+	binary.Write(buf, binary.BigEndian, f.Xmin)
+	binary.Write(buf, binary.BigEndian, f.XminEpoch)
+	binary.Write(buf, binary.BigEndian, f.CatalogXmin)
+	binary.Write(buf, binary.BigEndian, f.CatalogXminEpoch)
+	m.InitFromBytes(MsgCopyDataD, buf.Bytes())
+}
+
+func ReadHotStandbyFeedback(m *Message) (*HotStandbyFeedback, error) {
+	b, err := readReplication(m, MsgHotStandbyFeedbackH, 24)
+	if err != nil {
+		return nil, err
+	}
+	return &HotStandbyFeedback{
+		SendTime:         FromReplicationTime(int64(binary.BigEndian.Uint64(b))),
+		Xmin:             binary.BigEndian.Uint32(b[8:]),
+		XminEpoch:        binary.BigEndian.Uint32(b[12:]),
+		CatalogXmin:      binary.BigEndian.Uint32(b[16:]),
+		CatalogXminEpoch: binary.BigEndian.Uint32(b[20:]),
+	}, nil
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
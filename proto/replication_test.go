@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLSN(t *testing.T) {
+	lsn, err := ParseLSN("16/B374D848")
+	if err != nil || lsn != 0x16B374D848 {
+		t.Errorf("got %v, %v", lsn, err)
+	}
+	if s := lsn.String(); s != "16/B374D848" {
+		t.Errorf("got %q", s)
+	}
+	for _, bad := range []string{"", "16", "16/", "16/B374D848x", "g/1"} {
+		if _, err := ParseLSN(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestReplicationSerDes(t *testing.T) {
+	now := time.Date(2014, 5, 1, 12, 0, 0, 123456000, time.UTC)
+	var m core.Message
+
+	InitXLogData(&m, 0x100, 0x200, now, []byte("BEGIN"))
+	if mt := ReplicationMessageType(roundTrip(t, &m)); mt != MsgXLogDataW {
+		t.Errorf("got message type %q", mt)
+	}
+	x, err := ReadXLogData(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Start != 0x100 || x.End != 0x200 || !x.SendTime.Equal(now) ||
+		string(x.Data) != "BEGIN" {
+		t.Errorf("unexpected XLogData %#v", x)
+	}
+	if _, err = ReadPrimaryKeepalive(&m); err == nil {
+		t.Errorf("expected an error reading XLogData as a keepalive")
+	}
+
+	InitPrimaryKeepalive(&m, 0x300, now, true)
+	k, err := ReadPrimaryKeepalive(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.End != 0x300 || !k.SendTime.Equal(now) || !k.ReplyRequested {
+		t.Errorf("unexpected PrimaryKeepalive %#v", k)
+	}
+
+	InitStandbyStatusUpdate(&m, 3, 2, 1, now, false)
+	u, err := ReadStandbyStatusUpdate(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Written != 3 || u.Flushed != 2 || u.Applied != 1 ||
+		!u.SendTime.Equal(now) || u.ReplyRequested {
+		t.Errorf("unexpected StandbyStatusUpdate %#v", u)
+	}
+
+	f := &HotStandbyFeedback{SendTime: now, Xmin: 700, XminEpoch: 1,
+		CatalogXmin: 690, CatalogXminEpoch: 1}
+	InitHotStandbyFeedback(&m, f)
+	got, err := ReadHotStandbyFeedback(roundTrip(t, &m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.SendTime = f.SendTime
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("got %#v; want %#v", got, f)
+	}
+
+	m.InitFromBytes(MsgCopyDataD, []byte{MsgPrimaryKeepaliveK, 0})
+	if _, err = ReadPrimaryKeepalive(&m); err == nil {
+		t.Errorf("expected an error reading a short keepalive")
+	}
+}
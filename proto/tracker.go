@@ -0,0 +1,396 @@
+package proto
+
+import (
+	"encoding/binary"
+	. "github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"sync"
+)
+
+// Phase is where a connection is in the protocol, as seen by a
+// Tracker.
+type Phase int
+
+const (
+	// Before the frontend's StartupMessage (including SSL
+	// negotiation), and again after AuthenticationOk until the
+	// backend is first ready for a query
+	PhaseStartup Phase = iota
+	// After the StartupMessage, until AuthenticationOk
+	PhaseAuthentication
+	// Ready for a query, with nothing outstanding
+	PhaseIdle
+	// A simple Query is in progress
+	PhaseSimpleQuery
+	// An extended query batch has been started and the backend
+	// has not yet answered its Sync with ReadyForQuery
+	PhaseExtendedQuery
+	PhaseCopyIn
+	PhaseCopyOut
+	PhaseCopyBoth
+	// A FunctionCall is in progress
+	PhaseFunctionCall
+	// The connection is over: the frontend sent Terminate or a
+	// CancelRequest, or the backend reported a startup error.
+	PhaseTerminated
+)
+
+var phaseNames = [...]string{
+	PhaseStartup:        "startup",
+	PhaseAuthentication: "authentication",
+	PhaseIdle:           "idle",
+	PhaseSimpleQuery:    "simple query",
+	PhaseExtendedQuery:  "extended query",
+	PhaseCopyIn:         "copy in",
+	PhaseCopyOut:        "copy out",
+	PhaseCopyBoth:       "copy both",
+	PhaseFunctionCall:   "function call",
+	PhaseTerminated:     "terminated",
+}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// Tracker follows the state of a single connection by looking at
+// every message sent in either direction. It only looks at message
+// types and the payloads of StartupMessage, Authentication and
+// ReadyForQuery messages, which it forces but does not otherwise
+// disturb, so messages can still be read or forwarded afterwards.
+//
+// Messages that are not valid in the current state are reported as
+// ErrProtocol errors and otherwise ignored. Tracker methods may be
+// called from several goroutines at once, e.g. those routing each
+// direction of a session.
+type Tracker struct {
+	lock  sync.Mutex
+	phase Phase
+	// Whether the backend has sent AuthenticationOk
+	authenticated bool
+	// The phase to return to once COPY is over
+	copyFrom   Phase
+	feCopyDone bool
+	beCopyDone bool
+	// Whether the backend gave up on COPY before the frontend was
+	// done with it; the backend ignores the rest of the frontend's
+	// COPY messages
+	copyAborted bool
+	txnStatus   ConnStatus
+	// The message types of requests still owed a ReadyForQuery:
+	// Query, Sync or FunctionCall, oldest first
+	requests []byte
+	// Whether extended query messages have been sent since the
+	// last Sync
+	unsynced bool
+	// Whether the backend reported an error in an extended query
+	// batch and is ignoring messages until Sync
+	errPending bool
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{phase: PhaseStartup, txnStatus: RfqIdle}
+}
+
+// The current protocol phase
+func (t *Tracker) Phase() Phase {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.phase
+}
+
+// The transaction status from the last ReadyForQuery
+func (t *Tracker) TxnStatus() ConnStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.txnStatus
+}
+
+// The number of Sync-terminated batches the backend has not yet
+// answered with ReadyForQuery
+func (t *Tracker) PendingSyncs() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := 0
+	for _, r := range t.requests {
+		if r == MsgSyncS {
+			n++
+		}
+	}
+	return n
+}
+
+// The number of requests (Query, Sync or FunctionCall) the backend
+// has not yet answered with ReadyForQuery
+func (t *Tracker) PendingRequests() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.requests)
+}
+
+// Whether the backend reported an error during an extended query
+// batch, and is discarding messages until the next Sync
+func (t *Tracker) ErrorPending() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.errPending
+}
+
+// Whether the tracked connection is ready for a query with nothing
+// in progress
+func (t *Tracker) Idle() bool {
+	return t.Phase() == PhaseIdle
+}
+
+func (t *Tracker) violation(format string, args ...interface{}) error {
+	return e.Protocol("%v phase: "+format,
+		append([]interface{}{t.phase}, args...)...)
+}
+
+// Account for the message m sent by the frontend
+func (t *Tracker) FrontendMessage(m *Message) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	mt := m.MsgType()
+	if t.copyAborted {
+		switch mt {
+		case MsgCopyDataD, MsgFlushH:
+			return nil
+		case MsgCopyDoneC, MsgCopyFailF:
+			t.copyAborted = false
+			return nil
+		case MsgSyncS:
+			t.copyAborted = false
+		}
+	}
+	switch t.phase {
+	case PhaseTerminated:
+		return t.violation("unexpected frontend message %q", mt)
+	case PhaseStartup:
+		if t.authenticated {
+			// requests may be sent before the backend is
+			// ready for them, and are answered in turn
+			break
+		}
+		if mt != MsgTypeFirst {
+			return t.violation("unexpected frontend message %q", mt)
+		}
+		if IsStartupMessage(m) {
+			t.phase = PhaseAuthentication
+		} else if IsCancelRequest(m) {
+			t.phase = PhaseTerminated
+		} else if !IsSSLRequest(m) {
+			return t.violation("unknown startup packet")
+		}
+		return nil
+	case PhaseAuthentication:
+		if mt != MsgPasswordMessageP {
+			return t.violation("unexpected frontend message %q", mt)
+		}
+		return nil
+	case PhaseCopyIn, PhaseCopyBoth:
+		switch mt {
+		case MsgCopyDataD:
+			return nil
+		case MsgCopyDoneC, MsgCopyFailF:
+			t.feCopyDone = true
+			t.endCopy()
+			return nil
+		case MsgFlushH, MsgSyncS:
+			if t.phase == PhaseCopyIn {
+				// ignored by the backend during copy in
+				return nil
+			}
+		}
+		return t.violation("unexpected frontend message %q", mt)
+	}
+
+	switch mt {
+	case MsgQueryQ:
+		t.request(mt, PhaseSimpleQuery)
+	case MsgFunctionCallF:
+		t.request(mt, PhaseFunctionCall)
+	case MsgSyncS:
+		t.unsynced = false
+		t.request(mt, PhaseExtendedQuery)
+	case MsgParseP, MsgBindB, MsgDescribeD, MsgExecuteE, MsgCloseC,
+		MsgFlushH:
+		t.unsynced = true
+		if t.phase == PhaseIdle {
+			t.phase = PhaseExtendedQuery
+		}
+	case MsgTerminateX:
+		t.phase = PhaseTerminated
+	case MsgCopyDataD, MsgCopyDoneC, MsgCopyFailF:
+		return t.violation("unexpected %q outside of copy in", mt)
+	default:
+		return t.violation("unexpected frontend message %q", mt)
+	}
+	return nil
+}
+
+// Note a request that the backend will answer with ReadyForQuery
+func (t *Tracker) request(mt byte, phase Phase) {
+	t.requests = append(t.requests, mt)
+	if t.phase == PhaseIdle {
+		t.phase = phase
+	}
+}
+
+// Return to the phase that started COPY once both sides are done
+// with it.
+func (t *Tracker) endCopy() {
+	if t.phase == PhaseCopyBoth && !(t.feCopyDone && t.beCopyDone) {
+		return
+	}
+	t.phase = t.copyFrom
+}
+
+func (t *Tracker) startCopy(mt byte, phase Phase) error {
+	switch t.phase {
+	case PhaseSimpleQuery, PhaseExtendedQuery:
+	default:
+		return t.violation("unexpected backend message %q", mt)
+	}
+	t.copyFrom = t.phase
+	t.feCopyDone = false
+	t.beCopyDone = false
+	t.copyAborted = false
+	t.phase = phase
+	return nil
+}
+
+// Account for the message m sent by the backend
+func (t *Tracker) BackendMessage(m *Message) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	mt := m.MsgType()
+	switch mt {
+	case MsgParameterStatusS, MsgNoticeResponseN,
+		MsgNotificationResponseA:
+		// asynchronous messages may come at any time
+		return nil
+	}
+
+	switch t.phase {
+	case PhaseTerminated:
+		return t.violation("unexpected backend message %q", mt)
+	case PhaseStartup:
+		switch mt {
+		case MsgBackendKeyDataK:
+			return nil
+		case MsgReadyForQueryZ:
+			return t.readyForQuery(m)
+		case MsgErrorResponseE:
+			t.phase = PhaseTerminated
+			return nil
+		}
+		return t.violation("unexpected backend message %q", mt)
+	case PhaseAuthentication:
+		switch mt {
+		case MsgAuthenticationOkR:
+			payload, err := m.Force()
+			if err != nil {
+				return err
+			}
+			if len(payload) < 4 {
+				return t.violation("short Authentication message")
+			}
+			if AuthType(binary.BigEndian.Uint32(payload)) == AuthOk {
+				t.phase = PhaseStartup
+				t.authenticated = true
+			}
+			return nil
+		case MsgErrorResponseE:
+			t.phase = PhaseTerminated
+			return nil
+		}
+		return t.violation("unexpected backend message %q", mt)
+	case PhaseCopyOut, PhaseCopyBoth:
+		switch mt {
+		case MsgCopyDataD:
+			return nil
+		case MsgCopyDoneC:
+			t.beCopyDone = true
+			t.endCopy()
+			return nil
+		case MsgErrorResponseE:
+			// the backend has given up on COPY
+			t.copyAborted = !t.feCopyDone
+			t.phase = t.copyFrom
+		}
+	case PhaseCopyIn:
+		if mt == MsgErrorResponseE {
+			t.copyAborted = true
+			t.phase = t.copyFrom
+		}
+	}
+
+	switch mt {
+	case MsgReadyForQueryZ:
+		return t.readyForQuery(m)
+	case MsgCopyInResponseG:
+		return t.startCopy(mt, PhaseCopyIn)
+	case MsgCopyOutResponseH:
+		return t.startCopy(mt, PhaseCopyOut)
+	case MsgCopyBothResponseW:
+		return t.startCopy(mt, PhaseCopyBoth)
+	case MsgCopyDataD, MsgCopyDoneC:
+		return t.violation("unexpected %q outside of copy out", mt)
+	case MsgErrorResponseE:
+		if t.phase == PhaseExtendedQuery {
+			t.errPending = true
+		}
+	case MsgRowDescriptionT, MsgDataRowD, MsgCommandCompleteC,
+		MsgEmptyQueryResponseI, MsgParseComplete1, MsgBindComplete2,
+		MsgCloseComplete3, MsgNoDataN, MsgPortalSuspendedS,
+		MsgParameterDescriptionT, MsgFunctionCallResponseV:
+	default:
+		return t.violation("unexpected backend message %q", mt)
+	}
+	if t.phase == PhaseIdle {
+		return t.violation("unexpected backend message %q", mt)
+	}
+	return nil
+}
+
+func (t *Tracker) readyForQuery(m *Message) error {
+	payload, err := m.Force()
+	if err != nil {
+		return err
+	}
+	if len(payload) != 1 {
+		return t.violation("ReadyForQuery is wrong size")
+	}
+
+	if t.phase != PhaseStartup {
+		if len(t.requests) == 0 {
+			return t.violation("unexpected ReadyForQuery")
+		}
+		if t.requests[0] == MsgSyncS {
+			t.errPending = false
+		}
+		t.requests = t.requests[1:]
+	}
+	t.txnStatus = ConnStatus(payload[0])
+
+	if len(t.requests) > 0 {
+		switch t.requests[0] {
+		case MsgQueryQ:
+			t.phase = PhaseSimpleQuery
+		case MsgFunctionCallF:
+			t.phase = PhaseFunctionCall
+		default:
+			t.phase = PhaseExtendedQuery
+		}
+	} else if t.unsynced {
+		t.phase = PhaseExtendedQuery
+	} else {
+		t.phase = PhaseIdle
+	}
+	return nil
+}
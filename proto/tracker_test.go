@@ -0,0 +1,188 @@
+package proto
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"testing"
+)
+
+func msg(msgType byte) *core.Message {
+	var m core.Message
+	m.InitFromBytes(msgType, nil)
+	return &m
+}
+
+func rfq(status ConnStatus) *core.Message {
+	var m core.Message
+	InitReadyForQuery(&m, status)
+	return &m
+}
+
+// A message from one side and the phase expected after it
+type trackerStep struct {
+	fromFrontend bool
+	m            *core.Message
+	phase        Phase
+}
+
+func fe(m *core.Message, phase Phase) trackerStep {
+	return trackerStep{true, m, phase}
+}
+
+func be(m *core.Message, phase Phase) trackerStep {
+	return trackerStep{false, m, phase}
+}
+
+func runSteps(t *testing.T, tr *Tracker, steps []trackerStep) {
+	for i, step := range steps {
+		var err error
+		if step.fromFrontend {
+			err = tr.FrontendMessage(step.m)
+		} else {
+			err = tr.BackendMessage(step.m)
+		}
+		if err != nil {
+			t.Fatalf("step %v (%q): %v", i, step.m.MsgType(), err)
+		}
+		if p := tr.Phase(); p != step.phase {
+			t.Fatalf("step %v (%q): got phase %v; want %v",
+				i, step.m.MsgType(), p, step.phase)
+		}
+	}
+}
+
+// A tracker that has gone through startup and is idle
+func startedTracker(t *testing.T) *Tracker {
+	var startup, ok, ps core.Message
+	InitStartupMessage(&startup, map[string]string{"user": "test"})
+	InitAuthenticationOk(&ok)
+	InitParameterStatus(&ps, "server_version", "9.4.0")
+
+	tr := NewTracker()
+	runSteps(t, tr, []trackerStep{
+		fe(&startup, PhaseAuthentication),
+		be(&ok, PhaseStartup),
+		be(&ps, PhaseStartup),
+		be(msg(MsgBackendKeyDataK), PhaseStartup),
+		be(rfq(RfqIdle), PhaseIdle),
+	})
+	return tr
+}
+
+func TestTrackerSimpleQuery(t *testing.T) {
+	tr := startedTracker(t)
+	runSteps(t, tr, []trackerStep{
+		fe(msg(MsgQueryQ), PhaseSimpleQuery),
+		be(msg(MsgCommandCompleteC), PhaseSimpleQuery),
+		be(rfq(RfqInTrans), PhaseIdle),
+		fe(msg(MsgQueryQ), PhaseSimpleQuery),
+		be(msg(MsgCopyInResponseG), PhaseCopyIn),
+		fe(msg(MsgCopyDataD), PhaseCopyIn),
+		fe(msg(MsgCopyDoneC), PhaseSimpleQuery),
+		be(msg(MsgCommandCompleteC), PhaseSimpleQuery),
+		be(rfq(RfqInTrans), PhaseIdle),
+		fe(msg(MsgTerminateX), PhaseTerminated),
+	})
+	if s := tr.TxnStatus(); s != RfqInTrans {
+		t.Errorf("got transaction status %c; want %c", s, RfqInTrans)
+	}
+}
+
+func TestTrackerExtendedQuery(t *testing.T) {
+	tr := startedTracker(t)
+	runSteps(t, tr, []trackerStep{
+		fe(msg(MsgParseP), PhaseExtendedQuery),
+		fe(msg(MsgBindB), PhaseExtendedQuery),
+		fe(msg(MsgExecuteE), PhaseExtendedQuery),
+		fe(msg(MsgSyncS), PhaseExtendedQuery),
+		fe(msg(MsgBindB), PhaseExtendedQuery),
+		fe(msg(MsgExecuteE), PhaseExtendedQuery),
+		fe(msg(MsgSyncS), PhaseExtendedQuery),
+		be(msg(MsgParseComplete1), PhaseExtendedQuery),
+		be(msg(MsgErrorResponseE), PhaseExtendedQuery),
+	})
+	if n := tr.PendingSyncs(); n != 2 {
+		t.Errorf("got %v pending syncs; want 2", n)
+	}
+	if !tr.ErrorPending() {
+		t.Errorf("expected error to be pending until Sync")
+	}
+	runSteps(t, tr, []trackerStep{
+		be(rfq(RfqIdle), PhaseExtendedQuery),
+	})
+	if tr.ErrorPending() || tr.PendingSyncs() != 1 {
+		t.Errorf("got error pending %v with %v syncs; want none and 1",
+			tr.ErrorPending(), tr.PendingSyncs())
+	}
+	runSteps(t, tr, []trackerStep{
+		be(msg(MsgBindComplete2), PhaseExtendedQuery),
+		be(msg(MsgCommandCompleteC), PhaseExtendedQuery),
+		be(rfq(RfqIdle), PhaseIdle),
+	})
+}
+
+func TestTrackerCopyInError(t *testing.T) {
+	tr := startedTracker(t)
+	// the frontend keeps sending COPY data it pipelined before it
+	// sees the backend's error
+	runSteps(t, tr, []trackerStep{
+		fe(msg(MsgQueryQ), PhaseSimpleQuery),
+		be(msg(MsgCopyInResponseG), PhaseCopyIn),
+		fe(msg(MsgCopyDataD), PhaseCopyIn),
+		be(msg(MsgErrorResponseE), PhaseSimpleQuery),
+		fe(msg(MsgCopyDataD), PhaseSimpleQuery),
+		be(rfq(RfqIdle), PhaseIdle),
+		fe(msg(MsgCopyDataD), PhaseIdle),
+		fe(msg(MsgCopyDoneC), PhaseIdle),
+	})
+	if err := tr.FrontendMessage(msg(MsgCopyDataD)); err == nil {
+		t.Errorf("expected error for CopyData after the end of COPY")
+	}
+
+	tr = startedTracker(t)
+	runSteps(t, tr, []trackerStep{
+		fe(msg(MsgParseP), PhaseExtendedQuery),
+		fe(msg(MsgBindB), PhaseExtendedQuery),
+		fe(msg(MsgExecuteE), PhaseExtendedQuery),
+		be(msg(MsgParseComplete1), PhaseExtendedQuery),
+		be(msg(MsgBindComplete2), PhaseExtendedQuery),
+		be(msg(MsgCopyInResponseG), PhaseCopyIn),
+		fe(msg(MsgCopyDataD), PhaseCopyIn),
+		be(msg(MsgErrorResponseE), PhaseExtendedQuery),
+		fe(msg(MsgCopyDataD), PhaseExtendedQuery),
+		fe(msg(MsgFlushH), PhaseExtendedQuery),
+		fe(msg(MsgSyncS), PhaseExtendedQuery),
+	})
+	if !tr.ErrorPending() || tr.PendingSyncs() != 1 {
+		t.Errorf("got error pending %v with %v syncs; want true and 1",
+			tr.ErrorPending(), tr.PendingSyncs())
+	}
+	runSteps(t, tr, []trackerStep{
+		be(rfq(RfqIdle), PhaseIdle),
+	})
+	if err := tr.FrontendMessage(msg(MsgCopyDoneC)); err == nil {
+		t.Errorf("expected error for CopyDone after Sync")
+	}
+}
+
+func TestTrackerViolations(t *testing.T) {
+	tr := NewTracker()
+	if err := tr.FrontendMessage(msg(MsgQueryQ)); err == nil {
+		t.Errorf("expected error for Query before startup")
+	}
+
+	tr = startedTracker(t)
+	err := tr.BackendMessage(msg(MsgDataRowD))
+	if _, ok := err.(e.ErrProtocol); !ok {
+		t.Errorf("got %#v for DataRow while idle; want ErrProtocol", err)
+	}
+	if err = tr.BackendMessage(rfq(RfqIdle)); err == nil {
+		t.Errorf("expected error for unrequested ReadyForQuery")
+	}
+	if err = tr.FrontendMessage(msg(MsgCopyDataD)); err == nil {
+		t.Errorf("expected error for CopyData outside of copy")
+	}
+	if p := tr.Phase(); p != PhaseIdle {
+		t.Errorf("violations changed phase to %v", p)
+	}
+}
@@ -0,0 +1,471 @@
+package replication
+
+import (
+	"encoding/binary"
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"io"
+	"time"
+)
+
+// The messages of pgoutput, the output plugin behind Postgres' own
+// logical replication, as decoded by Decoder. Start a stream for it
+// with the options "proto_version" and "publication_names"; version
+// 2 adds streaming of large transactions in progress ("streaming"
+// 'on'), whose messages arrive between StreamStart and StreamStop
+// and carry the xid of their transaction.
+
+// Begin starts a transaction.
+type Begin struct {
+	// The position of the commit record
+	FinalLSN   proto.LSN
+	CommitTime time.Time
+	Xid        uint32
+}
+
+// Commit ends a transaction.
+type Commit struct {
+	Flags byte
+	// The position of the commit record
+	LSN proto.LSN
+	// The end of the transaction's records, to acknowledge once its
+	// changes are safely processed
+	EndLSN     proto.LSN
+	CommitTime time.Time
+}
+
+// Origin names the replication origin a transaction came from.
+type Origin struct {
+	// The position of the commit on the origin server
+	LSN  proto.LSN
+	Name string
+}
+
+// Relation describes a table, before the first change to it, and
+// again whenever it changes.
+type Relation struct {
+	ID        proto.Oid
+	Namespace string
+	Name      string
+	// The table's replica identity setting: 'd' for the primary
+	// key, 'n' for nothing, 'f' for all columns, or 'i' for an index
+	ReplicaIdentity byte
+	Columns         []Column
+}
+
+type Column struct {
+	// Whether the column is part of the replica identity
+	Key     bool
+	Name    string
+	TypeOid proto.Oid
+	TypeMod int32
+}
+
+// Type describes a type that is not built in, before the first
+// relation with a column of the type.
+type Type struct {
+	Oid       proto.Oid
+	Namespace string
+	Name      string
+}
+
+// Insert is a new row of Relation.
+type Insert struct {
+	Xid      uint32
+	Relation *Relation
+	New      []interface{}
+}
+
+// Update is a changed row of Relation. Old is the old row if the
+// replica identity is full, or its key columns if a key changed,
+// with OldKeyOnly set; otherwise it is nil.
+type Update struct {
+	Xid        uint32
+	Relation   *Relation
+	Old        []interface{}
+	OldKeyOnly bool
+	New        []interface{}
+}
+
+// Delete is a deleted row of Relation: the whole row if the replica
+// identity is full, or else its key columns, with OldKeyOnly set.
+type Delete struct {
+	Xid        uint32
+	Relation   *Relation
+	Old        []interface{}
+	OldKeyOnly bool
+}
+
+// Truncate empties Relations.
+type Truncate struct {
+	Xid             uint32
+	Relations       []*Relation
+	Cascade         bool
+	RestartIdentity bool
+}
+
+// LogicalMessage is a message written with pg_logical_emit_message,
+// sent if the "messages" option is on.
+type LogicalMessage struct {
+	Xid           uint32
+	Transactional bool
+	LSN           proto.LSN
+	Prefix        string
+	Content       []byte
+}
+
+// StreamStart starts a block of changes of the transaction Xid.
+type StreamStart struct {
+	Xid uint32
+	// Whether this is the first block of the transaction
+	First bool
+}
+
+// StreamStop ends a block of changes.
+type StreamStop struct{}
+
+// StreamCommit commits a streamed transaction.
+type StreamCommit struct {
+	Xid        uint32
+	Flags      byte
+	LSN        proto.LSN
+	EndLSN     proto.LSN
+	CommitTime time.Time
+}
+
+// StreamAbort aborts a streamed transaction or, if SubXid differs
+// from Xid, one of its subtransactions. The abort position and time
+// are only sent with parallel streaming, from version 4.
+type StreamAbort struct {
+	Xid       uint32
+	SubXid    uint32
+	AbortLSN  proto.LSN
+	AbortTime time.Time
+}
+
+// Unchanged stands for the value of a TOASTed column an update left
+// alone, which is not sent.
+type Unchanged struct{}
+
+// Decoder decodes pgoutput messages, keeping track of the relations
+// they describe. It is not safe for concurrent use.
+type Decoder struct {
+	relations map[proto.Oid]*Relation
+	streaming bool
+	err       error
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{relations: make(map[proto.Oid]*Relation)}
+}
+
+// Decode decodes the pgoutput message data, the Data of an XLogData,
+// into one of the message types above, such as *Insert. Column
+// values are decoded with codec according to their type, and may
+// refer to data.
+func (d *Decoder) Decode(data []byte) (interface{}, error) {
+	r := &msgReader{b: data}
+	msgType := r.byte()
+	var msg interface{}
+	switch msgType {
+	case 'B':
+		msg = &Begin{FinalLSN: r.lsn(), CommitTime: r.time(), Xid: r.uint32()}
+	case 'C':
+		msg = &Commit{Flags: r.byte(), LSN: r.lsn(), EndLSN: r.lsn(),
+			CommitTime: r.time()}
+	case 'O':
+		msg = &Origin{LSN: r.lsn(), Name: r.cstring()}
+	case 'R':
+		d.xid(r)
+		rel := &Relation{ID: r.oid(), Namespace: r.cstring(),
+			Name: r.cstring(), ReplicaIdentity: r.byte()}
+		n := int(r.uint16())
+		for i := 0; i < n && r.err == nil; i++ {
+			rel.Columns = append(rel.Columns, Column{Key: r.byte()&1 != 0,
+				Name: r.cstring(), TypeOid: r.oid(), TypeMod: int32(r.uint32())})
+		}
+		if r.err == nil {
+			d.relations[rel.ID] = rel
+		}
+		msg = rel
+	case 'Y':
+		d.xid(r)
+		msg = &Type{Oid: r.oid(), Namespace: r.cstring(), Name: r.cstring()}
+	case 'I':
+		ins := &Insert{Xid: d.xid(r)}
+		ins.Relation = d.relation(r)
+		if r.expect('N') {
+			ins.New = d.tuple(r, ins.Relation)
+		}
+		msg = ins
+	case 'U':
+		upd := &Update{Xid: d.xid(r)}
+		upd.Relation = d.relation(r)
+		kind := r.byte()
+		if kind == 'K' || kind == 'O' {
+			upd.OldKeyOnly = kind == 'K'
+			upd.Old = d.tuple(r, upd.Relation)
+			kind = r.byte()
+		}
+		if kind != 'N' && r.err == nil {
+			r.err = e.Decode("unexpected tuple type %q in update", kind)
+		}
+		upd.New = d.tuple(r, upd.Relation)
+		msg = upd
+	case 'D':
+		del := &Delete{Xid: d.xid(r)}
+		del.Relation = d.relation(r)
+		kind := r.byte()
+		if kind != 'K' && kind != 'O' && r.err == nil {
+			r.err = e.Decode("unexpected tuple type %q in delete", kind)
+		}
+		del.OldKeyOnly = kind == 'K'
+		del.Old = d.tuple(r, del.Relation)
+		msg = del
+	case 'T':
+		t := &Truncate{Xid: d.xid(r)}
+		n := int(r.uint32())
+		options := r.byte()
+		t.Cascade = options&1 != 0
+		t.RestartIdentity = options&2 != 0
+		for i := 0; i < n && r.err == nil; i++ {
+			t.Relations = append(t.Relations, d.relation(r))
+		}
+		msg = t
+	case 'M':
+		lm := &LogicalMessage{Xid: d.xid(r)}
+		lm.Transactional = r.byte()&1 != 0
+		lm.LSN = r.lsn()
+		lm.Prefix = r.cstring()
+		lm.Content = r.bytes(int(r.uint32()))
+		msg = lm
+	case 'S':
+		msg = &StreamStart{Xid: r.uint32(), First: r.byte() == 1}
+		d.streaming = r.err == nil
+	case 'E':
+		msg = &StreamStop{}
+		d.streaming = false
+	case 'c':
+		msg = &StreamCommit{Xid: r.uint32(), Flags: r.byte(), LSN: r.lsn(),
+			EndLSN: r.lsn(), CommitTime: r.time()}
+	case 'A':
+		a := &StreamAbort{Xid: r.uint32(), SubXid: r.uint32()}
+		if len(r.b) > 0 {
+			a.AbortLSN = r.lsn()
+			a.AbortTime = r.time()
+		}
+		msg = a
+	default:
+		if r.err == nil {
+			r.err = e.Decode("unknown pgoutput message type %q", msgType)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return msg, nil
+}
+
+// Read the xid that the messages inside a streamed block start with
+func (d *Decoder) xid(r *msgReader) uint32 {
+	if !d.streaming {
+		return 0
+	}
+	return r.uint32()
+}
+
+// Read the id of a relation described earlier
+func (d *Decoder) relation(r *msgReader) *Relation {
+	id := r.oid()
+	rel, ok := d.relations[id]
+	if !ok && r.err == nil {
+		r.err = e.Decode("unknown relation %v", id)
+	}
+	return rel
+}
+
+// Read and decode a row of rel
+func (d *Decoder) tuple(r *msgReader, rel *Relation) []interface{} {
+	n := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	if n > len(rel.Columns) {
+		r.err = e.Decode("got %v columns for relation %v of %v columns",
+			n, rel.Name, len(rel.Columns))
+		return nil
+	}
+	vals := make([]interface{}, n)
+	for i := range vals {
+		var format proto.EncFmt
+		switch kind := r.byte(); kind {
+		case 'n':
+			continue
+		case 'u':
+			vals[i] = Unchanged{}
+			continue
+		case 't':
+			format = proto.EncFmtTxt
+		case 'b':
+			format = proto.EncFmtBinary
+		default:
+			if r.err == nil {
+				r.err = e.Decode("unknown column kind %q", kind)
+			}
+			return nil
+		}
+		data := r.bytes(int(r.uint32()))
+		if r.err != nil {
+			return nil
+		}
+		val, err := codec.DecodeValue(data, rel.Columns[i].TypeOid, format)
+		if err != nil {
+			r.err = err
+			return nil
+		}
+		vals[i] = val
+	}
+	return vals
+}
+
+// Change is a message decoded from a logical replication stream.
+type Change struct {
+	// The position of the XLogData the message arrived in
+	LSN proto.LSN
+	// One of the message types above, such as *Insert
+	Message interface{}
+}
+
+// Changes reads s in a goroutine, decoding its XLogData and sending
+// each message on the returned channel, which is closed when the
+// stream ends or done is closed; Err then reports why. Nothing is
+// acknowledged: call s.Ack with the EndLSN of each Commit once the
+// transaction's changes are safely processed. Neither s nor d may
+// otherwise be used until the channel is closed, except that s may
+// be closed once done is, without waiting for the channel. done may
+// be nil if the stream is only ever ended by the server.
+func (d *Decoder) Changes(s *Stream, done <-chan bool) <-chan *Change {
+	changes := make(chan *Change)
+	go func() {
+		defer close(changes)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			msg, err := s.Next()
+			if err != nil {
+				if err != io.EOF {
+					d.err = err
+				}
+				return
+			}
+			x, ok := msg.(*proto.XLogData)
+			if !ok {
+				continue
+			}
+			// the data is only valid until the next message
+			data := append([]byte(nil), x.Data...)
+			if msg, err = d.Decode(data); err != nil {
+				d.err = err
+				return
+			}
+			select {
+			case changes <- &Change{x.Start, msg}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+// Err returns the error that ended Changes, or nil if the server
+// ended the stream.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Reads the fields of a message, keeping the first error
+type msgReader struct {
+	b   []byte
+	err error
+}
+
+func (r *msgReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = e.Decode("pgoutput message is too short")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *msgReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *msgReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *msgReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *msgReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *msgReader) oid() proto.Oid {
+	return proto.Oid(r.uint32())
+}
+
+func (r *msgReader) lsn() proto.LSN {
+	return proto.LSN(r.uint64())
+}
+
+func (r *msgReader) time() time.Time {
+	return proto.FromReplicationTime(int64(r.uint64()))
+}
+
+func (r *msgReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, c := range r.b {
+		if c == 0 {
+			s := string(r.b[:i])
+			r.b = r.b[i+1:]
+			return s
+		}
+	}
+	r.err = e.Decode("unterminated string in pgoutput message")
+	return ""
+}
+
+// Read the given tuple type, failing on any other
+func (r *msgReader) expect(kind byte) bool {
+	if got := r.byte(); got != kind && r.err == nil {
+		r.err = e.Decode("unexpected tuple type %q", got)
+	}
+	return r.err == nil
+}
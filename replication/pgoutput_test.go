@@ -0,0 +1,221 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/server"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Build a pgoutput message from its fields: strings are written
+// null-terminated, byte slices as they are, and numbers in big-endian
+// order
+func pgoMsg(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		switch v := f.(type) {
+		case string:
+			buf.WriteString(v)
+			buf.WriteByte(0)
+		case []byte:
+			buf.Write(v)
+		default:
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// A text column value
+func textCol(s string) []byte {
+	return pgoMsg(byte('t'), uint32(len(s)), []byte(s))
+}
+
+var (
+	commitTime = time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	pgTime     = uint64(proto.ToReplicationTime(commitTime))
+	relMsg     = pgoMsg(byte('R'), uint32(16384), "public", "widgets",
+		byte('d'), uint16(2),
+		byte(1), "id", uint32(proto.OidInt4), int32(-1),
+		byte(0), "name", uint32(proto.OidText), int32(-1))
+)
+
+func TestDecode(t *testing.T) {
+	d := NewDecoder()
+	msg, err := d.Decode(relMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, ok := msg.(*Relation)
+	if !ok || rel.Name != "widgets" || rel.Namespace != "public" ||
+		len(rel.Columns) != 2 || !rel.Columns[0].Key || rel.Columns[1].Key ||
+		rel.Columns[1].TypeOid != proto.OidText {
+		t.Fatalf("got %#v", msg)
+	}
+
+	for i, tt := range []struct {
+		data []byte
+		want interface{}
+	}{
+		{pgoMsg(byte('B'), uint64(0x200), pgTime, uint32(700)),
+			&Begin{0x200, commitTime, 700}},
+		{pgoMsg(byte('C'), byte(0), uint64(0x200), uint64(0x230), pgTime),
+			&Commit{0, 0x200, 0x230, commitTime}},
+		{pgoMsg(byte('O'), uint64(0x100), "upstream"),
+			&Origin{0x100, "upstream"}},
+		{pgoMsg(byte('Y'), uint32(16390), "public", "mood"),
+			&Type{16390, "public", "mood"}},
+		{pgoMsg(byte('I'), uint32(16384), byte('N'), uint16(2),
+			textCol("1"), byte('n')),
+			&Insert{0, rel, []interface{}{int64(1), nil}}},
+		{pgoMsg(byte('U'), uint32(16384), byte('K'), uint16(1), textCol("1"),
+			byte('N'), uint16(2), textCol("2"), byte('u')),
+			&Update{0, rel, []interface{}{int64(1)}, true,
+				[]interface{}{int64(2), Unchanged{}}}},
+		{pgoMsg(byte('U'), uint32(16384), byte('N'), uint16(2), textCol("2"),
+			textCol("gear")),
+			&Update{0, rel, nil, false, []interface{}{int64(2), "gear"}}},
+		{pgoMsg(byte('D'), uint32(16384), byte('O'), uint16(2), textCol("2"),
+			textCol("gear")),
+			&Delete{0, rel, []interface{}{int64(2), "gear"}, false}},
+		{pgoMsg(byte('T'), uint32(1), byte(3), uint32(16384)),
+			&Truncate{0, []*Relation{rel}, true, true}},
+		{pgoMsg(byte('M'), byte(1), uint64(0x300), "audit", uint32(2), []byte("hi")),
+			&LogicalMessage{0, true, 0x300, "audit", []byte("hi")}},
+		{pgoMsg(byte('S'), uint32(800), byte(1)), &StreamStart{800, true}},
+		{pgoMsg(byte('I'), uint32(800), uint32(16384), byte('N'), uint16(1),
+			textCol("3")),
+			&Insert{800, rel, []interface{}{int64(3)}}},
+		{pgoMsg(byte('E')), &StreamStop{}},
+		{pgoMsg(byte('A'), uint32(800), uint32(801)),
+			&StreamAbort{Xid: 800, SubXid: 801}},
+		{pgoMsg(byte('A'), uint32(800), uint32(801), uint64(0x400), pgTime),
+			&StreamAbort{800, 801, 0x400, commitTime}},
+		{pgoMsg(byte('c'), uint32(800), byte(0), uint64(0x500), uint64(0x530),
+			pgTime),
+			&StreamCommit{800, 0, 0x500, 0x530, commitTime}},
+	} {
+		got, err := d.Decode(tt.data)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: got %#v; want %#v", i, got, tt.want)
+		}
+	}
+
+	for i, bad := range [][]byte{
+		{},
+		pgoMsg(byte('Z')),
+		pgoMsg(byte('B'), uint64(0x200)),
+		pgoMsg(byte('I'), uint32(1), byte('N'), uint16(0)),
+		pgoMsg(byte('I'), uint32(16384), byte('N'), uint16(3)),
+		pgoMsg(byte('I'), uint32(16384), byte('N'), uint16(1), byte('x')),
+		pgoMsg(byte('I'), uint32(16384), byte('N'), uint16(1), textCol("one")),
+		pgoMsg(byte('D'), uint32(16384), byte('N'), uint16(0)),
+		pgoMsg(byte('O'), uint64(0x100), []byte("unterminated")),
+	} {
+		if msg, err := d.Decode(bad); err == nil {
+			t.Errorf("%d: expected an error; got %#v", i, msg)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	statuses := make(chan *proto.StandbyStatusUpdate, 10)
+	src := &Source{
+		Script: []Event{
+			{Data: relMsg, Pos: 0x16B6C88},
+			{Data: pgoMsg(byte('B'), uint64(0x16B6D00), pgTime, uint32(700))},
+			{Data: pgoMsg(byte('I'), uint32(16384), byte('N'), uint16(2),
+				textCol("1"), textCol("sprocket"))},
+			{Data: pgoMsg(byte('C'), byte(0), uint64(0x16B6D00),
+				uint64(0x16B6D30), pgTime)},
+			{Keepalive: true, ReplyRequested: true},
+		},
+		EndStream: true,
+		Statuses:  statuses,
+	}
+	conn, err := Connect(&serverConnector{&server.Server{Handler: src}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.CreateSlot("s", "pgoutput", false); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.StartLogical("s", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder()
+	var got []interface{}
+	for change := range d.Changes(stream, nil) {
+		got = append(got, change.Message)
+		if c, ok := change.Message.(*Commit); ok {
+			stream.Ack(c.EndLSN)
+		}
+	}
+	if err = d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %#v", got)
+	}
+	if ins, ok := got[2].(*Insert); !ok ||
+		!reflect.DeepEqual(ins.New, []interface{}{int64(1), "sprocket"}) {
+		t.Errorf("got %#v; want the insert", got[2])
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var last *proto.StandbyStatusUpdate
+	for len(statuses) > 0 {
+		last = <-statuses
+	}
+	if last == nil || last.Flushed != 0x16B6D30 {
+		t.Errorf("got status update %#v", last)
+	}
+}
+
+func TestChangesDone(t *testing.T) {
+	src := &Source{
+		Script: []Event{
+			{Data: relMsg, Pos: 0x16B6C88},
+			{Data: pgoMsg(byte('B'), uint64(0x16B6D00), pgTime, uint32(700))},
+		},
+	}
+	conn, err := Connect(&serverConnector{&server.Server{Handler: src}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := conn.StartPhysical("", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop reading with a change left unreceived, and the server
+	// waiting for the client to end the stream
+	d := NewDecoder()
+	done := make(chan bool)
+	changes := d.Changes(stream, done)
+	if change := <-changes; change == nil {
+		t.Fatal("got no changes")
+	}
+	close(done)
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _ = range changes {
+	}
+	if err = d.Err(); err != nil {
+		t.Error(err)
+	}
+	if _, err = conn.IdentifySystem(); err != nil {
+		t.Errorf("could not run a command after the stream: %v", err)
+	}
+}
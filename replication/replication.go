@@ -0,0 +1,491 @@
+// Package replication implements the frontend side of the streaming
+// replication protocol: it runs the replication commands on a
+// replication connection, and then streams the log in CopyBoth mode,
+// answering keepalives and reporting progress to the server. A
+// Decoder turns the logical changes of the pgoutput plugin into Go
+// values, and a Source stands in for the server in tests.
+package replication
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default interval between status updates sent to the server
+const DefaultStatusInterval = 10 * time.Second
+
+// StartupParams returns a copy of the startup parameters params that
+// asks for a replication connection to their database, which can
+// run logical replication. Pass it to the Connector given to Connect.
+func StartupParams(params map[string]string) map[string]string {
+	result := make(map[string]string, len(params)+1)
+	for name, value := range params {
+		result[name] = value
+	}
+	result["replication"] = "database"
+	return result
+}
+
+// Conn is a replication connection to a server.
+type Conn struct {
+	// The client the replication commands run on, which also
+	// holds the server's parameters. It must not be used while a
+	// Stream is open.
+	Client *femebe.Client
+	// How often an open Stream reports its progress to the
+	// server, as the server's wal_receiver_status_interval
+	// would; DefaultStatusInterval if zero
+	StatusInterval time.Duration
+
+	stream core.Stream
+}
+
+// Connect opens a replication connection through c, whose startup
+// parameters must include "replication", as StartupParams adds.
+func Connect(c femebe.Connector) (*Conn, error) {
+	be, err := c.Startup()
+	if err != nil {
+		return nil, err
+	}
+	client, err := femebe.NewClient(be)
+	if err != nil {
+		be.Close()
+		return nil, err
+	}
+	return &Conn{Client: client, stream: be}, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.Client.Close()
+}
+
+// SystemInfo is the result of IDENTIFY_SYSTEM.
+type SystemInfo struct {
+	SystemID string
+	Timeline int32
+	// The current end of the log
+	XLogPos proto.LSN
+	// The database of the connection, if it has one
+	DBName string
+}
+
+// IdentifySystem asks the server to identify itself.
+func (c *Conn) IdentifySystem() (*SystemInfo, error) {
+	var row struct {
+		SystemID string  `femebe:"systemid"`
+		Timeline int32   `femebe:"timeline"`
+		XLogPos  string  `femebe:"xlogpos"`
+		DBName   *string `femebe:"dbname"`
+	}
+	if err := c.queryRow("IDENTIFY_SYSTEM", &row); err != nil {
+		return nil, err
+	}
+	pos, err := proto.ParseLSN(row.XLogPos)
+	if err != nil {
+		return nil, err
+	}
+	info := &SystemInfo{SystemID: row.SystemID, Timeline: row.Timeline,
+		XLogPos: pos}
+	if row.DBName != nil {
+		info.DBName = *row.DBName
+	}
+	return info, nil
+}
+
+// Slot is a replication slot made by CreateSlot.
+type Slot struct {
+	Name string
+	// The position from which the slot's changes are consistent
+	ConsistentPoint proto.LSN
+	// The snapshot exported by a logical slot, if any
+	SnapshotName string
+	// The output plugin of a logical slot
+	OutputPlugin string
+}
+
+// CreateSlot creates a replication slot with the given name: a
+// logical one decoding changes with the given output plugin, such as
+// "pgoutput", or a physical one if plugin is empty. A temporary slot
+// is dropped when the connection ends.
+func (c *Conn) CreateSlot(name, plugin string, temporary bool) (*Slot, error) {
+	sql := "CREATE_REPLICATION_SLOT " + quoteIdent(name)
+	if temporary {
+		sql += " TEMPORARY"
+	}
+	if plugin != "" {
+		sql += " LOGICAL " + quoteIdent(plugin)
+	} else {
+		sql += " PHYSICAL"
+	}
+
+	var row struct {
+		Name            string  `femebe:"slot_name"`
+		ConsistentPoint *string `femebe:"consistent_point"`
+		SnapshotName    *string `femebe:"snapshot_name"`
+		OutputPlugin    *string `femebe:"output_plugin"`
+	}
+	if err := c.queryRow(sql, &row); err != nil {
+		return nil, err
+	}
+	slot := &Slot{Name: row.Name}
+	if row.ConsistentPoint != nil {
+		pos, err := proto.ParseLSN(*row.ConsistentPoint)
+		if err != nil {
+			return nil, err
+		}
+		slot.ConsistentPoint = pos
+	}
+	if row.SnapshotName != nil {
+		slot.SnapshotName = *row.SnapshotName
+	}
+	if row.OutputPlugin != nil {
+		slot.OutputPlugin = *row.OutputPlugin
+	}
+	return slot, nil
+}
+
+// DropSlot drops the replication slot with the given name.
+func (c *Conn) DropSlot(name string) error {
+	_, err := c.Client.Exec("DROP_REPLICATION_SLOT " + quoteIdent(name))
+	return err
+}
+
+// Run sql and scan the single row it returns into dst
+func (c *Conn) queryRow(sql string, dst interface{}) error {
+	rows, err := c.Client.Query(sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%v returned no rows", sql)
+	}
+	if err = rows.Scan(dst); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// StartLogical starts streaming the changes decoded by the logical
+// slot with the given name, from the position start, or where the
+// slot left off if that is later. The options are passed to the
+// slot's output plugin.
+func (c *Conn) StartLogical(slot string, start proto.LSN,
+	options map[string]string) (*Stream, error) {
+	sql := "START_REPLICATION SLOT " + quoteIdent(slot) + " LOGICAL " +
+		start.String()
+	if len(options) > 0 {
+		names := make([]string, 0, len(options))
+		for name := range options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		opts := make([]string, len(names))
+		for i, name := range names {
+			opts[i] = quoteIdent(name) + " " + quoteLiteral(options[name])
+		}
+		sql += " (" + strings.Join(opts, ", ") + ")"
+	}
+	return c.start(sql, true)
+}
+
+// StartPhysical starts streaming the log from the position start on
+// the given timeline, or the current one if zero. The slot is
+// optional.
+func (c *Conn) StartPhysical(slot string, start proto.LSN,
+	timeline int32) (*Stream, error) {
+	sql := "START_REPLICATION"
+	if slot != "" {
+		sql += " SLOT " + quoteIdent(slot)
+	}
+	sql += " PHYSICAL " + start.String()
+	if timeline != 0 {
+		sql += fmt.Sprintf(" TIMELINE %d", timeline)
+	}
+	return c.start(sql, false)
+}
+
+// Run a START_REPLICATION command and wait for the server to switch
+// to CopyBoth mode
+func (c *Conn) start(sql string, logical bool) (*Stream, error) {
+	var m core.Message
+	proto.InitQuery(&m, sql)
+	if err := c.stream.Send(&m); err != nil {
+		return nil, err
+	}
+	if err := c.stream.Flush(); err != nil {
+		return nil, err
+	}
+	for {
+		if err := c.stream.Next(&m); err != nil {
+			return nil, err
+		}
+		switch m.MsgType() {
+		case proto.MsgCopyBothResponseW:
+			if _, err := proto.ReadCopyBothResponse(&m); err != nil {
+				return nil, err
+			}
+			return c.newStream(logical), nil
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&m)
+			if err != nil {
+				return nil, err
+			}
+			if err = c.finish(); err != nil {
+				return nil, err
+			}
+			return nil, er
+		default:
+			if err := m.Discard(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Read the rest of the response to a command, up to ReadyForQuery
+func (c *Conn) finish() error {
+	var m core.Message
+	for {
+		if err := c.stream.Next(&m); err != nil {
+			return err
+		}
+		if m.MsgType() == proto.MsgReadyForQueryZ {
+			rfq, err := proto.ReadReadyForQuery(&m)
+			if err != nil {
+				return err
+			}
+			c.Client.TxnStatus = rfq.ConnStatus
+			return nil
+		}
+		if err := m.Discard(); err != nil {
+			return err
+		}
+	}
+}
+
+// Stream is a replication stream started by StartLogical or
+// StartPhysical. It reports its progress to the server every
+// StatusInterval, and whenever the server asks for it. Its methods
+// other than Next and Close may be called from any goroutine, and
+// Close may be called while another goroutine is in Next.
+type Stream struct {
+	conn *Conn
+	// Held while reading from the server
+	readLock sync.Mutex
+	m        core.Message
+	logical  bool
+	// whether the server has ended the stream
+	copyDone bool
+
+	lock     sync.Mutex
+	written  proto.LSN
+	flushed  proto.LSN
+	feedback *proto.HotStandbyFeedback
+	stop     chan bool
+	closed   bool
+}
+
+func (c *Conn) newStream(logical bool) *Stream {
+	s := &Stream{conn: c, logical: logical, stop: make(chan bool)}
+	interval := c.StatusInterval
+	if interval == 0 {
+		interval = DefaultStatusInterval
+	}
+	go s.reportStatus(interval)
+	return s
+}
+
+// Send status updates every interval until the stream is closed
+func (s *Stream) reportStatus(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SendStatus(false); err != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Next reads the next message from the server: a *proto.XLogData, or
+// a *proto.PrimaryKeepalive, which is answered if the server asks.
+// The Data of an XLogData is only valid until the next call. Next
+// returns io.EOF once the server ends the stream, and an error it
+// sends as a *proto.ErrorResponse.
+func (s *Stream) Next() (interface{}, error) {
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	return s.next()
+}
+
+func (s *Stream) next() (interface{}, error) {
+	for !s.copyDone {
+		if err := s.conn.stream.Next(&s.m); err != nil {
+			return nil, err
+		}
+		switch s.m.MsgType() {
+		case proto.MsgCopyDataD:
+			switch proto.ReplicationMessageType(&s.m) {
+			case proto.MsgXLogDataW:
+				x, err := proto.ReadXLogData(&s.m)
+				if err != nil {
+					return nil, err
+				}
+				s.received(x)
+				return x, nil
+			case proto.MsgPrimaryKeepaliveK:
+				k, err := proto.ReadPrimaryKeepalive(&s.m)
+				if err != nil {
+					return nil, err
+				}
+				if k.ReplyRequested {
+					if err = s.SendStatus(false); err != nil {
+						return nil, err
+					}
+				}
+				return k, nil
+			}
+		case proto.MsgCopyDoneC:
+			s.copyDone = true
+		case proto.MsgErrorResponseE:
+			er, err := proto.ReadErrorResponse(&s.m)
+			if err != nil {
+				return nil, err
+			}
+			s.copyDone = true
+			return nil, er
+		default:
+			if err := s.m.Discard(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, io.EOF
+}
+
+// Note the position of data received. The changes from a logical
+// slot are at the position of their record; raw log data ends where
+// its bytes do.
+func (s *Stream) received(x *proto.XLogData) {
+	pos := x.Start
+	if !s.logical {
+		pos += proto.LSN(len(x.Data))
+	}
+	s.lock.Lock()
+	if pos > s.written {
+		s.written = pos
+	}
+	s.lock.Unlock()
+}
+
+// Ack tells the server, with the next status update, that everything
+// up to pos has been durably processed, so it need not be kept for
+// this slot any longer.
+func (s *Stream) Ack(pos proto.LSN) {
+	s.lock.Lock()
+	if pos > s.flushed {
+		s.flushed = pos
+	}
+	if pos > s.written {
+		s.written = pos
+	}
+	s.lock.Unlock()
+}
+
+// SetFeedback sets the hot standby feedback sent with each status
+// update; nil sends none.
+func (s *Stream) SetFeedback(f *proto.HotStandbyFeedback) {
+	s.lock.Lock()
+	s.feedback = f
+	s.lock.Unlock()
+}
+
+// SendStatus sends a status update, and hot standby feedback if set,
+// to the server now, asking it to reply with a keepalive if
+// replyRequested is set.
+func (s *Stream) SendStatus(replyRequested bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	var m core.Message
+	now := time.Now()
+	proto.InitStandbyStatusUpdate(&m, s.written, s.flushed, s.flushed,
+		now, replyRequested)
+	if err := s.conn.stream.Send(&m); err != nil {
+		return err
+	}
+	if s.feedback != nil {
+		f := *s.feedback
+		f.SendTime = now
+		proto.InitHotStandbyFeedback(&m, &f)
+		if err := s.conn.stream.Send(&m); err != nil {
+			return err
+		}
+	}
+	return s.conn.stream.Flush()
+}
+
+// Close ends the stream, with a last status update, and waits for the
+// server to end its side, discarding anything more it sends. The Conn
+// can then run commands again.
+func (s *Stream) Close() error {
+	if err := s.SendStatus(false); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	var m core.Message
+	proto.InitCopyDone(&m)
+	err := s.conn.stream.Send(&m)
+	if err == nil {
+		err = s.conn.stream.Flush()
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// wait out any other reader, which may see the end of the
+	// stream itself
+	s.readLock.Lock()
+	defer s.readLock.Unlock()
+	for !s.copyDone {
+		if _, err = s.next(); err == io.EOF {
+			break
+		} else if _, ok := err.(*proto.ErrorResponse); !ok && err != nil {
+			return err
+		}
+	}
+	return s.conn.finish()
+}
@@ -0,0 +1,216 @@
+package replication
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/server"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const startQuery = `START_REPLICATION SLOT "s" LOGICAL 0/16B6C88 ` +
+	`("proto_version" '1', "publication_names" 'it''s')`
+
+// Answers the replication commands as a server with one logical
+// slot, streaming a single change
+type replHandler struct {
+	statuses chan *proto.StandbyStatusUpdate
+	feedback chan *proto.HotStandbyFeedback
+}
+
+func (h *replHandler) Query(s *server.Session, query string) error {
+	switch {
+	case query == "IDENTIFY_SYSTEM":
+		return codec.WriteRows(s.Stream,
+			[]string{"systemid", "timeline", "xlogpos", "dbname"},
+			[][]interface{}{{"6015", int32(1), "0/16B6C50", "postgres"}}, nil)
+	case query == `CREATE_REPLICATION_SLOT "s" TEMPORARY LOGICAL "pgoutput"`:
+		return codec.WriteRows(s.Stream,
+			[]string{"slot_name", "consistent_point", "snapshot_name",
+				"output_plugin"},
+			[][]interface{}{{"s", "0/16B6C88", nil, "pgoutput"}}, nil)
+	case query == `DROP_REPLICATION_SLOT "s"`:
+		return s.Complete("DROP_REPLICATION_SLOT")
+	case query == startQuery:
+		return h.stream(s)
+	}
+	return server.Error("42601", "syntax error at or near %q", query)
+}
+
+func (h *replHandler) stream(s *server.Session) error {
+	var m core.Message
+	now := time.Now()
+	proto.InitCopyBothResponse(&m, proto.EncFmtBinary, nil)
+	s.Stream.Send(&m)
+	proto.InitXLogData(&m, 0x16B6C88, 0x16B6D00, now, []byte("BEGIN"))
+	s.Stream.Send(&m)
+	proto.InitPrimaryKeepalive(&m, 0x16B6D00, now, true)
+	s.Stream.Send(&m)
+	if err := s.Stream.Flush(); err != nil {
+		return err
+	}
+	for {
+		if err := s.Stream.Next(&m); err != nil {
+			return err
+		}
+		switch m.MsgType() {
+		case proto.MsgCopyDataD:
+			switch proto.ReplicationMessageType(&m) {
+			case proto.MsgStandbyStatusUpdateR:
+				u, err := proto.ReadStandbyStatusUpdate(&m)
+				if err != nil {
+					return err
+				}
+				h.statuses <- u
+			case proto.MsgHotStandbyFeedbackH:
+				f, err := proto.ReadHotStandbyFeedback(&m)
+				if err != nil {
+					return err
+				}
+				h.feedback <- f
+			}
+		case proto.MsgCopyDoneC:
+			proto.InitCopyDone(&m)
+			s.Stream.Send(&m)
+			return s.Complete("START_REPLICATION")
+		default:
+			return server.Error("08P01", "unexpected message %q", m.MsgType())
+		}
+	}
+}
+
+func (h *replHandler) Parse(s *server.Session, stmt *server.Statement) error {
+	return server.Error("08P01", "extended query protocol not supported")
+}
+
+func (h *replHandler) Bind(s *server.Session, portal *server.Portal) error {
+	return nil
+}
+
+func (h *replHandler) Execute(s *server.Session, portal *server.Portal,
+	maxRows uint32) error {
+	return nil
+}
+
+type serverConnector struct {
+	srv *server.Server
+}
+
+func (c *serverConnector) Startup() (core.Stream, error) {
+	feConn, beConn := net.Pipe()
+	go c.srv.ServeConn(beConn)
+	be := core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn))
+	var m core.Message
+	proto.InitStartupMessage(&m, StartupParams(map[string]string{"user": "alice"}))
+	if err := be.Send(&m); err != nil {
+		return nil, err
+	}
+	return be, be.Flush()
+}
+
+func (c *serverConnector) Cancel(backendPid, secretKey uint32) error {
+	return nil
+}
+
+func TestReplication(t *testing.T) {
+	h := &replHandler{
+		statuses: make(chan *proto.StandbyStatusUpdate, 10),
+		feedback: make(chan *proto.HotStandbyFeedback, 10),
+	}
+	conn, err := Connect(&serverConnector{&server.Server{Handler: h}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.StatusInterval = time.Hour
+
+	info, err := conn.IdentifySystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info != (SystemInfo{"6015", 1, 0x16B6C50, "postgres"}) {
+		t.Errorf("got %#v", info)
+	}
+
+	slot, err := conn.CreateSlot("s", "pgoutput", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *slot != (Slot{"s", 0x16B6C88, "", "pgoutput"}) {
+		t.Errorf("got %#v", slot)
+	}
+
+	if _, err = conn.StartLogical("s", 0x16B6C88, nil); err == nil {
+		t.Errorf("expected an error starting with the wrong options")
+	} else if _, ok := err.(*proto.ErrorResponse); !ok {
+		t.Errorf("got %#v; want an ErrorResponse", err)
+	}
+
+	stream, err := conn.StartLogical("s", 0x16B6C88, map[string]string{
+		"publication_names": "it's",
+		"proto_version":     "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := msg.(*proto.XLogData); !ok || x.Start != 0x16B6C88 ||
+		string(x.Data) != "BEGIN" {
+		t.Errorf("got %#v; want the XLogData", msg)
+	}
+	stream.Ack(0x16B6C90)
+	msg, err = stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := msg.(*proto.PrimaryKeepalive); !ok || !k.ReplyRequested {
+		t.Errorf("got %#v; want the keepalive", msg)
+	}
+	u := <-h.statuses
+	if u.Written != 0x16B6C90 || u.Flushed != 0x16B6C90 || u.Applied != 0x16B6C90 {
+		t.Errorf("got status update %#v", u)
+	}
+
+	stream.SetFeedback(&proto.HotStandbyFeedback{Xmin: 700})
+	if err = stream.SendStatus(false); err != nil {
+		t.Fatal(err)
+	}
+	<-h.statuses
+	if f := <-h.feedback; f.Xmin != 700 || f.SendTime.IsZero() {
+		t.Errorf("got feedback %#v", f)
+	}
+
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Next(); err != io.EOF {
+		t.Errorf("got %v after closing; want EOF", err)
+	}
+	if err = conn.DropSlot("s"); err != nil {
+		t.Error(err)
+	}
+	if _, err = conn.IdentifySystem(); err != nil {
+		t.Error(err)
+	}
+	if conn.Client.TxnStatus != proto.RfqIdle {
+		t.Errorf("got transaction status %q", conn.Client.TxnStatus)
+	}
+}
+
+func TestStartupParams(t *testing.T) {
+	params := map[string]string{"user": "alice", "database": "db"}
+	got := StartupParams(params)
+	if got["replication"] != "database" || got["user"] != "alice" {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := params["replication"]; ok || len(params) != 2 {
+		t.Errorf("modified the original parameters: %v", params)
+	}
+}
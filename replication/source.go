@@ -0,0 +1,352 @@
+package replication
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/server"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a step of the script a Source plays: it sends Data, if
+// any, as XLogData, then a keepalive if Keepalive is set, and then
+// waits for WaitFlushed if set.
+type Event struct {
+	Data []byte
+	// The position of Data in the log, or if zero, just past the
+	// data before it. Positions must increase through the script.
+	Pos            proto.LSN
+	Keepalive      bool
+	ReplyRequested bool
+	// A position the client must report flushed before the script
+	// goes on
+	WaitFlushed proto.LSN
+}
+
+// Source is a fake replication server for testing replication
+// clients without Postgres. It is a server.Handler answering
+// IDENTIFY_SYSTEM, CREATE_REPLICATION_SLOT, DROP_REPLICATION_SLOT and
+// START_REPLICATION, which plays the Script in CopyBoth mode. As a
+// real server does, it keeps the position each slot's client has
+// flushed, from their status updates, and a stream resumes from
+// there, skipping the data before it.
+type Source struct {
+	SystemID string
+	Timeline int32
+	Script   []Event
+	// Whether to end the stream once the script is played, rather
+	// than wait for the client to end it
+	EndStream bool
+	// If set, the status updates and hot standby feedback received
+	// are sent on, and must be read
+	Statuses chan<- *proto.StandbyStatusUpdate
+	Feedback chan<- *proto.HotStandbyFeedback
+
+	lock  sync.Mutex
+	cond  *sync.Cond
+	slots map[string]*sourceSlot
+}
+
+type sourceSlot struct {
+	Slot
+	flushed proto.LSN
+}
+
+// Flushed returns the position the client of the named slot last
+// reported flushed.
+func (src *Source) Flushed(slot string) proto.LSN {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+	if s, ok := src.slots[slot]; ok {
+		return s.flushed
+	}
+	return 0
+}
+
+// The positions of the script's data, and the end of its log
+func (src *Source) positions() ([]proto.LSN, proto.LSN) {
+	positions := make([]proto.LSN, len(src.Script))
+	var pos proto.LSN
+	for i, ev := range src.Script {
+		if ev.Pos != 0 {
+			pos = ev.Pos
+		}
+		positions[i] = pos
+		pos += proto.LSN(len(ev.Data))
+	}
+	return positions, pos
+}
+
+func (src *Source) Query(s *server.Session, query string) error {
+	words := strings.Fields(strings.TrimRight(query, "; "))
+	if len(words) == 0 {
+		return server.Error("42601", "syntax error")
+	}
+	switch strings.ToUpper(words[0]) {
+	case "IDENTIFY_SYSTEM":
+		timeline := src.Timeline
+		if timeline == 0 {
+			timeline = 1
+		}
+		_, end := src.positions()
+		return codec.WriteRows(s.Stream,
+			[]string{"systemid", "timeline", "xlogpos", "dbname"},
+			[][]interface{}{{src.SystemID, timeline, end.String(),
+				s.Database()}}, nil)
+	case "CREATE_REPLICATION_SLOT":
+		return src.createSlot(s, words[1:])
+	case "DROP_REPLICATION_SLOT":
+		if len(words) < 2 {
+			return server.Error("42601", "syntax error")
+		}
+		name := unquoteIdent(words[1])
+		src.lock.Lock()
+		_, ok := src.slots[name]
+		delete(src.slots, name)
+		src.lock.Unlock()
+		if !ok {
+			return server.Error("42704",
+				"replication slot %q does not exist", name)
+		}
+		return s.Complete("DROP_REPLICATION_SLOT")
+	case "START_REPLICATION":
+		return src.start(s, words[1:])
+	}
+	return server.Error("42601", "syntax error at or near %q", words[0])
+}
+
+// CREATE_REPLICATION_SLOT name [TEMPORARY] {LOGICAL plugin | PHYSICAL}
+// makes a slot consistent from the start of the script.
+func (src *Source) createSlot(s *server.Session, args []string) error {
+	if len(args) < 2 {
+		return server.Error("42601", "syntax error")
+	}
+	slot := &sourceSlot{Slot: Slot{Name: unquoteIdent(args[0])}}
+	for i, arg := range args[1:] {
+		if strings.ToUpper(arg) == "LOGICAL" && i+2 < len(args) {
+			slot.OutputPlugin = unquoteIdent(args[i+2])
+		}
+	}
+	if positions, _ := src.positions(); len(positions) > 0 {
+		slot.ConsistentPoint = positions[0]
+	}
+
+	src.lock.Lock()
+	if src.slots == nil {
+		src.slots = make(map[string]*sourceSlot)
+	}
+	_, exists := src.slots[slot.Name]
+	if !exists {
+		src.slots[slot.Name] = slot
+	}
+	src.lock.Unlock()
+	if exists {
+		return server.Error("42710",
+			"replication slot %q already exists", slot.Name)
+	}
+
+	var plugin interface{}
+	if slot.OutputPlugin != "" {
+		plugin = slot.OutputPlugin
+	}
+	return codec.WriteRows(s.Stream,
+		[]string{"slot_name", "consistent_point", "snapshot_name",
+			"output_plugin"},
+		[][]interface{}{{slot.Name, slot.ConsistentPoint.String(), nil,
+			plugin}}, nil)
+}
+
+// START_REPLICATION [SLOT name] [LOGICAL | PHYSICAL] pos [...] plays
+// the script from pos, or where the slot left off if later.
+func (src *Source) start(s *server.Session, args []string) error {
+	var slot *sourceSlot
+	var start proto.LSN
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "SLOT":
+			if i+1 == len(args) {
+				return server.Error("42601", "syntax error")
+			}
+			i++
+			name := unquoteIdent(args[i])
+			src.lock.Lock()
+			slot = src.slots[name]
+			src.lock.Unlock()
+			if slot == nil {
+				return server.Error("42704",
+					"replication slot %q does not exist", name)
+			}
+		case "LOGICAL", "PHYSICAL":
+		default:
+			pos, err := proto.ParseLSN(args[i])
+			if err != nil {
+				return server.Error("42601", "syntax error at or near %q",
+					args[i])
+			}
+			start = pos
+			// ignore the timeline and plugin options
+			i = len(args)
+		}
+	}
+	src.lock.Lock()
+	if slot != nil && slot.flushed > start {
+		start = slot.flushed
+	}
+	if src.cond == nil {
+		src.cond = sync.NewCond(&src.lock)
+	}
+	src.lock.Unlock()
+
+	var m core.Message
+	proto.InitCopyBothResponse(&m, proto.EncFmtBinary, nil)
+	if err := s.Stream.Send(&m); err != nil {
+		return err
+	}
+	if err := s.Stream.Flush(); err != nil {
+		return err
+	}
+
+	// read the client's messages alongside the script; it has
+	// everything before where it starts
+	flushed := start
+	clientDone := false
+	readErr := make(chan error, 1)
+	go func() {
+		err := src.readStatus(s.Stream, slot, &flushed)
+		src.lock.Lock()
+		clientDone = true
+		src.cond.Broadcast()
+		src.lock.Unlock()
+		readErr <- err
+	}()
+
+	positions, end := src.positions()
+	for i, ev := range src.Script {
+		if err := src.play(s.Stream, ev, positions[i], start, end); err != nil {
+			return err
+		}
+		if ev.WaitFlushed != 0 {
+			src.lock.Lock()
+			for flushed < ev.WaitFlushed && !clientDone {
+				src.cond.Wait()
+			}
+			src.lock.Unlock()
+		}
+	}
+	if src.EndStream {
+		proto.InitCopyDone(&m)
+		if err := s.Stream.Send(&m); err != nil {
+			return err
+		}
+		if err := s.Stream.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := <-readErr; err != nil {
+		return err
+	}
+	if !src.EndStream {
+		proto.InitCopyDone(&m)
+		if err := s.Stream.Send(&m); err != nil {
+			return err
+		}
+	}
+	return s.Complete("START_STREAMING")
+}
+
+// Send the event ev, at position pos, skipping data before start
+func (src *Source) play(s core.Stream, ev Event, pos, start, end proto.LSN) error {
+	var m core.Message
+	if ev.Data != nil && pos >= start {
+		proto.InitXLogData(&m, pos, end, time.Now(), ev.Data)
+		if err := s.Send(&m); err != nil {
+			return err
+		}
+	}
+	if ev.Keepalive {
+		proto.InitPrimaryKeepalive(&m, end, time.Now(), ev.ReplyRequested)
+		if err := s.Send(&m); err != nil {
+			return err
+		}
+	}
+	return s.Flush()
+}
+
+// Read the client's status updates until it ends the stream, keeping
+// the position flushed
+func (src *Source) readStatus(s core.Stream, slot *sourceSlot,
+	flushed *proto.LSN) error {
+	var m core.Message
+	for {
+		if err := s.Next(&m); err != nil {
+			return err
+		}
+		switch m.MsgType() {
+		case proto.MsgCopyDataD:
+			switch proto.ReplicationMessageType(&m) {
+			case proto.MsgStandbyStatusUpdateR:
+				u, err := proto.ReadStandbyStatusUpdate(&m)
+				if err != nil {
+					return err
+				}
+				src.lock.Lock()
+				if u.Flushed > *flushed {
+					*flushed = u.Flushed
+				}
+				if slot != nil && u.Flushed > slot.flushed {
+					slot.flushed = u.Flushed
+				}
+				src.cond.Broadcast()
+				src.lock.Unlock()
+				if src.Statuses != nil {
+					src.Statuses <- u
+				}
+			case proto.MsgHotStandbyFeedbackH:
+				f, err := proto.ReadHotStandbyFeedback(&m)
+				if err != nil {
+					return err
+				}
+				if src.Feedback != nil {
+					src.Feedback <- f
+				}
+			}
+		case proto.MsgCopyDoneC:
+			return nil
+		case proto.MsgCopyFailF:
+			cf, err := proto.ReadCopyFail(&m)
+			if err != nil {
+				return err
+			}
+			return server.Error("57014", "COPY failed: %v", cf.Message)
+		default:
+			if err := m.Discard(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (src *Source) Parse(s *server.Session, stmt *server.Statement) error {
+	return server.Error("08P01",
+		"extended query protocol not supported in a replication connection")
+}
+
+func (src *Source) Bind(s *server.Session, portal *server.Portal) error {
+	return server.Error("08P01",
+		"extended query protocol not supported in a replication connection")
+}
+
+func (src *Source) Execute(s *server.Session, portal *server.Portal,
+	maxRows uint32) error {
+	return server.Error("08P01",
+		"extended query protocol not supported in a replication connection")
+}
+
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.Replace(s[1:len(s)-1], `""`, `"`, -1)
+	}
+	return strings.ToLower(s)
+}
@@ -0,0 +1,104 @@
+package replication
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/server"
+	"io"
+	"testing"
+	"time"
+)
+
+// Read s to the end, acknowledging each XLogData, and return the
+// data with the slot's flushed position when each arrived
+func readAll(t *testing.T, src *Source, s *Stream) (data []string, flushed []proto.LSN) {
+	for {
+		msg, err := s.Next()
+		if err == io.EOF {
+			return data, flushed
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if x, ok := msg.(*proto.XLogData); ok {
+			data = append(data, string(x.Data))
+			flushed = append(flushed, src.Flushed("s"))
+			s.Ack(x.Start + proto.LSN(len(x.Data)))
+		}
+	}
+}
+
+func TestSource(t *testing.T) {
+	src := &Source{
+		SystemID: "6015",
+		Script: []Event{
+			{Data: []byte("a"), Pos: 0x100},
+			{Data: []byte("b"), Keepalive: true, ReplyRequested: true,
+				WaitFlushed: 0x102},
+			{Data: []byte("c"), Pos: 0x200},
+		},
+		EndStream: true,
+	}
+	conn, err := Connect(&serverConnector{&server.Server{Handler: src}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.StatusInterval = 10 * time.Millisecond
+
+	info, err := conn.IdentifySystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *info != (SystemInfo{"6015", 1, 0x201, "alice"}) {
+		t.Errorf("got %#v", info)
+	}
+	slot, err := conn.CreateSlot("s", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *slot != (Slot{Name: "s", ConsistentPoint: 0x100}) {
+		t.Errorf("got %#v", slot)
+	}
+	if _, err = conn.CreateSlot("s", "", false); err == nil {
+		t.Errorf("expected an error creating a slot twice")
+	}
+	if _, err = conn.StartPhysical("nope", 0, 0); err == nil {
+		t.Errorf("expected an error starting an unknown slot")
+	}
+
+	stream, err := conn.StartPhysical("s", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, flushed := readAll(t, src, stream)
+	if len(data) != 3 || data[0] != "a" || data[2] != "c" {
+		t.Fatalf("got %q", data)
+	}
+	if flushed[2] < 0x102 {
+		t.Errorf("got the data after the wait with only %v flushed", flushed[2])
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pos := src.Flushed("s"); pos != 0x201 {
+		t.Errorf("got flushed position %v", pos)
+	}
+
+	// the slot resumes where it left off
+	stream, err = conn.StartPhysical("s", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = readAll(t, src, stream); len(data) != 0 {
+		t.Errorf("got %q resuming", data)
+	}
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = conn.DropSlot("s"); err != nil {
+		t.Error(err)
+	}
+	if err = conn.DropSlot("s"); err == nil {
+		t.Errorf("expected an error dropping a dropped slot")
+	}
+}
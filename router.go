@@ -0,0 +1,214 @@
+package femebe
+
+import (
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"sync"
+)
+
+// Action tells a ChainRouter what to do with a message once an
+// Interceptor has seen it.
+type Action int
+
+const (
+	// Pass the message on to the next Interceptor, and after the
+	// last one, to its destination
+	Forward Action = iota
+	// Stop here and do not deliver the message
+	Drop
+	// Stop here and send the message back where it came from
+	// instead of delivering it
+	Reply
+)
+
+// Interceptor looks at a message on its way through a ChainRouter
+// and decides what happens to it. It may replace the contents of m
+// to rewrite the message before forwarding it, or to reply with a
+// different message.
+//
+// Messages may not be fully buffered (see core.Message.IsBuffered).
+// An Interceptor that reads the payload must call m.Force first so
+// the message can still be delivered intact; one that replaces m,
+// or drops it, must not leave any of the original payload unread.
+// Each Interceptor gets to read a buffered payload from the start.
+//
+// Returning an error stops routing in that direction.
+type Interceptor func(m *core.Message) (Action, error)
+
+// Injector sends messages of its own to either side of a
+// connection, in between the ones being routed. Messages are sent
+// and flushed immediately.
+type Injector interface {
+	SendFrontend(m *core.Message) error
+	SendBackend(m *core.Message) error
+}
+
+// ChainRouter is a Router that passes each message through a chain
+// of Interceptors for its direction before delivering it, and that
+// can inject messages of its own. Interceptors should all be added
+// before routing starts.
+type ChainRouter interface {
+	Router
+	Injector
+	// Add Interceptors for messages from the frontend, to run in
+	// order after those already added.
+	InterceptFrontend(interceptors ...Interceptor)
+	// Add Interceptors for messages from the backend, to run in
+	// order after those already added.
+	InterceptBackend(interceptors ...Interceptor)
+}
+
+// A Stream that may be sent to from both routing directions at once
+type lockedStream struct {
+	stream core.Stream
+	lock   sync.Mutex
+}
+
+func (s *lockedStream) send(m *core.Message, flush bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.stream.Send(m); err != nil {
+		return err
+	}
+	if flush {
+		return s.stream.Flush()
+	}
+	return nil
+}
+
+func (s *lockedStream) flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stream.Flush()
+}
+
+type chainRouter struct {
+	fe      lockedStream
+	be      lockedStream
+	feBuf   core.Message
+	beBuf   core.Message
+	feChain []Interceptor
+	beChain []Interceptor
+
+	keyLock    sync.Mutex
+	backendPid uint32
+	secretKey  uint32
+	notify     func(backendPid, secretKey uint32)
+}
+
+// Make a new ChainRouter for the two streams. Without any
+// Interceptors, it behaves like the Router from NewSimpleRouter:
+// messages are delivered as they are, the "to" stream is flushed
+// when no more messages are available on the "from" stream, and
+// the backend's cancellation data is captured, before any
+// Interceptor sees it.
+func NewChainRouter(fe, be core.Stream) ChainRouter {
+	return &chainRouter{
+		fe: lockedStream{stream: fe},
+		be: lockedStream{stream: be},
+	}
+}
+
+func (c *chainRouter) InterceptFrontend(interceptors ...Interceptor) {
+	c.feChain = append(c.feChain, interceptors...)
+}
+
+func (c *chainRouter) InterceptBackend(interceptors ...Interceptor) {
+	c.beChain = append(c.beChain, interceptors...)
+}
+
+func (c *chainRouter) SendFrontend(m *core.Message) error {
+	return c.fe.send(m, true)
+}
+
+func (c *chainRouter) SendBackend(m *core.Message) error {
+	return c.be.send(m, true)
+}
+
+func (c *chainRouter) BackendKeyData() (uint32, uint32) {
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	return c.backendPid, c.secretKey
+}
+
+func (c *chainRouter) NotifyBackendKeyData(f func(backendPid, secretKey uint32)) {
+	c.keyLock.Lock()
+	c.notify = f
+	pid, secret := c.backendPid, c.secretKey
+	c.keyLock.Unlock()
+	if pid != 0 || secret != 0 {
+		f(pid, secret)
+	}
+}
+
+func (c *chainRouter) RouteFrontend() error {
+	if err := c.fe.stream.Next(&c.feBuf); err != nil {
+		return err
+	}
+	return c.route(&c.feBuf, c.feChain, &c.fe, &c.be)
+}
+
+func (c *chainRouter) RouteBackend() error {
+	if err := c.be.stream.Next(&c.beBuf); err != nil {
+		return err
+	}
+	if proto.IsBackendKeyData(&c.beBuf) {
+		if _, err := c.beBuf.Force(); err != nil {
+			return err
+		}
+		beInfo, err := proto.ReadBackendKeyData(&c.beBuf)
+		if err != nil {
+			return err
+		}
+		c.keyLock.Lock()
+		c.backendPid = beInfo.BackendPid
+		c.secretKey = beInfo.SecretKey
+		notify := c.notify
+		c.keyLock.Unlock()
+		if notify != nil {
+			notify(beInfo.BackendPid, beInfo.SecretKey)
+		}
+	}
+	return c.route(&c.beBuf, c.beChain, &c.be, &c.fe)
+}
+
+// Run m, just read from "from", through chain and act on the
+// result.
+func (c *chainRouter) route(m *core.Message, chain []Interceptor,
+	from, to *lockedStream) (err error) {
+	action := Forward
+	for _, intercept := range chain {
+		if m.IsBuffered() {
+			// rewind the payload for this Interceptor
+			payload, _ := m.Force()
+			m.InitFromBytes(m.MsgType(), payload)
+		}
+		action, err = intercept(m)
+		if err != nil {
+			return err
+		}
+		if action != Forward {
+			break
+		}
+	}
+
+	// Flush as the simple Router does, even if the last message
+	// of a batch does not go to "to": earlier ones may have.
+	flush := !from.stream.HasNext()
+	switch action {
+	case Forward:
+		return to.send(m, flush)
+	case Reply:
+		if err = from.send(m, true); err != nil {
+			return err
+		}
+	case Drop:
+		if err = m.Discard(); err != nil {
+			return err
+		}
+	}
+	if flush {
+		return to.flush()
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package femebe
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A backend that sends BackendKeyData and answers every query with
+// a CommandComplete carrying the query text.
+func runEchoQueryBackend(conn net.Conn) {
+	be := core.NewBackendStream(conn)
+	defer be.Close()
+	var m core.Message
+	m.InitFromBytes(proto.MsgBackendKeyDataK,
+		[]byte{0, 0, 0, 42, 0, 0, 0, 7})
+	be.Send(&m)
+	proto.InitReadyForQuery(&m, proto.RfqIdle)
+	be.Send(&m)
+	for {
+		if err := be.Next(&m); err != nil {
+			return
+		}
+		q, err := proto.ReadQuery(&m)
+		if err != nil {
+			return
+		}
+		proto.InitCommandComplete(&m, q.Query)
+		be.Send(&m)
+		proto.InitReadyForQuery(&m, proto.RfqIdle)
+		be.Send(&m)
+	}
+}
+
+func TestChainRouter(t *testing.T) {
+	clientConn, feConn := net.Pipe()
+	beConn, serverConn := net.Pipe()
+	go runEchoQueryBackend(serverConn)
+
+	r := NewChainRouter(
+		core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn)),
+		core.NewBackendStream(util.NewBufferedReadWriteCloser(beConn)))
+
+	var seen []string
+	logQueries := func(m *core.Message) (Action, error) {
+		if m.MsgType() != proto.MsgQueryQ {
+			return Forward, nil
+		}
+		if _, err := m.Force(); err != nil {
+			return Drop, err
+		}
+		q, err := proto.ReadQuery(m)
+		if err != nil {
+			return Drop, err
+		}
+		seen = append(seen, q.Query)
+		return Forward, nil
+	}
+	rejectDrops := func(m *core.Message) (Action, error) {
+		q, err := proto.ReadQuery(m)
+		if err != nil || !strings.HasPrefix(q.Query, "DROP") {
+			return Forward, err
+		}
+		var er core.Message
+		proto.InitErrorResponse(&er, map[byte]string{
+			'S': "ERROR",
+			'C': "42501",
+			'M': "not allowed",
+		})
+		if err = r.SendFrontend(&er); err != nil {
+			return Drop, err
+		}
+		proto.InitReadyForQuery(m, proto.RfqIdle)
+		return Reply, nil
+	}
+	upcase := func(m *core.Message) (Action, error) {
+		q, err := proto.ReadQuery(m)
+		if err != nil {
+			return Drop, err
+		}
+		proto.InitQuery(m, strings.ToUpper(q.Query))
+		return Forward, nil
+	}
+	r.InterceptFrontend(logQueries, rejectDrops, upcase)
+
+	backendMessages := 0
+	r.InterceptBackend(func(m *core.Message) (Action, error) {
+		backendMessages++
+		return Forward, nil
+	})
+
+	go func() {
+		for r.RouteFrontend() == nil {
+		}
+	}()
+	go func() {
+		for r.RouteBackend() == nil {
+		}
+	}()
+
+	client := core.NewBackendStream(clientConn)
+	defer client.Close()
+	// Read up to ReadyForQuery, returning the types of messages
+	// received and the last CommandComplete tag
+	receive := func() (types string, tag string) {
+		var m core.Message
+		for {
+			if err := client.Next(&m); err != nil {
+				t.Fatal(err)
+			}
+			types += string(m.MsgType())
+			if m.MsgType() == proto.MsgCommandCompleteC {
+				cc, err := proto.ReadCommandComplete(&m)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tag = fmt.Sprintf("%v %v", cc.Tag, cc.AffectedCount)
+			} else if _, err := m.Force(); err != nil {
+				t.Fatal(err)
+			}
+			if m.MsgType() == proto.MsgReadyForQueryZ {
+				return types, tag
+			}
+		}
+	}
+	query := func(q string) (string, string) {
+		var m core.Message
+		proto.InitQuery(&m, q)
+		if err := client.Send(&m); err != nil {
+			t.Fatal(err)
+		}
+		return receive()
+	}
+
+	if types, _ := receive(); types != "KZ" {
+		t.Errorf("got messages %q; want KZ", types)
+	}
+	if pid, key := r.BackendKeyData(); pid != 42 || key != 7 {
+		t.Errorf("got key data (%v, %v); want (42, 7)", pid, key)
+	}
+
+	if types, tag := query("select 1"); types != "CZ" || tag != "SELECT 1" {
+		t.Errorf("got messages %q, tag %q; want CZ, SELECT 1", types, tag)
+	}
+	if types, _ := query("DROP TABLE users"); types != "EZ" {
+		t.Errorf("got messages %q; want EZ", types)
+	}
+	if types, tag := query("select 2"); types != "CZ" || tag != "SELECT 2" {
+		t.Errorf("got messages %q, tag %q; want CZ, SELECT 2", types, tag)
+	}
+
+	want := "select 1; DROP TABLE users; select 2"
+	if got := strings.Join(seen, "; "); got != want {
+		t.Errorf("logged queries %q; want %q", got, want)
+	}
+	// Key data and ReadyForQuery, then a CommandComplete and
+	// ReadyForQuery for each query that made it through
+	if backendMessages != 6 {
+		t.Errorf("intercepted %v backend messages; want 6", backendMessages)
+	}
+}
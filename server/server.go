@@ -0,0 +1,272 @@
+// Package server implements the backend side of the protocol, so
+// that a Go program can be spoken to by psql and other Postgres
+// clients. A Server accepts connections, negotiates SSL, reads the
+// StartupMessage, authenticates the user and reports its parameters;
+// a Handler then answers the queries of each Session.
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/uhoh-itsmaciek/femebe/auth"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	e "github.com/uhoh-itsmaciek/femebe/error"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The parameters reported to every client, unless overridden in
+// Server.Parameters. Clients such as psql and the JDBC driver rely on
+// several of them.
+var defaultParameters = map[string]string{
+	"server_version":              "9.4.0",
+	"server_encoding":             "UTF8",
+	"client_encoding":             "UTF8",
+	"DateStyle":                   "ISO, MDY",
+	"IntervalStyle":               "postgres",
+	"TimeZone":                    "UTC",
+	"integer_datetimes":           "on",
+	"standard_conforming_strings": "on",
+	"is_superuser":                "off",
+}
+
+// Server accepts connections from Postgres clients and runs a Session
+// for each one. The zero value, with a Handler set, is usable: it
+// rejects SSL and trusts every user.
+type Server struct {
+	// Answers the queries of every session
+	Handler Handler
+	// Authenticates each session's user; nil lets everyone in
+	Authenticator auth.Authenticator
+	// Configuration for SSL connections; nil rejects SSLRequests
+	TLSConfig *tls.Config
+	// Parameters to report to clients in ParameterStatus messages,
+	// in addition to or overriding the defaults
+	Parameters map[string]string
+	// Where to log errors from sessions; nil for the standard
+	// logger
+	ErrorLog *log.Logger
+
+	lock     sync.Mutex
+	lastPid  uint32
+	sessions map[uint32]*Session
+}
+
+// ListenAndServe listens on addr, a host:port or a Unix socket path,
+// and serves connections from it.
+func (srv *Server) ListenAndServe(addr string) error {
+	ln, err := util.AutoListen(addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve accepts connections from ln and serves each in its own
+// goroutine, until ln returns an error. Temporary errors, such as
+// running out of file descriptors, are retried after a pause.
+func (srv *Server) Serve(ln net.Listener) error {
+	defer ln.Close()
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				srv.logf("accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go func() {
+			if err := srv.ServeConn(conn); err != nil {
+				srv.logf("session error: %v", err)
+			}
+		}()
+	}
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// ServeConn runs the startup sequence on conn and then a session
+// until the client terminates it, and closes conn. A CancelRequest is
+// passed on to the session it names. The returned error is nil if the
+// client left cleanly.
+func (srv *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	fe, startup, err := srv.negotiate(conn)
+	if err != nil || startup == nil {
+		return err
+	}
+
+	s := &Session{
+		Stream:     fe,
+		Params:     startup.Params,
+		Parameters: make(map[string]string),
+		server:     srv,
+		statements: make(map[string]*Statement),
+		portals:    make(map[string]*Portal),
+		txnStatus:  proto.RfqIdle,
+	}
+	user := s.User()
+	if user == "" {
+		return s.fatal("28000",
+			"no PostgreSQL user name specified in startup packet")
+	}
+	authenticator := srv.Authenticator
+	if authenticator == nil {
+		authenticator = auth.NewTrustAuthenticator()
+	}
+	if err = authenticator.Authenticate(fe, user); err != nil {
+		return err
+	}
+
+	if err = srv.register(s); err != nil {
+		return err
+	}
+	defer srv.unregister(s)
+	if err = s.sendStartup(); err != nil {
+		return err
+	}
+	return s.run()
+}
+
+// Read the first message from conn, accepting or rejecting requests
+// for encryption before it, and return the stream to the client and
+// its StartupMessage. A CancelRequest is handled here, and no
+// StartupMessage returned.
+func (srv *Server) negotiate(conn net.Conn) (core.Stream, *proto.StartupMessage, error) {
+	fe := core.NewFrontendStream(util.NewBufferedReadWriteCloser(conn))
+	var m core.Message
+	if err := fe.Next(&m); err != nil {
+		return nil, nil, err
+	}
+
+	encrypted := false
+	for proto.IsSSLRequest(&m) || proto.IsGSSENCRequest(&m) {
+		if proto.IsSSLRequest(&m) && srv.TLSConfig != nil && !encrypted {
+			var err error
+			if fe, err = core.AcceptTLS(conn, srv.TLSConfig); err != nil {
+				return nil, nil, err
+			}
+			encrypted = true
+		} else {
+			err := fe.SendSSLRequestResponse(core.RejectSSLRequest)
+			if err == nil {
+				err = fe.Flush()
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		// the client follows up with another request or its
+		// real startup message
+		if err := fe.Next(&m); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if proto.IsCancelRequest(&m) {
+		cancel, err := proto.ReadCancelRequest(&m)
+		if err != nil {
+			return nil, nil, err
+		}
+		srv.cancel(cancel.BackendPid, cancel.SecretKey)
+		return nil, nil, nil
+	}
+
+	startup, err := proto.ReadStartupMessage(&m)
+	if err != nil {
+		code := "08P01"
+		if _, ok := err.(e.ErrStartupVersion); ok {
+			code = "0A000"
+		}
+		sendError(fe, "FATAL", code, err.Error())
+		return nil, nil, err
+	}
+	return fe, startup, nil
+}
+
+// Give s a process id and secret key that clients can cancel its
+// queries with
+func (srv *Server) register(s *Session) error {
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	s.SecretKey = binary.BigEndian.Uint32(key[:])
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[uint32]*Session)
+	}
+	for {
+		srv.lastPid++
+		if _, ok := srv.sessions[srv.lastPid]; !ok && srv.lastPid != 0 {
+			break
+		}
+	}
+	s.BackendPid = srv.lastPid
+	srv.sessions[s.BackendPid] = s
+	return nil
+}
+
+func (srv *Server) unregister(s *Session) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	delete(srv.sessions, s.BackendPid)
+}
+
+// Pass a cancellation on to the Handler, if it can cancel queries and
+// the key matches. As in Postgres, the client is not told whether it
+// worked.
+func (srv *Server) cancel(pid, key uint32) {
+	srv.lock.Lock()
+	s, ok := srv.sessions[pid]
+	srv.lock.Unlock()
+	if !ok || s.SecretKey != key {
+		return
+	}
+	if c, ok := srv.Handler.(CancelHandler); ok {
+		c.Cancel(s)
+	}
+}
+
+// The parameters to report to a new session, in name order
+func (srv *Server) parameters(startup map[string]string) ([]string, map[string]string) {
+	params := make(map[string]string, len(defaultParameters))
+	for name, value := range defaultParameters {
+		params[name] = value
+	}
+	if name, ok := startup["application_name"]; ok {
+		params["application_name"] = name
+	}
+	for name, value := range srv.Parameters {
+		params[name] = value
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, params
+}
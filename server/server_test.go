@@ -0,0 +1,315 @@
+package server
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/auth"
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"github.com/uhoh-itsmaciek/femebe/util"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Answers "SELECT n" queries and prepared statements adding one to
+// an int4
+type testHandler struct {
+	cancelled chan *Session
+}
+
+func (h *testHandler) Query(s *Session, query string) error {
+	var n int32
+	if _, err := fmt.Sscanf(query, "SELECT %d", &n); err == nil {
+		return codec.WriteRows(s.Stream, []string{"n"},
+			[][]interface{}{{n}}, nil)
+	}
+	if query == "BEGIN" {
+		s.SetTxnStatus(proto.RfqInTrans)
+		return s.Complete("BEGIN")
+	}
+	if query == "boom" {
+		return fmt.Errorf("boom")
+	}
+	return Error("42601", "syntax error at or near %q", query)
+}
+
+func (h *testHandler) Parse(s *Session, stmt *Statement) error {
+	if stmt.Query != "SELECT $1 + 1" {
+		return Error("42601", "syntax error")
+	}
+	stmt.ParamOids = []proto.Oid{proto.OidInt4}
+	stmt.Fields = []proto.FieldDescription{
+		*codec.DefaultRegistry.NewField("sum", proto.OidInt4),
+	}
+	return nil
+}
+
+func (h *testHandler) Bind(s *Session, portal *Portal) error {
+	val, err := portal.Param(0)
+	portal.Data = val
+	return err
+}
+
+func (h *testHandler) Execute(s *Session, portal *Portal, maxRows uint32) error {
+	w := portal.Writer()
+	if err := w.WriteRow(s.Stream, []interface{}{portal.Data.(int64) + 1}); err != nil {
+		return err
+	}
+	return w.WriteComplete(s.Stream)
+}
+
+func (h *testHandler) Cancel(s *Session) {
+	h.cancelled <- s
+}
+
+// Connect a client to srv, and return its stream to the server,
+// having sent the StartupMessage
+func connect(t *testing.T, srv *Server, params map[string]string) (core.Stream, chan error) {
+	feConn, beConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(beConn) }()
+	be := core.NewBackendStream(util.NewBufferedReadWriteCloser(feConn))
+	var m core.Message
+	proto.InitStartupMessage(&m, params)
+	if err := be.Send(&m); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return be, done
+}
+
+// Read messages up to ReadyForQuery, returning the types of the others
+func untilReady(t *testing.T, be core.Stream) (types []byte, status proto.ConnStatus) {
+	var m core.Message
+	for {
+		if err := be.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType() == proto.MsgReadyForQueryZ {
+			rfq, err := proto.ReadReadyForQuery(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return types, rfq.ConnStatus
+		}
+		types = append(types, m.MsgType())
+		m.Discard()
+	}
+}
+
+func send(t *testing.T, be core.Stream, init ...func(m *core.Message)) {
+	var m core.Message
+	for _, fn := range init {
+		fn(&m)
+		if err := be.Send(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := be.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartup(t *testing.T) {
+	srv := &Server{
+		Handler:    &testHandler{},
+		Parameters: map[string]string{"server_version": "9.6.0"},
+	}
+	be, done := connect(t, srv, map[string]string{
+		"user": "alice", "application_name": "test",
+	})
+
+	var m core.Message
+	params := make(map[string]string)
+	var key *proto.BackendKeyData
+	for {
+		if err := be.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType() == proto.MsgReadyForQueryZ {
+			break
+		}
+		switch m.MsgType() {
+		case proto.MsgParameterStatusS:
+			ps, err := proto.ReadParameterStatus(&m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params[ps.Name] = ps.Value
+		case proto.MsgBackendKeyDataK:
+			var err error
+			if key, err = proto.ReadBackendKeyData(&m); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			m.Discard()
+		}
+	}
+	if params["server_version"] != "9.6.0" || params["application_name"] != "test" ||
+		params["client_encoding"] != "UTF8" {
+		t.Errorf("got parameters %v", params)
+	}
+	if key == nil || key.BackendPid == 0 {
+		t.Fatalf("got BackendKeyData %#v", key)
+	}
+
+	// cancel the session's query
+	h := srv.Handler.(*testHandler)
+	h.cancelled = make(chan *Session, 1)
+	cancelConn, beConn := net.Pipe()
+	go srv.ServeConn(beConn)
+	proto.InitCancelRequest(&m, key.BackendPid, key.SecretKey)
+	core.NewBackendStream(cancelConn).Send(&m)
+	if s := <-h.cancelled; s.User() != "alice" || s.Database() != "alice" {
+		t.Errorf("cancelled session of %v", s.Params)
+	}
+
+	send(t, be, proto.InitTerminate)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSimpleQuery(t *testing.T) {
+	srv := &Server{Handler: &testHandler{}}
+	be, _ := connect(t, srv, map[string]string{"user": "alice"})
+	untilReady(t, be)
+
+	send(t, be, func(m *core.Message) { proto.InitQuery(m, "SELECT 42") })
+	var r codec.ResultReader
+	if ok, err := r.Next(be); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if vals, _ := r.Values(); !reflect.DeepEqual(vals, []interface{}{int64(42)}) {
+		t.Errorf("got %#v", vals)
+	}
+	if ok, err := r.Next(be); ok || err != nil || r.Complete.AffectedCount != 1 {
+		t.Fatalf("got %v, %v, %#v", ok, err, r.Complete)
+	}
+	if types, status := untilReady(t, be); len(types) != 0 || status != proto.RfqIdle {
+		t.Errorf("got %q, %c", types, status)
+	}
+
+	tests := []struct {
+		query  string
+		types  string
+		status proto.ConnStatus
+	}{
+		{" ", "I", proto.RfqIdle},
+		{"SELEC", "E", proto.RfqIdle},
+		{"BEGIN", "C", proto.RfqInTrans},
+		{"boom", "E", proto.RfqError},
+	}
+	for _, test := range tests {
+		send(t, be, func(m *core.Message) { proto.InitQuery(m, test.query) })
+		types, status := untilReady(t, be)
+		if string(types) != test.types || status != test.status {
+			t.Errorf("%q: got %q, %c; want %q, %c", test.query, types, status,
+				test.types, test.status)
+		}
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	srv := &Server{Handler: &testHandler{}}
+	be, _ := connect(t, srv, map[string]string{"user": "alice"})
+	untilReady(t, be)
+
+	send(t, be,
+		func(m *core.Message) { proto.InitParse(m, "add", "SELECT $1 + 1", nil) },
+		func(m *core.Message) { proto.InitDescribe(m, proto.IsStmt, "add") },
+		func(m *core.Message) {
+			proto.InitBind(m, "", "add", nil, [][]byte{[]byte("41")},
+				[]proto.EncFmt{proto.EncFmtBinary})
+		},
+		func(m *core.Message) { proto.InitDescribe(m, proto.IsPortal, "") },
+		func(m *core.Message) { proto.InitExecute(m, "", 0) },
+		proto.InitSync)
+
+	var m core.Message
+	var r codec.ResultReader
+	for _, want := range []byte{proto.MsgParseComplete1,
+		proto.MsgParameterDescriptionT, proto.MsgRowDescriptionT,
+		proto.MsgBindComplete2, proto.MsgRowDescriptionT} {
+		if err := be.Next(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.MsgType() != want {
+			t.Fatalf("got %q; want %q", m.MsgType(), want)
+		}
+		if _, err := r.Accept(&m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Fields[0].Format != proto.EncFmtBinary {
+		t.Errorf("got fields %#v", r.Fields)
+	}
+	if ok, err := r.Next(be); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if vals, _ := r.Values(); !reflect.DeepEqual(vals, []interface{}{int64(42)}) {
+		t.Errorf("got %#v", vals)
+	}
+	if types, _ := untilReady(t, be); string(types) != "C" {
+		t.Errorf("got %q", types)
+	}
+
+	// after an error, messages are skipped until Sync
+	send(t, be,
+		func(m *core.Message) { proto.InitBind(m, "", "nope", nil, nil, nil) },
+		func(m *core.Message) { proto.InitExecute(m, "", 0) },
+		proto.InitSync,
+		func(m *core.Message) { proto.InitParse(m, "add", "SELECT $1 + 1", nil) },
+		func(m *core.Message) { proto.InitClose(m, proto.IsStmt, "add") },
+		func(m *core.Message) { proto.InitParse(m, "add", "SELECT $1 + 1", nil) },
+		proto.InitSync)
+	if types, _ := untilReady(t, be); string(types) != "E" {
+		t.Errorf("got %q", types)
+	}
+	if types, _ := untilReady(t, be); string(types) != "E" {
+		t.Errorf("got %q", types)
+	}
+	// closing the statement frees its name
+	send(t, be,
+		func(m *core.Message) { proto.InitClose(m, proto.IsStmt, "add") },
+		func(m *core.Message) { proto.InitParse(m, "add", "SELECT $1 + 1", nil) },
+		proto.InitSync)
+	if types, _ := untilReady(t, be); string(types) != "31" {
+		t.Errorf("got %q", types)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	srv := &Server{
+		Handler: &testHandler{},
+		Authenticator: auth.NewMD5Authenticator(func(user string) (string, bool) {
+			return "secret", user == "alice"
+		}),
+	}
+	be, _ := connect(t, srv, map[string]string{"user": "alice"})
+	if err := auth.Authenticate(be, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, status := untilReady(t, be); status != proto.RfqIdle {
+		t.Errorf("got status %c", status)
+	}
+
+	be, done := connect(t, srv, map[string]string{"user": "alice"})
+	if err := auth.Authenticate(be, "alice", "wrong"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if err := <-done; err == nil {
+		t.Errorf("expected an error")
+	}
+
+	be, done = connect(t, srv, map[string]string{"database": "db"})
+	if err := be.Next(new(core.Message)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Errorf("expected an error without a user")
+	}
+}
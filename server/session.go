@@ -0,0 +1,483 @@
+package server
+
+import (
+	"fmt"
+	"github.com/uhoh-itsmaciek/femebe/codec"
+	"github.com/uhoh-itsmaciek/femebe/core"
+	"github.com/uhoh-itsmaciek/femebe/proto"
+	"strings"
+)
+
+// Handler answers the queries of sessions. Its methods are called
+// from each session's own goroutine, so a Handler shared by a Server
+// must be safe for concurrent use; state belonging to one session
+// can be kept in Session.Data.
+//
+// An error returned by a method is sent to the client as an
+// ErrorResponse: a *proto.ErrorResponse, such as one made with Error,
+// is sent as it is, and any other error as an internal error. The
+// Session sends ReadyForQuery, and the responses to Parse, Bind,
+// Describe and Close, itself.
+type Handler interface {
+	// Answer a simple query, which may hold several statements,
+	// by sending the results of each to s: a RowDescription,
+	// DataRows and a CommandComplete (see codec.WriteRows), or
+	// just a CommandComplete. Empty queries are answered without
+	// calling the Handler.
+	Query(s *Session, query string) error
+	// Prepare stmt. Parse may fill in the types of parameters the
+	// client left unspecified (zero), and must set stmt.Fields if
+	// the statement returns rows.
+	Parse(s *Session, stmt *Statement) error
+	// Check the parameters bound in portal, perhaps decoding them
+	// into portal.Data for Execute.
+	Bind(s *Session, portal *Portal) error
+	// Run portal, sending its DataRows, without a RowDescription,
+	// and a CommandComplete to s (see Portal.Writer). If maxRows
+	// is nonzero, at most that many rows are sent; if more
+	// remain, PortalSuspended is sent instead of CommandComplete,
+	// and the client may call Execute again to continue.
+	Execute(s *Session, portal *Portal, maxRows uint32) error
+}
+
+// CancelHandler is a Handler that can cancel the query running in a
+// session when a client asks it to.
+type CancelHandler interface {
+	Handler
+	// Cancel the current query of s, if there is one. This is
+	// called from the goroutine of the cancelling connection.
+	Cancel(s *Session)
+}
+
+// Statement is a statement prepared with Parse.
+type Statement struct {
+	// The name of the statement; the empty string is the unnamed
+	// statement.
+	Name  string
+	Query string
+	// The types of the parameters; zero for those neither the
+	// client nor the Handler specified
+	ParamOids []proto.Oid
+	// The columns of the result, or nil if there are none. Their
+	// formats are ignored; those of a portal come from Bind.
+	Fields []proto.FieldDescription
+	// For use by the Handler
+	Data interface{}
+}
+
+// Portal is a prepared statement bound to parameters with Bind.
+type Portal struct {
+	// The name of the portal; the empty string is the unnamed
+	// portal.
+	Name      string
+	Statement *Statement
+	// Parameter values, nil for NULL, as bound by the client
+	Params       [][]byte
+	ParamFormats []proto.EncFmt
+	// The columns of the result, in the formats requested by the
+	// client, or nil if there are none
+	Fields []proto.FieldDescription
+	// For use by the Handler
+	Data interface{}
+}
+
+// Param decodes the i-th parameter as its type in the statement; a
+// parameter of unspecified type is decoded as text.
+func (p *Portal) Param(i int) (interface{}, error) {
+	if i < 0 || i >= len(p.Params) {
+		return nil, fmt.Errorf("no parameter %v", i+1)
+	}
+	var format proto.EncFmt
+	switch len(p.ParamFormats) {
+	case 0:
+	case 1:
+		format = p.ParamFormats[0]
+	default:
+		format = p.ParamFormats[i]
+	}
+	typ := p.Statement.ParamOids[i]
+	if typ == 0 {
+		typ = proto.OidText
+	}
+	return codec.DecodeValue(p.Params[i], typ, format)
+}
+
+// Writer returns a writer of the rows of the portal's result.
+func (p *Portal) Writer() *codec.ResultWriter {
+	return &codec.ResultWriter{Fields: p.Fields}
+}
+
+// Session is a client's connection to a Server, once it has logged
+// in.
+type Session struct {
+	// The stream to the client. Handlers send their results on
+	// it; the Session flushes it when the client waits for them.
+	Stream core.Stream
+	// The parameters of the client's StartupMessage
+	Params map[string]string
+	// The parameters reported to the client with ParameterStatus
+	Parameters map[string]string
+	// The key data the client can cancel queries with
+	BackendPid uint32
+	SecretKey  uint32
+	// For use by the Handler
+	Data interface{}
+
+	server     *Server
+	statements map[string]*Statement
+	portals    map[string]*Portal
+	txnStatus  proto.ConnStatus
+	// Whether an error in the extended protocol has the session
+	// skipping messages until the next Sync
+	failed bool
+}
+
+// User returns the name of the user the client logged in as.
+func (s *Session) User() string {
+	return s.Params["user"]
+}
+
+// Database returns the name of the database the client asked for,
+// which defaults to the user name.
+func (s *Session) Database() string {
+	if db := s.Params["database"]; db != "" {
+		return db
+	}
+	return s.User()
+}
+
+// TxnStatus returns the transaction status reported in ReadyForQuery.
+func (s *Session) TxnStatus() proto.ConnStatus {
+	return s.txnStatus
+}
+
+// SetTxnStatus sets the transaction status reported in ReadyForQuery,
+// for Handlers that implement transactions. An error sent while in a
+// transaction sets it to proto.RfqError.
+func (s *Session) SetTxnStatus(status proto.ConnStatus) {
+	s.txnStatus = status
+}
+
+// SetParameter changes the value of a parameter, as after a SET, and
+// reports it to the client.
+func (s *Session) SetParameter(name, value string) error {
+	s.Parameters[name] = value
+	var m core.Message
+	proto.InitParameterStatus(&m, name, value)
+	return s.Stream.Send(&m)
+}
+
+// Notice sends the client a NoticeResponse with the given message.
+func (s *Session) Notice(format string, args ...interface{}) error {
+	var m core.Message
+	proto.InitNoticeResponse(&m, map[byte]string{
+		'S': "NOTICE",
+		'V': "NOTICE",
+		'C': "00000",
+		'M': fmt.Sprintf(format, args...),
+	})
+	return s.Stream.Send(&m)
+}
+
+// Complete sends a CommandComplete with the given tag, such as
+// "INSERT 0 1", to the client.
+func (s *Session) Complete(tag string) error {
+	var m core.Message
+	proto.InitCommandComplete(&m, tag)
+	return s.Stream.Send(&m)
+}
+
+// Error returns an ErrorResponse with the given SQLSTATE code and
+// message, for a Handler to return.
+func Error(code, format string, args ...interface{}) *proto.ErrorResponse {
+	return &proto.ErrorResponse{Details: map[byte]string{
+		'S': "ERROR",
+		'V': "ERROR",
+		'C': code,
+		'M': fmt.Sprintf(format, args...),
+	}}
+}
+
+// Send an ErrorResponse and flush
+func sendError(fe core.Stream, severity, code, msg string) error {
+	var m core.Message
+	proto.InitErrorResponse(&m, map[byte]string{
+		'S': severity,
+		'V': severity,
+		'C': code,
+		'M': msg,
+	})
+	if err := fe.Send(&m); err != nil {
+		return err
+	}
+	return fe.Flush()
+}
+
+// Send a FATAL error to the client, which ends the session, and
+// return it.
+func (s *Session) fatal(code, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if err := sendError(s.Stream, "FATAL", code, msg); err != nil {
+		return err
+	}
+	return &proto.ErrorResponse{Details: map[byte]string{
+		'S': "FATAL", 'C': code, 'M': msg,
+	}}
+}
+
+// Report the error err to the client. In the extended protocol, the
+// messages that follow are skipped until the next Sync. An error is
+// returned only if it could not be sent.
+func (s *Session) fail(err error, extended bool) error {
+	details := map[byte]string{'S': "ERROR", 'V': "ERROR", 'C': "XX000",
+		'M': err.Error()}
+	if er, ok := err.(*proto.ErrorResponse); ok {
+		details = er.Details
+	}
+	var m core.Message
+	proto.InitErrorResponse(&m, details)
+	if s.txnStatus == proto.RfqInTrans {
+		s.txnStatus = proto.RfqError
+	}
+	s.failed = extended
+	return s.Stream.Send(&m)
+}
+
+// Report the parameters and key data of the session, and that it is
+// ready for queries
+func (s *Session) sendStartup() error {
+	var m core.Message
+	names, params := s.server.parameters(s.Params)
+	for _, name := range names {
+		s.Parameters[name] = params[name]
+		proto.InitParameterStatus(&m, name, params[name])
+		if err := s.Stream.Send(&m); err != nil {
+			return err
+		}
+	}
+	proto.InitBackendKeyData(&m, s.BackendPid, s.SecretKey)
+	if err := s.Stream.Send(&m); err != nil {
+		return err
+	}
+	return s.readyForQuery()
+}
+
+func (s *Session) readyForQuery() error {
+	var m core.Message
+	proto.InitReadyForQuery(&m, s.txnStatus)
+	if err := s.Stream.Send(&m); err != nil {
+		return err
+	}
+	return s.Stream.Flush()
+}
+
+// Answer the client's messages until it terminates the session
+func (s *Session) run() error {
+	var m core.Message
+	for {
+		if err := s.Stream.Next(&m); err != nil {
+			return err
+		}
+		t := m.MsgType()
+		if s.failed && t != proto.MsgSyncS && t != proto.MsgTerminateX {
+			if err := m.Discard(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var err error
+		switch t {
+		case proto.MsgQueryQ:
+			err = s.query(&m)
+		case proto.MsgParseP:
+			err = s.parse(&m)
+		case proto.MsgBindB:
+			err = s.bind(&m)
+		case proto.MsgDescribeD:
+			err = s.describe(&m)
+		case proto.MsgExecuteE:
+			err = s.execute(&m)
+		case proto.MsgCloseC:
+			err = s.close(&m)
+		case proto.MsgSyncS:
+			s.failed = false
+			err = s.readyForQuery()
+		case proto.MsgFlushH:
+			err = s.Stream.Flush()
+		case proto.MsgTerminateX:
+			return nil
+		default:
+			return s.fatal("08P01", "invalid frontend message type %q", t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) query(m *core.Message) error {
+	q, err := proto.ReadQuery(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	// as in Postgres, a simple query replaces the unnamed
+	// statement and portal
+	delete(s.statements, "")
+	delete(s.portals, "")
+	if strings.TrimSpace(q.Query) == "" {
+		proto.InitEmptyQueryResponse(m)
+		err = s.Stream.Send(m)
+	} else if err = s.server.Handler.Query(s, q.Query); err != nil {
+		err = s.fail(err, false)
+	}
+	if err != nil {
+		return err
+	}
+	return s.readyForQuery()
+}
+
+func (s *Session) parse(m *core.Message) error {
+	p, err := proto.ReadParse(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	if _, ok := s.statements[p.Name]; ok && p.Name != "" {
+		return s.fail(Error("42P05",
+			"prepared statement %q already exists", p.Name), true)
+	}
+	stmt := &Statement{Name: p.Name, Query: p.Query, ParamOids: p.ParamOids}
+	if err = s.server.Handler.Parse(s, stmt); err != nil {
+		return s.fail(err, true)
+	}
+	s.statements[p.Name] = stmt
+	proto.InitParseComplete(m)
+	return s.Stream.Send(m)
+}
+
+func (s *Session) bind(m *core.Message) error {
+	b, err := proto.ReadBind(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	stmt, ok := s.statements[b.Statement]
+	if !ok {
+		return s.fail(Error("26000", "prepared statement %q does not exist",
+			b.Statement), true)
+	}
+	if len(b.Params) != len(stmt.ParamOids) {
+		return s.fail(Error("08P01", "bind message supplies %v parameters, "+
+			"but prepared statement %q requires %v", len(b.Params),
+			stmt.Name, len(stmt.ParamOids)), true)
+	}
+	if n := len(b.ParamFormats); n > 1 && n != len(b.Params) {
+		return s.fail(Error("08P01", "bind message has %v parameter "+
+			"formats but %v parameters", n, len(b.Params)), true)
+	}
+	if _, ok := s.portals[b.Portal]; ok && b.Portal != "" {
+		return s.fail(Error("42P03", "cursor %q already exists", b.Portal), true)
+	}
+
+	portal := &Portal{
+		Name:         b.Portal,
+		Statement:    stmt,
+		Params:       b.Params,
+		ParamFormats: b.ParamFormats,
+	}
+	if stmt.Fields != nil {
+		if n := len(b.ResultFormats); n > 1 && n != len(stmt.Fields) {
+			return s.fail(Error("08P01", "bind message has %v result "+
+				"formats but query has %v columns", n, len(stmt.Fields)), true)
+		}
+		portal.Fields = make([]proto.FieldDescription, len(stmt.Fields))
+		for i, f := range stmt.Fields {
+			f.Format = b.ResultFormat(i)
+			portal.Fields[i] = f
+		}
+	}
+	if err = s.server.Handler.Bind(s, portal); err != nil {
+		return s.fail(err, true)
+	}
+	s.portals[b.Portal] = portal
+	proto.InitBindComplete(m)
+	return s.Stream.Send(m)
+}
+
+func (s *Session) describe(m *core.Message) error {
+	d, err := proto.ReadDescribe(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	var fields []proto.FieldDescription
+	switch d.Kind {
+	case proto.IsStmt:
+		stmt, ok := s.statements[d.Name]
+		if !ok {
+			return s.fail(Error("26000", "prepared statement %q does not exist",
+				d.Name), true)
+		}
+		proto.InitParameterDescription(m, stmt.ParamOids)
+		if err = s.Stream.Send(m); err != nil {
+			return err
+		}
+		// before Bind, the formats are not known yet
+		fields = make([]proto.FieldDescription, len(stmt.Fields))
+		for i, f := range stmt.Fields {
+			f.Format = proto.EncFmtTxt
+			fields[i] = f
+		}
+		if stmt.Fields == nil {
+			fields = nil
+		}
+	case proto.IsPortal:
+		portal, ok := s.portals[d.Name]
+		if !ok {
+			return s.fail(Error("34000", "portal %q does not exist", d.Name), true)
+		}
+		fields = portal.Fields
+	}
+	if fields == nil {
+		proto.InitNoData(m)
+	} else {
+		proto.InitRowDescription(m, fields)
+	}
+	return s.Stream.Send(m)
+}
+
+func (s *Session) execute(m *core.Message) error {
+	x, err := proto.ReadExecute(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	portal, ok := s.portals[x.Portal]
+	if !ok {
+		return s.fail(Error("34000", "portal %q does not exist", x.Portal), true)
+	}
+	if err = s.server.Handler.Execute(s, portal, x.MaxRows); err != nil {
+		return s.fail(err, true)
+	}
+	return nil
+}
+
+func (s *Session) close(m *core.Message) error {
+	c, err := proto.ReadClose(m)
+	if err != nil {
+		return s.fatal("08P01", "%v", err)
+	}
+	switch c.Kind {
+	case proto.IsStmt:
+		stmt := s.statements[c.Name]
+		delete(s.statements, c.Name)
+		// as in Postgres, closing a statement closes its
+		// portals
+		for name, portal := range s.portals {
+			if portal.Statement == stmt {
+				delete(s.portals, name)
+			}
+		}
+	case proto.IsPortal:
+		delete(s.portals, c.Name)
+	}
+	proto.InitCloseComplete(m)
+	return s.Stream.Send(m)
+}
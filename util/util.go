@@ -94,3 +94,25 @@ func NegotiateTLS(c net.Conn, config *SSLConfig) (net.Conn, error) {
 
 	return c, nil
 }
+
+// AcceptTLS is the server-side counterpart of NegotiateTLS: after an
+// SSLRequest has been read from c, it accepts the request and
+// performs the server side of the TLS handshake, returning the
+// encrypted connection. The config must provide a certificate.
+func AcceptTLS(c net.Conn, config *tls.Config) (net.Conn, error) {
+	if config == nil ||
+		(len(config.Certificates) == 0 && config.GetCertificate == nil) {
+		return nil, errors.New("TLS configuration has no certificates")
+	}
+
+	// the response to an SSLRequest is a single unframed byte
+	if _, err := c.Write([]byte{'S'}); err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Server(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}